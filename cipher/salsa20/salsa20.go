@@ -0,0 +1,54 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package salsa20 implements an XSalsa20 stream with a 16 byte IV, which can
+// be used as a drop-in replacement for AES-256 in CTR mode. The 24 byte
+// XSalsa20 nonce is the IV followed by 8 zero bytes.
+package salsa20
+
+import (
+	"crypto/cipher"
+
+	"golang.org/x/crypto/salsa20"
+)
+
+type stream struct {
+	key       [32]byte
+	nonce     [24]byte
+	keyStream []byte // key stream generated so far
+	offset    int    // number of key stream bytes used
+}
+
+// Stream creates a new XSalsa20 stream.
+// The supplied key must be 32 bytes long and the iv 16 bytes.
+func Stream(key, iv []byte) cipher.Stream {
+	if len(key) != 32 {
+		panic("salsa20: XSalsa20 key is not 32 bytes long")
+	}
+	if len(iv) != 16 {
+		panic("salsa20: XSalsa20 IV is not 16 bytes long")
+	}
+	var s stream
+	copy(s.key[:], key)
+	copy(s.nonce[:], iv) // the remaining 8 bytes are zero
+	return &s
+}
+
+// XORKeyStream XORs each byte in the given slice with a byte from the
+// cipher's key stream (see crypto/cipher.Stream).
+func (s *stream) XORKeyStream(dst, src []byte) {
+	if len(dst) < len(src) {
+		panic("salsa20: output smaller than input")
+	}
+	// salsa20.XORKeyStream always starts at the beginning of the key stream,
+	// generate it in advance (doubling its length, if necessary)
+	if n := s.offset + len(src); n > len(s.keyStream) {
+		s.keyStream = make([]byte, 2*n)
+		salsa20.XORKeyStream(s.keyStream, s.keyStream, s.nonce[:], &s.key)
+	}
+	for i := range src {
+		dst[i] = src[i] ^ s.keyStream[s.offset+i]
+	}
+	s.offset += len(src)
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package salsa20
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/salsa20"
+)
+
+var (
+	key = make([]byte, 32)
+	iv  = make([]byte, 16)
+)
+
+func init() {
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		panic(err)
+	}
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		panic(err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	plaintext := make([]byte, 1000)
+	if _, err := io.ReadFull(rand.Reader, plaintext); err != nil {
+		t.Fatal(err)
+	}
+	// encrypt in one go with the reference implementation
+	var k [32]byte
+	copy(k[:], key)
+	nonce := make([]byte, 24)
+	copy(nonce, iv)
+	ref := make([]byte, len(plaintext))
+	salsa20.XORKeyStream(ref, plaintext, nonce, &k)
+	// encrypt in chunks which do not align with the block size
+	ciphertext := make([]byte, len(plaintext))
+	stream := Stream(key, iv)
+	stream.XORKeyStream(ciphertext[:10], plaintext[:10])
+	stream.XORKeyStream(ciphertext[10:500], plaintext[10:500])
+	stream.XORKeyStream(ciphertext[500:], plaintext[500:])
+	if !bytes.Equal(ciphertext, ref) {
+		t.Fatal("ciphertexts differ")
+	}
+	// decrypt
+	decrypted := make([]byte, len(ciphertext))
+	Stream(key, iv).XORKeyStream(decrypted, ciphertext)
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Error("plaintexts differ")
+	}
+}
+
+func TestStreamPanics(t *testing.T) {
+	for _, f := range []func(){
+		func() { Stream(make([]byte, 31), iv) },
+		func() { Stream(key, make([]byte, 15)) },
+		func() { Stream(key, iv).XORKeyStream(make([]byte, 1), make([]byte, 2)) },
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Error("should panic")
+				}
+			}()
+			f()
+		}()
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// mutekeyd is a local key server for Mute which implements the key server
+// JSON-RPC API for a single domain. It is meant for testing mutecrypt and
+// mutectrl against localhost.
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/frankbraun/codechain/util/bzero"
+	"github.com/frankbraun/codechain/util/home"
+	"github.com/mutecomm/mute/def/version"
+	"github.com/mutecomm/mute/encdb"
+	"github.com/mutecomm/mute/keyserver/server"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/release"
+	"github.com/mutecomm/mute/util"
+	"github.com/mutecomm/mute/util/descriptors"
+	"github.com/urfave/cli"
+)
+
+var (
+	defaultHomeDir = home.AppDataDir("mutekeyd", false)
+	defaultLogDir  = filepath.Join(defaultHomeDir, "log")
+)
+
+func init() {
+	cli.VersionPrinter = release.PrintVersion
+}
+
+// readPassphrase reads the passphrase from the file descriptor given by the
+// --passphrase-fd option.
+func readPassphrase(c *cli.Context) ([]byte, error) {
+	var fp *os.File
+	fs := c.GlobalString("passphrase-fd")
+	if fs == "stdin" {
+		fp = os.Stdin
+	} else {
+		fd, err := strconv.Atoi(fs)
+		if err != nil {
+			return nil, log.Errorf("cannot parse --passphrase-fd %s: argument "+
+				"must be \"stdin\" or an integer (a file descriptor)", fs)
+		}
+		fp = os.NewFile(uintptr(fd), "passphrase-fd")
+	}
+	log.Infof("read passphrase from fd %d", fp.Fd())
+	return util.Readline(fp)
+}
+
+// prepare creates the necessary directories, initializes logging and checks
+// for superfluous arguments.
+func prepare(c *cli.Context) error {
+	if len(c.Args()) > 0 {
+		return log.Errorf("superfluous argument(s): %s",
+			strings.Join(c.Args(), " "))
+	}
+	err := util.CreateDirs(c.GlobalString("homedir"), c.GlobalString("logdir"))
+	if err != nil {
+		return err
+	}
+	return log.Init(c.GlobalString("loglevel"), "keysv",
+		c.GlobalString("logdir"), c.GlobalBool("logconsole"))
+}
+
+func create(c *cli.Context) error {
+	domain := c.String("domain")
+	if domain == "" {
+		return log.Error("option --domain is mandatory")
+	}
+	passphrase, err := readPassphrase(c)
+	if err != nil {
+		return err
+	}
+	defer bzero.Bytes(passphrase)
+	dbname := filepath.Join(c.GlobalString("homedir"), "keyserver")
+	log.Infof("create key server database %s", dbname)
+	return server.Create(dbname, passphrase, c.Int("iterations"), domain)
+}
+
+func serve(c *cli.Context) error {
+	passphrase, err := readPassphrase(c)
+	if err != nil {
+		return err
+	}
+	defer bzero.Bytes(passphrase)
+	dbname := filepath.Join(c.GlobalString("homedir"), "keyserver")
+	ks, err := server.Open(dbname, passphrase)
+	if err != nil {
+		return err
+	}
+	defer ks.Close()
+	addr := c.String("address")
+	cert := c.String("tls-cert")
+	key := c.String("tls-key")
+	log.Infof("serving key server for domain '%s' on %s", ks.Domain(), addr)
+	if cert != "" || key != "" {
+		err = http.ListenAndServeTLS(addr, cert, key, ks)
+	} else {
+		err = http.ListenAndServe(addr, ks)
+	}
+	return log.Error(err)
+}
+
+func mutekeydMain() error {
+	defer log.Flush()
+
+	var err error
+	app := cli.NewApp()
+	app.Usage = "local key server for Mute"
+	app.Version = version.Number
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "homedir",
+			Value: defaultHomeDir,
+			Usage: "set home directory",
+		},
+		descriptors.PassphraseFDFlag,
+		cli.StringFlag{
+			Name:  "loglevel",
+			Value: "info",
+			Usage: "logging level {trace, debug, info, warn, error, critical}",
+		},
+		cli.StringFlag{
+			Name:  "logdir",
+			Value: defaultLogDir,
+			Usage: "directory to log output",
+		},
+		cli.BoolFlag{
+			Name:  "logconsole",
+			Usage: "enable logging to console",
+		},
+	}
+	app.Commands = []cli.Command{
+		{
+			Name:  "create",
+			Usage: "Create key server database for domain",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "domain",
+					Usage: "domain served by key server",
+				},
+				cli.IntFlag{
+					Name:  "iterations",
+					Value: encdb.KDFIterations,
+					Usage: "number of KDF iterations used for database creation",
+				},
+			},
+			Before: prepare,
+			Action: func(c *cli.Context) {
+				err = create(c)
+			},
+		},
+		{
+			Name:  "serve",
+			Usage: "Serve key server JSON-RPC API",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "address",
+					Value: "127.0.0.1:8443",
+					Usage: "address to listen on",
+				},
+				cli.StringFlag{
+					Name:  "tls-cert",
+					Usage: "TLS certificate file (serve plain HTTP, if not set)",
+				},
+				cli.StringFlag{
+					Name:  "tls-key",
+					Usage: "TLS key file (serve plain HTTP, if not set)",
+				},
+			},
+			Before: prepare,
+			Action: func(c *cli.Context) {
+				err = serve(c)
+			},
+		},
+	}
+	if e := app.Run(os.Args); e != nil {
+		return e
+	}
+	return err
+}
+
+func main() {
+	// work around defer not working after os.Exit()
+	if err := mutekeydMain(); err != nil {
+		util.Fatal(err)
+	}
+}
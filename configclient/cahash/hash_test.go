@@ -21,3 +21,9 @@ func TestHash(t *testing.T) {
 		t.Error("Hash no match")
 	}
 }
+
+func TestHashNoPEM(t *testing.T) {
+	if _, err := Hash([]byte("not a certificate")); err != ErrNoPEM {
+		t.Errorf("should fail with ErrNoPEM: %v", err)
+	}
+}
@@ -11,7 +11,6 @@ import (
 	"errors"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"sort"
 	"time"
 
@@ -19,6 +18,7 @@ import (
 	"github.com/mutecomm/mute/configclient/roundrobin"
 	"github.com/mutecomm/mute/configclient/sortedmap"
 	"github.com/mutecomm/mute/util/times"
+	"github.com/mutecomm/mute/util/transport"
 )
 
 var (
@@ -35,14 +35,16 @@ const skew = 82800
 
 // Config contains configuration data for the config call, and it's result.
 type Config struct {
-	PublicKey    []byte            // Public key of configd. Decoded/binary
-	URLList      string            // The list of the configd urls. "10,www.google.com:3912;20,8.8.8.8:80;10,irl.com:1020"
-	CACert       []byte            // The current CACert, if any. Will always be set after config update
-	Map          map[string]string // The configuration map. If set it will be overwritten
-	LastSignDate uint64            // The last signdate, will be updated
-	Timeout      int64             // Timeout, can be zero (will be set to 30)
-	servers      []string          // list of servers generated from URLList
-	curServer    int               // current server in servers list
+	PublicKey    []byte                 // Public key of configd. Decoded/binary
+	URLList      string                 // The list of the configd urls. "10,www.google.com:3912;20,8.8.8.8:80;10,irl.com:1020"
+	CACert       []byte                 // The current CACert, if any. Will always be set after config update
+	Map          map[string]string      // The configuration map. If set it will be overwritten
+	LastSignDate uint64                 // The last signdate, will be updated
+	Timeout      int64                  // Timeout, can be zero (will be set to 30)
+	History      []*sortedmap.SignedMap // The last MaxHistory verified configurations, oldest first
+	Pinned       map[string]string      // Locally pinned keys, override the configuration map
+	servers      []string               // list of servers generated from URLList
+	curServer    int                    // current server in servers list
 }
 
 // Update a configuration structure.
@@ -79,10 +81,16 @@ GetConfigLoop:
 	c.servers = append(c.servers[c.curServer:], c.servers[:c.curServer]...)
 	c.curServer = 0
 
-	if hisHash, ok = cert.Config["CACertHash"]; !ok {
-		c.Map = cert.Config
+	// refuse unsigned and older configurations
+	if _, err := c.checkHistory(cert); err != nil {
+		return err
+	}
+	m := c.effectiveMap(cert.Config)
+
+	if hisHash, ok = m[CACertHashKey]; !ok {
+		c.Map = m
 		c.LastSignDate = cert.SignDate
-		return nil
+		return c.addHistory(cert)
 	}
 	if certHashb, err = hex.DecodeString(hisHash); err != nil {
 		return err
@@ -104,9 +112,9 @@ GetConfigLoop:
 	if err != nil {
 		return err
 	}
-	c.Map = cert.Config
+	c.Map = m
 	c.LastSignDate = cert.SignDate
-	return nil
+	return c.addHistory(cert)
 }
 
 func readBody(rc io.ReadCloser) ([]byte, error) {
@@ -130,7 +138,10 @@ func fixURL(URL string) string {
 // consideration. Timeout is in seconds. Configuration can be accessed via
 // cert.Config (map[string]string).
 func getConfig(configURL string, publicKey []byte, lastSignDate uint64, timeout int64) (cert *sortedmap.SignedMap, err error) {
-	c := &http.Client{Timeout: time.Second * time.Duration(timeout)}
+	c, err := transport.New(nil, time.Second*time.Duration(timeout))
+	if err != nil {
+		return nil, err
+	}
 	resp, err := c.Get(fixURL(configURL) + "config")
 	if err != nil {
 		return nil, err
@@ -145,7 +156,10 @@ func getConfig(configURL string, publicKey []byte, lastSignDate uint64, timeout
 // getCACert returns the ca certificate (verified). certHash is from
 // GetConfig().Config["CACertHash"]
 func getCACert(configURL string, certHash string, timeout int64) ([]byte, error) {
-	c := &http.Client{Timeout: time.Second * time.Duration(timeout)}
+	c, err := transport.New(nil, time.Second*time.Duration(timeout))
+	if err != nil {
+		return nil, err
+	}
 	resp, err := c.Get(fixURL(configURL) + "cacert")
 	if err != nil {
 		return nil, err
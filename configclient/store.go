@@ -0,0 +1,209 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package configclient
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"sort"
+
+	"github.com/mutecomm/mute/configclient/cahash"
+	"github.com/mutecomm/mute/configclient/sortedmap"
+)
+
+var (
+	// ErrUnsigned is returned if a configuration is not signed.
+	ErrUnsigned = errors.New("configclient: configuration not signed")
+	// ErrOlderConfig is returned if a configuration is older than the
+	// latest verified one.
+	ErrOlderConfig = errors.New("configclient: configuration older than latest one")
+	// ErrNoHistory is returned if a configuration has no verified history.
+	ErrNoHistory = errors.New("configclient: no verified configuration")
+	// ErrMapMismatch is returned if the configuration map does not match the
+	// latest verified configuration (and the pinned keys).
+	ErrMapMismatch = errors.New("configclient: configuration map does not match latest verified one")
+)
+
+// CACertHashKey is the configuration key of the CA certificate hash.
+const CACertHashKey = "CACertHash"
+
+// MaxHistory is the maximum number of verified configurations kept in the
+// history (Changes needs the last two).
+const MaxHistory = 10
+
+// Change describes the change of a single configuration key.
+type Change struct {
+	Key string // configuration key
+	Old string // old value ("" for added keys)
+	New string // new value ("" for removed keys)
+}
+
+// Diff returns the changes from configuration map old to configuration map
+// new, sorted by key.
+func Diff(old, new map[string]string) []Change {
+	var changes []Change
+	for k, v := range old {
+		if n, ok := new[k]; !ok || n != v {
+			changes = append(changes, Change{Key: k, Old: v, New: n})
+		}
+	}
+	for k, v := range new {
+		if _, ok := old[k]; !ok {
+			changes = append(changes, Change{Key: k, New: v})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Key < changes[j].Key
+	})
+	return changes
+}
+
+// verify verifies the signature of the signed map sm with the given publicKey.
+func verify(publicKey []byte, sm *sortedmap.SignedMap) error {
+	if len(sm.Signature) == 0 {
+		return ErrUnsigned
+	}
+	if !sm.Config.Sort().Verify(sm.SignDate, publicKey, sm.Signature) {
+		return sortedmap.ErrNoVerify
+	}
+	return nil
+}
+
+// latest returns the latest verified configuration or nil.
+func (c *Config) latest() *sortedmap.SignedMap {
+	if len(c.History) == 0 {
+		return nil
+	}
+	return c.History[len(c.History)-1]
+}
+
+// checkHistory verifies the signed map sm and checks that it is not older
+// than the latest configuration in the history. It returns true, if sm has to
+// be added to the history.
+func (c *Config) checkHistory(sm *sortedmap.SignedMap) (bool, error) {
+	if err := verify(c.PublicKey, sm); err != nil {
+		return false, err
+	}
+	if latest := c.latest(); latest != nil {
+		if sm.SignDate == latest.SignDate &&
+			bytes.Equal(sm.Signature, latest.Signature) {
+			return false, nil // same configuration again
+		}
+		if sm.SignDate <= latest.SignDate {
+			return false, ErrOlderConfig
+		}
+	}
+	return true, nil
+}
+
+// addHistory verifies the signed map sm and adds it to the configuration
+// history. Unsigned configurations and configurations which are older than
+// the latest one are refused. Only the last MaxHistory configurations are
+// kept.
+func (c *Config) addHistory(sm *sortedmap.SignedMap) error {
+	add, err := c.checkHistory(sm)
+	if err != nil {
+		return err
+	}
+	if add {
+		c.History = append(c.History, sm)
+		if len(c.History) > MaxHistory {
+			c.History = append([]*sortedmap.SignedMap(nil),
+				c.History[len(c.History)-MaxHistory:]...)
+		}
+	}
+	return nil
+}
+
+// effectiveMap returns the configuration map m with all pinned keys applied.
+func (c *Config) effectiveMap(m map[string]string) map[string]string {
+	em := make(map[string]string)
+	for k, v := range m {
+		em[k] = v
+	}
+	for k, v := range c.Pinned {
+		em[k] = v
+	}
+	return em
+}
+
+// Verify verifies a (cached) configuration. That is, all configurations in
+// the history must be signed by PublicKey with increasing sign dates and Map
+// must be the latest configuration with the pinned keys applied.
+func (c *Config) Verify() error {
+	if len(c.History) == 0 {
+		return ErrNoHistory
+	}
+	for i, sm := range c.History {
+		if err := verify(c.PublicKey, sm); err != nil {
+			return err
+		}
+		if i > 0 && sm.SignDate <= c.History[i-1].SignDate {
+			return ErrOlderConfig
+		}
+	}
+	latest := c.latest()
+	if c.LastSignDate != latest.SignDate {
+		return ErrOlderConfig
+	}
+	if len(Diff(c.effectiveMap(latest.Config), c.Map)) > 0 {
+		return ErrMapMismatch
+	}
+	return nil
+}
+
+// Changes returns the changes between the previous and the latest verified
+// configuration (without pinned keys).
+func (c *Config) Changes() []Change {
+	var old map[string]string
+	if len(c.History) > 1 {
+		old = c.History[len(c.History)-2].Config
+	}
+	latest := c.latest()
+	if latest == nil {
+		return nil
+	}
+	return Diff(old, latest.Config)
+}
+
+// Pin pins the configuration key to the given value. That is, it overrides
+// the value of the key in the configuration map locally (also for future
+// updates), until it is unpinned.
+func (c *Config) Pin(key, value string) {
+	if c.Pinned == nil {
+		c.Pinned = make(map[string]string)
+	}
+	c.Pinned[key] = value
+	if c.Map == nil {
+		c.Map = make(map[string]string)
+	}
+	c.Map[key] = value
+}
+
+// Unpin removes the pin of the configuration key. The key gets the value of
+// the latest verified configuration again (if it has one).
+func (c *Config) Unpin(key string) {
+	delete(c.Pinned, key)
+	if latest := c.latest(); latest != nil {
+		if v, ok := latest.Config[key]; ok {
+			c.Map[key] = v
+			return
+		}
+	}
+	delete(c.Map, key)
+}
+
+// PinCACert pins the given CA certificate. The CA certificate is used
+// instead of the one defined by the configuration server.
+func (c *Config) PinCACert(cert []byte) error {
+	hash, err := cahash.Hash(cert)
+	if err != nil {
+		return err
+	}
+	c.CACert = cert
+	c.Pin(CACertHashKey, hex.EncodeToString(hash))
+	return nil
+}
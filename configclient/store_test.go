@@ -0,0 +1,206 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package configclient
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/mutecomm/mute/configclient/cahash"
+	"github.com/mutecomm/mute/configclient/sortedmap"
+)
+
+var testCACert = "-----BEGIN CERTIFICATE-----\nMIICZTCCAc4CCQDxv0PZsialmTANBgkqhkiG9w0BAQsFADB3MQswCQYDVQQGEwJE\nRTEPMA0GA1UECAwGQmVybGluMQ8wDQYDVQQHDAZCZXJsaW4xETAPBgNVBAoMCE11\ndGUgTHRkMQ8wDQYDVQQLDAZEZXZPcHMxIjAgBgNVBAMMGSouc2VydmljZWd1YXJk\nLmNoYXZwbi5uZXQwHhcNMTUwNzA4MjAwNDI0WhcNMjUwNzA1MjAwNDI0WjB3MQsw\nCQYDVQQGEwJERTEPMA0GA1UECAwGQmVybGluMQ8wDQYDVQQHDAZCZXJsaW4xETAP\nBgNVBAoMCE11dGUgTHRkMQ8wDQYDVQQLDAZEZXZPcHMxIjAgBgNVBAMMGSouc2Vy\ndmljZWd1YXJkLmNoYXZwbi5uZXQwgZ8wDQYJKoZIhvcNAQEBBQADgY0AMIGJAoGB\nALYA93q8vzCm+M8rNCMeRrLbJ2bvT4PRO1g1DKGz8sgEdSW2T9aPYwQEF2tJFsSm\nd2Pp32MBxlb0zkHuu5/XTQD6g6f5FPeZ7lwdrY33mpYp606FXXjX48a7EWu9c3tg\nGKUCZ71cm4UkoBTV1A0Q5A8X0TnwRxGLgNzvpiGBCLVXAgMBAAEwDQYJKoZIhvcN\nAQELBQADgYEAFwPCnrofpwRbLYgrmYbkEH12l29H0bhj5Ljvge+WyyCklT/Ryn7Y\nI2TW0K81xqN5zXvKrrAidOdBydxegdYGSGqBtrpOxumo7Nzyqa5W6Zsue1xUeEdW\nvMBA0Mcaga2CJgOouZAIhArTey5HfCIKFAjUZuTyFoZ80r96kEi9SKY=\n-----END CERTIFICATE-----"
+
+func signMap(
+	t *testing.T,
+	privKey ed25519.PrivateKey,
+	m map[string]string,
+	signDate uint64,
+) *sortedmap.SignedMap {
+	var pk [ed25519.PrivateKeySize]byte
+	copy(pk[:], privKey)
+	return &sortedmap.SignedMap{
+		Config:    m,
+		Signature: sortedmap.StringMap(m).Sort().Sign(signDate, &pk),
+		SignDate:  signDate,
+	}
+}
+
+func TestHistory(t *testing.T) {
+	publicKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{PublicKey: publicKey}
+	if err := c.Verify(); err != ErrNoHistory {
+		t.Errorf("should fail with ErrNoHistory: %v", err)
+	}
+	first := signMap(t, privKey, map[string]string{"a": "1", "b": "2"}, 100)
+	if err := c.addHistory(first); err != nil {
+		t.Fatal(err)
+	}
+	// same configuration again
+	if err := c.addHistory(first); err != nil {
+		t.Fatal(err)
+	}
+	// unsigned configuration
+	unsigned := &sortedmap.SignedMap{Config: first.Config, SignDate: 101}
+	if err := c.addHistory(unsigned); err != ErrUnsigned {
+		t.Errorf("should fail with ErrUnsigned: %v", err)
+	}
+	// wrong signature
+	wrong := signMap(t, privKey, map[string]string{"a": "1"}, 101)
+	wrong.Config = first.Config
+	if err := c.addHistory(wrong); err != sortedmap.ErrNoVerify {
+		t.Errorf("should fail with sortedmap.ErrNoVerify: %v", err)
+	}
+	// older configuration
+	older := signMap(t, privKey, map[string]string{"a": "0"}, 99)
+	if err := c.addHistory(older); err != ErrOlderConfig {
+		t.Errorf("should fail with ErrOlderConfig: %v", err)
+	}
+	second := signMap(t, privKey, map[string]string{"a": "3", "c": "4"}, 200)
+	if err := c.addHistory(second); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.History) != 2 {
+		t.Fatalf("wrong history length: %d", len(c.History))
+	}
+	// verify
+	c.Map = c.effectiveMap(second.Config)
+	c.LastSignDate = second.SignDate
+	if err := c.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	// changes
+	changes := []Change{
+		{Key: "a", Old: "1", New: "3"},
+		{Key: "b", Old: "2"},
+		{Key: "c", New: "4"},
+	}
+	if !reflect.DeepEqual(c.Changes(), changes) {
+		t.Errorf("wrong changes: %v", c.Changes())
+	}
+	// tampered map
+	c.Map["a"] = "5"
+	if err := c.Verify(); err != ErrMapMismatch {
+		t.Errorf("should fail with ErrMapMismatch: %v", err)
+	}
+	// tampered history
+	c.Map["a"] = "3"
+	c.History[0].Config["a"] = "5"
+	if err := c.Verify(); err != sortedmap.ErrNoVerify {
+		t.Errorf("should fail with sortedmap.ErrNoVerify: %v", err)
+	}
+}
+
+func TestHistoryLimit(t *testing.T) {
+	publicKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{PublicKey: publicKey}
+	var sm *sortedmap.SignedMap
+	for i := 1; i <= MaxHistory+5; i++ {
+		sm = signMap(t, privKey, map[string]string{"a": strconv.Itoa(i)},
+			uint64(i*100))
+		if err := c.addHistory(sm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(c.History) != MaxHistory {
+		t.Fatalf("wrong history length: %d", len(c.History))
+	}
+	if c.History[0].SignDate != 600 {
+		t.Errorf("oldest configurations not removed: %d", c.History[0].SignDate)
+	}
+	c.Map = c.effectiveMap(sm.Config)
+	c.LastSignDate = sm.SignDate
+	if err := c.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	changes := []Change{{Key: "a", Old: "14", New: "15"}}
+	if !reflect.DeepEqual(c.Changes(), changes) {
+		t.Errorf("wrong changes: %v", c.Changes())
+	}
+}
+
+func TestPin(t *testing.T) {
+	publicKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{PublicKey: publicKey}
+	sm := signMap(t, privKey, map[string]string{"a": "1", "b": "2"}, 100)
+	if err := c.addHistory(sm); err != nil {
+		t.Fatal(err)
+	}
+	c.Map = c.effectiveMap(sm.Config)
+	c.LastSignDate = sm.SignDate
+	// pin keys
+	c.Pin("a", "local")
+	c.Pin("new", "value")
+	if c.Map["a"] != "local" || c.Map["new"] != "value" {
+		t.Errorf("keys not pinned: %v", c.Map)
+	}
+	if err := c.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	// pinned keys are kept for new configurations
+	sm = signMap(t, privKey, map[string]string{"a": "3", "b": "2"}, 200)
+	if err := c.addHistory(sm); err != nil {
+		t.Fatal(err)
+	}
+	c.Map = c.effectiveMap(sm.Config)
+	c.LastSignDate = sm.SignDate
+	if c.Map["a"] != "local" {
+		t.Errorf("pinned key overwritten: %s", c.Map["a"])
+	}
+	// unpin keys
+	c.Unpin("a")
+	c.Unpin("new")
+	if c.Map["a"] != "3" {
+		t.Errorf("key not unpinned: %s", c.Map["a"])
+	}
+	if _, ok := c.Map["new"]; ok {
+		t.Error("key not removed")
+	}
+	if err := c.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	// pin CA certificate
+	if err := c.PinCACert([]byte("no cert")); err != cahash.ErrNoPEM {
+		t.Errorf("should fail with cahash.ErrNoPEM: %v", err)
+	}
+	if err := c.PinCACert([]byte(testCACert)); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := cahash.Hash([]byte(testCACert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Map[CACertHashKey] != hex.EncodeToString(hash) {
+		t.Error("CA certificate hash not pinned")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	if changes := Diff(nil, nil); len(changes) != 0 {
+		t.Errorf("unexpected changes: %v", changes)
+	}
+	m := map[string]string{"a": "1"}
+	if changes := Diff(m, m); len(changes) != 0 {
+		t.Errorf("unexpected changes: %v", changes)
+	}
+	changes := Diff(nil, m)
+	if !reflect.DeepEqual(changes, []Change{{Key: "a", New: "1"}}) {
+		t.Errorf("wrong changes: %v", changes)
+	}
+}
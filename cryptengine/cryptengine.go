@@ -20,6 +20,8 @@ import (
 	"github.com/mutecomm/mute/encdb"
 	"github.com/mutecomm/mute/keydb"
 	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/msg"
+	"github.com/mutecomm/mute/uid"
 	"github.com/mutecomm/mute/util"
 	"github.com/mutecomm/mute/util/descriptors"
 	"github.com/urfave/cli"
@@ -35,6 +37,9 @@ var (
 	defaultHomeDir = home.AppDataDir("mute", false)
 	defaultLogDir  = filepath.Join(defaultHomeDir, "log")
 	errExit        = errors.New("cryptengine: requests exit")
+	// errInvalidSenderUID is returned by verifySenderUID, if the sender UID
+	// message contradicts the local hash chain.
+	errInvalidSenderUID = errors.New("cryptengine: invalid sender UID")
 )
 
 // CryptEngine abstracts a mutecrypt command engine.
@@ -206,6 +211,18 @@ func New() *CryptEngine {
 		Name:  "domain",
 		Usage: "key server domain",
 	}
+	notbeforeFlag := cli.StringFlag{
+		Name:  "notbefore",
+		Usage: "UID not valid before this time (RFC3339, default: valid immediately)",
+	}
+	notafterFlag := cli.StringFlag{
+		Name:  "notafter",
+		Usage: "UID not valid after this time (RFC3339, default: one year from now)",
+	}
+	repoURIFlag := cli.StringSliceFlag{
+		Name:  "repouri",
+		Usage: "KeyInit repository (can be given multiple times, default: domain of user ID)",
+	}
 	ce.app.Commands = []cli.Command{
 		{
 			Name:  "db",
@@ -333,6 +350,27 @@ func New() *CryptEngine {
 						ce.err = ce.dbVersion(ce.fileTable.OutputFP)
 					},
 				},
+				{
+					Name:  "migrate",
+					Usage: "Migrate DB to current version",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "only show pending migrations",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.dbMigrate(ce.fileTable.OutputFP,
+							c.Bool("dry-run"))
+					},
+				},
 			},
 		},
 		{
@@ -403,6 +441,26 @@ register the UID message with the keyserver yet.
 							Name:  "id",
 							Usage: "user ID to generate",
 						},
+						cli.BoolFlag{
+							Name:  "escrow",
+							Usage: "include signature escrow key (private key is written to output, store it offline)",
+						},
+						cli.StringFlag{
+							Name:  "pfs",
+							Value: uid.Strict.String(),
+							Usage: "PFS preference (mandatory, strict, or optional)",
+						},
+						cli.StringFlag{
+							Name:  "mixaddress",
+							Usage: "mix address for static key messages (only for --pfs optional)",
+						},
+						cli.StringFlag{
+							Name:  "nymaddress",
+							Usage: "nym address for static key messages (only for --pfs optional)",
+						},
+						repoURIFlag,
+						notbeforeFlag,
+						notafterFlag,
 					},
 					Before: func(c *cli.Context) error {
 						if len(c.Args()) > 0 {
@@ -411,10 +469,22 @@ register the UID message with the keyserver yet.
 						if !c.IsSet("id") {
 							return log.Error("option --id is mandatory")
 						}
+						if c.String("pfs") == uid.Optional.String() {
+							if !c.IsSet("mixaddress") {
+								return log.Error("option --mixaddress is mandatory for --pfs optional")
+							}
+							if !c.IsSet("nymaddress") {
+								return log.Error("option --nymaddress is mandatory for --pfs optional")
+							}
+						}
 						return ce.prepare(c, true)
 					},
 					Action: func(c *cli.Context) {
 						ce.err = ce.generate(c.String("id"), c.GlobalBool("keyserver"),
+							c.Bool("escrow"), c.String("pfs"),
+							c.String("mixaddress"), c.String("nymaddress"),
+							c.StringSlice("repouri"),
+							c.String("notbefore"), c.String("notafter"),
 							ce.fileTable.OutputFP)
 					},
 				},
@@ -458,6 +528,40 @@ Tries to register a pregenerated UID message with the corresponding keyserver.
 							Name:  "id",
 							Usage: "user ID to update",
 						},
+						repoURIFlag,
+						notbeforeFlag,
+						notafterFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						return ce.prepare(c, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.genupdate(c.String("id"),
+							c.StringSlice("repouri"), c.String("notbefore"),
+							c.String("notafter"))
+					},
+				},
+				{
+					Name:  "recover",
+					Usage: "recover user ID with signature escrow key",
+					Description: `
+Generates an update for a user ID whose signature key has been lost. The
+update is signed with the signature escrow key (read from input) and replaces
+all other keys. Register it with the keyserver with 'uid update'.
+`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "id",
+							Usage: "user ID to recover",
+						},
+						notbeforeFlag,
+						notafterFlag,
 					},
 					Before: func(c *cli.Context) error {
 						if len(c.Args()) > 0 {
@@ -469,7 +573,8 @@ Tries to register a pregenerated UID message with the corresponding keyserver.
 						return ce.prepare(c, true)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.genupdate(c.String("id"))
+						ce.err = ce.recoverUID(c.String("id"), c.String("notbefore"),
+							c.String("notafter"), ce.fileTable.InputFP)
 					},
 				},
 				{
@@ -530,6 +635,32 @@ Delete a user ID (registered or unregistered).
 						ce.err = ce.deleteUID(c.String("id"), c.Bool("force"))
 					},
 				},
+				{
+					Name:  "validity",
+					Usage: "show validity of user ID",
+					Description: `
+Shows the validity window (NOTBEFORE and NOTAFTER as Unix time) of the latest
+UID message of a user ID and whether it has been registered.
+`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "id",
+							Usage: "user ID to show validity for",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						return ce.prepare(c, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.validity(c.String("id"), ce.fileTable.OutputFP)
+					},
+				},
 				{
 					Name:  "list",
 					Usage: "list own (mapped) user IDs",
@@ -565,9 +696,13 @@ Delete a user ID (registered or unregistered).
 							Name:  "nymaddress",
 							Usage: "nym address for KeyInit message",
 						},
-						cli.StringFlag{
+						cli.StringSliceFlag{
 							Name:  "token",
-							Usage: "payment token",
+							Usage: "payment token (one per KeyInit repository, in order)",
+						},
+						cli.BoolFlag{
+							Name:  "single-use",
+							Usage: "publish single-use KeyInit message (no fallback)",
 						},
 					},
 					Before: func(c *cli.Context) error {
@@ -591,7 +726,7 @@ Delete a user ID (registered or unregistered).
 					Action: func(c *cli.Context) {
 						ce.err = ce.addKeyInit(c.String("id"),
 							c.String("mixaddress"), c.String("nymaddress"),
-							c.String("token"))
+							c.StringSlice("token"), c.Bool("single-use"))
 					},
 				},
 				{
@@ -624,6 +759,10 @@ Delete a user ID (registered or unregistered).
 							Name:  "id",
 							Usage: "user ID",
 						},
+						cli.BoolFlag{
+							Name:  "consumed",
+							Usage: "only flush consumed single-use KeyInit messages",
+						},
 					},
 					Before: func(c *cli.Context) error {
 						if len(c.Args()) > 0 {
@@ -635,7 +774,61 @@ Delete a user ID (registered or unregistered).
 						return ce.prepare(c, true)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.flushKeyInit(c.String("id"))
+						ce.err = ce.flushKeyInit(c.String("id"),
+							c.Bool("consumed"))
+					},
+				},
+				{
+					Name:  "count",
+					Usage: "count unused single-use KeyInit messages",
+					Description: `
+Shows the number of single-use KeyInit messages of the user ID which have not
+been consumed yet and are still valid.
+`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "id",
+							Usage: "user ID",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						return ce.prepare(c, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.countKeyInit(c.String("id"),
+							ce.fileTable.OutputFP)
+					},
+				},
+				{
+					Name:  "repos",
+					Usage: "show KeyInit repositories",
+					Description: `
+Shows the KeyInit repositories of the user ID as JSON array.
+`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "id",
+							Usage: "user ID",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						return ce.prepare(c, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.showRepoURIs(c.String("id"),
+							ce.fileTable.OutputFP)
 					},
 				},
 			},
@@ -791,6 +984,11 @@ Delete a user ID (registered or unregistered).
 					Name:  "nymaddress",
 					Usage: "nymaddress to receive future messages at",
 				},
+				cli.StringFlag{
+					Name:  "status",
+					Value: msg.StatusOK.String(),
+					Usage: "status code of message (reset and error send an empty message to restart the session)",
+				},
 			},
 			Before: func(c *cli.Context) error {
 				if len(c.Args()) > 0 {
@@ -810,7 +1008,8 @@ Delete a user ID (registered or unregistered).
 			Action: func(c *cli.Context) {
 				ce.err = ce.encrypt(ce.fileTable.OutputFP, c.String("from"),
 					c.String("to"), c.Bool("sign"), c.String("nymaddress"),
-					ce.fileTable.InputFP, ce.fileTable.StatusFP)
+					c.String("status"), ce.fileTable.InputFP,
+					ce.fileTable.StatusFP)
 			},
 		},
 		{
@@ -827,6 +1026,47 @@ Delete a user ID (registered or unregistered).
 					ce.fileTable.StatusFP)
 			},
 		},
+		{
+			Name:  "verify",
+			Usage: "verify permanent signature of message",
+			Description: `
+Verify the permanent signature of the decrypted message content read from
+input-fd against the UID message of the sender with the given hash (as
+reported by decrypt) in the key database. Without --uid-hash the current UID
+message of the sender is used.
+`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "id",
+					Usage: "user ID of sender",
+				},
+				cli.StringFlag{
+					Name:  "signature",
+					Usage: "base64 encoded permanent signature",
+				},
+				cli.StringFlag{
+					Name:  "uid-hash",
+					Usage: "hash of sender UID message used for the signature",
+				},
+			},
+			Before: func(c *cli.Context) error {
+				if len(c.Args()) > 0 {
+					return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+				}
+				if !c.IsSet("id") {
+					return log.Error("option --id is mandatory")
+				}
+				if !c.IsSet("signature") {
+					return log.Error("option --signature is mandatory")
+				}
+				return ce.prepare(c, true)
+			},
+			Action: func(c *cli.Context) {
+				ce.err = ce.verify(c.String("id"), c.String("signature"),
+					c.String("uid-hash"), ce.fileTable.InputFP,
+					ce.fileTable.StatusFP)
+			},
+		},
 		{
 			Name:  "quit",
 			Usage: "end program",
@@ -14,6 +14,7 @@ import (
 	"github.com/frankbraun/codechain/util/bzero"
 	"github.com/mutecomm/mute/keydb"
 	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/util"
 )
 
 // create a new KeyDB.
@@ -115,3 +116,39 @@ func (ce *CryptEngine) dbVersion(w io.Writer) error {
 	fmt.Fprintf(w, "version=%s\n", version)
 	return nil
 }
+
+// migrate the KeyDB to the current version (or only show pending migrations
+// for dryRun).
+func (ce *CryptEngine) dbMigrate(w io.Writer, dryRun bool) error {
+	keydbname := filepath.Join(ce.homedir, "keys")
+	// read passphrase
+	log.Infof("read passphrase from fd %d", ce.fileTable.PassphraseFD)
+	passphrase, err := util.Readline(ce.fileTable.PassphraseFP)
+	if err != nil {
+		return err
+	}
+	defer bzero.Bytes(passphrase)
+	log.Info("done")
+	pending, err := keydb.PendingMigrations(keydbname, passphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "keydb:\n")
+	for _, migration := range pending {
+		fmt.Fprintf(w, "migrate to version %d (%s)\n", migration.Version,
+			migration.Description)
+	}
+	if len(pending) == 0 {
+		fmt.Fprintf(w, "version=%s is current\n", keydb.Version)
+	}
+	if dryRun || len(pending) == 0 {
+		return nil
+	}
+	// opening keyDB applies the migrations
+	log.Infof("migrate keyDB '%s'", keydbname)
+	keyDB, err := keydb.Open(keydbname, passphrase)
+	if err != nil {
+		return err
+	}
+	return keyDB.Close()
+}
@@ -11,13 +11,18 @@ import (
 
 	"github.com/mutecomm/mute/cipher"
 	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/keydb"
 	"github.com/mutecomm/mute/log"
 	"github.com/mutecomm/mute/msg"
 	"github.com/mutecomm/mute/uid"
 )
 
-// TODO: better selection of identities. Take NOTBEFORE and NOTAFTER into account.
-// At the moment only the most current UID message is used for every identity.
+// getRecipientIdentities returns the currently valid UID message for every
+// identity. For identities without a valid UID message (expired or not valid
+// yet) the latest UID message is returned instead, messages sent to them
+// (for example, before a failed rollover) must remain decryptable. All UID
+// messages of an identity share the same encryption key, therefore one UID
+// message per identity suffices.
 func (ce *CryptEngine) getRecipientIdentities() ([]*uid.Message, error) {
 	var uidMsgs []*uid.Message
 	identities, err := ce.keyDB.GetPrivateIdentities()
@@ -26,8 +31,11 @@ func (ce *CryptEngine) getRecipientIdentities() ([]*uid.Message, error) {
 	}
 	for _, identity := range identities {
 		log.Debugf("identity=%s", identity)
-		// TODO: get all UID messages for given identity which are not expired
 		uidMsg, _, err := ce.keyDB.GetPrivateUID(identity, true)
+		if err == keydb.ErrNoValidUID {
+			log.Warnf("cryptengine: no valid UID for identity %s", identity)
+			uidMsg, _, err = ce.keyDB.GetLatestPrivateUID(identity, true)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -61,6 +69,9 @@ func (ce *CryptEngine) decrypt(w io.Writer, r io.Reader, statusfp *os.File) erro
 	// decrypt message
 	var senderID string
 	var sig string
+	var status msg.StatusCode
+	var lost uint64
+	var senderUID *msg.Sender
 	args := &msg.DecryptArgs{
 		Writer:     w,
 		Identities: identities,
@@ -69,15 +80,45 @@ func (ce *CryptEngine) decrypt(w io.Writer, r io.Reader, statusfp *os.File) erro
 		Rand:       cipher.RandReader,
 		KeyStore:   ce,
 	}
-	senderID, sig, err = msg.Decrypt(args)
+	senderID, sig, status, lost, senderUID, err = msg.Decrypt(args)
 	if err != nil {
-		// TODO: handle msg.ErrStatusError, should trigger a subsequent
-		// encrypted message with StatusError
-		return err
+		// the session is unknown and the message could not be authenticated
+		// (the sender might be forged), report it to the caller
+		if err != msg.ErrStatusError && err != msg.ErrStatusReset {
+			return err
+		}
+		log.Warnf("cryptengine: session with %s unknown", senderID)
+		fmt.Fprintf(statusfp, "SENDERIDENTITY:\t%s\n", senderID)
+		fmt.Fprintf(statusfp, "SESSION:\tUNKNOWN\n")
+		return nil
 	}
 	fmt.Fprintf(statusfp, "SENDERIDENTITY:\t%s\n", senderID)
 	if sig != "" {
 		fmt.Fprintf(statusfp, "SIGNATURE:\t%s\n", sig)
+		// the signature has been made with the key of the sender UID message
+		fmt.Fprintf(statusfp, "SENDERUIDHASH:\t%s\n", senderUID.UID.UIDHash())
+	}
+	if status != msg.StatusOK {
+		// the sender reset the session, the (empty) message only signals that
+		fmt.Fprintf(statusfp, "STATUS:\t%s\n", status)
+	}
+	if lost > 0 {
+		// messages of the session have been skipped
+		fmt.Fprintf(statusfp, "LOST:\t%d\n", lost)
+	}
+	// verify sender UID locally (without revealing the sender to the key
+	// server), if possible
+	// (if it cannot be verified locally, the caller falls back to the key
+	// server, an invalid sender UID is reported)
+	verified, err := ce.verifySenderUID(senderUID)
+	switch {
+	case err == errInvalidSenderUID:
+		fmt.Fprintf(statusfp, "SENDERUID:\tINVALID\n")
+	case err != nil:
+		// the message has already been decrypted, do not fail
+		log.Warnf("cryptengine: cannot verify sender UID locally: %s", err)
+	case verified:
+		fmt.Fprintf(statusfp, "SENDERUID:\tVERIFIED\n")
 	}
 	return nil
 }
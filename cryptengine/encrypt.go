@@ -18,14 +18,21 @@ import (
 
 // encrypt reads data from r, encrypts it for identity to (with identity from
 // as sender), and writes it to w.
+// If status is not "ok", an empty message with the given status code is
+// encrypted instead (see msg.StatusCode) and r is not read.
 func (ce *CryptEngine) encrypt(
 	w io.Writer,
 	from, to string,
 	sign bool,
 	nymAddress string,
+	status string,
 	r io.Reader,
 	statusfp *os.File,
 ) error {
+	statusCode, err := msg.ParseStatusCode(status)
+	if err != nil {
+		return err
+	}
 	// map pseudonyms
 	fromID, fromDomain, err := identity.MapPlus(from)
 	if err != nil {
@@ -67,6 +74,7 @@ func (ce *CryptEngine) encrypt(
 		Reader:                 r,
 		Rand:                   cipher.RandReader,
 		KeyStore:               ce,
+		StatusCode:             statusCode,
 	}
 	nymAddress, err = msg.Encrypt(args)
 	if err != nil {
@@ -8,19 +8,56 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"fmt"
+	"sort"
 
 	"github.com/mutecomm/mute/cipher"
 	"github.com/mutecomm/mute/cipher/aes256"
 	"github.com/mutecomm/mute/encode/base64"
 	"github.com/mutecomm/mute/keyserver/hashchain"
 	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/msg"
 	"github.com/mutecomm/mute/uid"
 	"github.com/mutecomm/mute/uid/identity"
 )
 
+// checkHashChainEntry checks that the hash chain entry at position pos has
+// the correct format and links to the previous entry with hash prevHash.
+// It returns the hash of entry.
+func checkHashChainEntry(entry string, pos uint64, prevHash []byte) ([]byte, error) {
+	hashEntryN, TYPE, NONCE, HashID, CrUID, UIDIndex, err := hashchain.SplitEntry(entry)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(TYPE, hashchain.Type) {
+		return nil, log.Error("cryptengine: invalid hash chain entry type")
+	}
+	entryN := make([]byte, 153)
+	copy(entryN, TYPE)
+	copy(entryN[1:], NONCE)
+	copy(entryN[9:], HashID)
+	copy(entryN[41:], CrUID)
+	copy(entryN[89:], UIDIndex)
+	copy(entryN[121:], prevHash)
+	if !bytes.Equal(hashEntryN, cipher.SHA256(entryN)) {
+		return nil, log.Errorf("cryptengine: hash chain entry %d invalid", pos)
+	}
+	return hashEntryN, nil
+}
+
+// hashChainFork reports a fork of the hash chain of the given domain at
+// position pos. That is, the key server presents a hash chain which differs
+// from the local copy and therefore must have rewritten its history.
+func hashChainFork(domain string, pos uint64, reason string) error {
+	return log.Errorf("cryptengine: HASH CHAIN FORK DETECTED for domain '%s' "+
+		"at position %d: %s (the key server rewrote its history, do not "+
+		"trust it)", domain, pos, reason)
+}
+
 // syncHashChain brings local hash chain in sync with key server at the given
-// domain. It just downloads the new entries and does not validate them
-// whatsoever.
+// domain. It downloads the new entries, makes sure they extend the local hash
+// chain and are properly linked, and stores them atomically. Forks (the key
+// server presents a hash chain which does not extend the local one) are
+// reported as errors.
 func (ce *CryptEngine) syncHashChain(domain string) error {
 	// get JSON-RPC client
 	client, _, err := ce.cache.Get(domain, ce.keydPort, ce.keydHost, ce.homedir,
@@ -39,7 +76,7 @@ func (ce *CryptEngine) syncHashChain(domain string) error {
 		return log.Error("cryptengine: fetch last hash chain entry reply has the wrong type")
 	}
 	// parse hash chain position
-	hcPosFloat := reply["HCPos"].(float64)
+	hcPosFloat, ok := reply["HCPos"].(float64)
 	if !ok {
 		return log.Error("cryptengine: fetch last hash chain position reply has the wrong type")
 	}
@@ -51,21 +88,32 @@ func (ce *CryptEngine) syncHashChain(domain string) error {
 	if err != nil {
 		return err
 	}
-	var start, end uint64
+	var start uint64
+	var lastEntry string
 	if found {
 		log.Debugf("cryptengine: last position for domain '%s': %d", domain, pos)
-		if pos >= hcPos {
+		if pos > hcPos {
+			return hashChainFork(domain, hcPos,
+				"key server hash chain is shorter than local copy")
+		}
+		lastEntry, err = ce.keyDB.GetHashChainEntry(domain, pos)
+		if err != nil {
+			return err
+		}
+		if pos == hcPos {
+			if lastEntry != hcEntry {
+				return hashChainFork(domain, pos,
+					"last entry differs from local copy")
+			}
 			// already in sync
 			log.Debugf("cryptengine: hash chain already in sync")
 			return nil
 		}
-		// sync the missing entries
-		start = pos + 1
-		end = hcPos
+		// sync the missing entries (including our last one to detect forks)
+		start = pos
 	} else {
 		// no entries found -> get everything
 		start = 0
-		end = hcPos
 		log.Debugf("cryptengine: no entry found for domain '%s'", domain)
 	}
 	// get JSON-RPC client
@@ -77,7 +125,7 @@ func (ce *CryptEngine) syncHashChain(domain string) error {
 	// get missing chain entries
 	content := make(map[string]interface{})
 	content["StartPosition"] = start
-	content["EndPosition"] = end
+	content["EndPosition"] = hcPos
 	reply, err = client.JSONRPCRequest("KeyHashchain.FetchHashChain", content)
 	if err != nil {
 		return err
@@ -88,30 +136,56 @@ func (ce *CryptEngine) syncHashChain(domain string) error {
 		return log.Error("cryptengine: fetch hash chain entries reply has the wrong type")
 	}
 	// parse first hash chain position
-	hcPosFirstFloat := reply["HCFirstPos"].(float64)
+	hcFirstPosFloat, ok := reply["HCFirstPos"].(float64)
 	if !ok {
 		return log.Error("cryptengine: fetch hash chain first position reply has the wrong type")
 	}
-	hcFirstPos := uint64(hcPosFirstFloat)
-	for i := hcFirstPos; i <= hcPos; i++ {
-		entry, ok := hcEntries[i-hcFirstPos].(string)
+	if uint64(hcFirstPosFloat) != start {
+		return log.Error("cryptengine: fetch hash chain returned wrong first position")
+	}
+	if uint64(len(hcEntries)) != hcPos-start+1 {
+		return log.Error("cryptengine: fetch hash chain returned wrong number of entries")
+	}
+	var entries []string
+	for i := start; i <= hcPos; i++ {
+		entry, ok := hcEntries[i-start].(string)
 		if !ok {
 			return log.Error("cryptengine: fetch hash chain entry is not a string")
 		}
 		log.Debugf("cryptengine: HC#%d: %s", i, entry)
-		// store entry in database
-		err := ce.keyDB.AddHashChainEntry(domain, i, entry)
+		entries = append(entries, entry)
+	}
+	if entries[len(entries)-1] != hcEntry {
+		return hashChainFork(domain, hcPos,
+			"last entry differs from fetched hash chain")
+	}
+	// make sure the new entries extend the local hash chain
+	prevHash := make([]byte, sha256.Size)
+	if found {
+		if entries[0] != lastEntry {
+			return hashChainFork(domain, pos, "entry differs from local copy")
+		}
+		prevHash, _, _, _, _, _, err = hashchain.SplitEntry(lastEntry)
 		if err != nil {
-			return nil
+			return err
 		}
+		entries = entries[1:]
+		start++
 	}
-
-	return nil
+	for i, entry := range entries {
+		prevHash, err = checkHashChainEntry(entry, start+uint64(i), prevHash)
+		if err != nil {
+			return err
+		}
+	}
+	// store entries in database
+	return ce.keyDB.AddHashChainEntries(domain, start, entries)
 }
 
 // validateHashChain validates the local hash chain for the given domain.
 // That is, it checks that each entry has the correct length and the links are
-// valid.
+// valid. Only the entries after the last validated position are checked,
+// the last validated position is persisted in keyDB.
 func (ce *CryptEngine) validateHashChain(domain string) error {
 	// make sure we have a hashchain for the given domain
 	max, found, err := ce.keyDB.GetLastHashChainPos(domain)
@@ -122,36 +196,33 @@ func (ce *CryptEngine) validateHashChain(domain string) error {
 		return log.Errorf("no hash chain entries found for domain '%s'", domain)
 	}
 
-	var hashEntryN, TYPE, NONCE, HashID, CrUID, UIDIndex, hashEntryNminus1 []byte
-	for i := uint64(0); i <= max; i++ {
-		entry, err := ce.keyDB.GetHashChainEntry(domain, i)
+	// continue from last validated position, if possible
+	start := uint64(0)
+	prevHash := make([]byte, sha256.Size)
+	validated, found, err := ce.keyDB.GetValidatedHashChainPos(domain)
+	if err != nil {
+		return err
+	}
+	if found && validated <= max {
+		entry, err := ce.keyDB.GetHashChainEntry(domain, validated)
 		if err != nil {
 			return err
 		}
-		log.Debugf("cryptengine: validate entry %d: %s", i, entry)
-
-		if i == 0 {
-			hashEntryNminus1 = make([]byte, sha256.Size)
-		} else {
-			hashEntryNminus1 = hashEntryN
-		}
-		hashEntryN, TYPE, NONCE, HashID, CrUID, UIDIndex, err = hashchain.SplitEntry(entry)
+		prevHash, _, _, _, _, _, err = hashchain.SplitEntry(entry)
 		if err != nil {
 			return err
 		}
-		if !bytes.Equal(TYPE, hashchain.Type) {
-			return log.Error("cryptengine: invalid hash chain entry type")
+		start = validated + 1
+	}
+	for i := start; i <= max; i++ {
+		entry, err := ce.keyDB.GetHashChainEntry(domain, i)
+		if err != nil {
+			return err
 		}
-
-		entryN := make([]byte, 153)
-		copy(entryN, TYPE)
-		copy(entryN[1:], NONCE)
-		copy(entryN[9:], HashID)
-		copy(entryN[41:], CrUID)
-		copy(entryN[89:], UIDIndex)
-		copy(entryN[121:], hashEntryNminus1)
-		if !bytes.Equal(hashEntryN, cipher.SHA256(entryN)) {
-			return log.Errorf("cryptengine: hash chain entry %d invalid", i)
+		log.Debugf("cryptengine: validate entry %d: %s", i, entry)
+		prevHash, err = checkHashChainEntry(entry, i, prevHash)
+		if err != nil {
+			return err
 		}
 	}
 
@@ -163,7 +234,7 @@ func (ce *CryptEngine) validateHashChain(domain string) error {
 
 	// make sure UIDMessageReplies are recorded in hash chain
 	for _, id := range ids {
-		_, msgReply, err := ce.keyDB.GetPrivateUID(id, false)
+		_, msgReply, err := ce.keyDB.GetLatestPrivateUID(id, false)
 		if err != nil {
 			return err
 		}
@@ -178,7 +249,8 @@ func (ce *CryptEngine) validateHashChain(domain string) error {
 		}
 	}
 
-	return nil
+	// record validated position
+	return ce.keyDB.SetValidatedHashChainPos(domain, max)
 }
 
 func (ce *CryptEngine) fetchUID(
@@ -240,20 +312,22 @@ func (ce *CryptEngine) fetchUID(
 func (ce *CryptEngine) verifyServerSig(
 	uid *uid.Message,
 	msgReply *uid.MessageReply,
+	chain string,
 	position uint64,
 ) error {
+	srvID := "keyserver@" + chain
 	// For the first keyserver message we do not need to verify the server signature
-	if uid.Localpart() == "keyserver" && uid.UIDContent.MSGCOUNT == 0 {
+	if uid.Identity() == srvID && uid.UIDContent.MSGCOUNT == 0 {
 		return nil
 	}
 
 	// Get keyserver UID
-	srvUID, _, found, err := ce.keyDB.GetPublicUID("keyserver@"+uid.Domain(), position)
+	srvUID, _, found, err := ce.keyDB.GetPublicUID(srvID, position)
 	if err != nil {
 		return err
 	}
 	if !found {
-		return log.Errorf("cryptengine: no keyserver signature key found for domain '%s'", uid.Domain())
+		return log.Errorf("cryptengine: no keyserver signature key found for domain '%s'", chain)
 	}
 
 	// Verify server signature
@@ -263,28 +337,438 @@ func (ce *CryptEngine) verifyServerSig(
 	return nil
 }
 
+// fetchVerifiedUID fetches the UID message of mappedID recorded at position
+// pos in the hash chain of chain (with the given k2, CrUID, and UIDIndex
+// parts of the hash chain entry) from the corresponding key server. It
+// decrypts the UID message and verifies the self-signature and the server
+// signature.
+func (ce *CryptEngine) fetchVerifiedUID(
+	chain, mappedID string,
+	pos uint64,
+	k2, CrUID, UIDIndex []byte,
+) (*uid.Message, error) {
+	// Compute: IDKEY = HASH(k2 | Identity)
+	tmp := make([]byte, len(k2)+len(mappedID))
+	copy(tmp, k2)
+	copy(tmp[len(k2):], mappedID)
+	IDKEY := cipher.SHA256(tmp)
+
+	// Fetch from Key Repository: UIDMessageReply = GET(UIDIndex)
+	msgReply, err := ce.fetchUID(chain, UIDIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decrypt UIDHash = AES_256_CBC_Decrypt( IDKEY, CrUID)
+	UIDHash := aes256.CBCDecrypt(IDKEY, CrUID)
+	log.Debugf("cryptengine: UIDHash=%s", base64.Encode(UIDHash))
+
+	// Decrypt UIDMessageReply.UIDMessage with UIDHash
+	index, uid, err := msgReply.Decrypt(UIDHash)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("cryptengine: UIDMessage=%s", uid.JSON())
+
+	// Check index
+	if !bytes.Equal(index, UIDIndex) {
+		return nil, log.Errorf("cryptengine: index != UIDIndex")
+	}
+
+	// Verify self signature
+	if err := uid.VerifySelfSig(); err != nil {
+		return nil, log.Error(err)
+	}
+
+	// Verify server signature
+	if err := ce.verifyServerSig(uid, msgReply, chain, pos); err != nil {
+		return nil, err
+	}
+	return uid, nil
+}
+
+// maxLinkDepth is the maximum number of chain links followed for a single
+// search (this also breaks cycles of chain links).
+const maxLinkDepth = 3
+
+// followLink follows the AUTHORITATIVE link for the given domain recorded in
+// the hash chain of chain and returns the domain of the linked hash chain.
+// The link entry must be signed by the key server of chain (LINKAUTHORITY)
+// and the linked key server must be the connected identity of the link entry.
+// The linked hash chain is synced and validated.
+func (ce *CryptEngine) followLink(chain, domain string, depth int) (string, error) {
+	if depth >= maxLinkDepth {
+		return "", log.Errorf("cryptengine: more than %d chain links", maxLinkDepth)
+	}
+	// get JSON-RPC client
+	client, _, err := ce.cache.Get(chain, ce.keydPort, ce.keydHost, ce.homedir,
+		"KeyRepository.GetLink")
+	if err != nil {
+		return "", err
+	}
+	// Call KeyRepository.GetLink
+	content := make(map[string]interface{})
+	content["Domain"] = domain
+	reply, err := client.JSONRPCRequest("KeyRepository.GetLink", content)
+	if err != nil {
+		return "", err
+	}
+	linkID, ok := reply["Identity"].(string)
+	if !ok {
+		return "", log.Error("cryptengine: get link identity has the wrong type")
+	}
+	posFloat, ok := reply["Position"].(float64)
+	if !ok {
+		return "", log.Error("cryptengine: get link position has the wrong type")
+	}
+	pos := uint64(posFloat)
+
+	// make sure the link entry is part of the local hash chain
+	if err := ce.syncHashChain(chain); err != nil {
+		return "", err
+	}
+	hcEntry, err := ce.keyDB.GetHashChainEntry(chain, pos)
+	if err != nil {
+		return "", err
+	}
+	_, TYPE, NONCE, HashID, CrUID, UIDIndex, err := hashchain.SplitEntry(hcEntry)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(TYPE, hashchain.Type) {
+		return "", log.Error("cryptengine: invalid hash chain entry type")
+	}
+	k1, k2 := cipher.CKDF(NONCE)
+	tmp := make([]byte, len(k1)+len(linkID))
+	copy(tmp, k1)
+	copy(tmp[len(k1):], linkID)
+	if !bytes.Equal(HashID, cipher.SHA256(tmp)) {
+		return "", log.Error("cryptengine: get link returned bogus position")
+	}
+	msg, err := ce.fetchVerifiedUID(chain, linkID, pos, k2, CrUID, UIDIndex)
+	if err != nil {
+		return "", err
+	}
+	if err := msg.Check(); err != nil {
+		return "", err
+	}
+	link := msg.UIDContent.CHAINLINK
+	if !link.Serves(domain) {
+		return "", log.Errorf("cryptengine: link entry does not serve domain '%s'", domain)
+	}
+
+	// verify LINKAUTHORITY
+	srvUID, _, found, err := ce.keyDB.GetPublicUID("keyserver@"+chain, pos)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", log.Errorf("cryptengine: no keyserver signature key found for domain '%s'", chain)
+	}
+	if err := msg.VerifyLinkAuthority(srvUID.SigPubKey()); err != nil {
+		return "", err
+	}
+
+	// sync and validate linked hash chain
+	_, origin, err := identity.Split(link.IDENTITY)
+	if err != nil {
+		return "", log.Error(err)
+	}
+	if err := ce.syncHashChain(origin); err != nil {
+		return "", err
+	}
+	if err := ce.validateHashChain(origin); err != nil {
+		return "", err
+	}
+	// LAST must be part of the linked hash chain
+	lastPos, found, err := ce.keyDB.GetHashChainPos(origin, link.LAST)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", log.Errorf("cryptengine: CHAINLINK.LAST not found in hash chain of '%s'", origin)
+	}
+	// the linked key server must be the connected identity
+	if err := ce.search(link.IDENTITY, false, depth+1); err != nil {
+		return "", err
+	}
+	originUID, _, found, err := ce.keyDB.GetPublicUID(link.IDENTITY, lastPos)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", log.Errorf("cryptengine: no UID found for '%s'", link.IDENTITY)
+	}
+	if err := msg.VerifyConnected(originUID); err != nil {
+		return "", err
+	}
+	log.Infof("cryptengine: domain '%s' linked to hash chain of '%s'",
+		domain, origin)
+	return origin, nil
+}
+
+// hashChainDomain returns the domain of the hash chain which records the
+// identities of the given domain. If no local hash chain exists for domain,
+// the AUTHORITATIVE links in all local hash chains are followed.
+func (ce *CryptEngine) hashChainDomain(domain string, depth int) (string, error) {
+	_, found, err := ce.keyDB.GetLastHashChainPos(domain)
+	if err != nil {
+		return "", err
+	}
+	if found {
+		return domain, nil
+	}
+	chains, err := ce.keyDB.GetHashChainDomains()
+	if err != nil {
+		return "", err
+	}
+	for _, chain := range chains {
+		origin, err := ce.followLink(chain, domain, depth)
+		if err != nil {
+			log.Infof("cryptengine: no link for domain '%s' in hash chain of '%s': %s",
+				domain, chain, err)
+			continue
+		}
+		return origin, nil
+	}
+	return "", log.Errorf("no hash chain entries found for domain '%s'", domain)
+}
+
+// verifyConnectedIdentity verifies the UID message msg of a connected
+// identity with an AUTHORITATIVE chain link against the UID message of the
+// linked identity, which is searched in its own hash chain.
+func (ce *CryptEngine) verifyConnectedIdentity(msg *uid.Message, depth int) error {
+	link := msg.UIDContent.CHAINLINK
+	if link.Type() != uid.ConnectedIdentity || !link.AUTHORITATIVE {
+		return nil
+	}
+	if depth >= maxLinkDepth {
+		return log.Errorf("cryptengine: more than %d chain links", maxLinkDepth)
+	}
+	_, domain, err := identity.Split(link.IDENTITY)
+	if err != nil {
+		return log.Error(err)
+	}
+	chain, err := ce.hashChainDomain(domain, depth+1)
+	if err != nil {
+		return err
+	}
+	if err := ce.syncHashChain(chain); err != nil {
+		return err
+	}
+	// LAST must be part of the linked hash chain
+	lastPos, found, err := ce.keyDB.GetHashChainPos(chain, link.LAST)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return log.Errorf("cryptengine: CHAINLINK.LAST not found in hash chain of '%s'", chain)
+	}
+	if err := ce.search(link.IDENTITY, false, depth+1); err != nil {
+		return err
+	}
+	origin, _, found, err := ce.keyDB.GetPublicUID(link.IDENTITY, lastPos)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return log.Errorf("cryptengine: no UID found for '%s'", link.IDENTITY)
+	}
+	return msg.VerifyConnected(origin)
+}
+
+// verifyUIDChain verifies that the UID message msg recorded at position pos
+// in the hash chain of chain is a valid successor of the UID message prev
+// (the UID message with the same identity recorded before). If prev is nil,
+// msg must be the first UID message of its identity.
+// That is, MSGCOUNT must increase by one, the USERSIGNATURE (or
+// ESCROWSIGNATURE) must be valid for prev, and the LASTENTRY must be
+// recorded in the hash chain before pos and must not go backwards.
+func (ce *CryptEngine) verifyUIDChain(
+	chain string,
+	prev, msg *uid.Message,
+	pos uint64,
+) error {
+	lastPos, err := ce.lastEntryPos(chain, msg, pos)
+	if err != nil {
+		return err
+	}
+	if prev == nil {
+		if msg.UIDContent.MSGCOUNT != 0 {
+			return log.Errorf("cryptengine: first UID message of '%s' has MSGCOUNT %d",
+				msg.Identity(), msg.UIDContent.MSGCOUNT)
+		}
+		return nil
+	}
+	if err := msg.VerifyUserSig(prev); err != nil {
+		return log.Errorf("cryptengine: UID message chain of '%s' broken at position %d: %s",
+			msg.Identity(), pos, err)
+	}
+	prevLastPos, err := ce.lastEntryPos(chain, prev, pos)
+	if err != nil {
+		return err
+	}
+	if lastPos < prevLastPos {
+		return log.Errorf("cryptengine: LASTENTRY of UID message of '%s' at position %d goes backwards",
+			msg.Identity(), pos)
+	}
+	return nil
+}
+
+// lastEntryPos returns the position of the LASTENTRY of the UID message msg
+// in the hash chain of chain. The LASTENTRY must be recorded before pos.
+// An empty LASTENTRY (only allowed for key servers) has position 0.
+func (ce *CryptEngine) lastEntryPos(
+	chain string,
+	msg *uid.Message,
+	pos uint64,
+) (uint64, error) {
+	if msg.UIDContent.LASTENTRY == "" {
+		return 0, nil
+	}
+	lastPos, found, err := ce.keyDB.GetHashChainPos(chain, msg.UIDContent.LASTENTRY)
+	if err != nil {
+		return 0, err
+	}
+	if !found || lastPos >= pos {
+		return 0, log.Errorf("cryptengine: LASTENTRY of UID message of '%s' not recorded in hash chain before position %d",
+			msg.Identity(), pos)
+	}
+	return lastPos, nil
+}
+
+// verifySenderUID verifies the sender UID message contained in a decrypted
+// message against the local hash chain of the sender's domain and stores it
+// in keyDB, without talking to the key server. It returns false, if the UID
+// message cannot be verified locally (e.g., because the local hash chain is
+// stale). Then the caller has to fall back to searchHashChain.
+// If the UID message contradicts the local hash chain, errInvalidSenderUID is
+// returned.
+func (ce *CryptEngine) verifySenderUID(sender *msg.Sender) (bool, error) {
+	mappedID := sender.UID.Identity()
+	_, domain, err := identity.Split(mappedID)
+	if err != nil {
+		return false, log.Error(err)
+	}
+	max, found, err := ce.keyDB.GetLastHashChainPos(domain)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		log.Infof("cryptengine: no local hash chain for domain '%s'", domain)
+		return false, nil
+	}
+	// the local hash chain must know the last entry known to the sender
+	_, found, err = ce.keyDB.GetHashChainPos(domain, sender.LastKeychainHash)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		log.Infof("cryptengine: local hash chain for domain '%s' is stale", domain)
+		return false, nil
+	}
+	// search hash chain for UIDIndex (backwards, the UID message is probably
+	// recent)
+	for i := max + 1; i > 0; i-- {
+		pos := i - 1
+		hcEntry, err := ce.keyDB.GetHashChainEntry(domain, pos)
+		if err != nil {
+			return false, err
+		}
+		_, _, NONCE, HashID, CrUID, UIDIndex, err := hashchain.SplitEntry(hcEntry)
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(UIDIndex, sender.UIDIndex) {
+			continue
+		}
+		// make sure the entry belongs to the identity and the UID message
+		k1, k2 := cipher.CKDF(NONCE)
+		tmp := make([]byte, len(k1)+len(mappedID))
+		copy(tmp, k1)
+		copy(tmp[len(k1):], mappedID)
+		if !bytes.Equal(HashID, cipher.SHA256(tmp)) {
+			log.Warnf("cryptengine: hash chain entry %d does not belong to '%s'",
+				pos, mappedID)
+			return false, errInvalidSenderUID
+		}
+		copy(tmp, k2)
+		IDKEY := cipher.SHA256(tmp)
+		UIDHash, _, _ := sender.UID.Encrypt()
+		if !bytes.Equal(aes256.CBCDecrypt(IDKEY, CrUID), UIDHash) {
+			log.Warnf("cryptengine: hash chain entry %d does not belong to UID message of '%s'",
+				pos, mappedID)
+			return false, errInvalidSenderUID
+		}
+		if err := sender.UID.VerifySelfSig(); err != nil {
+			log.Warnf("cryptengine: UID message of '%s': %s", mappedID, err)
+			return false, errInvalidSenderUID
+		}
+		// UID message already known?
+		cached, cachedPos, found, err := ce.keyDB.GetPublicUID(mappedID, pos)
+		if err != nil {
+			return false, err
+		}
+		if found && cachedPos == pos {
+			return true, nil
+		}
+		// links to other hash chains cannot be verified locally
+		if sender.UID.UIDContent.CHAINLINK != nil {
+			return false, nil
+		}
+		// the UID message must continue the locally known chain of UID
+		// messages (otherwise fall back to search all of them)
+		if !found {
+			cached = nil
+		}
+		if err := ce.verifyUIDChain(domain, cached, sender.UID, pos); err != nil {
+			log.Infof("cryptengine: cannot verify UID message of '%s' locally: %s",
+				mappedID, err)
+			return false, nil
+		}
+		if err := ce.keyDB.AddPublicUID(sender.UID, pos); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	log.Infof("cryptengine: UID message of '%s' not found in local hash chain",
+		mappedID)
+	return false, nil
+}
+
 // searchHashChain searches the local hash chain corresponding to the given id
 // for the id. It talks to the corresponding key server to retrieve necessary
 // UIDMessageReplys and stores found UIDMessages in the local keyDB.
+// Identities of domains without local hash chain are searched in linked hash
+// chains (see hashChainDomain).
 func (ce *CryptEngine) searchHashChain(id string, searchOnly bool) error {
+	return ce.search(id, searchOnly, 0)
+}
+
+// search implements searchHashChain, depth is the number of chain links
+// followed so far.
+func (ce *CryptEngine) search(id string, searchOnly bool, depth int) error {
 	// map identity
 	mappedID, domain, err := identity.MapPlus(id)
 	if err != nil {
 		return err
 	}
 	// make sure we have a hashchain for the given domain
-	max, found, err := ce.keyDB.GetLastHashChainPos(domain)
+	chain, err := ce.hashChainDomain(domain, depth)
 	if err != nil {
 		return err
 	}
-	if !found {
-		return log.Errorf("no hash chain entries found for domain '%s'", domain)
+	max, _, err := ce.keyDB.GetLastHashChainPos(chain)
+	if err != nil {
+		return err
 	}
 
 	var TYPE, NONCE, HashID, CrUID, UIDIndex []byte
-	var matchFound bool
+	var prev *uid.Message
+	var msgs []*uid.Message
+	var positions []uint64
 	for i := uint64(0); i <= max; i++ {
-		hcEntry, err := ce.keyDB.GetHashChainEntry(domain, i)
+		hcEntry, err := ce.keyDB.GetHashChainEntry(chain, i)
 		if err != nil {
 			return err
 		}
@@ -317,80 +801,59 @@ func (ce *CryptEngine) searchHashChain(id string, searchOnly bool) error {
 		log.Debugf("cryptengine: UIDIndex=%s", base64.Encode(UIDIndex))
 
 		// Check UID already exists in keyDB
-		_, pos, found, err := ce.keyDB.GetPublicUID(mappedID, i)
+		cached, pos, found, err := ce.keyDB.GetPublicUID(mappedID, i)
 		if err != nil {
 			return err
 		}
 		if found && pos == i {
-			// UID exists already -> skip entry
-			matchFound = true
+			// UID exists already (and has been verified) -> skip entry
+			prev = cached
 			continue
 		}
 
-		// Compute: IDKEY = HASH(k2 | Identity)
-		tmp = make([]byte, len(k2)+len(mappedID))
-		copy(tmp, k2)
-		copy(tmp[len(k2):], mappedID)
-		IDKEY := cipher.SHA256(tmp)
-
-		// Fetch from Key Repository: UIDMessageReply = GET(UIDIndex)
-		msgReply, err := ce.fetchUID(domain, UIDIndex)
+		uid, err := ce.fetchVerifiedUID(chain, mappedID, i, k2, CrUID, UIDIndex)
 		if err != nil {
 			return err
 		}
 
-		// Decrypt UIDHash = AES_256_CBC_Decrypt( IDKEY, CrUID)
-		UIDHash := aes256.CBCDecrypt(IDKEY, CrUID)
-		log.Debugf("cryptengine: UIDHash=%s", base64.Encode(UIDHash))
-
-		// Decrypt UIDMessageReply.UIDMessage with UIDHash
-		index, uid, err := msgReply.Decrypt(UIDHash)
-		if err != nil {
+		// Verify connected identity
+		if err := ce.verifyConnectedIdentity(uid, depth); err != nil {
 			return err
 		}
-		log.Debugf("cryptengine: UIDMessage=%s", uid.JSON())
 
-		// Check index
-		if !bytes.Equal(index, UIDIndex) {
-			return log.Errorf("cryptengine: index != UIDIndex")
-		}
-
-		// Verify self signature
-		if err := uid.VerifySelfSig(); err != nil {
-			return log.Error(err)
-		}
-
-		// Verify server signature
-		if err := ce.verifyServerSig(uid, msgReply, i); err != nil {
-			return err
-		}
-
-		// TODO: make sure the whole chain of UIDMessages is valid
-
-		// Store UIDMessage
-		if err := ce.keyDB.AddPublicUID(uid, i); err != nil {
+		// Make sure the whole chain of UIDMessages is valid
+		if err := ce.verifyUIDChain(chain, prev, uid, i); err != nil {
 			return err
 		}
-		matchFound = true
+		prev = uid
+		msgs = append(msgs, uid)
+		positions = append(positions, i)
 
 		// If no further entry can be found, the latest UIDMessage entry has been found
 	}
 
-	if matchFound {
-		return nil
+	if prev == nil {
+		return log.Errorf("no hash chain entry found of id '%s'", id)
 	}
 
-	return log.Errorf("no hash chain entry found of id '%s'", id)
+	// Store verified UIDMessages
+	return ce.keyDB.AddPublicUIDs(msgs, positions)
 }
 
+// lookupHashChain looks up the hash chain positions of the given id with the
+// corresponding key server (see searchHashChain).
 func (ce *CryptEngine) lookupHashChain(id string) error {
 	// map identity
 	mappedID, domain, err := identity.MapPlus(id)
 	if err != nil {
 		return err
 	}
+	chain, err := ce.hashChainDomain(domain, 0)
+	if err != nil {
+		return err
+	}
 	// get JSON-RPC client
-	client, _, err := ce.cache.Get(domain, ce.keydPort, ce.keydHost, ce.homedir,
+	client, _, err := ce.cache.Get(chain, ce.keydPort, ce.keydHost, ce.homedir,
 		"KeyHashchain.LookupUID")
 	if err != nil {
 		return err
@@ -409,15 +872,22 @@ func (ce *CryptEngine) lookupHashChain(id string) error {
 		}
 		return log.Error("cryptengine: lookup ID reply has the wrong type")
 	}
-	var TYPE, NONCE, HashID, CrUID, UIDIndex []byte
-	var matchFound bool
+	// verify the UID messages in hash chain order
+	var hcPosList []uint64
 	for k, v := range hcPositions {
 		hcPosFloat, ok := v.(float64)
 		if !ok {
 			return log.Errorf("cryptengine: lookup ID reply position entry %d has the wrong type", k)
 		}
-		hcPos := uint64(hcPosFloat)
-		hcEntry, err := ce.keyDB.GetHashChainEntry(domain, hcPos)
+		hcPosList = append(hcPosList, uint64(hcPosFloat))
+	}
+	sort.Slice(hcPosList, func(i, j int) bool { return hcPosList[i] < hcPosList[j] })
+	var TYPE, NONCE, HashID, CrUID, UIDIndex []byte
+	var prev *uid.Message
+	var msgs []*uid.Message
+	var positions []uint64
+	for _, hcPos := range hcPosList {
+		hcEntry, err := ce.keyDB.GetHashChainEntry(chain, hcPos)
 		if err != nil {
 			return err
 		}
@@ -445,70 +915,43 @@ func (ce *CryptEngine) lookupHashChain(id string) error {
 		log.Debugf("cryptengine: UIDIndex=%s", base64.Encode(UIDIndex))
 
 		// Check UID already exists in keyDB
-		_, pos, found, err := ce.keyDB.GetPublicUID(mappedID, hcPos)
+		cached, pos, found, err := ce.keyDB.GetPublicUID(mappedID, hcPos)
 		if err != nil {
 			return err
 		}
 		if found && pos == hcPos {
-			// UID exists already -> skip entry
-			matchFound = true
+			// UID exists already (and has been verified) -> skip entry
+			prev = cached
 			continue
 		}
 
-		// Compute: IDKEY = HASH(k2 | Identity)
-		tmp = make([]byte, len(k2)+len(mappedID))
-		copy(tmp, k2)
-		copy(tmp[len(k2):], mappedID)
-		IDKEY := cipher.SHA256(tmp)
-
-		// Fetch from Key Repository: UIDMessageReply = GET(UIDIndex)
-		msgReply, err := ce.fetchUID(domain, UIDIndex)
+		uid, err := ce.fetchVerifiedUID(chain, mappedID, hcPos, k2, CrUID, UIDIndex)
 		if err != nil {
 			return err
 		}
 
-		// Decrypt UIDHash = AES_256_CBC_Decrypt( IDKEY, CrUID)
-		UIDHash := aes256.CBCDecrypt(IDKEY, CrUID)
-		log.Debugf("cryptengine: UIDHash=%s", base64.Encode(UIDHash))
-
-		// Decrypt UIDMessageReply.UIDMessage with UIDHash
-		index, uid, err := msgReply.Decrypt(UIDHash)
-		if err != nil {
+		// Verify connected identity
+		if err := ce.verifyConnectedIdentity(uid, 0); err != nil {
 			return err
 		}
-		log.Debugf("cryptengine: UIDMessage=%s", uid.JSON())
-
-		// Check index
-		if !bytes.Equal(index, UIDIndex) {
-			return log.Errorf("cryptengine: index != UIDIndex")
-		}
 
-		// Verify self signature
-		if err := uid.VerifySelfSig(); err != nil {
-			return log.Error(err)
-		}
-
-		// Verify server signature
-		if err := ce.verifyServerSig(uid, msgReply, hcPos); err != nil {
+		// Make sure the whole chain of UIDMessages is valid
+		if err := ce.verifyUIDChain(chain, prev, uid, hcPos); err != nil {
 			return err
 		}
-
-		// TODO: make sure the whole chain of UIDMessages is valid
-
-		// Store UIDMessage
-		if err := ce.keyDB.AddPublicUID(uid, hcPos); err != nil {
-			return err
-		}
-		matchFound = true
+		prev = uid
+		msgs = append(msgs, uid)
+		positions = append(positions, hcPos)
 
 		// If no further entry can be found, the latest UIDMessage entry has been found
 	}
 
-	if matchFound {
-		return nil
+	if prev == nil {
+		return log.Errorf("lookup found no entry of id '%s'", id)
 	}
 
-	return log.Errorf("lookup found no entry of id '%s'", id)
+	// Store verified UIDMessages
+	return ce.keyDB.AddPublicUIDs(msgs, positions)
 }
 
 // showHashChain shows the hash chain of the given domain on output-fd.
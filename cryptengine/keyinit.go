@@ -5,7 +5,10 @@
 package cryptengine
 
 import (
+	"encoding/json"
+	"fmt"
 	"math"
+	"os"
 
 	"github.com/mutecomm/mute/cipher"
 	"github.com/mutecomm/mute/log"
@@ -14,21 +17,19 @@ import (
 	"github.com/mutecomm/mute/util/times"
 )
 
-func (ce *CryptEngine) addKeyInit(pseudonym, mixaddress, nymaddress, token string) error {
-	// map pseudonym
-	id, domain, err := identity.MapPlus(pseudonym)
-	if err != nil {
-		return err
-	}
-	// TODO: check token?
+// publishKeyInit publishes a new KeyInit message for msg (paid with token) to
+// the KeyInit repository repoURI and stores it in keyDB. If singleUse is true,
+// the KeyInit message cannot serve as a fallback key and its private key is
+// destroyed after the first session has been started with it.
+func (ce *CryptEngine) publishKeyInit(
+	msg *uid.Message,
+	repoURI, mixaddress, nymaddress, token string,
+	singleUse bool,
+) error {
 	// generate KeyInit
-	msg, _, err := ce.keyDB.GetPrivateUID(id, true)
-	if err != nil {
-		return err
-	}
 	// TODO: fix parameter!
 	ki, pubKeyHash, privateKey, err := msg.KeyInit(0,
-		uint64(times.NinetyDaysLater()), 0, true, domain, mixaddress,
+		uint64(times.NinetyDaysLater()), 0, !singleUse, repoURI, mixaddress,
 		nymaddress, cipher.RandReader)
 	if err != nil {
 		return err
@@ -44,7 +45,7 @@ func (ce *CryptEngine) addKeyInit(pseudonym, mixaddress, nymaddress, token strin
 	privateKeys = append(privateKeys, privateKey)
 	tokens = append(tokens, token)
 	// get JSON-RPC client and capabilities
-	client, caps, err := ce.cache.Get(domain, ce.keydPort, ce.keydHost,
+	client, caps, err := ce.cache.Get(repoURI, ce.keydPort, ce.keydHost,
 		ce.homedir, "KeyInitRepository.AddKeyInit")
 	if err != nil {
 		return err
@@ -86,86 +87,229 @@ func (ce *CryptEngine) addKeyInit(pseudonym, mixaddress, nymaddress, token strin
 	return nil
 }
 
-func (ce *CryptEngine) fetchKeyInit(pseudonym string) error {
+// addKeyInit publishes new KeyInit messages for nym pseudonym to all KeyInit
+// repositories of the nym's UID. tokens contains one payment token for every
+// repository (in the order of UIDContent.REPOURIS). Publishing fails only, if
+// no repository could be reached.
+func (ce *CryptEngine) addKeyInit(
+	pseudonym, mixaddress, nymaddress string,
+	tokens []string,
+	singleUse bool,
+) error {
 	// map pseudonym
-	id, domain, err := identity.MapPlus(pseudonym)
+	id, err := identity.Map(pseudonym)
 	if err != nil {
 		return err
 	}
-	// get corresponding public ID
-	msg, _, found, err := ce.keyDB.GetPublicUID(id, math.MaxInt64) // TODO: use simpler API
+	// TODO: check token?
+	msg, _, err := ce.keyDB.GetPrivateUID(id, true)
 	if err != nil {
 		return err
 	}
-	if !found {
-		return log.Errorf("not UID for '%s' found", id)
+	if len(tokens) != len(msg.UIDContent.REPOURIS) {
+		return log.Errorf("cryptengine: %d KeyInit repositories, but %d tokens",
+			len(msg.UIDContent.REPOURIS), len(tokens))
 	}
-	// get SIGKEYHASH
-	sigKeyHash, err := msg.SigKeyHash()
+	var published bool
+	for i, repoURI := range msg.UIDContent.REPOURIS {
+		err = ce.publishKeyInit(msg, repoURI, mixaddress, nymaddress, tokens[i],
+			singleUse)
+		if err != nil {
+			log.Warnf("cryptengine: could not publish KeyInit to %s: %s",
+				repoURI, err)
+			continue
+		}
+		published = true
+	}
+	if !published {
+		return err
+	}
+	return nil
+}
+
+// showRepoURIs shows the KeyInit repository URIs of nym pseudonym as JSON
+// array on outfp.
+func (ce *CryptEngine) showRepoURIs(pseudonym string, outfp *os.File) error {
+	// map pseudonym
+	id, err := identity.Map(pseudonym)
+	if err != nil {
+		return err
+	}
+	msg, _, err := ce.keyDB.GetPrivateUID(id, false)
 	if err != nil {
 		return err
 	}
+	jsn, err := json.Marshal(msg.UIDContent.REPOURIS)
+	if err != nil {
+		return log.Error(err)
+	}
+	fmt.Fprintln(outfp, string(jsn))
+	return nil
+}
+
+// fetchKeyInitFrom fetches a KeyInit message for SIGKEYHASH sigKeyHash from
+// the KeyInit repository repoURI.
+func (ce *CryptEngine) fetchKeyInitFrom(
+	repoURI, sigKeyHash string,
+) (*uid.KeyInit, error) {
 	// get JSON-RPC client and capabilities
-	client, _, err := ce.cache.Get(domain, ce.keydPort, ce.keydHost,
+	client, _, err := ce.cache.Get(repoURI, ce.keydPort, ce.keydHost,
 		ce.homedir, "KeyInitRepository.FetchKeyInit")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	// call server
 	content := make(map[string]interface{})
 	content["SigKeyHash"] = sigKeyHash
 	reply, err := client.JSONRPCRequest("KeyInitRepository.FetchKeyInit", content)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	rep, ok := reply["KeyInit"].(string)
 	if !ok {
-		return log.Errorf("cryptengine: could not fetch key init for '%s'", sigKeyHash)
+		return nil, log.Errorf("cryptengine: could not fetch key init for '%s'", sigKeyHash)
 	}
 	ki, err := uid.NewJSONKeyInit([]byte(rep))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if ki.Contents.REPOURI != repoURI {
+		return nil, log.Error(uid.ErrRepoURI)
 	}
-	// store public key init message
-	return ce.keyDB.AddPublicKeyInit(ki)
+	return ki, nil
 }
 
-func (ce *CryptEngine) flushKeyInit(pseudonym string) error {
+// fetchKeyInit fetches a KeyInit message for nym pseudonym. The KeyInit
+// repositories of the nym's UID are tried in order until one succeeds.
+func (ce *CryptEngine) fetchKeyInit(pseudonym string) error {
 	// map pseudonym
-	id, domain, err := identity.MapPlus(pseudonym)
+	id, err := identity.Map(pseudonym)
 	if err != nil {
 		return err
 	}
 	// get corresponding public ID
-	msg, _, err := ce.keyDB.GetPrivateUID(id, true)
+	msg, _, found, err := ce.keyDB.GetPublicUID(id, math.MaxInt64) // TODO: use simpler API
 	if err != nil {
 		return err
 	}
-	// get JSON-RPC client and capabilities
-	client, _, err := ce.cache.Get(domain, ce.keydPort, ce.keydHost,
-		ce.homedir, "KeyInitRepository.FlushKeyInit")
+	if !found {
+		return log.Errorf("not UID for '%s' found", id)
+	}
+	// get SIGKEYHASH
+	sigKeyHash, err := msg.SigKeyHash()
 	if err != nil {
 		return err
 	}
-	// call server
-	content := make(map[string]interface{})
-	nonce, signature := msg.SignNonce()
-	content["SigPubKey"] = msg.UIDContent.SIGKEY.PUBKEY
-	content["Nonce"] = nonce
-	content["Signature"] = signature
-	_, err = client.JSONRPCRequest("KeyInitRepository.FlushKeyInit", content)
+	for _, repoURI := range msg.UIDContent.REPOURIS {
+		var ki *uid.KeyInit
+		ki, err = ce.fetchKeyInitFrom(repoURI, sigKeyHash)
+		if err == nil {
+			err = ki.Verify(msg.UIDContent.REPOURIS, msg.UIDContent.SIGKEY.PUBKEY)
+		}
+		if err != nil {
+			log.Warnf("cryptengine: could not fetch KeyInit from %s: %s",
+				repoURI, err)
+			continue
+		}
+		// store public key init message
+		return ce.keyDB.AddPublicKeyInit(ki)
+	}
+	if err != nil && msg.PFSPreference() == uid.Optional {
+		// messages to nyms with optional PFS preference can be encrypted to
+		// their static key instead (see msg.Encrypt)
+		log.Warnf("cryptengine: no KeyInit for '%s', using static key", id)
+		return nil
+	}
+	return err
+}
+
+// countKeyInit writes the number of single-use KeyInit messages of nym
+// pseudonym which have not been consumed yet and are still valid to outfp.
+func (ce *CryptEngine) countKeyInit(pseudonym string, outfp *os.File) error {
+	// map pseudonym
+	id, err := identity.Map(pseudonym)
 	if err != nil {
 		return err
 	}
-	/*
-		rep, ok := reply["KeyInit"].(string)
-		if !ok {
-			return log.Errorf("cryptengine: could not fetch key init for '%s'", sigKeyHash)
+	msg, _, err := ce.keyDB.GetPrivateUID(id, false)
+	if err != nil {
+		return err
+	}
+	sigKeyHash, err := msg.SigKeyHash()
+	if err != nil {
+		return err
+	}
+	n, err := ce.keyDB.NumSingleUseKeyInits(sigKeyHash, uint64(times.Now()))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(outfp, "SINGLEUSE:\t%d\n", n)
+	return nil
+}
+
+// flushKeyInit flushes the KeyInit messages of nym pseudonym from all its
+// KeyInit repositories. If consumed is true, only the consumed single-use
+// KeyInit messages are flushed and afterwards deleted from keyDB.
+func (ce *CryptEngine) flushKeyInit(pseudonym string, consumed bool) error {
+	// map pseudonym
+	id, err := identity.Map(pseudonym)
+	if err != nil {
+		return err
+	}
+	// get corresponding public ID
+	msg, _, err := ce.keyDB.GetPrivateUID(id, true)
+	if err != nil {
+		return err
+	}
+	var sigKeyHash string
+	var sessionAnchorHashes []string
+	if consumed {
+		sigKeyHash, err = msg.SigKeyHash()
+		if err != nil {
+			return err
 		}
-		_, err = uid.NewJSONKeyInit([]byte(rep))
+		kis, err := ce.keyDB.GetConsumedKeyInits(sigKeyHash)
 		if err != nil {
 			return err
 		}
-	*/
+		if len(kis) == 0 {
+			log.Infof("cryptengine: no consumed KeyInits of '%s'", id)
+			return nil
+		}
+		for _, ki := range kis {
+			sessionAnchorHashes = append(sessionAnchorHashes,
+				ki.SessionAnchorHash())
+		}
+	}
+	var flushed bool
+	for _, repoURI := range msg.UIDContent.REPOURIS {
+		// get JSON-RPC client and capabilities
+		client, _, err := ce.cache.Get(repoURI, ce.keydPort, ce.keydHost,
+			ce.homedir, "KeyInitRepository.FlushKeyInit")
+		if err == nil {
+			// call server
+			content := make(map[string]interface{})
+			nonce, signature := msg.SignNonce()
+			content["SigPubKey"] = msg.UIDContent.SIGKEY.PUBKEY
+			content["Nonce"] = nonce
+			content["Signature"] = signature
+			if consumed {
+				content["SessionAnchorHashes"] = sessionAnchorHashes
+			}
+			_, err = client.JSONRPCRequest("KeyInitRepository.FlushKeyInit", content)
+		}
+		if err != nil {
+			log.Warnf("cryptengine: could not flush KeyInits from %s: %s",
+				repoURI, err)
+			continue
+		}
+		flushed = true
+	}
+	if !flushed {
+		return log.Errorf("cryptengine: could not flush KeyInits of '%s'", id)
+	}
+	if consumed {
+		return ce.keyDB.DelConsumedKeyInits(sigKeyHash)
+	}
 	return nil
 }
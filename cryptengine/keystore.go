@@ -12,6 +12,7 @@ import (
 	"github.com/mutecomm/mute/msg/session"
 	"github.com/mutecomm/mute/uid"
 	"github.com/mutecomm/mute/util"
+	"github.com/mutecomm/mute/util/times"
 )
 
 // GetSessionState implements corresponding method for msg.KeyStore interface.
@@ -77,6 +78,12 @@ func (ce *CryptEngine) GetPrivateKeyEntry(pubKeyHash string) (*uid.KeyEntry, err
 	return ke, nil
 }
 
+// ConsumePrivateKeyEntry implements corresponding method for msg.KeyStore
+// interface.
+func (ce *CryptEngine) ConsumePrivateKeyEntry(pubKeyHash string) error {
+	return ce.keyDB.ConsumePrivateKeyInit(pubKeyHash, uint64(times.Now()))
+}
+
 // GetPublicKeyEntry implements corresponding method for msg.KeyStore interface.
 func (ce *CryptEngine) GetPublicKeyEntry(uidMsg *uid.Message) (*uid.KeyEntry, string, error) {
 	log.Debugf("ce.FindKeyEntry: uidMsg.Identity()=%s", uidMsg.Identity())
@@ -183,6 +190,20 @@ func (ce *CryptEngine) DelMessageKey(
 	return ce.keyDB.DelMessageKey(sessionKey, sender, msgIndex)
 }
 
+// SkipMessageKeys implements corresponding method for msg.KeyStore interface.
+func (ce *CryptEngine) SkipMessageKeys(
+	sessionKey string,
+	msgIndex, cleanupTime uint64,
+) (uint64, error) {
+	return ce.keyDB.SkipMessageKeys(sessionKey, msgIndex, cleanupTime)
+}
+
+// CleanupMessageKeys implements corresponding method for msg.KeyStore
+// interface.
+func (ce *CryptEngine) CleanupMessageKeys(t uint64) error {
+	return ce.keyDB.CleanupMessageKeys(t)
+}
+
 // AddSessionKey implements corresponding method for msg.KeyStore interface.
 func (ce *CryptEngine) AddSessionKey(
 	hash, json, privKey string,
@@ -5,11 +5,14 @@
 package cryptengine
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"math"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/mutecomm/mute/cipher"
 	"github.com/mutecomm/mute/log"
@@ -17,19 +20,53 @@ import (
 	"github.com/mutecomm/mute/uid/identity"
 )
 
+// parseValidity parses the validity window of an UID message given as
+// RFC3339 timestamps. Empty timestamps are returned as 0.
+func parseValidity(notbefore, notafter string) (uint64, uint64, error) {
+	var nb, na uint64
+	if notbefore != "" {
+		t, err := time.Parse(time.RFC3339, notbefore)
+		if err != nil {
+			return 0, 0, log.Error(err)
+		}
+		nb = uint64(t.Unix())
+	}
+	if notafter != "" {
+		t, err := time.Parse(time.RFC3339, notafter)
+		if err != nil {
+			return 0, 0, log.Error(err)
+		}
+		na = uint64(t.Unix())
+	}
+	return nb, na, nil
+}
+
 // generate a new nym and store it in keydb.
+// If escrow is true, the private signature escrow key is written to outputfp
+// (it is not stored in keydb).
+// mixaddress and nymaddress are only used if the pfs preference is optional.
 func (ce *CryptEngine) generate(
 	pseudonym string,
-	keyserver bool,
+	keyserver, escrow bool,
+	pfs, mixaddress, nymaddress string,
+	repoURIs []string,
+	notbefore, notafter string,
 	outputfp *os.File,
 ) error {
+	nb, na, err := parseValidity(notbefore, notafter)
+	if err != nil {
+		return err
+	}
 	// map pseudonym
 	id, domain, err := identity.MapPlus(pseudonym)
 	if err != nil {
 		return err
 	}
+	pfsPreference, err := uid.ParsePFSPreference(pfs)
+	if err != nil {
+		return err
+	}
 	// create new UID
-	// TODO: allow different PFS preferences
 	var lastEntry string
 	if !keyserver {
 		// no lastEntry, because this will be the first entry in hashchain
@@ -38,8 +75,8 @@ func (ce *CryptEngine) generate(
 			return err
 		}
 	}
-	uid, err := uid.Create(id, false, "", "", uid.Strict, lastEntry,
-		cipher.RandReader)
+	uid, err := uid.Create(id, escrow, mixaddress, nymaddress, pfsPreference,
+		lastEntry, repoURIs, nb, na, cipher.RandReader)
 	if err != nil {
 		return err
 	}
@@ -59,6 +96,9 @@ func (ce *CryptEngine) generate(
 			fmt.Fprintf(outputfp, "{\"PRIVSIGKEY\": %q}\n", uid.PrivateSigKey())
 		}
 	}
+	if escrow {
+		fmt.Fprintf(outputfp, "{\"PRIVESCROWKEY\": %q}\n", uid.PrivateEscrowKey())
+	}
 	log.Infof("nym '%s' generated successfully", id)
 	return nil
 }
@@ -73,7 +113,7 @@ func (ce *CryptEngine) registerOrUpdate(
 	}
 	// TODO: check token?
 	// get UID from keyDB
-	msg, messageReply, err := ce.keyDB.GetPrivateUID(id, false)
+	msg, messageReply, err := ce.keyDB.GetLatestPrivateUID(id, false)
 	if err != nil {
 		return err
 	}
@@ -131,19 +171,73 @@ func (ce *CryptEngine) register(pseudonym, tokenString string) error {
 }
 
 // genupdate generates an update for the (registered) nym and stores it in keydb.
-func (ce *CryptEngine) genupdate(pseudonym string) error {
+func (ce *CryptEngine) genupdate(
+	pseudonym string,
+	repoURIs []string,
+	notbefore, notafter string,
+) error {
 	// map pseudonym
 	id, err := identity.Map(pseudonym)
 	if err != nil {
 		return err
 	}
+	nb, na, err := parseValidity(notbefore, notafter)
+	if err != nil {
+		return err
+	}
 	// get old UID from keyDB
-	oldUID, _, err := ce.keyDB.GetPrivateUID(id, true)
+	oldUID, _, err := ce.keyDB.GetLatestPrivateUID(id, true)
 	if err != nil {
 		return err
 	}
 	// generate new UID
-	newUID, err := oldUID.Update(cipher.RandReader)
+	newUID, err := oldUID.Update(repoURIs, nb, na, cipher.RandReader)
+	if err != nil {
+		return err
+	}
+	// store new UID in keyDB
+	return ce.keyDB.AddPrivateUID(newUID)
+}
+
+// recoverUID generates an update for the nym signed with the private escrow
+// key read from infp and stores it in keydb. The previous UID message is taken
+// from the key hashchain, because the own private UID may have been lost.
+func (ce *CryptEngine) recoverUID(
+	pseudonym string,
+	notbefore, notafter string,
+	infp *os.File,
+) error {
+	// map pseudonym
+	id, err := identity.Map(pseudonym)
+	if err != nil {
+		return err
+	}
+	nb, na, err := parseValidity(notbefore, notafter)
+	if err != nil {
+		return err
+	}
+	// read private escrow key
+	scanner := bufio.NewScanner(infp)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return log.Error(err)
+		}
+		return log.Error("cryptengine: cannot read escrow key")
+	}
+	escrowKey := strings.TrimSpace(scanner.Text())
+	// get latest registered UID from key hashchain
+	if err := ce.searchHashChain(id, false); err != nil {
+		return err
+	}
+	oldUID, _, found, err := ce.keyDB.GetPublicUID(id, math.MaxInt64)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return log.Errorf("cryptengine: UID for '%s' not found in hash chain", id)
+	}
+	// generate recovered UID
+	newUID, err := oldUID.Recover(cipher.RandReader, escrowKey, nb, na)
 	if err != nil {
 		return err
 	}
@@ -165,7 +259,7 @@ func (ce *CryptEngine) deleteUID(pseudonym string, force bool) error {
 	}
 
 	// get UID from keyDB
-	msg, _, err := ce.keyDB.GetPrivateUID(id, false)
+	msg, _, err := ce.keyDB.GetLatestPrivateUID(id, false)
 	if err != nil {
 		return err
 	}
@@ -188,6 +282,25 @@ func (ce *CryptEngine) deleteUID(pseudonym string, force bool) error {
 	return ce.keyDB.DelPrivateUID(msg)
 }
 
+// validity shows the validity window (NOTBEFORE and NOTAFTER as Unix time) of
+// the latest UID message of nym and whether it has been registered with the
+// key server on outfp.
+func (ce *CryptEngine) validity(pseudonym string, outfp *os.File) error {
+	// map pseudonym
+	id, err := identity.Map(pseudonym)
+	if err != nil {
+		return err
+	}
+	msg, msgReply, err := ce.keyDB.GetLatestPrivateUID(id, false)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(outfp, "NOTBEFORE:\t%d\n", msg.UIDContent.NOTBEFORE)
+	fmt.Fprintf(outfp, "NOTAFTER:\t%d\n", msg.UIDContent.NOTAFTER)
+	fmt.Fprintf(outfp, "REGISTERED:\t%t\n", msgReply != nil)
+	return nil
+}
+
 // list UIDs shows all own (mapped) users IDs on outfp.
 func (ce *CryptEngine) listUIDs(outfp *os.File) error {
 	ids, err := ce.keyDB.GetPrivateIdentities()
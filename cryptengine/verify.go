@@ -0,0 +1,71 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cryptengine
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/msg"
+	"github.com/mutecomm/mute/uid"
+	"github.com/mutecomm/mute/uid/identity"
+)
+
+// verify reads message content from r and verifies the base64 encoded
+// permanent signature sig of it against the UID message of identity id with
+// the given uidHash (the sender UID message of the received message).
+// Signatures which have been stored without uidHash are verified against the
+// current UID message of id.
+func (ce *CryptEngine) verify(
+	id, sig, uidHash string,
+	r io.Reader,
+	statusfp *os.File,
+) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	// get UID from keyDB
+	var (
+		uidMsg *uid.Message
+		found  bool
+	)
+	if uidHash != "" {
+		uidMsg, _, found, err = ce.keyDB.GetPublicUIDByHash(idMapped, uidHash)
+	} else {
+		uidMsg, _, found, err = ce.keyDB.GetPublicUID(idMapped, math.MaxInt64)
+	}
+	if err != nil {
+		return err
+	}
+	if !found {
+		return log.Errorf("cryptengine: UID message of '%s' used for signature not found",
+			idMapped)
+	}
+	signature, err := base64.Decode(sig)
+	if err != nil {
+		return err
+	}
+	if len(signature) != ed25519.SignatureSize {
+		return log.Error(msg.ErrWrongSignatureLength)
+	}
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return log.Error(err)
+	}
+	contentHash := cipher.SHA512(content)
+	if !ed25519.Verify(uidMsg.PublicSigKey32()[:], contentHash, signature) {
+		return log.Error(msg.ErrInvalidSignature)
+	}
+	fmt.Fprintf(statusfp, "VERIFIED:\t%s\n", idMapped)
+	return nil
+}
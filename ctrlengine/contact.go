@@ -15,6 +15,7 @@ import (
 
 	"github.com/frankbraun/codechain/util/bzero"
 	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/msg"
 	"github.com/mutecomm/mute/msgdb"
 	"github.com/mutecomm/mute/serviceguard/client"
 	"github.com/mutecomm/mute/uid/identity"
@@ -357,6 +358,36 @@ func (ce *CtrlEngine) contactUnblock(id, contact string) error {
 	return nil
 }
 
+func (ce *CtrlEngine) contactResetSession(
+	c *cli.Context,
+	id, contact string,
+) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	contactMapped, err := identity.Map(contact)
+	if err != nil {
+		return err
+	}
+
+	// make sure contact exists
+	unmappedID, _, contactType, err := ce.msgDB.GetContact(idMapped,
+		contactMapped)
+	if err != nil {
+		return err
+	}
+	if unmappedID == "" {
+		return log.Errorf("ctrlengine: unknown contact %s", contact)
+	}
+	if contactType == msgdb.BlackList {
+		return log.Errorf("ctrlengine: %s is blocked", contact)
+	}
+
+	// the StatusReset message starts a new session from a fresh KeyInit
+	return ce.addStatus(c, idMapped, contactMapped, msg.StatusReset)
+}
+
 func (ce *CtrlEngine) contactList(outfp io.Writer, id string) error {
 	idMapped, err := identity.Map(id)
 	if err != nil {
@@ -6,6 +6,7 @@
 package ctrlengine
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -97,8 +98,13 @@ func (ce *CtrlEngine) getConfig(homedir string, offline bool) error {
 		if err := json.Unmarshal([]byte(jsn), &ce.config); err != nil {
 			return err
 		}
-		// apply old configuration
-		err := def.InitMute(&ce.config)
+		// verify and apply old configuration
+		err := ce.config.Verify()
+		if err != nil {
+			log.Warnf("ctrlengine: cannot verify cached config: %s", err)
+		} else {
+			err = def.InitMute(&ce.config)
+		}
 		if err != nil {
 			// init failed -> update config (which will try init again)
 			fmt.Fprintf(ce.fileTable.StatusFP,
@@ -107,7 +113,7 @@ func (ce *CtrlEngine) getConfig(homedir string, offline bool) error {
 				return log.Error("ctrlengine: cannot fetch config in " +
 					"--offline mode, run without")
 			}
-			err := ce.upkeepFetchconf(ce.msgDB, homedir, false, nil,
+			err := ce.upkeepFetchconf(ce.msgDB, homedir, false, false, nil,
 				ce.fileTable.StatusFP)
 			if err != nil {
 				return err
@@ -137,10 +143,18 @@ func (ce *CtrlEngine) getConfig(homedir string, offline bool) error {
 								"--offline mode\n")
 					} else {
 						// update config
-						err := ce.upkeepFetchconf(ce.msgDB, homedir, false, nil,
-							ce.fileTable.StatusFP)
+						err := ce.upkeepFetchconf(ce.msgDB, homedir, false,
+							false, nil, ce.fileTable.StatusFP)
 						if err != nil {
-							return err
+							if last > def.FetchconfMaxDuration {
+								return err
+							}
+							// fall back to cached (verified) config
+							log.Warn("ctrlengine: cannot fetch outdated " +
+								"config, using cached config")
+							fmt.Fprintf(ce.fileTable.StatusFP,
+								"ctrlengine: cannot fetch outdated config, "+
+									"using cached config\n")
 						}
 					}
 				}
@@ -152,7 +166,7 @@ func (ce *CtrlEngine) getConfig(homedir string, offline bool) error {
 			return log.Error("ctrlengine: cannot fetch config in --offline mode")
 		}
 		fmt.Fprintf(ce.fileTable.StatusFP, "no system config found\n")
-		err := ce.upkeepFetchconf(ce.msgDB, homedir, false, nil,
+		err := ce.upkeepFetchconf(ce.msgDB, homedir, false, false, nil,
 			ce.fileTable.StatusFP)
 		if err != nil {
 			return err
@@ -297,7 +311,7 @@ func buildCmdList(commands []cli.Command, prefix string) []string {
 	var cmds []string
 	for _, cmd := range commands {
 		if cmd.Subcommands != nil {
-			cmds = append(cmds, buildCmdList(cmd.Subcommands, cmd.Name+" ")...)
+			cmds = append(cmds, buildCmdList(cmd.Subcommands, prefix+cmd.Name+" ")...)
 		} else {
 			cmds = append(cmds, prefix+cmd.Name)
 		}
@@ -307,12 +321,42 @@ func buildCmdList(commands []cli.Command, prefix string) []string {
 
 var (
 	interactive bool
+	commandMode bool // commands are read from command-fd
 	line        *liner.State
 )
 
-// loop runs the CtrlEngine in a loop and reads commands from the file
-// descriptor command-fd.
-// TODO: actually read from command-fd!
+// runCommand runs the command given in line ln. It returns true, if an exit
+// has been requested. The returned error is the error of the command.
+func (ce *CtrlEngine) runCommand(c *cli.Context, ln string) (bool, error) {
+	args := []string{ce.app.Name}
+	// in the loop these global variables are reset, therefore we have to
+	// pass them in again
+	args = append(args,
+		"--homedir", c.GlobalString("homedir"),
+		"--logdir", c.GlobalString("logdir"),
+		"--loglevel", c.GlobalString("loglevel"),
+	)
+	args = append(args, strings.Fields(ln)...)
+	if err := ce.app.Run(args); err != nil {
+		log.Infof("command execution failed (app): %s", err)
+		return false, err
+	}
+	if ce.err != nil {
+		err := ce.err
+		ce.err = nil
+		if err == errExit {
+			return true, nil
+		}
+		log.Infof("command execution failed (cmd): %s", err)
+		return false, ce.translateError(err)
+	}
+	log.Info("command successful")
+	return false, nil
+}
+
+// loop runs the CtrlEngine in a loop. If the option --command-fd is set, the
+// commands are read from the file descriptor command-fd (see commandLoop).
+// Otherwise, the commands are read interactively from the terminal.
 func (ce *CtrlEngine) loop(c *cli.Context) {
 	if len(c.Args()) > 0 {
 		ce.err = fmt.Errorf("ctrlengine: unknown command '%s', try 'help'",
@@ -324,6 +368,11 @@ func (ce *CtrlEngine) loop(c *cli.Context) {
 
 	interactive = true
 
+	if c.GlobalIsSet("command-fd") {
+		ce.commandLoop(c)
+		return
+	}
+
 	// run command(s)
 	line = liner.NewLiner()
 	defer line.Close()
@@ -359,40 +408,72 @@ func (ce *CtrlEngine) loop(c *cli.Context) {
 		}
 		line.AppendHistory(ln)
 
-		args := []string{ce.app.Name}
 		if ln == "" {
 			log.Infof("read empty line")
 			continue
 		}
 		log.Infof("read: %s", ln)
-		// in the loop these global variables are reset, therefore we have to
-		// pass them in again
-		args = append(args,
-			"--homedir", c.GlobalString("homedir"),
-			"--logdir", c.GlobalString("logdir"),
-			"--loglevel", c.GlobalString("loglevel"),
-		)
-		args = append(args, strings.Fields(ln)...)
-		if err := ce.app.Run(args); err != nil {
+		quit, err := ce.runCommand(c, ln)
+		if quit {
+			// exit requested -> return
+			log.Info("ctrlengine: stopping (exit requested)")
+			return
+		}
+		if err != nil {
 			// command execution failed -> issue status and continue
-			log.Infof("command execution failed (app): %s", err)
 			fmt.Fprintln(ce.fileTable.StatusFP, err)
+		}
+	}
+}
+
+// commandLoop reads newline-delimited commands from the file descriptor
+// command-fd and runs them until the command "quit" is read or command-fd is
+// closed. The following status lines are written to status-fd:
+//
+//	READY.          the engine is ready to read the next command
+//	OK              the last command was successful
+//	ERROR:\t<msg>   the last command failed with the error message <msg>
+//	QUITTING        the engine stops after a "quit" command
+//
+// Every command is answered with exactly one OK or ERROR: line, which is
+// written after the output of the command itself and followed by READY. (or
+// QUITTING). Empty lines are answered with READY. only.
+// Messages cannot be read from input-fd in command mode (it might be the same
+// file descriptor as command-fd), they have to be given with --file.
+func (ce *CtrlEngine) commandLoop(c *cli.Context) {
+	commandMode = true
+	defer func() { commandMode = false }()
+	log.Infof("read commands from fd %d", ce.fileTable.CommandFD)
+	scanner := bufio.NewScanner(ce.fileTable.CommandFP)
+	fmt.Fprintln(ce.fileTable.StatusFP, "READY.")
+	for scanner.Scan() {
+		ln := scanner.Text()
+		if ln == "" {
+			log.Infof("read empty line")
+			fmt.Fprintln(ce.fileTable.StatusFP, "READY.")
 			continue
 		}
-		if ce.err != nil {
-			if ce.err == errExit {
-				// exit requested -> return
-				log.Info("ctrlengine: stopping (exit requested)")
-				ce.err = nil
-				return
-			}
+		log.Infof("read: %s", ln)
+		quit, err := ce.runCommand(c, ln)
+		if err != nil {
 			// command execution failed -> issue status and continue
-			fmt.Fprintln(ce.fileTable.StatusFP, ce.translateError(ce.err))
-			ce.err = nil
+			msg := strings.Replace(err.Error(), "\n", " ", -1)
+			fmt.Fprintf(ce.fileTable.StatusFP, "ERROR:\t%s\n", msg)
 		} else {
-			log.Info("command successful")
+			fmt.Fprintln(ce.fileTable.StatusFP, "OK")
+		}
+		if quit {
+			// exit requested -> return
+			log.Info("ctrlengine: stopping (exit requested)")
+			fmt.Fprintln(ce.fileTable.StatusFP, "QUITTING")
+			return
 		}
+		fmt.Fprintln(ce.fileTable.StatusFP, "READY.")
 	}
+	if err := scanner.Err(); err != nil {
+		ce.err = log.Errorf("ctrlengine: %s", err)
+	}
+	log.Info("ctrlengine: stopping (command-fd closed)")
 }
 
 func (ce *CtrlEngine) getID(c *cli.Context) string {
@@ -509,6 +590,14 @@ func New() *CtrlEngine {
 		Name:  "msgnum",
 		Usage: "message ID to process",
 	}
+	notbeforeFlag := cli.StringFlag{
+		Name:  "notbefore",
+		Usage: "UID not valid before this time (RFC3339, default: valid immediately)",
+	}
+	notafterFlag := cli.StringFlag{
+		Name:  "notafter",
+		Usage: "UID not valid after this time (RFC3339, default: one year from now)",
+	}
 	ce.app.Commands = []cli.Command{
 		{
 			Name:  "app",
@@ -606,7 +695,7 @@ func New() *CtrlEngine {
 				*/
 				{
 					Name:  "vacuum",
-					Usage: "Do full DB rebuild (VACUUM)",
+					Usage: "Do full DB rebuild (VACUUM) and rebuild the message search index",
 					/*
 						Flags: []cli.Flag{
 							cli.StringFlag{
@@ -665,6 +754,89 @@ func New() *CtrlEngine {
 						ce.err = ce.dbVersion(c, ce.fileTable.OutputFP)
 					},
 				},
+				{
+					Name:      "backup",
+					Usage:     "Write encrypted backup of DBs and config",
+					ArgsUsage: "file",
+					Description: `
+Writes a consistent snapshot of the message and key databases (including the
+wallet state) together with the config files to a single archive file. The
+archive is encrypted and authenticated with the passphrase of the databases.
+`,
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) == 0 {
+							return log.Error("backup file is mandatory")
+						}
+						if len(c.Args()) > 1 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args()[1:], " "))
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.dbBackup(c, ce.fileTable.StatusFP,
+							c.Args().First())
+					},
+				},
+				{
+					Name:      "restore",
+					Usage:     "Restore DBs and config from encrypted backup",
+					ArgsUsage: "file",
+					Description: `
+Restores the message and key databases and the config files from an archive
+written by "db backup". The passphrase must be the one used for the backup.
+Existing databases are only replaced with --force (they are kept as *.orig),
+because restoring rolls back the session state: restored session keys may be
+reused. The restore is refused, if *.orig files from an earlier restore exist.
+`,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "force",
+							Usage: "overwrite existing databases",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) == 0 {
+							return log.Error("backup file is mandatory")
+						}
+						if len(c.Args()) > 1 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args()[1:], " "))
+						}
+						return ce.prepare(c, false, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.dbRestore(c, ce.fileTable.StatusFP,
+							c.Args().First(), c.Bool("force"))
+					},
+				},
+				{
+					Name:  "migrate",
+					Usage: "Migrate DBs to current version",
+					Description: `
+Migrates the message and key databases to the current version. Before a
+database is migrated, its files are backed up (e.g., msgs.v6.db and
+msgs.v6.key for msgdb version 6). Databases are also migrated automatically
+when they are opened, use --dry-run to show the pending migrations first.
+`,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "only show pending migrations",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, false, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.dbMigrate(c, ce.fileTable.OutputFP,
+							c.Bool("dry-run"))
+					},
+				},
 			},
 		},
 		{
@@ -684,6 +856,17 @@ Tries to register a new user ID with the corresponding key server.
 						mindelayFlag,
 						maxdelayFlag,
 						nodelaycheckFlag,
+						cli.StringSliceFlag{
+							Name:  "repouri",
+							Usage: "KeyInit repository (can be given multiple times, default: domain of ID)",
+						},
+						cli.StringFlag{
+							Name:  "pfs",
+							Value: "strict",
+							Usage: "PFS preference (mandatory, strict, or optional)",
+						},
+						notbeforeFlag,
+						notafterFlag,
 					},
 					Before: func(c *cli.Context) error {
 						if len(c.Args()) > 0 {
@@ -699,7 +882,10 @@ Tries to register a new user ID with the corresponding key server.
 					},
 					Action: func(c *cli.Context) {
 						ce.err = ce.uidNew(c, int32(c.Int("mindelay")),
-							int32(c.Int("maxdelay")), c.String("host"))
+							int32(c.Int("maxdelay")), c.String("host"),
+							c.String("pfs"),
+							c.StringSlice("repouri"), c.String("notbefore"),
+							c.String("notafter"))
 					},
 				},
 				{
@@ -922,6 +1108,34 @@ Tries to register a new user ID with the corresponding key server.
 							c.String("contact"))
 					},
 				},
+				{
+					Name:  "reset-session",
+					Usage: "reset session with contact for active user ID",
+					Description: `
+Reset the session with contact and start a new session from a fresh KeyInit
+message. The (empty) reset message is sent with the next 'msg send'.
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						contactFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("contact") {
+							return log.Error("option --contact is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.contactResetSession(c, ce.getID(c),
+							c.String("contact"))
+					},
+				},
 				{
 					Name:  "list",
 					Usage: "list contacts for active user ID (white list)",
@@ -993,17 +1207,14 @@ email body as the actual message.
 							Name:  "mail-input",
 							Usage: "treat input as email message",
 						},
-						// TODO: implement options
-						/*
-							cli.StringSliceFlag{
-								Name:  "attach",
-								Usage: "file to append as attachment",
-							},
-							cli.BoolFlag{
-								Name:  "permanent-signature",
-								Usage: "add permanent sign. to message",
-							},
-						*/
+						cli.StringSliceFlag{
+							Name:  "attach",
+							Usage: "file to append as attachment",
+						},
+						cli.BoolFlag{
+							Name:  "permanent-signature",
+							Usage: "add permanent sign. to message",
+						},
 						mindelayFlag,
 						maxdelayFlag,
 						nodelaycheckFlag,
@@ -1022,6 +1233,9 @@ email body as the actual message.
 						if c.IsSet("mail-input") && c.IsSet("to") {
 							return log.Error("options --to and --mail-input exclude each other")
 						}
+						if commandMode && !c.IsSet("file") {
+							return log.Error("option --file is mandatory in command mode")
+						}
 						if err := checkDelayArgs(c); err != nil {
 							return err
 						}
@@ -1036,6 +1250,61 @@ email body as the actual message.
 							line, ce.fileTable.InputFP)
 					},
 				},
+				{
+					Name:  "reply",
+					Usage: "add a reply to a message to outqueue",
+					Description: `
+Add a reply to the message with the given message number to outqueue.
+The reply is sent to the peer of the original message, the original message
+is quoted, and the reply is marked as an answer to it (In-Reply-To).
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						msgNumFlag,
+						cli.StringFlag{
+							Name:  "file",
+							Usage: "read reply from file",
+						},
+						cli.StringSliceFlag{
+							Name:  "attach",
+							Usage: "file to append as attachment",
+						},
+						cli.BoolFlag{
+							Name:  "permanent-signature",
+							Usage: "add permanent sign. to message",
+						},
+						mindelayFlag,
+						maxdelayFlag,
+						nodelaycheckFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("msgnum") {
+							return log.Error("option --msgnum is mandatory")
+						}
+						if commandMode && !c.IsSet("file") {
+							return log.Error("option --file is mandatory in command mode")
+						}
+						if err := checkDelayArgs(c); err != nil {
+							return err
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.msgReply(c, ce.getID(c),
+							int64(c.Int("msgnum")), c.String("file"),
+							c.Bool("permanent-signature"),
+							c.StringSlice("attach"),
+							int32(c.Int("mindelay")), int32(c.Int("maxdelay")),
+							line, ce.fileTable.InputFP)
+					},
+				},
 				{
 					Name:  "send",
 					Usage: "send messages from out queue",
@@ -1046,6 +1315,7 @@ email body as the actual message.
 							Name:  "fail-delivery",
 							Usage: "Fail on first delivery attempt (for testing purposes)",
 						},
+						hostFlag,
 					},
 					Before: func(c *cli.Context) error {
 						if len(c.Args()) > 0 {
@@ -1058,7 +1328,7 @@ email body as the actual message.
 					},
 					Action: func(c *cli.Context) {
 						ce.err = ce.msgSend(c, ce.getID(c), c.Bool("all"),
-							c.Bool("fail-delivery"))
+							c.Bool("fail-delivery"), c.String("host"))
 					},
 				},
 				{
@@ -1088,6 +1358,10 @@ email body as the actual message.
 					Usage: "list messages",
 					Flags: []cli.Flag{
 						idFlag,
+						cli.StringFlag{
+							Name:  "folder",
+							Usage: "only list messages in folder (inbox, archive, trash, starred, or sent; default: all except trash)",
+						},
 					},
 					Before: func(c *cli.Context) error {
 						if len(c.Args()) > 0 {
@@ -1096,10 +1370,84 @@ email body as the actual message.
 						if !interactive && !c.IsSet("id") {
 							return log.Error("option --id is mandatory")
 						}
+						if _, err := msgdb.ParseFolder(c.String("folder")); err != nil {
+							return err
+						}
 						return ce.prepare(c, true, true)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.msgList(ce.fileTable.OutputFP, ce.getID(c))
+						ce.err = ce.msgList(ce.fileTable.OutputFP, ce.getID(c),
+							c.String("folder"))
+					},
+				},
+				{
+					Name:      "search",
+					Usage:     "search messages",
+					ArgsUsage: "query",
+					Description: `
+Searches the subject lines and bodies of all messages (except the ones in
+trash) for the given full-text query. Terms are combined with AND, OR and
+NOT can be used explicitly, and a term ending with * matches all words
+with that prefix (e.g., meet*). Use subject:term to search subject lines only.
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						cli.StringFlag{
+							Name:  "from",
+							Usage: "only search messages from this sender",
+						},
+						cli.StringFlag{
+							Name:  "since",
+							Usage: "only search messages not older than date (RFC 3339 or YYYY-MM-DD)",
+						},
+						cli.StringFlag{
+							Name:  "until",
+							Usage: "only search messages not newer than date (RFC 3339 or YYYY-MM-DD)",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) == 0 {
+							return log.Error("query is mandatory")
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if _, err := parseDate(c.String("since")); err != nil {
+							return err
+						}
+						if _, err := parseDate(c.String("until")); err != nil {
+							return err
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.msgSearch(ce.fileTable.OutputFP, ce.getID(c),
+							strings.Join(c.Args(), " "), c.String("from"),
+							c.String("since"), c.String("until"))
+					},
+				},
+				{
+					Name:  "thread",
+					Usage: "list conversation with contact",
+					Flags: []cli.Flag{
+						idFlag,
+						contactFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("contact") {
+							return log.Error("option --contact is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.msgThread(ce.fileTable.OutputFP, ce.getID(c),
+							c.String("contact"))
 					},
 				},
 				{
@@ -1126,6 +1474,238 @@ email body as the actual message.
 							int64(c.Int("msgnum")))
 					},
 				},
+				{
+					Name:  "attachments",
+					Usage: "Commands for message attachments",
+					Subcommands: []cli.Command{
+						{
+							Name:  "list",
+							Usage: "list attachments of message",
+							Flags: []cli.Flag{
+								idFlag,
+								msgNumFlag,
+							},
+							Before: func(c *cli.Context) error {
+								if len(c.Args()) > 0 {
+									return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+								}
+								if !interactive && !c.IsSet("id") {
+									return log.Error("option --id is mandatory")
+								}
+								if !c.IsSet("msgnum") {
+									return log.Error("option --msgnum is mandatory")
+								}
+								return ce.prepare(c, true, true)
+							},
+							Action: func(c *cli.Context) {
+								ce.err = ce.msgAttachmentsList(ce.fileTable.OutputFP,
+									ce.getID(c), int64(c.Int("msgnum")))
+							},
+						},
+						{
+							Name:  "save",
+							Usage: "save attachments of message to disk",
+							Description: `
+Saves the attachments of a message to the directory given by --dir (default:
+current directory). If option --attachid is set, only the attachment with the
+given ID (see 'msg attachments list') is saved. Existing files are not
+overwritten.
+`,
+							Flags: []cli.Flag{
+								idFlag,
+								msgNumFlag,
+								cli.IntFlag{
+									Name:  "attachid",
+									Usage: "attachment ID to save (default: all)",
+								},
+								cli.StringFlag{
+									Name:  "dir",
+									Value: ".",
+									Usage: "directory to save attachments to",
+								},
+							},
+							Before: func(c *cli.Context) error {
+								if len(c.Args()) > 0 {
+									return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+								}
+								if !interactive && !c.IsSet("id") {
+									return log.Error("option --id is mandatory")
+								}
+								if !c.IsSet("msgnum") {
+									return log.Error("option --msgnum is mandatory")
+								}
+								return ce.prepare(c, true, true)
+							},
+							Action: func(c *cli.Context) {
+								ce.err = ce.msgAttachmentsSave(ce.fileTable.StatusFP,
+									ce.getID(c), int64(c.Int("msgnum")),
+									int64(c.Int("attachid")), c.String("dir"))
+							},
+						},
+					},
+				},
+				{
+					Name:  "verify",
+					Usage: "verify permanent signature of message",
+					Description: `
+Verifies the permanent signature(s) of a received message against the UID of
+the sender which was used to sign the message (recorded when the message was
+received, the current UID for older messages) and checks that the signed content matches the stored
+message. The verification status shown by 'msg list' and 'msg read' is
+updated accordingly.
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						msgNumFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("msgnum") {
+							return log.Error("option --msgnum is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.msgVerify(c, ce.fileTable.StatusFP,
+							ce.getID(c), int64(c.Int("msgnum")))
+					},
+				},
+				{
+					Name:  "archive",
+					Usage: "move a message to the archive",
+					Description: `
+Moves a message to the archive folder. Use "msg restore" to move it back.
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						msgNumFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("msgnum") {
+							return log.Error("option --msgnum is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.msgArchive(ce.getID(c), int64(c.Int("msgnum")))
+					},
+				},
+				{
+					Name:  "trash",
+					Usage: "move a message to trash",
+					Description: `
+Moves a message to the trash folder. Messages in trash are permanently
+deleted by "upkeep all" after the trash retention period.
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						msgNumFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("msgnum") {
+							return log.Error("option --msgnum is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.msgTrash(ce.getID(c), int64(c.Int("msgnum")))
+					},
+				},
+				{
+					Name:  "restore",
+					Usage: "restore a message from archive or trash",
+					Description: `
+Moves an archived or trashed message back to its original folder.
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						msgNumFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("msgnum") {
+							return log.Error("option --msgnum is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.msgRestore(ce.getID(c), int64(c.Int("msgnum")))
+					},
+				},
+				{
+					Name:  "star",
+					Usage: "star a message",
+					Description: `
+Stars a message (starred messages are listed in the starred folder).
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						msgNumFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("msgnum") {
+							return log.Error("option --msgnum is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.msgStar(ce.getID(c), int64(c.Int("msgnum")), true)
+					},
+				},
+				{
+					Name:  "unstar",
+					Usage: "unstar a message",
+					Description: `
+Removes the star from a message.
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						msgNumFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("msgnum") {
+							return log.Error("option --msgnum is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.msgStar(ce.getID(c), int64(c.Int("msgnum")), false)
+					},
+				},
 				{
 					Name:  "delete",
 					Usage: "delete a message",
@@ -1168,6 +1748,11 @@ A deleted message is permanently gone. Handle with care!
 							Name:  "period",
 							Usage: "perform task only if last execution was earlier than period",
 						},
+						cli.StringFlag{
+							Name:  "trash-retention",
+							Value: def.TrashRetention.String(),
+							Usage: "permanently delete messages which have been in trash for longer than trash-retention",
+						},
 					},
 					Before: func(c *cli.Context) error {
 						if len(c.Args()) > 0 {
@@ -1180,11 +1765,15 @@ A deleted message is permanently gone. Handle with care!
 						if !c.IsSet("period") {
 							return log.Error("option --period is mandatory")
 						}
+						if _, err := time.ParseDuration(c.String("trash-retention")); err != nil {
+							return log.Errorf("option --trash-retention: %s", err)
+						}
 						return ce.prepare(c, true, true)
 					},
 					Action: func(c *cli.Context) {
 						ce.err = ce.upkeepAll(c, ce.getID(c),
-							c.String("period"), ce.fileTable.StatusFP)
+							c.String("period"), c.String("trash-retention"),
+							ce.fileTable.StatusFP)
 					},
 				},
 				{
@@ -1195,6 +1784,10 @@ A deleted message is permanently gone. Handle with care!
 							Name:  "show",
 							Usage: "Show config on output-fd",
 						},
+						cli.BoolFlag{
+							Name:  "diff",
+							Usage: "Show changes to previous config on output-fd",
+						},
 					},
 					Before: func(c *cli.Context) error {
 						if len(c.Args()) > 0 {
@@ -1206,7 +1799,55 @@ A deleted message is permanently gone. Handle with care!
 					Action: func(c *cli.Context) {
 						ce.err = ce.upkeepFetchconf(ce.msgDB,
 							c.GlobalString("homedir"), c.Bool("show"),
-							ce.fileTable.OutputFP, ce.fileTable.StatusFP)
+							c.Bool("diff"), ce.fileTable.OutputFP,
+							ce.fileTable.StatusFP)
+					},
+				},
+				{
+					Name:  "pinconf",
+					Usage: "Pin (override) Mute system config keys locally",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "key",
+							Usage: "config key to pin",
+						},
+						cli.StringFlag{
+							Name:  "value",
+							Usage: "value to pin config key to",
+						},
+						cli.BoolFlag{
+							Name:  "unpin",
+							Usage: "unpin config key (use server value again)",
+						},
+						cli.StringFlag{
+							Name:  "cacert",
+							Usage: "pin CA certificate from file",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("key") && !c.IsSet("cacert") {
+							return log.Error("option --key or --cacert is mandatory")
+						}
+						if c.IsSet("unpin") && !c.IsSet("key") {
+							return log.Error("option --unpin requires option --key")
+						}
+						if c.IsSet("unpin") && c.IsSet("value") {
+							return log.Error("options --unpin and --value exclude each other")
+						}
+						if c.IsSet("key") && !c.IsSet("unpin") && !c.IsSet("value") {
+							return log.Error("option --value is mandatory")
+						}
+						return ce.prepare(c, true, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.upkeepPinconf(ce.msgDB,
+							c.GlobalString("homedir"), c.String("key"),
+							c.String("value"), c.Bool("unpin"),
+							c.String("cacert"), ce.fileTable.StatusFP)
 					},
 				},
 				{
@@ -1277,6 +1918,76 @@ A deleted message is permanently gone. Handle with care!
 							ce.fileTable.StatusFP)
 					},
 				},
+				{
+					Name:  "uid",
+					Usage: "Rollover user ID before it expires",
+					Description: `
+Generates, registers, and publishes an updated UID message (and new KeyInit
+messages), if the current UID message of the user ID expires within the
+remaining duration.
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						hostFlag,
+						cli.StringFlag{
+							Name:  "remaining",
+							Value: "720h",
+							Usage: "rollover UID only if remaining time is less than remaining",
+						},
+						notafterFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.upkeepUID(c, ce.getID(c), c.String("host"),
+							c.String("remaining"), c.String("notafter"),
+							ce.fileTable.StatusFP)
+					},
+				},
+				{
+					Name:  "keyinits",
+					Usage: "Top up pool of single-use KeyInit messages",
+					Description: `
+Flushes consumed single-use KeyInit messages of the user ID from its KeyInit
+repositories and publishes new single-use KeyInit messages, until pool many
+unused ones are available.
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						hostFlag,
+						cli.IntFlag{
+							Name:  "pool",
+							Value: def.KeyInitPool,
+							Usage: "number of unused single-use KeyInit messages to keep published",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if c.Int("pool") < 0 {
+							return log.Error("option --pool must not be negative")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.upkeepKeyInits(c, ce.getID(c),
+							c.String("host"), c.Int("pool"),
+							ce.fileTable.StatusFP)
+					},
+				},
 				{
 					Name:  "hashchain",
 					Usage: "Sync and verify hashchain for the given domain.",
@@ -1378,10 +2089,8 @@ func decodeWalletKey(p string) (*[ed25519.PrivateKeySize]byte, error) {
 	return &ret, nil
 }
 
-func (ce *CtrlEngine) openMsgDB(
-	homedir string,
-) error {
-	// read passphrase, if necessary
+// readPassphrase reads the passphrase, if necessary.
+func (ce *CtrlEngine) readPassphrase() error {
 	if ce.passphrase == nil {
 		fmt.Fprintf(ce.fileTable.StatusFP, "read passphrase from fd %d (not echoed)\n",
 			ce.fileTable.PassphraseFD)
@@ -1394,6 +2103,16 @@ func (ce *CtrlEngine) openMsgDB(
 		}
 		log.Info("done")
 	}
+	return nil
+}
+
+func (ce *CtrlEngine) openMsgDB(
+	homedir string,
+) error {
+	// read passphrase, if necessary
+	if err := ce.readPassphrase(); err != nil {
+		return err
+	}
 
 	// open msgDB
 	msgdbname := filepath.Join(homedir, "msgs")
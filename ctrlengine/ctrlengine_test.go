@@ -0,0 +1,113 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mutecomm/mute/util/descriptors"
+	"github.com/urfave/cli"
+)
+
+// runCommandLoop runs the command loop of a new CtrlEngine with the given
+// commands written to a pipe and returns the written status lines.
+func runCommandLoop(t *testing.T, commands ...string) []string {
+	tmpdir, err := ioutil.TempDir("", "ctrlengine_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	cmdR, cmdW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmdR.Close()
+	statusFP, err := ioutil.TempFile(tmpdir, "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer statusFP.Close()
+	ce := New()
+	ce.app.Writer = ioutil.Discard
+	ce.prepared = true
+	ce.fileTable = &descriptors.Table{
+		InputFP:   cmdR,
+		OutputFP:  statusFP,
+		StatusFP:  statusFP,
+		CommandFP: cmdR,
+	}
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String("homedir", tmpdir, "")
+	set.String("logdir", tmpdir, "")
+	set.String("loglevel", "error", "")
+	c := cli.NewContext(ce.app, set, nil)
+	oldInteractive := interactive
+	defer func() { interactive = oldInteractive }()
+	interactive = true
+	if _, err := cmdW.WriteString(strings.Join(commands, "\n")); err != nil {
+		t.Fatal(err)
+	}
+	cmdW.Close()
+	ce.commandLoop(c)
+	if ce.err != nil {
+		t.Fatal(ce.err)
+	}
+	if commandMode {
+		t.Error("command mode not reset")
+	}
+	status, err := ioutil.ReadFile(statusFP.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(status), "\n"), "\n")
+}
+
+func checkStatusLines(t *testing.T, status, expected []string) {
+	if len(status) != len(expected) {
+		t.Fatalf("wrong status lines: %q", status)
+	}
+	for i := range expected {
+		if !strings.HasPrefix(status[i], expected[i]) {
+			t.Errorf("status line %d: %q does not start with %q", i,
+				status[i], expected[i])
+		}
+	}
+}
+
+func TestCommandLoop(t *testing.T) {
+	status := runCommandLoop(t,
+		"help",
+		"",
+		"quit superfluous",
+		"msg add --from alice@mute.berlin --to bob@mute.berlin",
+		"quit",
+		"help",
+	)
+	checkStatusLines(t, status, []string{
+		"READY.",
+		"OK",
+		"READY.",
+		"READY.",
+		"ERROR:\tsuperfluous argument(s): superfluous",
+		"READY.",
+		"ERROR:\toption --file is mandatory in command mode",
+		"READY.",
+		"OK",
+		"QUITTING",
+	})
+}
+
+func TestCommandLoopClosed(t *testing.T) {
+	status := runCommandLoop(t, "help")
+	checkStatusLines(t, status, []string{
+		"READY.",
+		"OK",
+		"READY.",
+	})
+}
@@ -9,19 +9,24 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"crypto/ed25519"
 
 	"github.com/frankbraun/codechain/util/bzero"
 	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encdb"
 	"github.com/mutecomm/mute/encode/base64"
 	"github.com/mutecomm/mute/log"
 	"github.com/mutecomm/mute/msgdb"
+	"github.com/mutecomm/mute/util/backup"
+	"github.com/mutecomm/mute/util/times"
 	"github.com/urfave/cli"
 	"golang.org/x/crypto/ssh/terminal"
 )
@@ -143,7 +148,7 @@ func (ce *CtrlEngine) dbCreate(
 	}
 	defer msgDB.Close()
 	// configure to make sure mutecrypt has config file
-	err = ce.upkeepFetchconf(msgDB, homedir, false, nil, statusfp)
+	err = ce.upkeepFetchconf(msgDB, homedir, false, false, nil, statusfp)
 	if err != nil {
 		return err
 	}
@@ -370,6 +375,10 @@ func mutecryptDBVacuum(
 }
 
 func (ce *CtrlEngine) dbVacuum(c *cli.Context, autoVacuumMode string) error {
+	// rebuild full-text index before vacuuming to release unused index pages
+	if err := ce.msgDB.RebuildIndex(); err != nil {
+		return err
+	}
 	if err := ce.msgDB.Vacuum(autoVacuumMode); err != nil {
 		return err
 	}
@@ -464,3 +473,259 @@ func (ce *CtrlEngine) dbVersion(c *cli.Context, w io.Writer) error {
 	}
 	return nil
 }
+
+func mutecryptDBMigrate(
+	c *cli.Context,
+	w io.Writer,
+	passphrase []byte,
+	dryRun bool,
+) error {
+	args := []string{
+		"--homedir", c.GlobalString("homedir"),
+		"--loglevel", c.GlobalString("loglevel"),
+		"--logdir", c.GlobalString("logdir"),
+		"db", "migrate",
+	}
+	if dryRun {
+		args = append(args, "--dry-run")
+	}
+	cmd := exec.Command("mutecrypt", args...)
+	cmd.Stdout = w
+	var errbuf bytes.Buffer
+	cmd.Stderr = &errbuf
+	ppR, ppW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ppR.Close()
+	ppW.Write(passphrase)
+	ppW.Close()
+	cmd.ExtraFiles = append(cmd.ExtraFiles, ppR)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(errbuf.String()))
+	}
+	return nil
+}
+
+func (ce *CtrlEngine) dbMigrate(c *cli.Context, w io.Writer, dryRun bool) error {
+	if err := ce.readPassphrase(); err != nil {
+		return err
+	}
+	homedir := c.GlobalString("homedir")
+	msgdbname := filepath.Join(homedir, "msgs")
+	pending, err := msgdb.PendingMigrations(msgdbname, ce.passphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "msgdb:\n")
+	for _, migration := range pending {
+		fmt.Fprintf(w, "migrate to version %d (%s)\n", migration.Version,
+			migration.Description)
+	}
+	if len(pending) == 0 {
+		fmt.Fprintf(w, "version=%s is current\n", msgdb.Version)
+	}
+	if !dryRun && len(pending) > 0 && ce.msgDB == nil {
+		// opening msgDB applies the migrations
+		if err := ce.openMsgDB(homedir); err != nil {
+			return err
+		}
+	}
+	if err := mutecryptDBMigrate(c, w, ce.passphrase, dryRun); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+// dbFiles are the database files contained in a backup.
+var dbFiles = []string{
+	"msgs" + encdb.DBSuffix,
+	"msgs" + encdb.KeySuffix,
+	"keys" + encdb.DBSuffix,
+	"keys" + encdb.KeySuffix,
+}
+
+func (ce *CtrlEngine) dbBackup(c *cli.Context, statfp io.Writer, file string) error {
+	homedir := c.GlobalString("homedir")
+	if _, err := os.Stat(file); err == nil {
+		return log.Errorf("ctrlengine: backup file '%s' exists already", file)
+	}
+	tmpdir, err := ioutil.TempDir(homedir, "backup")
+	if err != nil {
+		return log.Error(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	// take consistent snapshots of both databases
+	msgdbname := filepath.Join(homedir, "msgs")
+	err = encdb.Snapshot(ce.msgDB.DB(), msgdbname, filepath.Join(tmpdir, "msgs"))
+	if err != nil {
+		return log.Error(err)
+	}
+	keydbname := filepath.Join(homedir, "keys")
+	keyDB, err := encdb.Open(keydbname, ce.passphrase)
+	if err != nil {
+		return log.Error(err)
+	}
+	err = encdb.Snapshot(keyDB, keydbname, filepath.Join(tmpdir, "keys"))
+	keyDB.Close()
+	if err != nil {
+		return log.Error(err)
+	}
+	// the wallet state is contained in msgDB
+	archive := &backup.Archive{Created: times.Now()}
+	for _, name := range dbFiles {
+		data, err := ioutil.ReadFile(filepath.Join(tmpdir, name))
+		if err != nil {
+			return log.Error(err)
+		}
+		archive.Files = append(archive.Files, &backup.File{Name: name, Data: data})
+	}
+	// add config files
+	configdir := filepath.Join(homedir, "config")
+	infos, err := ioutil.ReadDir(configdir)
+	if err != nil && !os.IsNotExist(err) {
+		return log.Error(err)
+	}
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || strings.HasSuffix(info.Name(), ".new") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(configdir, info.Name()))
+		if err != nil {
+			return log.Error(err)
+		}
+		archive.Files = append(archive.Files,
+			&backup.File{Name: "config/" + info.Name(), Data: data})
+	}
+	// encrypt and write archive
+	enc, err := archive.Encrypt(ce.passphrase, encdb.KDFIterations,
+		cipher.RandReader)
+	if err != nil {
+		return log.Error(err)
+	}
+	fp, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return log.Error(err)
+	}
+	if _, err := fp.Write(enc); err != nil {
+		fp.Close()
+		return log.Error(err)
+	}
+	if err := fp.Close(); err != nil {
+		return log.Error(err)
+	}
+	log.Infof("ctrlengine: backup of %d files written to '%s'",
+		len(archive.Files), file)
+	fmt.Fprintf(statfp, "ctrlengine: backup of %d files written to '%s'\n",
+		len(archive.Files), file)
+	return nil
+}
+
+// writeRestoredFile writes the restored file f to homedir.
+func writeRestoredFile(homedir string, f *backup.File) error {
+	filename := filepath.Join(homedir, filepath.FromSlash(f.Name))
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return log.Error(err)
+	}
+	tmpfile := filename + ".new"
+	os.Remove(tmpfile) // ignore error
+	if err := ioutil.WriteFile(tmpfile, f.Data, 0600); err != nil {
+		return log.Error(err)
+	}
+	if err := os.Rename(tmpfile, filename); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+func (ce *CtrlEngine) dbRestore(
+	c *cli.Context,
+	statfp io.Writer,
+	file string,
+	force bool,
+) error {
+	if ce.msgDB != nil {
+		return log.Error("ctrlengine: cannot restore backup while msgDB is open")
+	}
+	homedir := c.GlobalString("homedir")
+	if err := ce.readPassphrase(); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return log.Error(err)
+	}
+	archive, err := backup.Decrypt(data, ce.passphrase)
+	if err != nil {
+		return log.Error(err)
+	}
+	for _, name := range dbFiles {
+		if archive.File(name) == nil {
+			return log.Errorf("ctrlengine: backup '%s' does not contain %s",
+				file, name)
+		}
+	}
+	created := time.Unix(archive.Created, 0).UTC().Format(time.RFC3339)
+	// restoring over existing databases rolls back the session state
+	var existing []string
+	for _, name := range dbFiles {
+		filename := filepath.Join(homedir, name)
+		info, err := os.Stat(filename)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return log.Error(err)
+		}
+		if !force {
+			return log.Errorf("ctrlengine: '%s' exists already, restoring the backup from %s would roll back the session state (use --force to overwrite)",
+				filename, created)
+		}
+		if strings.HasSuffix(name, encdb.DBSuffix) &&
+			info.ModTime().Unix() > archive.Created {
+			log.Warnf("ctrlengine: '%s' is newer than backup from %s",
+				filename, created)
+			fmt.Fprintf(statfp, "ctrlengine: '%s' is newer than backup from %s\n",
+				filename, created)
+		}
+		// never replace the databases kept by an earlier restore
+		if _, err := os.Stat(filename + ".orig"); err == nil {
+			return log.Errorf("ctrlengine: '%s' exists already (from an earlier restore), move it away first",
+				filename+".orig")
+		} else if !os.IsNotExist(err) {
+			return log.Error(err)
+		}
+		existing = append(existing, filename)
+	}
+	// keep the existing databases
+	for _, filename := range existing {
+		if err := os.Rename(filename, filename+".orig"); err != nil {
+			return log.Error(err)
+		}
+		fmt.Fprintf(statfp, "ctrlengine: moved '%s' to '%s'\n", filename,
+			filename+".orig")
+	}
+	// restore files
+	for _, f := range archive.Files {
+		if err := writeRestoredFile(homedir, f); err != nil {
+			return err
+		}
+	}
+	// make sure the restored message database can be opened (and migrate it)
+	if err := ce.openMsgDB(homedir); err != nil {
+		return err
+	}
+	log.Infof("ctrlengine: restored %d files from backup '%s' (created %s)",
+		len(archive.Files), file, created)
+	fmt.Fprintf(statfp, "ctrlengine: restored %d files from backup '%s' (created %s)\n",
+		len(archive.Files), file, created)
+	log.Warn("ctrlengine: restored session keys may be reused")
+	fmt.Fprintf(statfp, "WARNING: the restored key database contains the session state from %s.\n",
+		created)
+	fmt.Fprintf(statfp, "Session keys which have been used since then may be reused and messages\n")
+	fmt.Fprintf(statfp, "encrypted with later session keys cannot be decrypted.\n")
+	return nil
+}
@@ -11,8 +11,11 @@ import (
 	"io"
 	"io/ioutil"
 	"mime"
+	"mime/multipart"
+	"net/textproto"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -28,6 +31,7 @@ import (
 	"github.com/mutecomm/mute/mix/nymaddr"
 	"github.com/mutecomm/mute/msg"
 	mimeMsg "github.com/mutecomm/mute/msg/mime"
+	"github.com/mutecomm/mute/msg/msgid"
 	"github.com/mutecomm/mute/msgdb"
 	"github.com/mutecomm/mute/serviceguard/client"
 	"github.com/mutecomm/mute/uid/identity"
@@ -41,9 +45,10 @@ import (
 func mutecryptEncrypt(
 	c *cli.Context,
 	from, to string,
-	passphrase, msg []byte,
+	passphrase, message []byte,
 	sign bool,
 	nymAddress string,
+	status msg.StatusCode,
 ) (enc, nymaddress string, err error) {
 	if err := identity.IsMapped(from); err != nil {
 		return "", "", log.Error(err)
@@ -63,6 +68,9 @@ func mutecryptEncrypt(
 	if sign {
 		args = append(args, "--sign")
 	}
+	if status != msg.StatusOK {
+		args = append(args, "--status", status.String())
+	}
 	cmd := exec.Command("mutecrypt", args...)
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
@@ -83,7 +91,7 @@ func mutecryptEncrypt(
 	if err := cmd.Start(); err != nil {
 		return "", "", err
 	}
-	if _, err := stdin.Write(msg); err != nil {
+	if _, err := stdin.Write(message); err != nil {
 		return "", "", err
 	}
 	stdin.Close()
@@ -103,35 +111,20 @@ func mutecryptEncrypt(
 	return
 }
 
-func (ce *CtrlEngine) msgAdd(
-	c *cli.Context,
-	from, to, file string,
-	mailInput, permanentSignature bool,
-	attachments []string,
-	minDelay, maxDelay int32,
+// readMessage reads a message from file, from the terminal (if line is not
+// nil), or from r.
+func (ce *CtrlEngine) readMessage(
+	file string,
 	line *liner.State,
 	r io.Reader,
-) error {
-	fromMapped, err := identity.Map(from)
-	if err != nil {
-		return err
-	}
-	prev, _, err := ce.msgDB.GetNym(fromMapped)
-	if err != nil {
-		return err
-	}
-	if prev == "" {
-		return log.Errorf("user ID %s not found", from)
-	}
-
-	// TODO: handle attachments
-	var msg []byte
+) ([]byte, error) {
 	if file != "" {
 		// read message from file
-		msg, err = ioutil.ReadFile(file)
+		msg, err := ioutil.ReadFile(file)
 		if err != nil {
-			return log.Error(err)
+			return nil, log.Error(err)
 		}
+		return msg, nil
 	} else if line != nil {
 		// read message from terminal
 		fmt.Fprintln(ce.fileTable.StatusFP,
@@ -143,28 +136,36 @@ func (ce *CtrlEngine) msgAdd(
 				if err == io.EOF {
 					break
 				}
-				return log.Error(err)
+				return nil, log.Error(err)
 			}
 			inbuf.WriteString(ln + "\n")
 		}
-		msg = inbuf.Bytes()
-	} else {
-		// read message from stdin
-		msg, err = ioutil.ReadAll(r)
-		if err != nil {
-			return log.Error(err)
-		}
+		return inbuf.Bytes(), nil
 	}
-
-	if mailInput {
-		recipient, message, err := mail.Parse(bytes.NewBuffer(msg))
-		if err != nil {
-			return err
-		}
-		to = recipient
-		msg = []byte(message)
+	// read message from stdin
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, log.Error(err)
 	}
+	return msg, nil
+}
 
+// addMessage adds the message msg from user ID from to user ID to (which
+// replies to the message with ID inReplyTo, if set) with the given
+// attachments to the message DB.
+func (ce *CtrlEngine) addMessage(
+	from, to string,
+	msg []byte,
+	inReplyTo string,
+	permanentSignature bool,
+	attachments []string,
+	minDelay, maxDelay int32,
+	line *liner.State,
+) error {
+	fromMapped, err := identity.Map(from)
+	if err != nil {
+		return err
+	}
 	toMapped, err := identity.Map(to)
 	if err != nil {
 		return err
@@ -177,10 +178,31 @@ func (ce *CtrlEngine) msgAdd(
 		return log.Errorf("contact %s not found (for user ID %s)", to, from)
 	}
 
+	// read attachments
+	var atts []*msgdb.Attachment
+	for _, attachment := range attachments {
+		data, err := ioutil.ReadFile(attachment)
+		if err != nil {
+			return log.Error(err)
+		}
+		atts = append(atts, &msgdb.Attachment{
+			Filename: filepath.Base(attachment),
+			Data:     data,
+		})
+	}
+	if err := checkMIME(msg, atts); err != nil {
+		return err
+	}
+
 	// store message in message DB
+	messageID, err := msgid.Generate(fromMapped, cipher.RandReader)
+	if err != nil {
+		return log.Error(err)
+	}
 	now := times.Now()
 	err = ce.msgDB.AddMessage(fromMapped, toMapped, now, true, string(msg),
-		permanentSignature, minDelay, maxDelay)
+		messageID, inReplyTo, atts, nil, permanentSignature, minDelay,
+		maxDelay)
 	if err != nil {
 		return err
 	}
@@ -193,6 +215,304 @@ func (ce *CtrlEngine) msgAdd(
 	return nil
 }
 
+func (ce *CtrlEngine) msgAdd(
+	c *cli.Context,
+	from, to, file string,
+	mailInput, permanentSignature bool,
+	attachments []string,
+	minDelay, maxDelay int32,
+	line *liner.State,
+	r io.Reader,
+) error {
+	fromMapped, err := identity.Map(from)
+	if err != nil {
+		return err
+	}
+	prev, _, err := ce.msgDB.GetNym(fromMapped)
+	if err != nil {
+		return err
+	}
+	if prev == "" {
+		return log.Errorf("user ID %s not found", from)
+	}
+
+	msg, err := ce.readMessage(file, line, r)
+	if err != nil {
+		return err
+	}
+
+	if mailInput {
+		recipient, message, err := mail.Parse(bytes.NewBuffer(msg))
+		if err != nil {
+			return err
+		}
+		to = recipient
+		msg = []byte(message)
+	}
+
+	return ce.addMessage(from, to, msg, "", permanentSignature, attachments,
+		minDelay, maxDelay, line)
+}
+
+// quoteMessage returns the reply to the original message from sender (with
+// the given date) with the quoted original message appended.
+func quoteMessage(from string, date int64, original string, reply []byte) string {
+	subject, message := mimeMsg.SplitMessage(original)
+	if !strings.HasPrefix(subject, "Re: ") {
+		subject = "Re: " + subject
+	}
+	var b bytes.Buffer
+	b.WriteString(subject + "\n")
+	b.Write(reply)
+	if len(reply) > 0 && reply[len(reply)-1] != '\n' {
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "\nOn %s, %s wrote:\n",
+		time.Unix(date, 0).UTC().Format(time.RFC1123Z), from)
+	for _, ln := range strings.Split(strings.TrimRight(message, "\n"), "\n") {
+		if ln == "" {
+			b.WriteString(">\n")
+		} else {
+			b.WriteString("> " + ln + "\n")
+		}
+	}
+	return b.String()
+}
+
+func (ce *CtrlEngine) msgReply(
+	c *cli.Context,
+	id string,
+	msgNum int64,
+	file string,
+	permanentSignature bool,
+	attachments []string,
+	minDelay, maxDelay int32,
+	line *liner.State,
+	r io.Reader,
+) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	peer, messageID, _, err := ce.msgDB.GetMessageThreadIDs(idMapped, msgNum)
+	if err != nil {
+		return err
+	}
+	from, _, original, date, err := ce.msgDB.GetMessage(idMapped, msgNum)
+	if err != nil {
+		return err
+	}
+	reply, err := ce.readMessage(file, line, r)
+	if err != nil {
+		return err
+	}
+	msg := quoteMessage(from, date, original, reply)
+	return ce.addMessage(id, peer, []byte(msg), messageID, permanentSignature,
+		attachments, minDelay, maxDelay, line)
+}
+
+// checkMIME checks that message with the given attachments can be encoded
+// by encodeMessage.
+func checkMIME(message []byte, attachments []*msgdb.Attachment) error {
+	if len(attachments) == 0 && len(message) <= msg.MaxContentLength {
+		return nil // plain text message
+	}
+	// the MIME encoding requires a subject line
+	if subject, _ := mimeMsg.SplitMessage(string(message)); subject == "" {
+		return log.Error("ctrlengine: message with attachments or long message needs a subject line")
+	}
+	// base64 encoding expands data by 4/3
+	size := len(message)
+	for _, attachment := range attachments {
+		size += len(attachment.Data)
+	}
+	if size/3*4 > mimeMsg.MaxMsgSize {
+		return log.Errorf("ctrlengine: message too large (max. %d bytes)",
+			mimeMsg.MaxMsgSize/4*3)
+	}
+	return nil
+}
+
+// encodeMessage encodes the message from nym to peer with the given
+// messageID, inReplyTo, and attachments into one or more parts ready for
+// encryption. Messages with a subject line or attachments are MIME encoded
+// (which transfers the message ID and the ID of the message it replies to),
+// messages too large for a single encrypted message are MIME encoded and
+// split into chunks. Other messages are returned unchanged.
+func encodeMessage(
+	nym, peer, messageID, inReplyTo string,
+	message []byte,
+	attachments []*msgdb.Attachment,
+) ([]string, error) {
+	subject, _ := mimeMsg.SplitMessage(string(message))
+	if len(attachments) == 0 && len(message) <= msg.MaxContentLength &&
+		subject == "" {
+		return []string{string(message)}, nil // plain text message
+	}
+	if messageID == "" {
+		// message added before message IDs were stored
+		var err error
+		messageID, err = msgid.Generate(nym, cipher.RandReader)
+		if err != nil {
+			return nil, log.Error(err)
+		}
+	}
+	header := mimeMsg.Header{
+		From:      nym,
+		To:        peer,
+		MessageID: messageID,
+		InReplyTo: inReplyTo,
+	}
+	var atts []*mimeMsg.Attachment
+	for _, attachment := range attachments {
+		atts = append(atts, &mimeMsg.Attachment{
+			Filename: attachment.Filename,
+			Reader:   bytes.NewReader(attachment.Data),
+		})
+	}
+	var enc bytes.Buffer
+	if err := mimeMsg.New(&enc, header, string(message), atts); err != nil {
+		return nil, err
+	}
+	if enc.Len() <= msg.MaxContentLength {
+		return []string{enc.String()}, nil
+	}
+	return mimeMsg.EncodeChunks(header, enc.String(), msg.MaxContentLength)
+}
+
+// addChunk adds the decrypted chunk plainMsg from senderID to myID (from
+// inqueue entry iqIdx) together with its (verified) permanent signature sig
+// to msgDB. If all chunks of the message have been received, the message is
+// reassembled and added to msgDB. The reassembled message is only considered
+// to be signed, if all chunks are signed.
+func (ce *CtrlEngine) addChunk(
+	iqIdx int64,
+	myID, senderID, plainMsg, sig, uidHash string,
+) error {
+	header, _, piece, count, err := mimeMsg.DecodeChunk(plainMsg)
+	if err != nil {
+		// do not block the inqueue with malformed chunks
+		log.Warnf("ctrlengine: cannot decode chunk from %s -> discard chunk: %s",
+			senderID, err)
+		return ce.msgDB.DelInQueue(iqIdx)
+	}
+	// the message ID contains the sender, make sure chunks from different
+	// senders cannot be mixed
+	if msgid.Parse(header.MessageID) != senderID {
+		log.Warnf("ctrlengine: chunk %s not from %s -> discard chunk",
+			header.MessageID, senderID)
+		return ce.msgDB.DelInQueue(iqIdx)
+	}
+	err = ce.msgDB.AddChunk(iqIdx, header.MessageID, piece, count, plainMsg,
+		sig, uidHash)
+	if err == msgdb.ErrInvalidChunk {
+		log.Warnf("ctrlengine: invalid chunk %d of %d for %s -> discard chunk",
+			piece, count, header.MessageID)
+		return ce.msgDB.DelInQueue(iqIdx)
+	} else if err != nil {
+		return err
+	}
+	chunks, sigs, date, err := ce.msgDB.GetChunks(myID, header.MessageID)
+	if err != nil {
+		return err
+	}
+	if chunks == nil {
+		log.Debugf("chunk %d of %d for %s added", piece, count,
+			header.MessageID)
+		return nil
+	}
+	message, attachments, err := reassembleChunks(chunks)
+	if err != nil {
+		// the chunks have already been removed from the inqueue
+		log.Warnf("ctrlengine: cannot reassemble %s -> discard chunks: %s",
+			header.MessageID, err)
+		return ce.msgDB.DelChunks(myID, header.MessageID)
+	}
+	var signatures []*msgdb.Signature
+	for i, sig := range sigs {
+		if sig.Signature == "" {
+			if len(signatures) > 0 || i < len(sigs)-1 {
+				log.Warnf("ctrlengine: message %s only partially signed",
+					header.MessageID)
+			}
+			signatures = nil
+			break
+		}
+		signatures = append(signatures, sig)
+	}
+	err = ce.msgDB.AddMessage(myID, senderID, date, false, message,
+		header.MessageID, header.InReplyTo, attachments, signatures, false, 0,
+		0)
+	if err != nil {
+		return err
+	}
+	log.Infof("message %s reassembled from %d chunks", header.MessageID,
+		count)
+	return ce.msgDB.DelChunks(myID, header.MessageID)
+}
+
+// reassembleChunks reassembles the message from the given decrypted chunks
+// (in order) and decodes it with decodeMessage.
+func reassembleChunks(chunks []string) (string, []*msgdb.Attachment, error) {
+	var parts []string
+	for _, chunk := range chunks {
+		_, part, _, _, err := mimeMsg.DecodeChunk(chunk)
+		if err != nil {
+			return "", nil, err
+		}
+		parts = append(parts, part)
+	}
+	message, _, attachments, err := decodeMessage(strings.Join(parts, ""))
+	return message, attachments, err
+}
+
+// decodeMessage splits the decrypted message plainMsg into the actual message
+// and its attachments, if plainMsg is MIME encoded (see encodeMessage). The
+// MIME header is returned as well.
+// Otherwise plainMsg is returned unchanged (with a nil header).
+func decodeMessage(plainMsg string) (
+	string,
+	*mimeMsg.Header,
+	[]*msgdb.Attachment,
+	error,
+) {
+	if !mimeMsg.IsMIME(plainMsg) {
+		return plainMsg, nil, nil, nil // plain text message
+	}
+	header, _, message, attachments, err := mimeMsg.Parse(strings.NewReader(plainMsg))
+	if err != nil {
+		log.Warnf("ctrlengine: cannot parse MIME message, treat as plain text: %s", err)
+		return plainMsg, nil, nil, nil
+	}
+	var atts []*msgdb.Attachment
+	for _, attachment := range attachments {
+		data, err := ioutil.ReadAll(attachment.Reader)
+		if err != nil {
+			return "", nil, nil, log.Error(err)
+		}
+		atts = append(atts, &msgdb.Attachment{
+			Filename: attachment.Filename,
+			Data:     data,
+		})
+	}
+	return message, header, atts, nil
+}
+
+// threadIDs returns the message ID and the ID of the message it replies to
+// from the given MIME header of a message from senderID. The message IDs
+// contain the sender, message IDs from other senders are discarded.
+func threadIDs(header *mimeMsg.Header, senderID string) (string, string) {
+	if header == nil {
+		return "", ""
+	}
+	if msgid.Parse(header.MessageID) != senderID {
+		log.Warnf("ctrlengine: message ID %s not from %s -> discard it",
+			header.MessageID, senderID)
+		return "", ""
+	}
+	return header.MessageID, header.InReplyTo
+}
+
 func muteprotoCreate(
 	c *cli.Context,
 	msg string,
@@ -327,9 +647,8 @@ func (ce *CtrlEngine) procOutQueue(
 		resend, err := muteprotoDeliver(c, msg)
 		if err != nil {
 			// If the message delivery failed because the token expired in the
-			// meantime we retract the message from the outqueue (setting it
-			// back to 'ToSend') and start the delivery process for this
-			// message all over again.
+			// meantime we retract the envelope from the outqueue (restoring
+			// the encrypted message) and create a new envelope for it.
 			// Matching the error message string is not optimal, but the best
 			// available solution since the error results from calling another
 			// binary (muteproto).
@@ -384,11 +703,62 @@ func (ce *CtrlEngine) getNyms(id string, all bool) ([]string, error) {
 	return nyms, nil
 }
 
+// recvNymAddress returns a nymaddress for nym to receive messages at.
+func (ce *CtrlEngine) recvNymAddress(nym string) (string, error) {
+	// TODO! (implement more accounts? delay settings?)
+	privkey, server, secret, minDelay, maxDelay, _, err :=
+		ce.msgDB.GetAccount(nym, "")
+	if err != nil {
+		return "", err
+	}
+	_, domain, err := identity.Split(nym)
+	if err != nil {
+		return "", err
+	}
+	expire := times.ThirtyDaysLater() // TODO: make this settable
+	// the nymaddress is used for the whole session, it cannot be single-use
+	singleUse := false
+	var pubkey [ed25519.PublicKeySize]byte
+	copy(pubkey[:], privkey[32:])
+	_, nymaddress, err := util.NewNymAddress(domain, secret[:], expire,
+		singleUse, minDelay, maxDelay, nym, &pubkey, server, def.CACert)
+	if err != nil {
+		return "", err
+	}
+	return nymaddress, nil
+}
+
+// addStatus encrypts an empty message with the given status code from myID
+// to contact and adds it to the outqueue. It is sent with the next 'msg send'.
+func (ce *CtrlEngine) addStatus(
+	c *cli.Context,
+	myID, contact string,
+	status msg.StatusCode,
+) error {
+	recvNymAddress, err := ce.recvNymAddress(myID)
+	if err != nil {
+		return err
+	}
+	enc, nymaddress, err := mutecryptEncrypt(c, myID, contact, ce.passphrase,
+		nil, false, recvNymAddress, status)
+	if err != nil {
+		return log.Error(err)
+	}
+	// status messages have no corresponding message (msgID 0)
+	err = ce.msgDB.AddOutQueue(myID, 0, enc, nymaddress, def.MinDelay,
+		def.MaxDelay)
+	if err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
 func (ce *CtrlEngine) msgSend(
 	c *cli.Context,
 	id string,
 	all bool,
 	failDelivery bool,
+	host string,
 ) error {
 	nyms, err := ce.getNyms(id, all)
 	if err != nil {
@@ -417,8 +787,9 @@ func (ce *CtrlEngine) msgSend(
 
 		// add all undelivered messages to outqueue
 		var recvNymAddress string
+		var synced bool
 		for {
-			msgID, peer, msg, sign, minDelay, maxDelay, err :=
+			msgID, peer, message, sign, minDelay, maxDelay, err :=
 				ce.msgDB.GetUndeliveredMessage(nym)
 			if err != nil {
 				return err
@@ -428,42 +799,63 @@ func (ce *CtrlEngine) msgSend(
 				break // no more undelivered messages
 			}
 
-			// determine recipient nymaddress for encryption, if necessary
-			if recvNymAddress == "" {
-				// TODO! (implement more accounts? delay settings?)
-				privkey, server, secret, minDelay, maxDelay, _, err :=
-					ce.msgDB.GetAccount(nym, "")
-				if err != nil {
-					return err
-				}
+			// sync hash chain of nym before first encryption (the last
+			// hash chain entry is part of the encrypted message)
+			if !synced {
 				_, domain, err := identity.Split(nym)
 				if err != nil {
+					return log.Error(err)
+				}
+				if err := ce.upkeepHashchain(c, domain, host); err != nil {
 					return err
 				}
-				expire := times.ThirtyDaysLater() // TODO: make this settable
-				singleUse := false                // TODO correct?
-				var pubkey [ed25519.PublicKeySize]byte
-				copy(pubkey[:], privkey[32:])
-				_, recvNymAddress, err = util.NewNymAddress(domain, secret[:],
-					expire, singleUse, minDelay, maxDelay, nym, &pubkey, server,
-					def.CACert)
+				synced = true
+			}
+
+			// determine recipient nymaddress for encryption, if necessary
+			if recvNymAddress == "" {
+				recvNymAddress, err = ce.recvNymAddress(nym)
 				if err != nil {
 					return err
 				}
 			}
 
-			// encrypt
-			enc, nymaddress, err := mutecryptEncrypt(c, nym, peer,
-				ce.passphrase, msg, sign, recvNymAddress)
+			// add attachments and split into chunks, if necessary
+			attachments, err := ce.msgDB.GetAttachments(nym, msgID)
 			if err != nil {
-				return log.Error(err)
+				return err
 			}
-			// add to outqueue
-			log.Debug("add")
-			err = ce.msgDB.AddOutQueue(nym, msgID, enc, nymaddress,
-				minDelay, maxDelay)
+			_, messageID, inReplyTo, err := ce.msgDB.GetMessageThreadIDs(nym,
+				msgID)
 			if err != nil {
-				return log.Error(err)
+				return err
+			}
+			parts, err := encodeMessage(nym, peer, messageID, inReplyTo, message,
+				attachments)
+			if err != nil {
+				return err
+			}
+
+			// encrypt
+			var encs, nymaddresses []string
+			for _, part := range parts {
+				enc, nymaddress, err := mutecryptEncrypt(c, nym, peer,
+					ce.passphrase, []byte(part), sign, recvNymAddress,
+					msg.StatusOK)
+				if err != nil {
+					return log.Error(err)
+				}
+				encs = append(encs, enc)
+				nymaddresses = append(nymaddresses, nymaddress)
+			}
+			// add to outqueue
+			for i, enc := range encs {
+				log.Debug("add")
+				err = ce.msgDB.AddOutQueue(nym, msgID, enc, nymaddresses[i],
+					minDelay, maxDelay)
+				if err != nil {
+					return log.Error(err)
+				}
 			}
 		}
 
@@ -646,11 +1038,24 @@ func muteprotoFetch(
 	return
 }
 
+// mutecryptDecrypt decrypts the message enc. If the session of the message
+// was unknown to mutecrypt (the message could not be decrypted and has not
+// been authenticated) unknownSession is set. The status code of received
+// status messages is returned in status. uidStatus is "VERIFIED", if mutecrypt
+// could verify the UID message of the sender with the local hash chain, and
+// "INVALID", if the UID message contradicts the local hash chain (it is empty,
+// if the UID message could not be verified locally).
 func mutecryptDecrypt(
 	c *cli.Context,
 	passphrase, enc []byte,
 	statusFP io.Writer,
-) (senderID, message string, err error) {
+) (
+	senderID, message, sig, uidHash string,
+	unknownSession bool,
+	status msg.StatusCode,
+	uidStatus string,
+	err error,
+) {
 	args := []string{
 		"--homedir", c.GlobalString("homedir"),
 		"--loglevel", c.GlobalString("loglevel"),
@@ -660,7 +1065,7 @@ func mutecryptDecrypt(
 	cmd := exec.Command("mutecrypt", args...)
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
-		return "", "", err
+		return "", "", "", "", false, 0, "", err
 	}
 	var outbuf bytes.Buffer
 	cmd.Stdout = &outbuf
@@ -668,17 +1073,17 @@ func mutecryptDecrypt(
 	cmd.Stderr = &errbuf
 	ppR, ppW, err := os.Pipe()
 	if err != nil {
-		return "", "", log.Error(err)
+		return "", "", "", "", false, 0, "", log.Error(err)
 	}
 	defer ppR.Close()
 	ppW.Write(passphrase)
 	ppW.Close()
 	cmd.ExtraFiles = append(cmd.ExtraFiles, ppR)
 	if err := cmd.Start(); err != nil {
-		return "", "", log.Error(err)
+		return "", "", "", "", false, 0, "", log.Error(err)
 	}
 	if _, err := stdin.Write(enc); err != nil {
-		return "", "", log.Error(err)
+		return "", "", "", "", false, 0, "", log.Error(err)
 	}
 	stdin.Close()
 	if err := cmd.Wait(); err != nil {
@@ -687,25 +1092,69 @@ func mutecryptDecrypt(
 			log.Warn("could not decrypt pre-header, message dropped")
 			fmt.Fprintf(statusFP,
 				"could not decrypt pre-header, message dropped\n")
-			return "", "", nil
+			return "", "", "", "", false, 0, "", nil
 		}
-		return "", "", log.Errorf("%s: %s", err, errstr)
+		return "", "", "", "", false, 0, "", log.Errorf("%s: %s", err, errstr)
 	}
-	// TODO: parse and process signature!
 	scanner := bufio.NewScanner(&errbuf)
 	if scanner.Scan() {
 		line := scanner.Text()
 		parts := strings.Split(line, "\t")
 		if len(parts) != 2 || parts[0] != "SENDERIDENTITY:" {
-			return "", "",
+			return "", "", "", "", false, 0, "",
 				log.Errorf("ctrlengine: mutecrypt status output not parsable: %s", line)
 		}
 		senderID = parts[1]
 	} else {
-		return "", "", log.Error("ctrlengine: expecting mutecrypt output")
+		return "", "", "", "", false, 0, "", log.Error("ctrlengine: expecting mutecrypt output")
+	}
+	// optional permanent signature (already verified by mutecrypt) and hash
+	// of the sender UID message used for it, unknown session, status, number of
+	// possibly lost messages, and sender UID status
+	for scanner.Scan() {
+		line := scanner.Text()
+		parts := strings.Split(line, "\t")
+		if len(parts) != 2 {
+			return "", "", "", "", false, 0, "",
+				log.Errorf("ctrlengine: mutecrypt status output not parsable: %s", line)
+		}
+		switch parts[0] {
+		case "SIGNATURE:":
+			sig = parts[1]
+		case "SENDERUIDHASH:":
+			uidHash = parts[1]
+		case "SESSION:":
+			if parts[1] != "UNKNOWN" {
+				return "", "", "", "", false, 0, "",
+					log.Errorf("ctrlengine: mutecrypt status output not parsable: %s", line)
+			}
+			unknownSession = true
+		case "STATUS:":
+			status, err = msg.ParseStatusCode(parts[1])
+			if err != nil {
+				return "", "", "", "", false, 0, "", err
+			}
+		case "SENDERUID:":
+			if parts[1] != "VERIFIED" && parts[1] != "INVALID" {
+				return "", "", "", "", false, 0, "",
+					log.Errorf("ctrlengine: mutecrypt status output not parsable: %s", line)
+			}
+			uidStatus = parts[1]
+		case "LOST:":
+			lost, err := strconv.ParseUint(parts[1], 10, 64)
+			if err != nil {
+				return "", "", "", "", false, 0, "", log.Error(err)
+			}
+			log.Warnf("%d message(s) from %s possibly lost", lost, senderID)
+			fmt.Fprintf(statusFP, "%d message(s) from %s possibly lost\n",
+				lost, senderID)
+		default:
+			return "", "", "", "", false, 0, "",
+				log.Errorf("ctrlengine: mutecrypt status output not parsable: %s", line)
+		}
 	}
 	if err := scanner.Err(); err != nil {
-		return "", "", log.Error(err)
+		return "", "", "", "", false, 0, "", log.Error(err)
 	}
 
 	message = outbuf.String()
@@ -714,9 +1163,14 @@ func mutecryptDecrypt(
 
 func (ce *CtrlEngine) procInQueue(c *cli.Context, host string) error {
 	log.Debug("procInQueue()")
+	// discard chunks of incomplete messages
+	expire := times.Now() - int64(def.ChunkTimeout/time.Second)
+	if err := ce.msgDB.ExpireChunks(expire); err != nil {
+		return err
+	}
 	for {
 		// get message from msgDB
-		iqIdx, myID, contactID, msg, envelope, err := ce.msgDB.GetInQueue()
+		iqIdx, myID, contactID, encMsg, envelope, err := ce.msgDB.GetInQueue()
 		if err != nil {
 			return err
 		}
@@ -727,7 +1181,7 @@ func (ce *CtrlEngine) procInQueue(c *cli.Context, host string) error {
 		if envelope {
 			log.Debugf("decrypt envelope (iqIdx=%d)", iqIdx)
 			// decrypt envelope
-			message, err := base64.Decode(msg)
+			message, err := base64.Decode(encMsg)
 			if err != nil {
 				return log.Error(err)
 			}
@@ -760,8 +1214,8 @@ func (ce *CtrlEngine) procInQueue(c *cli.Context, host string) error {
 			}
 		} else {
 			log.Debugf("decrypt message (iqIdx=%d)", iqIdx)
-			senderID, plainMsg, err := mutecryptDecrypt(c, ce.passphrase,
-				[]byte(msg), ce.fileTable.StatusFP)
+			senderID, plainMsg, sig, uidHash, unknownSession, status, uidStatus, err := mutecryptDecrypt(c,
+				ce.passphrase, []byte(encMsg), ce.fileTable.StatusFP)
 			if err != nil {
 				return err
 			}
@@ -777,11 +1231,36 @@ func (ce *CtrlEngine) procInQueue(c *cli.Context, host string) error {
 			if err != nil {
 				return log.Error(err)
 			}
-			// TODO: we do not have to do request UID message from server
-			// here, but we should use the one contained in the message and
-			// compare it with hash chain entry (doesn't compromise anonymity)
+			if unknownSession || status != msg.StatusOK {
+				if err := ce.procStatus(iqIdx, senderID, contact,
+					contactType, unknownSession, status); err != nil {
+					return err
+				}
+				continue
+			}
+			if uidStatus == "INVALID" {
+				// the UID message contained in the message contradicts the
+				// local hash chain -> refuse message
+				log.Warnf("message from %s dropped (invalid sender UID)",
+					senderID)
+				fmt.Fprintf(ce.fileTable.StatusFP,
+					"message from %s dropped (invalid sender UID)\n", senderID)
+				if err := ce.msgDB.DelInQueue(iqIdx); err != nil {
+					return err
+				}
+				continue
+			}
 			var drop bool
-			if contact == "" {
+			if contact == "" && uidStatus == "VERIFIED" {
+				// the UID message contained in the message has been verified
+				// with the local hash chain, we do not have to request it from
+				// the key server (which would reveal who is writing to us)
+				err := add(ce.msgDB, myID, senderID, "", msgdb.GrayList)
+				if err != nil {
+					return err
+				}
+			} else if contact == "" {
+				// local hash chain is stale -> fall back to key server
 				err := ce.contactAdd(myID, senderID, "", host, msgdb.GrayList, c)
 				if err != nil {
 					return log.Error(err)
@@ -791,7 +1270,29 @@ func (ce *CtrlEngine) procInQueue(c *cli.Context, host string) error {
 				log.Debug("message from black listed contact dropped")
 				drop = true
 			}
-			err = ce.msgDB.RemoveInQueue(iqIdx, plainMsg, senderID, drop)
+			if !drop && mimeMsg.IsChunk(plainMsg) {
+				err := ce.addChunk(iqIdx, myID, senderID, plainMsg, sig,
+					uidHash)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			message, header, attachments, err := decodeMessage(plainMsg)
+			if err != nil {
+				return err
+			}
+			messageID, inReplyTo := threadIDs(header, senderID)
+			var signatures []*msgdb.Signature
+			if sig != "" {
+				signatures = []*msgdb.Signature{{
+					Content:   plainMsg,
+					Signature: sig,
+					UIDHash:   uidHash,
+				}}
+			}
+			err = ce.msgDB.RemoveInQueue(iqIdx, message, messageID,
+				inReplyTo, attachments, signatures, senderID, drop)
 			if err != nil {
 				return err
 			}
@@ -800,6 +1301,38 @@ func (ce *CtrlEngine) procInQueue(c *cli.Context, host string) error {
 	return nil
 }
 
+// procStatus processes the message with index iqIdx in the inqueue, which
+// either could not be decrypted because the session was unknown
+// (unknownSession is set) or is an empty status message which reset the
+// session (status is set).
+// Messages which could not be decrypted are not authenticated, the sender ID
+// might be forged. Therefore, we never reply to them automatically and never
+// add their sender as a contact.
+func (ce *CtrlEngine) procStatus(
+	iqIdx int64,
+	senderID, contact string,
+	contactType msgdb.ContactType,
+	unknownSession bool,
+	status msg.StatusCode,
+) error {
+	if unknownSession {
+		if contact == "" || contactType == msgdb.BlackList {
+			// unknown or black listed sender
+			log.Debugf("undecryptable message from %s dropped", senderID)
+		} else {
+			log.Infof("session with %s unknown", senderID)
+			fmt.Fprintf(ce.fileTable.StatusFP,
+				"message from %s could not be decrypted, reset session with 'contact reset-session'\n",
+				senderID)
+		}
+	} else {
+		log.Infof("session reset by %s (status %s)", senderID, status)
+		fmt.Fprintf(ce.fileTable.StatusFP, "session reset by %s\n", senderID)
+	}
+	// status messages are empty, nothing else to do
+	return ce.msgDB.DelInQueue(iqIdx)
+}
+
 func (ce *CtrlEngine) msgFetch(
 	c *cli.Context,
 	id string,
@@ -845,47 +1378,149 @@ func (ce *CtrlEngine) msgFetch(
 	return ce.procInQueue(c, host)
 }
 
-func (ce *CtrlEngine) msgList(w io.Writer, id string) error {
+// formatMsgID formats the message info id as a line for msg list.
+func formatMsgID(id *msgdb.MsgID) string {
+	var (
+		direction rune
+		status    rune
+	)
+	if id.Incoming {
+		direction = '>'
+		if id.Read {
+			status = 'R'
+		} else {
+			status = 'N'
+		}
+	} else {
+		direction = '<'
+		if id.Sent {
+			status = 'S'
+		} else {
+			status = 'P'
+		}
+	}
+	return fmt.Sprintf("%c%c %d\t%s\t%s\t%s\t%s%s",
+		direction,
+		status,
+		id.MsgID,
+		time.Unix(id.Date, 0).Format(time.RFC3339),
+		id.From,
+		id.To,
+		id.Subject,
+		signatureMarker(id.Incoming, id.Signed, id.Verified))
+}
+
+func (ce *CtrlEngine) msgList(w io.Writer, id, folder string) error {
 	idMapped, err := identity.Map(id)
 	if err != nil {
 		return err
 	}
-	ids, err := ce.msgDB.GetMsgIDs(idMapped)
+	f, err := msgdb.ParseFolder(folder)
+	if err != nil {
+		return err
+	}
+	ids, err := ce.msgDB.GetFolder(idMapped, f)
 	if err != nil {
 		return err
 	}
 	for _, id := range ids {
-		var (
-			direction rune
-			status    rune
-		)
-		if id.Incoming {
-			direction = '>'
-			if id.Read {
-				status = 'R'
-			} else {
-				status = 'N'
-			}
-		} else {
-			direction = '<'
-			if id.Sent {
-				status = 'S'
-			} else {
-				status = 'P'
-			}
+		fmt.Fprintln(w, formatMsgID(id))
+	}
+	return nil
+}
+
+// parseDate parses the given date for msg search, either in RFC 3339 format
+// or as a plain date (YYYY-MM-DD, UTC). The empty date is parsed as 0.
+func parseDate(date string) (int64, error) {
+	if date == "" {
+		return 0, nil
+	}
+	t, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", date)
+		if err != nil {
+			return 0, log.Errorf("ctrlengine: cannot parse date '%s'", date)
 		}
-		fmt.Fprintf(w, "%c%c %d\t%s\t%s\t%s\t%s\n",
-			direction,
-			status,
-			id.MsgID,
-			time.Unix(id.Date, 0).Format(time.RFC3339),
-			id.From,
-			id.To,
-			id.Subject)
+	}
+	return t.Unix(), nil
+}
+
+func (ce *CtrlEngine) msgSearch(
+	w io.Writer,
+	id, query, from, since, until string,
+) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	var fromMapped string
+	if from != "" {
+		fromMapped, err = identity.Map(from)
+		if err != nil {
+			return err
+		}
+	}
+	s, err := parseDate(since)
+	if err != nil {
+		return err
+	}
+	u, err := parseDate(until)
+	if err != nil {
+		return err
+	}
+	ids, err := ce.msgDB.Search(idMapped, query, fromMapped, s, u)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		fmt.Fprintln(w, formatMsgID(id))
+	}
+	return nil
+}
+
+func (ce *CtrlEngine) msgThread(w io.Writer, id, contact string) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	contactMapped, err := identity.Map(contact)
+	if err != nil {
+		return err
+	}
+	ids, err := ce.msgDB.GetThread(idMapped, contactMapped)
+	if err != nil {
+		return err
+	}
+	msgNums := make(map[string]int64)
+	for _, id := range ids {
+		if id.MessageID != "" {
+			msgNums[id.MessageID] = id.MsgID
+		}
+	}
+	for _, id := range ids {
+		line := formatMsgID(id)
+		if msgNum, ok := msgNums[id.InReplyTo]; ok {
+			line += fmt.Sprintf("\treply to %d", msgNum)
+		}
+		fmt.Fprintln(w, line)
 	}
 	return nil
 }
 
+// signatureMarker returns the tab separated signature marker for msg list.
+func signatureMarker(incoming, signed, verified bool) string {
+	switch {
+	case !signed:
+		return ""
+	case !incoming:
+		return "\tsigned"
+	case verified:
+		return "\tsigned, verified"
+	default:
+		return "\tsigned, not verified"
+	}
+}
+
 func (ce *CtrlEngine) msgRead(w io.Writer, myID string, msgID int64) error {
 	idMapped, err := identity.Map(myID)
 	if err != nil {
@@ -898,6 +1533,14 @@ func (ce *CtrlEngine) msgRead(w io.Writer, myID string, msgID int64) error {
 	if err := ce.msgDB.ReadMessage(msgID); err != nil {
 		return err
 	}
+	attachments, err := ce.msgDB.GetAttachments(idMapped, msgID)
+	if err != nil {
+		return err
+	}
+	_, signatures, verified, err := ce.msgDB.GetSignatures(idMapped, msgID)
+	if err != nil {
+		return err
+	}
 	subject, message := mimeMsg.SplitMessage(msg)
 	fmt.Fprintf(w, "Date: %s\r\n",
 		time.Unix(date, 0).UTC().Format(time.RFC1123Z))
@@ -906,10 +1549,143 @@ func (ce *CtrlEngine) msgRead(w io.Writer, myID string, msgID int64) error {
 	if subject != "" {
 		fmt.Fprintf(w, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
 	}
+	if len(signatures) > 0 {
+		// only received messages have signatures
+		fmt.Fprintf(w, "X-Mute-Signature: %s\r\n",
+			strings.TrimPrefix(signatureMarker(true, true, verified), "\t"))
+	}
 	fmt.Fprintf(w, "MIME-Version: 1.0\r\n")
-	fmt.Fprintf(w, "Content-Type: text/plain; charset=UTF-8\r\n")
+	if len(attachments) == 0 {
+		fmt.Fprintf(w, "Content-Type: text/plain; charset=UTF-8\r\n")
+		fmt.Fprintf(w, "\r\n")
+		fmt.Fprintf(w, "%s", message)
+		return nil
+	}
+	// write multipart message with attachments
+	writer := multipart.NewWriter(w)
+	fmt.Fprintf(w, "Content-Type: multipart/mixed; boundary=%s\r\n",
+		writer.Boundary())
 	fmt.Fprintf(w, "\r\n")
-	fmt.Fprintf(w, "%s", message)
+	mh := make(textproto.MIMEHeader)
+	mh.Add("Content-Type", "text/plain; charset=UTF-8")
+	part, err := writer.CreatePart(mh)
+	if err != nil {
+		return log.Error(err)
+	}
+	if _, err := io.WriteString(part, message); err != nil {
+		return log.Error(err)
+	}
+	for _, attachment := range attachments {
+		if attachment.Data == nil {
+			continue // attachment has been deleted
+		}
+		mh := make(textproto.MIMEHeader)
+		contentType := mime.TypeByExtension(filepath.Ext(attachment.Filename))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		mh.Add("Content-Type", contentType)
+		mh.Add("Content-Transfer-Encoding", "base64")
+		mh.Add("Content-Disposition", mime.FormatMediaType("attachment",
+			map[string]string{"filename": attachment.Filename}))
+		part, err := writer.CreatePart(mh)
+		if err != nil {
+			return log.Error(err)
+		}
+		encoder := base64.NewEncoder(part)
+		if _, err := encoder.Write(attachment.Data); err != nil {
+			return log.Error(err)
+		}
+		if err := encoder.Close(); err != nil {
+			return log.Error(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+func (ce *CtrlEngine) msgAttachmentsList(
+	w io.Writer,
+	myID string,
+	msgID int64,
+) error {
+	idMapped, err := identity.Map(myID)
+	if err != nil {
+		return err
+	}
+	if _, _, _, _, err := ce.msgDB.GetMessage(idMapped, msgID); err != nil {
+		return err
+	}
+	attachments, err := ce.msgDB.GetAttachments(idMapped, msgID)
+	if err != nil {
+		return err
+	}
+	for _, attachment := range attachments {
+		if attachment.Data == nil {
+			fmt.Fprintf(w, "%d\t%s\tdeleted\n", attachment.AttachID,
+				attachment.Filename)
+		} else {
+			fmt.Fprintf(w, "%d\t%s\t%d\n", attachment.AttachID,
+				attachment.Filename, len(attachment.Data))
+		}
+	}
+	return nil
+}
+
+func (ce *CtrlEngine) msgAttachmentsSave(
+	statusfp io.Writer,
+	myID string,
+	msgID int64,
+	attachID int64,
+	dir string,
+) error {
+	idMapped, err := identity.Map(myID)
+	if err != nil {
+		return err
+	}
+	if _, _, _, _, err := ce.msgDB.GetMessage(idMapped, msgID); err != nil {
+		return err
+	}
+	attachments, err := ce.msgDB.GetAttachments(idMapped, msgID)
+	if err != nil {
+		return err
+	}
+	var found bool
+	for _, attachment := range attachments {
+		if attachID != 0 && attachment.AttachID != attachID {
+			continue
+		}
+		found = true
+		if attachment.Data == nil {
+			log.Warnf("attachment %d has been deleted", attachment.AttachID)
+			continue
+		}
+		// filenames of received attachments are chosen by the sender,
+		// make sure we do not leave dir
+		filename := filepath.Base(attachment.Filename)
+		if filename == "." || filename == ".." || filename == string(filepath.Separator) {
+			return log.Errorf("ctrlengine: invalid attachment filename: %s",
+				attachment.Filename)
+		}
+		filename = filepath.Join(dir, filename)
+		if _, err := os.Stat(filename); err == nil {
+			return log.Errorf("ctrlengine: file %s exists already", filename)
+		}
+		err := ioutil.WriteFile(filename, attachment.Data, 0600)
+		if err != nil {
+			return log.Error(err)
+		}
+		log.Infof("attachment saved to %s", filename)
+		fmt.Fprintf(statusfp, "attachment saved to %s\n", filename)
+	}
+	if !found {
+		if attachID != 0 {
+			return log.Errorf("ctrlengine: unknown attachment %d", attachID)
+		}
+		return log.Errorf("ctrlengine: message %d has no attachments", msgID)
+	}
 	return nil
 }
 
@@ -920,3 +1696,159 @@ func (ce *CtrlEngine) msgDelete(myID string, msgID int64) error {
 	}
 	return ce.msgDB.DelMessage(idMapped, msgID)
 }
+
+func (ce *CtrlEngine) msgArchive(myID string, msgID int64) error {
+	idMapped, err := identity.Map(myID)
+	if err != nil {
+		return err
+	}
+	return ce.msgDB.ArchiveMessage(idMapped, msgID)
+}
+
+func (ce *CtrlEngine) msgTrash(myID string, msgID int64) error {
+	idMapped, err := identity.Map(myID)
+	if err != nil {
+		return err
+	}
+	return ce.msgDB.TrashMessage(idMapped, msgID, times.Now())
+}
+
+func (ce *CtrlEngine) msgRestore(myID string, msgID int64) error {
+	idMapped, err := identity.Map(myID)
+	if err != nil {
+		return err
+	}
+	return ce.msgDB.RestoreMessage(idMapped, msgID)
+}
+
+func (ce *CtrlEngine) msgStar(myID string, msgID int64, star bool) error {
+	idMapped, err := identity.Map(myID)
+	if err != nil {
+		return err
+	}
+	return ce.msgDB.StarMessage(idMapped, msgID, star)
+}
+
+// mutecryptVerify verifies the permanent signature sig of content with
+// the UID message of id with the given uidHash (or the current UID message of
+// id, if uidHash is not known).
+func mutecryptVerify(
+	c *cli.Context,
+	passphrase []byte,
+	id, sig, uidHash, content string,
+) error {
+	args := []string{
+		"--homedir", c.GlobalString("homedir"),
+		"--loglevel", c.GlobalString("loglevel"),
+		"--logdir", c.GlobalString("logdir"),
+		"verify",
+		"--id", id,
+		"--signature", sig,
+	}
+	if uidHash != "" {
+		args = append(args, "--uid-hash", uidHash)
+	}
+	cmd := exec.Command("mutecrypt", args...)
+	cmd.Stdin = strings.NewReader(content)
+	var errbuf bytes.Buffer
+	cmd.Stderr = &errbuf
+	ppR, ppW, err := os.Pipe()
+	if err != nil {
+		return log.Error(err)
+	}
+	defer ppR.Close()
+	ppW.Write(passphrase)
+	ppW.Close()
+	cmd.ExtraFiles = append(cmd.ExtraFiles, ppR)
+	if err := cmd.Run(); err != nil {
+		return log.Errorf("%s: %s", err, strings.TrimSpace(errbuf.String()))
+	}
+	return nil
+}
+
+// signedContent checks that the signed contents of the given signatures
+// match the stored message and attachments.
+func signedContent(
+	signatures []*msgdb.Signature,
+	message string,
+	attachments []*msgdb.Attachment,
+) error {
+	var (
+		signedMsg string
+		signedAtt []*msgdb.Attachment
+		err       error
+	)
+	if len(signatures) == 1 && !mimeMsg.IsChunk(signatures[0].Content) {
+		signedMsg, _, signedAtt, err = decodeMessage(signatures[0].Content)
+	} else {
+		var chunks []string
+		for _, sig := range signatures {
+			chunks = append(chunks, sig.Content)
+		}
+		signedMsg, signedAtt, err = reassembleChunks(chunks)
+	}
+	if err != nil {
+		return err
+	}
+	if signedMsg != message || len(signedAtt) != len(attachments) {
+		return log.Error("ctrlengine: signed content does not match message")
+	}
+	for i, attachment := range attachments {
+		if attachment.Filename != signedAtt[i].Filename ||
+			(attachment.Data != nil &&
+				!bytes.Equal(attachment.Data, signedAtt[i].Data)) {
+			return log.Error("ctrlengine: signed content does not match attachments")
+		}
+	}
+	return nil
+}
+
+func (ce *CtrlEngine) msgVerify(
+	c *cli.Context,
+	statusfp io.Writer,
+	myID string,
+	msgID int64,
+) error {
+	idMapped, err := identity.Map(myID)
+	if err != nil {
+		return err
+	}
+	peer, signatures, _, err := ce.msgDB.GetSignatures(idMapped, msgID)
+	if err != nil {
+		return err
+	}
+	if len(signatures) == 0 {
+		return log.Errorf("ctrlengine: message %d has no permanent signature",
+			msgID)
+	}
+	_, _, message, _, err := ce.msgDB.GetMessage(idMapped, msgID)
+	if err != nil {
+		return err
+	}
+	attachments, err := ce.msgDB.GetAttachments(idMapped, msgID)
+	if err != nil {
+		return err
+	}
+	err = signedContent(signatures, message, attachments)
+	if err == nil {
+		for _, sig := range signatures {
+			err = mutecryptVerify(c, ce.passphrase, peer, sig.Signature,
+				sig.UIDHash, sig.Content)
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		if err := ce.msgDB.SetVerified(msgID, false); err != nil {
+			return err
+		}
+		fmt.Fprintf(statusfp, "NOTVERIFIED:\t%d\n", msgID)
+		return err
+	}
+	if err := ce.msgDB.SetVerified(msgID, true); err != nil {
+		return err
+	}
+	fmt.Fprintf(statusfp, "VERIFIED:\t%d\n", msgID)
+	return nil
+}
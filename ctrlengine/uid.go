@@ -14,6 +14,7 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 
 	"github.com/frankbraun/codechain/util/bzero"
@@ -25,6 +26,7 @@ import (
 	mixclient "github.com/mutecomm/mute/mix/client"
 	"github.com/mutecomm/mute/msgdb"
 	"github.com/mutecomm/mute/serviceguard/client"
+	"github.com/mutecomm/mute/uid"
 	"github.com/mutecomm/mute/uid/identity"
 	"github.com/mutecomm/mute/util"
 	"github.com/mutecomm/mute/util/times"
@@ -45,10 +47,12 @@ func decodeED25519PubKeyBase64(p string) (*[ed25519.PublicKeySize]byte, error) {
 func mutecryptNewUID(
 	c *cli.Context,
 	passphrase []byte,
-	id, domain, host, mixaddress, nymaddress string,
+	id, domain, host, mixaddress, nymaddress, pfs string,
+	repoURIs []string,
+	notbefore, notafter string,
 	client *client.Client,
 ) error {
-	log.Infof("mutecryptNewUID(): id=%s, domain=%s", id, domain)
+	log.Infof("mutecryptNewUID(): id=%s, domain=%s, pfs=%s", id, domain, pfs)
 	args := []string{
 		"--homedir", c.GlobalString("homedir"),
 		"--loglevel", c.GlobalString("loglevel"),
@@ -81,9 +85,24 @@ func mutecryptNewUID(
 	cmd.ExtraFiles = append(cmd.ExtraFiles, commandReader)
 
 	// generate UID
-	_, err = io.WriteString(commandWriter, strings.Join([]string{
-		"uid", "generate", "--id", id + "\n",
-	}, " "))
+	args = []string{"uid", "generate", "--id", id, "--pfs", pfs}
+	if pfs == uid.Optional.String() {
+		// static key messages are delivered to the same addresses as
+		// KeyInit messages
+		args = append(args, "--mixaddress", mixaddress,
+			"--nymaddress", nymaddress)
+	}
+	for _, repoURI := range repoURIs {
+		args = append(args, "--repouri", repoURI)
+	}
+	if notbefore != "" {
+		args = append(args, "--notbefore", notbefore)
+	}
+	if notafter != "" {
+		args = append(args, "--notafter", notafter)
+	}
+	args = append(args, "\n")
+	_, err = io.WriteString(commandWriter, strings.Join(args, " "))
 	if err != nil {
 		return err
 	}
@@ -211,33 +230,14 @@ func mutecryptNewUID(
 	}
 
 	// add KeyInit messages
-	token, err = wallet.GetToken(client, "Message", owner)
-	if err != nil {
-		return err
+	if len(repoURIs) == 0 {
+		repoURIs = []string{domain}
 	}
-	_, err = io.WriteString(commandWriter, strings.Join([]string{
-		"keyinit", "add",
-		"--id", id,
-		"--mixaddress", mixaddress,
-		"--nymaddress", nymaddress,
-		"--token", base64.Encode(token.Token) + "\n",
-	}, " "))
+	err = mutecryptAddKeyInits(commandWriter, scanner, decoder, id,
+		c.String("host"), mixaddress, nymaddress, repoURIs, false, client)
 	if err != nil {
-		client.UnlockToken(token.Hash)
-		return err
-	}
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line != "READY." {
-			return errors.New(line)
-		}
-		break
-	}
-	if err := scanner.Err(); err != nil {
-		client.UnlockToken(token.Hash)
 		return err
 	}
-	client.DelToken(token.Hash)
 
 	// quit mutecrypt
 	if _, err := io.WriteString(commandWriter, "quit\n"); err != nil {
@@ -303,10 +303,31 @@ func mutecryptHashchainSearch(
 	return nil
 }
 
+// newKeyInitAddresses returns a new mixaddress and nymaddress for the
+// KeyInit messages of nym id with the given account on server.
+func newKeyInitAddresses(
+	id, domain string,
+	privkey *[ed25519.PrivateKeySize]byte,
+	server string,
+	secret *[64]byte,
+	minDelay, maxDelay int32,
+) (mixaddress, nymaddress string, err error) {
+	expire := times.ThirtyDaysLater() // TODO: make this settable
+	// the nymaddress is used for the whole session started with the KeyInit
+	// message and cannot be single-use (even for single-use KeyInits)
+	singleUse := false
+	var pubkey [ed25519.PublicKeySize]byte
+	copy(pubkey[:], privkey[32:])
+	return util.NewNymAddress(domain, secret[:], expire, singleUse, minDelay,
+		maxDelay, id, &pubkey, server, def.CACert)
+}
+
 func (ce *CtrlEngine) uidNew(
 	c *cli.Context,
 	minDelay, maxDelay int32,
-	host string,
+	host, pfs string,
+	repoURIs []string,
+	notbefore, notafter string,
 ) error {
 	// make sure the ID is well-formed
 	unmapped := c.String("id")
@@ -315,6 +336,11 @@ func (ce *CtrlEngine) uidNew(
 		return err
 	}
 
+	// make sure the PFS preference is well-formed
+	if _, err := uid.ParsePFSPreference(pfs); err != nil {
+		return err
+	}
+
 	// sync corresponding hashchain
 	if id != "keyserver" {
 		if err := ce.upkeepHashchain(c, domain, c.String("host")); err != nil {
@@ -364,19 +390,15 @@ func (ce *CtrlEngine) uidNew(
 	}
 
 	// get mixaddress and nymaddress for KeyInit message
-	expire := times.ThirtyDaysLater() // TODO: make this settable
-	singleUse := false                // TODO correct?
-	var pubkey [ed25519.PublicKeySize]byte
-	copy(pubkey[:], privkey[32:])
-	mixaddress, nymaddress, err := util.NewNymAddress(domain, secret[:], expire,
-		singleUse, minDelay, maxDelay, id, &pubkey, server, def.CACert)
+	mixaddress, nymaddress, err := newKeyInitAddresses(id, domain, &privkey,
+		server, &secret, minDelay, maxDelay)
 	if err != nil {
 		return err
 	}
 
 	// generate UID
 	err = mutecryptNewUID(c, ce.passphrase, id, domain, host, mixaddress,
-		nymaddress, ce.client)
+		nymaddress, pfs, repoURIs, notbefore, notafter, ce.client)
 	if err != nil {
 		return err
 	}
@@ -562,3 +584,475 @@ func (ce *CtrlEngine) uidList(outfp io.Writer) error {
 	}
 	return nil
 }
+
+// mutecryptUIDValidity returns the validity window of the latest UID message
+// of id and whether it has been registered with the key server.
+func mutecryptUIDValidity(
+	c *cli.Context,
+	id string,
+	passphrase []byte,
+) (notbefore, notafter int64, registered bool, err error) {
+	args := []string{
+		"--homedir", c.GlobalString("homedir"),
+		"--loglevel", c.GlobalString("loglevel"),
+		"--logdir", c.GlobalString("logdir"),
+		"uid", "validity",
+		"--id", id,
+	}
+	cmd := exec.Command("mutecrypt", args...)
+	var outbuf bytes.Buffer
+	cmd.Stdout = &outbuf
+	var errbuf bytes.Buffer
+	cmd.Stderr = &errbuf
+	ppR, ppW, err := os.Pipe()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	defer ppR.Close()
+	ppW.Write(passphrase)
+	ppW.Close()
+	cmd.ExtraFiles = append(cmd.ExtraFiles, ppR)
+	if err := cmd.Run(); err != nil {
+		return 0, 0, false,
+			log.Errorf("%s: %s", err, strings.TrimSpace(errbuf.String()))
+	}
+	scanner := bufio.NewScanner(&outbuf)
+	for scanner.Scan() {
+		line := scanner.Text()
+		parts := strings.Split(line, "\t")
+		if len(parts) != 2 {
+			return 0, 0, false,
+				log.Errorf("ctrlengine: mutecrypt output not parsable: %s", line)
+		}
+		switch parts[0] {
+		case "NOTBEFORE:":
+			notbefore, err = strconv.ParseInt(parts[1], 10, 64)
+		case "NOTAFTER:":
+			notafter, err = strconv.ParseInt(parts[1], 10, 64)
+		case "REGISTERED:":
+			registered, err = strconv.ParseBool(parts[1])
+		default:
+			err = fmt.Errorf("ctrlengine: mutecrypt output not parsable: %s", line)
+		}
+		if err != nil {
+			return 0, 0, false, log.Error(err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, false, log.Error(err)
+	}
+	return
+}
+
+// mutecryptReady waits for the READY. line of mutecrypt on scanner and
+// returns all other lines as error.
+func mutecryptReady(scanner *bufio.Scanner) error {
+	var cryptErr error
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "READY." {
+			return cryptErr
+		}
+		cryptErr = errors.New(line)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if cryptErr != nil {
+		return cryptErr
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// mutecryptAddKeyInits publishes new KeyInit messages for nym id to all
+// KeyInit repositories repoURIs with the running mutecrypt process (commands
+// are written to commandWriter, status is read from scanner, and output is
+// read from decoder). A "Message" token is paid for every repository.
+// If singleUse is true, single-use KeyInit messages are published.
+func mutecryptAddKeyInits(
+	commandWriter io.Writer,
+	scanner *bufio.Scanner,
+	decoder *json.Decoder,
+	id, host, mixaddress, nymaddress string,
+	repoURIs []string,
+	singleUse bool,
+	client *client.Client,
+) error {
+	var tokenHashes [][]byte
+	unlockTokens := func() {
+		for _, tokenHash := range tokenHashes {
+			client.UnlockToken(tokenHash)
+		}
+	}
+	args := []string{
+		"keyinit", "add",
+		"--id", id,
+		"--mixaddress", mixaddress,
+		"--nymaddress", nymaddress,
+	}
+	if singleUse {
+		args = append(args, "--single-use")
+	}
+	for _, repoURI := range repoURIs {
+		// get capabilities of KeyInit repository
+		capsArgs := []string{"caps", "show", "--domain", repoURI}
+		if host != "" {
+			capsArgs = append(capsArgs, "--host", host)
+		}
+		_, err := io.WriteString(commandWriter,
+			strings.Join(capsArgs, " ")+"\n")
+		if err != nil {
+			unlockTokens()
+			return err
+		}
+		if err := mutecryptReady(scanner); err != nil {
+			unlockTokens()
+			return err
+		}
+		var caps capabilities.Capabilities
+		if err := decoder.Decode(&caps); err != nil {
+			unlockTokens()
+			return err
+		}
+		owner, err := decodeED25519PubKeyBase64(caps.TKNPUBKEY)
+		if err != nil {
+			unlockTokens()
+			return err
+		}
+		// get token from wallet
+		token, err := wallet.GetToken(client, "Message", owner)
+		if err != nil {
+			unlockTokens()
+			return err
+		}
+		tokenHashes = append(tokenHashes, token.Hash)
+		args = append(args, "--token", base64.Encode(token.Token))
+	}
+	_, err := io.WriteString(commandWriter, strings.Join(args, " ")+"\n")
+	if err != nil {
+		unlockTokens()
+		return err
+	}
+	if err := mutecryptReady(scanner); err != nil {
+		unlockTokens()
+		return err
+	}
+	for _, tokenHash := range tokenHashes {
+		client.DelToken(tokenHash)
+	}
+	return nil
+}
+
+// mutecryptRolloverUID generates an update of UID id (if genupdate is true),
+// registers it with the key server, and publishes new KeyInit messages
+// signed by the updated UID.
+func mutecryptRolloverUID(
+	c *cli.Context,
+	passphrase []byte,
+	id, domain, host, mixaddress, nymaddress, notafter string,
+	genupdate bool,
+	client *client.Client,
+) error {
+	log.Infof("mutecryptRolloverUID(): id=%s, domain=%s", id, domain)
+	args := []string{
+		"--homedir", c.GlobalString("homedir"),
+		"--loglevel", c.GlobalString("loglevel"),
+		"--logdir", c.GlobalString("logdir"),
+	}
+	if host != "" {
+		args = append(args,
+			"--keyhost", host,
+			"--keyport", ":8080") // TODO: remove keyport hack!
+	}
+	cmd := exec.Command("mutecrypt", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(stderr)
+	passphraseReader, passphraseWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, passphraseReader)
+	commandReader, commandWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, commandReader)
+
+	// start process
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// write passphrase
+	plen := len(passphrase)
+	buf := make([]byte, plen+1)
+	defer bzero.Bytes(buf)
+	copy(buf, passphrase)
+	copy(buf[plen:], []byte("\n"))
+	if _, err := passphraseWriter.Write(buf); err != nil {
+		return err
+	}
+	passphraseWriter.Close()
+
+	// generate UID update
+	if genupdate {
+		args = []string{"uid", "genupdate", "--id", id}
+		if notafter != "" {
+			args = append(args, "--notafter", notafter)
+		}
+		args = append(args, "\n")
+		_, err = io.WriteString(commandWriter, strings.Join(args, " "))
+		if err != nil {
+			return err
+		}
+		if err := mutecryptReady(scanner); err != nil {
+			return err
+		}
+	}
+
+	// get capabilities
+	args = []string{"caps", "show", "--domain", domain}
+	if host != "" {
+		args = append(args, "--host", host)
+	}
+	args = append(args, "\n")
+	_, err = io.WriteString(commandWriter, strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+	if err := mutecryptReady(scanner); err != nil {
+		return err
+	}
+	var caps capabilities.Capabilities
+	decoder := json.NewDecoder(stdout)
+	if err := decoder.Decode(&caps); err != nil {
+		return err
+	}
+	owner, err := decodeED25519PubKeyBase64(caps.TKNPUBKEY)
+	if err != nil {
+		return err
+	}
+
+	// register UID update (the update is kept, if this fails)
+	token, err := wallet.GetToken(client, "UID", owner)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(commandWriter, strings.Join([]string{
+		"uid", "update",
+		"--id", id,
+		"--token", base64.Encode(token.Token) + "\n",
+	}, " "))
+	if err != nil {
+		client.UnlockToken(token.Hash)
+		return err
+	}
+	if err := mutecryptReady(scanner); err != nil {
+		client.UnlockToken(token.Hash)
+		return err
+	}
+	client.DelToken(token.Hash)
+
+	// get KeyInit repositories of the updated UID
+	_, err = io.WriteString(commandWriter, strings.Join([]string{
+		"keyinit", "repos",
+		"--id", id + "\n",
+	}, " "))
+	if err != nil {
+		return err
+	}
+	if err := mutecryptReady(scanner); err != nil {
+		return err
+	}
+	var repoURIs []string
+	if err := decoder.Decode(&repoURIs); err != nil {
+		return err
+	}
+
+	// add KeyInit messages signed by the updated UID
+	err = mutecryptAddKeyInits(commandWriter, scanner, decoder, id, host,
+		mixaddress, nymaddress, repoURIs, false, client)
+	if err != nil {
+		return err
+	}
+
+	// quit mutecrypt
+	if _, err := io.WriteString(commandWriter, "quit\n"); err != nil {
+		return err
+	}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "QUITTING" {
+			return errors.New(line)
+		}
+		break
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return cmd.Wait()
+}
+
+// mutecryptKeyInitCount returns the number of unused single-use KeyInit
+// messages of nym id.
+func mutecryptKeyInitCount(
+	c *cli.Context,
+	id string,
+	passphrase []byte,
+) (int, error) {
+	args := []string{
+		"--homedir", c.GlobalString("homedir"),
+		"--loglevel", c.GlobalString("loglevel"),
+		"--logdir", c.GlobalString("logdir"),
+		"keyinit", "count",
+		"--id", id,
+	}
+	cmd := exec.Command("mutecrypt", args...)
+	var outbuf bytes.Buffer
+	cmd.Stdout = &outbuf
+	var errbuf bytes.Buffer
+	cmd.Stderr = &errbuf
+	ppR, ppW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ppR.Close()
+	ppW.Write(passphrase)
+	ppW.Close()
+	cmd.ExtraFiles = append(cmd.ExtraFiles, ppR)
+	if err := cmd.Run(); err != nil {
+		return 0, log.Errorf("%s: %s", err, strings.TrimSpace(errbuf.String()))
+	}
+	line := strings.TrimSpace(outbuf.String())
+	parts := strings.Split(line, "\t")
+	if len(parts) != 2 || parts[0] != "SINGLEUSE:" {
+		return 0,
+			log.Errorf("ctrlengine: mutecrypt output not parsable: %s", line)
+	}
+	n, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, log.Error(err)
+	}
+	return n, nil
+}
+
+// mutecryptRefillKeyInits flushes the consumed single-use KeyInit messages of
+// nym id from its KeyInit repositories and publishes n new single-use KeyInit
+// messages.
+func mutecryptRefillKeyInits(
+	c *cli.Context,
+	passphrase []byte,
+	id, host, mixaddress, nymaddress string,
+	n int,
+	client *client.Client,
+) error {
+	log.Infof("mutecryptRefillKeyInits(): id=%s, n=%d", id, n)
+	args := []string{
+		"--homedir", c.GlobalString("homedir"),
+		"--loglevel", c.GlobalString("loglevel"),
+		"--logdir", c.GlobalString("logdir"),
+	}
+	if host != "" {
+		args = append(args,
+			"--keyhost", host,
+			"--keyport", ":8080") // TODO: remove keyport hack!
+	}
+	cmd := exec.Command("mutecrypt", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(stderr)
+	passphraseReader, passphraseWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, passphraseReader)
+	commandReader, commandWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, commandReader)
+
+	// start process
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// write passphrase
+	plen := len(passphrase)
+	buf := make([]byte, plen+1)
+	defer bzero.Bytes(buf)
+	copy(buf, passphrase)
+	copy(buf[plen:], []byte("\n"))
+	if _, err := passphraseWriter.Write(buf); err != nil {
+		return err
+	}
+	passphraseWriter.Close()
+
+	// flush consumed KeyInit messages
+	_, err = io.WriteString(commandWriter, strings.Join([]string{
+		"keyinit", "flush",
+		"--id", id,
+		"--consumed\n",
+	}, " "))
+	if err != nil {
+		return err
+	}
+	if err := mutecryptReady(scanner); err != nil {
+		return err
+	}
+
+	// get KeyInit repositories
+	_, err = io.WriteString(commandWriter, strings.Join([]string{
+		"keyinit", "repos",
+		"--id", id + "\n",
+	}, " "))
+	if err != nil {
+		return err
+	}
+	if err := mutecryptReady(scanner); err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(stdout)
+	var repoURIs []string
+	if err := decoder.Decode(&repoURIs); err != nil {
+		return err
+	}
+
+	// add single-use KeyInit messages
+	for i := 0; i < n; i++ {
+		err = mutecryptAddKeyInits(commandWriter, scanner, decoder, id, host,
+			mixaddress, nymaddress, repoURIs, true, client)
+		if err != nil {
+			return err
+		}
+	}
+
+	// quit mutecrypt
+	if _, err := io.WriteString(commandWriter, "quit\n"); err != nil {
+		return err
+	}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "QUITTING" {
+			return errors.New(line)
+		}
+		break
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return cmd.Wait()
+}
@@ -61,7 +61,8 @@ func checkExecution(
 func (ce *CtrlEngine) upkeepAll(
 	c *cli.Context,
 	unmappedID,
-	period string,
+	period,
+	trashRetention string,
 	statfp io.Writer,
 ) error {
 	mappedID, err := identity.Map(unmappedID)
@@ -87,12 +88,60 @@ func (ce *CtrlEngine) upkeepAll(
 		return err
 	}
 
+	// a failed UID rollover (or KeyInit refill) must not prevent the other
+	// upkeep tasks, the execution is not recorded and retried next time
+	var failed bool
+
+	// `upkeep uid`
+	if err := ce.upkeepUID(c, unmappedID, "", "720h", "", statfp); err != nil {
+		log.Warnf("ctrlengine: upkeep uid failed: %s", err)
+		fmt.Fprintf(statfp, "ctrlengine: upkeep uid failed: %s\n", err)
+		failed = true
+	}
+
+	// `upkeep keyinits`
+	if err := ce.upkeepKeyInits(c, unmappedID, "", def.KeyInitPool, statfp); err != nil {
+		log.Warnf("ctrlengine: upkeep keyinits failed: %s", err)
+		fmt.Fprintf(statfp, "ctrlengine: upkeep keyinits failed: %s\n", err)
+		failed = true
+	}
+
+	// purge trash
+	if err := ce.upkeepTrash(mappedID, trashRetention, now, statfp); err != nil {
+		return err
+	}
+
 	// TODO: call all upkeep tasks in mutecrypt
 
+	if failed {
+		return nil
+	}
+
 	// record time of execution
 	return ce.msgDB.SetUpkeepAll(mappedID, now)
 }
 
+// upkeepTrash permanently deletes all messages of mappedID which have been in
+// trash for longer than the given retention period.
+func (ce *CtrlEngine) upkeepTrash(
+	mappedID, retention string,
+	now int64,
+	statfp io.Writer,
+) error {
+	duration, err := time.ParseDuration(retention)
+	if err != nil {
+		return err
+	}
+	before := time.Unix(now, 0).Add(-duration).Unix()
+	n, err := ce.msgDB.PurgeTrash(mappedID, before)
+	if err != nil {
+		return err
+	}
+	log.Infof("ctrlengine: purged %d message(s) from trash", n)
+	fmt.Fprintf(statfp, "ctrlengine: purged %d message(s) from trash\n", n)
+	return nil
+}
+
 func writeConfigFile(homedir, domain string, config []byte) error {
 	configdir := filepath.Join(homedir, "config")
 	if err := os.MkdirAll(configdir, 0700); err != nil {
@@ -106,10 +155,40 @@ func writeConfigFile(homedir, domain string, config []byte) error {
 	return os.Rename(tmpfile, filepath.Join(configdir, domain))
 }
 
+// saveConfig stores the current configuration in the msgDB, applies it, and
+// writes it to the configuration file. It returns the nicely formatted
+// configuration.
+func (ce *CtrlEngine) saveConfig(
+	msgDB *msgdb.MsgDB,
+	homedir, netDomain string,
+) ([]byte, error) {
+	jsn, err := json.Marshal(ce.config)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	if err := msgDB.AddValue(netDomain, string(jsn)); err != nil {
+		return nil, err
+	}
+	// apply new configuration
+	if err := def.InitMute(&ce.config); err != nil {
+		return nil, err
+	}
+	// format configuration nicely
+	jsn, err = json.MarshalIndent(ce.config, "", "  ")
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	// write new configuration file
+	if err := writeConfigFile(homedir, netDomain, jsn); err != nil {
+		return nil, err
+	}
+	return jsn, nil
+}
+
 func (ce *CtrlEngine) upkeepFetchconf(
 	msgDB *msgdb.MsgDB,
 	homedir string,
-	show bool,
+	show, diff bool,
 	outfp, statfp io.Writer,
 ) error {
 	netDomain, pubkeyStr, configURL := def.ConfigParams()
@@ -119,43 +198,91 @@ func (ce *CtrlEngine) upkeepFetchconf(
 	if err != nil {
 		log.Error(err)
 	}
+	if !bytes.Equal(ce.config.PublicKey, publicKey) {
+		// history was signed by a different key, start over
+		ce.config.History = nil
+	}
 	ce.config.PublicKey = publicKey
 	ce.config.URLList = "10," + configURL
 	ce.config.Timeout = 0 // use default timeout
+	// the history length is limited, compare the latest sign dates
+	historyLen := len(ce.config.History)
+	lastSignDate := ce.config.LastSignDate
 	if err := ce.config.Update(); err != nil {
 		return log.Error(err)
 	}
-	jsn, err := json.Marshal(ce.config)
-	if err != nil {
-		return log.Error(err)
-	}
-	if err := msgDB.AddValue(netDomain, string(jsn)); err != nil {
-		return err
-	}
 	err = msgDB.AddValue("time."+netDomain, strconv.FormatInt(times.Now(), 10))
 	if err != nil {
 		return err
 	}
-	// apply new configuration
-	if err := def.InitMute(&ce.config); err != nil {
-		return err
-	}
-	// format configuration nicely
-	jsn, err = json.MarshalIndent(ce.config, "", "  ")
+	jsn, err := ce.saveConfig(msgDB, homedir, netDomain)
 	if err != nil {
-		return log.Error(err)
-	}
-	// write new configuration file
-	if err := writeConfigFile(homedir, netDomain, jsn); err != nil {
 		return err
 	}
 	// show new configuration
 	if show {
 		fmt.Fprintf(outfp, string(jsn)+"\n")
 	}
+	// show changes to previous configuration
+	if diff {
+		if historyLen > 0 && ce.config.LastSignDate == lastSignDate {
+			fmt.Fprintf(outfp, "configuration unchanged\n")
+		} else {
+			for _, change := range ce.config.Changes() {
+				_, pinned := ce.config.Pinned[change.Key]
+				switch {
+				case change.Old == "":
+					fmt.Fprintf(outfp, "+ %s: %s", change.Key, change.New)
+				case change.New == "":
+					fmt.Fprintf(outfp, "- %s: %s", change.Key, change.Old)
+				default:
+					fmt.Fprintf(outfp, "~ %s: %s -> %s", change.Key,
+						change.Old, change.New)
+				}
+				if pinned {
+					fmt.Fprintf(outfp, " (pinned)")
+				}
+				fmt.Fprintf(outfp, "\n")
+			}
+		}
+	}
 	return nil
 }
 
+func (ce *CtrlEngine) upkeepPinconf(
+	msgDB *msgdb.MsgDB,
+	homedir, key, value string,
+	unpin bool,
+	cacert string,
+	statfp io.Writer,
+) error {
+	netDomain, _, _ := def.ConfigParams()
+	if cacert != "" {
+		cert, err := ioutil.ReadFile(cacert)
+		if err != nil {
+			return log.Error(err)
+		}
+		if err := ce.config.PinCACert(cert); err != nil {
+			return log.Error(err)
+		}
+		log.Infof("pinned CA certificate '%s'", cacert)
+		fmt.Fprintf(statfp, "pinned CA certificate '%s'\n", cacert)
+	}
+	if key != "" {
+		if unpin {
+			ce.config.Unpin(key)
+			log.Infof("unpinned config key '%s'", key)
+			fmt.Fprintf(statfp, "unpinned config key '%s'\n", key)
+		} else {
+			ce.config.Pin(key, value)
+			log.Infof("pinned config key '%s' to '%s'", key, value)
+			fmt.Fprintf(statfp, "pinned config key '%s' to '%s'\n", key, value)
+		}
+	}
+	_, err := ce.saveConfig(msgDB, homedir, netDomain)
+	return err
+}
+
 func updateMuteFromSource(outfp, statfp io.Writer, commit string) error {
 	fmt.Fprintf(statfp, "updating Mute from source...\n")
 	binary, err := exec.LookPath(os.Args[0])
@@ -254,7 +381,7 @@ func (ce *CtrlEngine) upkeepUpdate(
 ) error {
 	log.Info("upkeepUpdate()")
 	// make sure we have the most current config
-	if err := ce.upkeepFetchconf(ce.msgDB, homedir, false, outfp, statfp); err != nil {
+	if err := ce.upkeepFetchconf(ce.msgDB, homedir, false, false, outfp, statfp); err != nil {
 		return err
 	}
 	commit := ce.config.Map["release.Commit"]
@@ -470,6 +597,9 @@ func mutecryptHashchainValidate(
 	return nil
 }
 
+// upkeepHashchain syncs the hash chain of the given domain with the key
+// server and validates the new part of it. Forks of the hash chain are
+// reported as errors.
 func (ce *CtrlEngine) upkeepHashchain(
 	c *cli.Context,
 	domain, host string,
@@ -479,11 +609,110 @@ func (ce *CtrlEngine) upkeepHashchain(
 	if err != nil {
 		return err
 	}
-	// verify hashchain
-	// TODO: we only have to validate the new part, not the whole hashchain!
+	// validate hashchain (only the entries added since the last validation)
 	err = mutecryptHashchainValidate(c, domain, host, ce.passphrase)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// upkeepUID performs an automatic rollover of the UID unmappedID, if it
+// expires within the remaining duration: An updated UID message (valid until
+// notafter) is generated, registered with the key server, and new KeyInit
+// messages are published. A previously generated, but unregistered update is
+// registered in any case.
+func (ce *CtrlEngine) upkeepUID(
+	c *cli.Context,
+	unmappedID, host, remaining, notafter string,
+	statfp io.Writer,
+) error {
+	mappedID, domain, err := identity.MapPlus(unmappedID)
+	if err != nil {
+		return err
+	}
+	remain, err := time.ParseDuration(remaining)
+	if err != nil {
+		return err
+	}
+	_, validUntil, registered, err := mutecryptUIDValidity(c, mappedID,
+		ce.passphrase)
+	if err != nil {
+		return err
+	}
+	genupdate := registered && times.Now()+int64(remain.Seconds()) >= validUntil
+	if registered && !genupdate {
+		log.Info("ctrlengine: upkeep uid not due")
+		fmt.Fprintf(statfp, "ctrlengine: upkeep uid not due\n")
+		return nil
+	}
+
+	// get mixaddress and nymaddress for KeyInit messages
+	privkey, server, secret, minDelay, maxDelay, _, err :=
+		ce.msgDB.GetAccount(mappedID, "")
+	if err != nil {
+		return err
+	}
+	mixaddress, nymaddress, err := newKeyInitAddresses(mappedID, domain,
+		privkey, server, secret, minDelay, maxDelay)
+	if err != nil {
+		return err
+	}
+
+	// rollover UID
+	err = mutecryptRolloverUID(c, ce.passphrase, mappedID, domain, host,
+		mixaddress, nymaddress, notafter, genupdate, ce.client)
+	if err != nil {
+		return err
+	}
+	log.Infof("UID %s updated", unmappedID)
+	fmt.Fprintf(statfp, "UID %s updated\n", unmappedID)
+	return nil
+}
+
+// upkeepKeyInits tops up the pool of unused single-use KeyInit messages of
+// the UID unmappedID to pool many KeyInit messages. Consumed single-use
+// KeyInit messages are flushed from the KeyInit repositories beforehand.
+func (ce *CtrlEngine) upkeepKeyInits(
+	c *cli.Context,
+	unmappedID, host string,
+	pool int,
+	statfp io.Writer,
+) error {
+	mappedID, domain, err := identity.MapPlus(unmappedID)
+	if err != nil {
+		return err
+	}
+	n, err := mutecryptKeyInitCount(c, mappedID, ce.passphrase)
+	if err != nil {
+		return err
+	}
+	if n >= pool {
+		log.Info("ctrlengine: upkeep keyinits not due")
+		fmt.Fprintf(statfp, "ctrlengine: upkeep keyinits not due\n")
+		return nil
+	}
+
+	// get mixaddress and nymaddress for KeyInit messages
+	privkey, server, secret, minDelay, maxDelay, _, err :=
+		ce.msgDB.GetAccount(mappedID, "")
+	if err != nil {
+		return err
+	}
+	mixaddress, nymaddress, err := newKeyInitAddresses(mappedID, domain,
+		privkey, server, secret, minDelay, maxDelay)
+	if err != nil {
+		return err
+	}
+
+	// refill pool
+	err = mutecryptRefillKeyInits(c, ce.passphrase, mappedID, host,
+		mixaddress, nymaddress, pool-n, ce.client)
+	if err != nil {
+		return err
+	}
+	log.Infof("%d single-use KeyInits published for %s", pool-n, unmappedID)
+	fmt.Fprintf(statfp, "%d single-use KeyInits published for %s\n", pool-n,
+		unmappedID)
+	return nil
+}
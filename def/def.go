@@ -9,6 +9,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -25,6 +26,7 @@ import (
 	"github.com/mutecomm/mute/serviceguard/client/keylookup"
 	"github.com/mutecomm/mute/serviceguard/client/walletrpc"
 	"github.com/mutecomm/mute/util"
+	"github.com/mutecomm/mute/util/transport"
 )
 
 // InitMute initializes Mute with the configuration from config.
@@ -106,6 +108,62 @@ func InitMute(config *configclient.Config) error {
 		return log.Error("config.Map[\"muteaccd.usage\"] undefined")
 	}
 
+	if err := initTransport(config.Map); err != nil {
+		return err
+	}
+
+	// pin CA certificate for the services
+	return pinServices(CACert)
+}
+
+// initTransport initializes the HTTP transport with the optional
+// configuration keys "transport.SOCKS5", "transport.Timeout", and
+// "transport.Retries". Usually these keys are pinned locally.
+// A transport which has already been set (for example, by a test) is kept.
+func initTransport(m map[string]string) error {
+	if socks5, ok := m["transport.SOCKS5"]; ok && socks5 != "" &&
+		transport.Default == nil {
+		t, err := transport.NewSOCKS5(socks5)
+		if err != nil {
+			return err
+		}
+		transport.Default = t
+	}
+	if timeout, ok := m["transport.Timeout"]; ok {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return log.Error("cannot parse config.Map[\"transport.Timeout\"]")
+		}
+		transport.DefaultTimeout = d
+	}
+	if retries, ok := m["transport.Retries"]; ok {
+		r, err := strconv.Atoi(retries)
+		if err != nil {
+			return log.Error("cannot parse config.Map[\"transport.Retries\"]")
+		}
+		transport.DefaultRetries = r
+	}
+	return nil
+}
+
+// pinServices pins the CA certificate cacert for the hosts of the mix account
+// server and the serviceguard services (wallet, key lookup, and issuers).
+func pinServices(cacert []byte) error {
+	if cacert == nil {
+		return nil
+	}
+	transport.Pin(mixclient.DefaultAccountServer, cacert)
+	for _, serviceURL := range []string{
+		walletrpc.ServiceURL,
+		keylookup.ServiceURL,
+		guardrpc.ServiceURL, // host template, pins all issuers
+	} {
+		u, err := url.Parse(serviceURL)
+		if err != nil {
+			return log.Error(err)
+		}
+		transport.Pin(u.Hostname(), cacert)
+	}
 	return nil
 }
 
@@ -193,6 +251,18 @@ const (
 	// WalletGetTokenMaxDuration defines the maximum duration before the
 	// acquisition of a token from the wallet is aborted.
 	WalletGetTokenMaxDuration = 5 * time.Minute // 5m
+
+	// ChunkTimeout defines the maximum duration chunks of an incomplete
+	// message are kept before they are discarded.
+	ChunkTimeout = 14 * 24 * time.Hour // 14d
+
+	// TrashRetention defines the default duration messages are kept in trash
+	// before they are permanently deleted during upkeep.
+	TrashRetention = 30 * 24 * time.Hour // 30d
+
+	// KeyInitPool defines the default number of unused single-use KeyInit
+	// messages which are kept published for every user ID.
+	KeyInitPool = 10
 )
 
 // CACert is the default certificate authority used for Mute.
@@ -255,3 +255,41 @@ func Incremental(db *sql.DB, pages int64) error {
 	}
 	return nil
 }
+
+// Snapshot writes a consistent copy of the encrypted database db with the
+// name dbname to the database with name snapname (the files snapname.db and
+// snapname.key must not exist). The copy is encrypted with the same key and
+// can be opened with the same passphrase.
+func Snapshot(db *sql.DB, dbname, snapname string) error {
+	snapfile := snapname + DBSuffix
+	snapkeyfile := snapname + KeySuffix
+	// make sure files do not exist already
+	exists, err := fileExists(snapfile)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("encdb: dbfile '%s' exists already", snapfile)
+	}
+	exists, err = fileExists(snapkeyfile)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("encdb: keyfile '%s' exists already", snapkeyfile)
+	}
+	// VACUUM INTO reads the database in a single transaction
+	if _, err := db.Exec("VACUUM INTO ?;", snapfile); err != nil {
+		return err
+	}
+	// make sure the snapshot is encrypted
+	encrypted, err := sqlite3.IsEncrypted(snapfile)
+	if err != nil {
+		return err
+	}
+	if !encrypted {
+		os.Remove(snapfile)
+		return fmt.Errorf("encdb: snapshot '%s' is not encrypted", snapfile)
+	}
+	return copyFile(snapkeyfile, dbname+KeySuffix)
+}
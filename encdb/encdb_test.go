@@ -272,3 +272,43 @@ func TestUpkeep(t *testing.T) {
 	}
 	encdb.Close()
 }
+
+func TestSnapshot(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "encdb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	dbname := filepath.Join(tmpdir, "encdb_test")
+	err = Create(dbname, passphrase, iter, []string{
+		"CREATE TABLE Test (ID INTEGER PRIMARY KEY, Test TEXT);",
+		"INSERT INTO Test (Test) VALUES ('snapshot');",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(dbname, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	snapname := filepath.Join(tmpdir, "snapshot")
+	if err := Snapshot(db, dbname, snapname); err != nil {
+		t.Fatal(err)
+	}
+	if err := Snapshot(db, dbname, snapname); err == nil {
+		t.Error("should fail")
+	}
+	snap, err := Open(snapname, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+	var test string
+	if err := snap.QueryRow("SELECT Test FROM Test;").Scan(&test); err != nil {
+		t.Fatal(err)
+	}
+	if test != "snapshot" {
+		t.Errorf("wrong snapshot content: %s", test)
+	}
+}
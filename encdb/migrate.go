@@ -0,0 +1,164 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package encdb
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// VersionKey is the entry in the KeyValueStore table of an encrypted database
+// which contains the schema version.
+const VersionKey = "Version"
+
+const (
+	getVersionQuery    = "SELECT ValueEntry FROM KeyValueStore WHERE KeyEntry=?;"
+	updateVersionQuery = "UPDATE KeyValueStore SET ValueEntry=? WHERE KeyEntry=?;"
+)
+
+// Migration describes a schema migration to Version (from Version-1).
+// Version 1 is the initial schema, so the first migration has Version 2.
+type Migration struct {
+	Version     int      // schema version after the migration
+	Description string   // short description of the migration
+	Queries     []string // queries executed within a single transaction
+}
+
+// SchemaVersion returns the schema version of db as recorded in the
+// KeyValueStore table. If no version has been recorded yet (the database is
+// being created), 0 is returned.
+func SchemaVersion(db *sql.DB) (int, error) {
+	var v string
+	err := db.QueryRow(getVersionQuery, VersionKey).Scan(&v)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, nil
+	case err != nil:
+		return 0, err
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("encdb: cannot parse schema version '%s'", v)
+	}
+	return version, nil
+}
+
+// checkMigrations makes sure that migrations are ordered and without gaps.
+func checkMigrations(migrations []Migration) error {
+	for i, migration := range migrations {
+		if migration.Version != i+2 {
+			return fmt.Errorf("encdb: migration %d has version %d, expected %d",
+				i, migration.Version, i+2)
+		}
+	}
+	return nil
+}
+
+// Pending returns the migrations which have not been applied to db yet.
+// It returns an error, if db has a newer schema version than the last
+// migration.
+func Pending(db *sql.DB, migrations []Migration) ([]Migration, error) {
+	if err := checkMigrations(migrations); err != nil {
+		return nil, err
+	}
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	if version == 0 {
+		return nil, nil // database is being created
+	}
+	if version > len(migrations)+1 {
+		return nil, fmt.Errorf("encdb: unknown schema version %d, please update software",
+			version)
+	}
+	return migrations[version-1:], nil
+}
+
+// copyFile copies the file src to dst (which is overwritten, if it exists).
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// BackupName returns the name of the backup of the database dbname which is
+// created before it is migrated from the given schema version:
+//
+//  dbname.vVERSION
+//
+// The backup can be opened with the passphrase of the original database.
+func BackupName(dbname string, version int) string {
+	return fmt.Sprintf("%s.v%d", dbname, version)
+}
+
+// Migrate applies all pending migrations to db, which must be the open
+// encrypted database with name dbname. Before the first migration is
+// applied, a snapshot of the database is written to BackupName(dbname,
+// version), replacing an existing backup of an earlier attempt. Every
+// migration (together with the update of the schema version) is executed in
+// its own transaction.
+func Migrate(dbname string, db *sql.DB, migrations []Migration) error {
+	pending, err := Pending(db, migrations)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	// backup database (copying the live database file could be inconsistent)
+	backup := BackupName(dbname, pending[0].Version-1)
+	for _, filename := range []string{backup + DBSuffix, backup + KeySuffix} {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := Snapshot(db, dbname, backup); err != nil {
+		return err
+	}
+	// apply migrations
+	for _, migration := range pending {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, query := range migration.Queries {
+			if _, err := tx.Exec(query); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("encdb: migration to version %d failed: %s",
+					migration.Version, err)
+			}
+		}
+		_, err = tx.Exec(updateVersionQuery, strconv.Itoa(migration.Version),
+			VersionKey)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package encdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testMigrations = []Migration{
+	{
+		Version:     2,
+		Description: "add column",
+		Queries: []string{
+			"ALTER TABLE Test ADD COLUMN Name TEXT NOT NULL DEFAULT '';",
+		},
+	},
+	{
+		Version:     3,
+		Description: "add table",
+		Queries: []string{
+			"CREATE TABLE Other (ID INTEGER PRIMARY KEY);",
+		},
+	},
+}
+
+func createVersionedDB(t *testing.T, tmpdir string) string {
+	dbname := filepath.Join(tmpdir, "encdb_test")
+	err := Create(dbname, passphrase, iter, []string{
+		"CREATE TABLE KeyValueStore (KeyEntry TEXT NOT NULL UNIQUE, ValueEntry TEXT NOT NULL);",
+		"CREATE TABLE Test (ID INTEGER PRIMARY KEY);",
+		"INSERT INTO KeyValueStore (KeyEntry, ValueEntry) VALUES ('Version', '1');",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dbname
+}
+
+func TestMigrate(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "encdb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	dbname := createVersionedDB(t, tmpdir)
+	db, err := Open(dbname, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	pending, err := Pending(db, testMigrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 {
+		t.Errorf("wrong number of pending migrations: %d", len(pending))
+	}
+	if err := Migrate(dbname, db, testMigrations); err != nil {
+		t.Fatal(err)
+	}
+	version, err := SchemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 3 {
+		t.Errorf("wrong version after migration: %d", version)
+	}
+	if _, err := db.Exec("INSERT INTO Other (ID) VALUES (1);"); err != nil {
+		t.Error(err)
+	}
+	pending, err = Pending(db, testMigrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("wrong number of pending migrations: %d", len(pending))
+	}
+	// backup has old version
+	backup, err := Open(BackupName(dbname, 1), passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	version, err = SchemaVersion(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 {
+		t.Errorf("wrong version of backup: %d", version)
+	}
+	// newer version than known
+	if _, err := Pending(db, testMigrations[:1]); err == nil {
+		t.Error("should fail")
+	}
+}
+
+func TestMigrateFailure(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "encdb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	dbname := createVersionedDB(t, tmpdir)
+	db, err := Open(dbname, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	migrations := []Migration{
+		testMigrations[0],
+		{
+			Version: 3,
+			Queries: []string{
+				"CREATE TABLE Other (ID INTEGER PRIMARY KEY);",
+				"INVALID QUERY;",
+			},
+		},
+	}
+	if err := Migrate(dbname, db, migrations); err == nil {
+		t.Fatal("should fail")
+	}
+	// first migration applied, second one rolled back
+	version, err := SchemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 {
+		t.Errorf("wrong version after failed migration: %d", version)
+	}
+	if _, err := db.Exec("INSERT INTO Other (ID) VALUES (1);"); err == nil {
+		t.Error("table of failed migration exists")
+	}
+	// migrations out of order
+	if _, err := Pending(db, testMigrations[1:]); err == nil {
+		t.Error("should fail")
+	}
+	// retry (the backup of the failed attempt is replaced)
+	if err := Migrate(dbname, db, migrations); err == nil {
+		t.Fatal("should fail")
+	}
+	if err := Migrate(dbname, db, testMigrations); err != nil {
+		t.Fatal(err)
+	}
+	backup, err := Open(BackupName(dbname, 2), passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	version, err = SchemaVersion(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 {
+		t.Errorf("wrong version of backup: %d", version)
+	}
+}
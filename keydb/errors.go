@@ -0,0 +1,13 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package keydb
+
+import (
+	"errors"
+)
+
+// ErrNoValidUID is raised when private UID messages exist for a nym, but
+// none of them is valid at the current time.
+var ErrNoValidUID = errors.New("keydb: no valid UID found (expired?)")
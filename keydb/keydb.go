@@ -13,14 +13,15 @@ import (
 	"github.com/mutecomm/mute/log"
 	"github.com/mutecomm/mute/uid"
 	"github.com/mutecomm/mute/uid/identity"
+	"github.com/mutecomm/mute/util/times"
 )
 
 // Version is the current keydb version.
-const Version = "1"
+const Version = "4"
 
 // Entries in KeyValueTable.
 const (
-	DBVersion = "Version" // version string of keydb
+	DBVersion = encdb.VersionKey // version string of keydb
 )
 
 const (
@@ -54,8 +55,10 @@ CREATE TABLE PrivateKeyInits (
   PUBKEYHASH      TEXT    NOT NULL,
   KeyInit         TEXT    NOT NULL,
   SigPubKey       TEXT    NOT NULL,
-  PRIVKEY         TEXT    NOT NULL,
-  ServerSignature TEXT    NOT NULL
+  PRIVKEY         TEXT    NOT NULL, -- empty after single-use KeyInit has been consumed
+  ServerSignature TEXT    NOT NULL,
+  FALLBACK        INTEGER NOT NULL, -- 1: KeyInit may serve as fallback key, 0: single-use
+  Consumed        INTEGER NOT NULL  -- time single-use KeyInit was consumed (0: not yet)
 );`
 	createQueryPublicKeyInits = `
 CREATE TABLE PublicKeyInits (
@@ -77,7 +80,8 @@ CREATE TABLE MessageKeys (
   SessionID INTEGER NOT NULL,
   Number    INTEGER NOT NULL, -- the key number
   Key       TEXT    NOT NULL, -- the actual key (JSON encoded)
-  Direction INTEGER NOT NULL  -- 1: sender key, 0: receiver key
+  Direction INTEGER NOT NULL, -- 1: sender key, 0: receiver key
+  CleanupTime INTEGER NOT NULL DEFAULT 0 -- >0: skipped receiver key
   -- TODO: fix this:
   -- FOREIGN KEY(SessionID) REFERENCES Sessions(SessionID) ON DELETE CASCADE
 );`
@@ -87,6 +91,12 @@ CREATE TABLE Hashchains (
   Domain   TEXT    NOT NULL,
   Position INTEGER NOT NULL,
   Entry    TEXT    NOT NULL
+);`
+	createQueryValidatedHashchains = `
+CREATE TABLE ValidatedHashchains (
+  ID       INTEGER PRIMARY KEY,
+  Domain   TEXT    NOT NULL UNIQUE,
+  Position INTEGER NOT NULL -- last validated position
 );`
 	createQuerySessionStates = `
 CREATE TABLE SessionStates (
@@ -118,12 +128,17 @@ CREATE TABLE SessionKeys (
 	delPrivateUIDQuery        = "DELETE FROM PrivateUIDs WHERE UIDMessage=?;"
 	getPrivateIdentitiesQuery = "SELECT DISTINCT IDENTITY FROM PrivateUIDs;"
 	getPrivateUIDQuery        = "SELECT UIDMessage, SIGPRIVKEY, ENCPRIVKEY, UIDMessageReply FROM PrivateUIDs WHERE IDENTITY=? ORDER BY MSGCOUNT DESC;"
-	addPrivateKeyInitQuery    = "INSERT INTO PrivateKeyInits (SIGKEYHASH, PUBKEYHASH, KeyInit, SigPubKey, PRIVKEY, ServerSignature) VALUES (?, ?, ?, ?, ?, ?);"
-	getPrivateKeyInitQuery    = "SELECT KeyInit, SigPubKey, PRIVKEY FROM PrivateKeyInits WHERE PUBKEYHASH=?;"
+	addPrivateKeyInitQuery    = "INSERT INTO PrivateKeyInits (SIGKEYHASH, PUBKEYHASH, KeyInit, SigPubKey, PRIVKEY, ServerSignature, FALLBACK, Consumed) VALUES (?, ?, ?, ?, ?, ?, ?, 0);"
+	getPrivateKeyInitQuery    = "SELECT KeyInit, SigPubKey, PRIVKEY FROM PrivateKeyInits WHERE PUBKEYHASH=? AND Consumed=0;"
+	consumeKeyInitQuery       = "UPDATE PrivateKeyInits SET PRIVKEY='', Consumed=? WHERE PUBKEYHASH=? AND FALLBACK=0 AND Consumed=0;"
+	getSingleUseKeyInitsQuery = "SELECT KeyInit FROM PrivateKeyInits WHERE SIGKEYHASH=? AND FALLBACK=0 AND Consumed=0;"
+	getConsumedKeyInitsQuery  = "SELECT KeyInit FROM PrivateKeyInits WHERE SIGKEYHASH=? AND Consumed>0;"
+	delConsumedKeyInitsQuery  = "DELETE FROM PrivateKeyInits WHERE SIGKEYHASH=? AND Consumed>0;"
 	addPublicKeyInitQuery     = "INSERT INTO PublicKeyInits (SIGKEYHASH, KeyInit) VALUES (?, ?);"
 	getPublicKeyInitQuery     = "SELECT KeyInit FROM PublicKeyInits WHERE SIGKEYHASH=?;"
 	addPublicUIDQuery         = "INSERT INTO PublicUIDs (IDENTITY, MSGCOUNT, POSITION, UIDMessage) VALUES (?, ?, ?, ?);"
 	getPublicUIDQuery         = "SELECT UIDMessage, POSITION FROM PublicUIDs WHERE IDENTITY=? and POSITION<=? ORDER BY POSITION DESC;"
+	getPublicUIDsQuery        = "SELECT UIDMessage, POSITION FROM PublicUIDs WHERE IDENTITY=? ORDER BY POSITION DESC;"
 	getSessionQuery           = "SELECT RootKeyHash, ChainKey, NumOfKeys FROM Sessions WHERE SessionKey=?;"
 	getSessionIDQuery         = "SELECT SessionID FROM Sessions WHERE SessionKey=?;"
 	updateSessionQuery        = "UPDATE Sessions SET ChainKey=?, NumOfKeys=? WHERE SessionKey=?;"
@@ -131,10 +146,17 @@ CREATE TABLE SessionKeys (
 	addMessageKeyQuery        = "INSERT INTO MessageKeys(SessionID, Number, Key, Direction) VALUES (?, ?, ?, ?);"
 	delMessageKeyQuery        = "DELETE FROM MessageKeys WHERE SessionID=? AND Number=? AND Direction=?;"
 	getMessageKeyQuery        = "SELECT Key FROM MessageKeys WHERE SessionID=? AND Number=? AND Direction=?;"
+	skipMessageKeysQuery      = "UPDATE MessageKeys SET CleanupTime=? WHERE SessionID=? AND Number<? AND Direction=0 AND CleanupTime=0;"
+	cleanupMessageKeysQuery   = "DELETE FROM MessageKeys WHERE CleanupTime>0 AND CleanupTime<?;"
 	addHashChainEntryQuery    = "INSERT INTO Hashchains(Domain, Position, Entry) VALUES (?, ?, ?);"
 	getHashChainEntryQuery    = "SELECT Entry FROM Hashchains WHERE Domain=? AND Position=?;"
 	getLastHashChainPosQuery  = "SELECT Position FROM Hashchains WHERE Domain=? ORDER BY Position DESC;"
 	delHashChainQuery         = "DELETE FROM Hashchains WHERE Domain=?;"
+	getHashChainPosQuery      = "SELECT Position FROM Hashchains WHERE Domain=? AND Entry=?;"
+	getHashChainDomainsQuery  = "SELECT DISTINCT Domain FROM Hashchains ORDER BY Domain ASC;"
+	getValidatedHCPosQuery    = "SELECT Position FROM ValidatedHashchains WHERE Domain=?;"
+	setValidatedHCPosQuery    = "INSERT OR REPLACE INTO ValidatedHashchains (Domain, Position) VALUES (?, ?);"
+	delValidatedHCPosQuery    = "DELETE FROM ValidatedHashchains WHERE Domain=?;"
 	updateSessionStateQuery   = "UPDATE SessionStates SET SenderSessionCount=?, SenderMessageCount=?, " +
 		"MaxRecipientCount=?, RecipientTemp=?, SenderSessionPub=?, NextSenderSessionPub=?, " +
 		"NextRecipientSessionPubSeen=?, NymAddress=?, KeyInitSession=? WHERE SessionStateKey=?;"
@@ -163,10 +185,15 @@ type KeyDB struct {
 	getPrivateUIDQuery        *sql.Stmt
 	addPrivateKeyInitQuery    *sql.Stmt
 	getPrivateKeyInitQuery    *sql.Stmt
+	consumeKeyInitQuery       *sql.Stmt
+	getSingleUseKeyInitsQuery *sql.Stmt
+	getConsumedKeyInitsQuery  *sql.Stmt
+	delConsumedKeyInitsQuery  *sql.Stmt
 	addPublicKeyInitQuery     *sql.Stmt
 	getPublicKeyInitQuery     *sql.Stmt
 	addPublicUIDQuery         *sql.Stmt
 	getPublicUIDQuery         *sql.Stmt
+	getPublicUIDsQuery        *sql.Stmt
 	getSessionQuery           *sql.Stmt
 	getSessionIDQuery         *sql.Stmt
 	updateSessionQuery        *sql.Stmt
@@ -174,10 +201,17 @@ type KeyDB struct {
 	addMessageKeyQuery        *sql.Stmt
 	delMessageKeyQuery        *sql.Stmt
 	getMessageKeyQuery        *sql.Stmt
+	skipMessageKeysQuery      *sql.Stmt
+	cleanupMessageKeysQuery   *sql.Stmt
 	addHashChainEntryQuery    *sql.Stmt
 	getHashChainEntryQuery    *sql.Stmt
 	getLastHashChainPosQuery  *sql.Stmt
 	delHashChainQuery         *sql.Stmt
+	getHashChainPosQuery      *sql.Stmt
+	getHashChainDomainsQuery  *sql.Stmt
+	getValidatedHCPosQuery    *sql.Stmt
+	setValidatedHCPosQuery    *sql.Stmt
+	delValidatedHCPosQuery    *sql.Stmt
 	updateSessionStateQuery   *sql.Stmt
 	insertSessionStateQuery   *sql.Stmt
 	getSessionStateQuery      *sql.Stmt
@@ -198,6 +232,7 @@ func Create(dbname string, passphrase []byte, iter int) error {
 		createQuerySessions,
 		createQueryMessageKeys,
 		createQueryHashchains,
+		createQueryValidatedHashchains,
 		createQuerySessionStates,
 		createQuerySessionKeys,
 	})
@@ -221,6 +256,70 @@ func (keyDB *KeyDB) Version() (string, error) {
 	return version, nil
 }
 
+// migrations contains the schema migrations of keydb (see encdb.Migrate).
+// The queries of a migration are frozen, they must not refer to the table
+// definitions above (which describe the current schema).
+var migrations = []encdb.Migration{
+	{
+		Version:     2,
+		Description: "single-use KeyInits (all previous KeyInits are fallbacks)",
+		Queries: []string{
+			"ALTER TABLE PrivateKeyInits ADD COLUMN FALLBACK INTEGER NOT NULL DEFAULT 1;",
+			"ALTER TABLE PrivateKeyInits ADD COLUMN Consumed INTEGER NOT NULL DEFAULT 0;",
+		},
+	},
+	{
+		Version:     3,
+		Description: "skipped message keys",
+		Queries: []string{
+			"ALTER TABLE MessageKeys ADD COLUMN CleanupTime INTEGER NOT NULL DEFAULT 0;",
+		},
+	},
+	{
+		Version:     4,
+		Description: "incremental hash chain validation",
+		Queries: []string{
+			`
+CREATE TABLE ValidatedHashchains (
+  ID       INTEGER PRIMARY KEY,
+  Domain   TEXT    NOT NULL UNIQUE,
+  Position INTEGER NOT NULL -- last validated position
+);`,
+		},
+	},
+}
+
+// migrate migrates the key database encDB with dbname to the current Version.
+func migrate(dbname string, encDB *sql.DB) error {
+	pending, err := encdb.Pending(encDB, migrations)
+	if err != nil {
+		return log.Error(err)
+	}
+	for _, migration := range pending {
+		log.Infof("keydb: migrate to version %d (%s)", migration.Version,
+			migration.Description)
+	}
+	if err := encdb.Migrate(dbname, encDB, migrations); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+// PendingMigrations returns the migrations which have not been applied to
+// the key database with dbname yet, without applying them.
+func PendingMigrations(dbname string, passphrase []byte) ([]encdb.Migration, error) {
+	encDB, err := encdb.Open(dbname, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer encDB.Close()
+	pending, err := encdb.Pending(encDB, migrations)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	return pending, nil
+}
+
 // Open opens the key database with dbname and passphrase.
 func Open(dbname string, passphrase []byte) (*KeyDB, error) {
 	var keyDB KeyDB
@@ -230,6 +329,11 @@ func Open(dbname string, passphrase []byte) (*KeyDB, error) {
 	if err != nil {
 		return nil, err
 	}
+	// migrate database, if necessary
+	if err := migrate(dbname, keyDB.encDB); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
 	// prepare statements
 	if keyDB.updateValueQuery, err = keyDB.encDB.Prepare(updateValueQuery); err != nil {
 		keyDB.encDB.Close()
@@ -271,6 +375,22 @@ func Open(dbname string, passphrase []byte) (*KeyDB, error) {
 		keyDB.encDB.Close()
 		return nil, err
 	}
+	if keyDB.consumeKeyInitQuery, err = keyDB.encDB.Prepare(consumeKeyInitQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
+	if keyDB.getSingleUseKeyInitsQuery, err = keyDB.encDB.Prepare(getSingleUseKeyInitsQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
+	if keyDB.getConsumedKeyInitsQuery, err = keyDB.encDB.Prepare(getConsumedKeyInitsQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
+	if keyDB.delConsumedKeyInitsQuery, err = keyDB.encDB.Prepare(delConsumedKeyInitsQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
 	if keyDB.addPublicKeyInitQuery, err = keyDB.encDB.Prepare(addPublicKeyInitQuery); err != nil {
 		keyDB.encDB.Close()
 		return nil, err
@@ -287,6 +407,10 @@ func Open(dbname string, passphrase []byte) (*KeyDB, error) {
 		keyDB.encDB.Close()
 		return nil, err
 	}
+	if keyDB.getPublicUIDsQuery, err = keyDB.encDB.Prepare(getPublicUIDsQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
 	if keyDB.getSessionQuery, err = keyDB.encDB.Prepare(getSessionQuery); err != nil {
 		keyDB.encDB.Close()
 		return nil, err
@@ -315,6 +439,14 @@ func Open(dbname string, passphrase []byte) (*KeyDB, error) {
 		keyDB.encDB.Close()
 		return nil, err
 	}
+	if keyDB.skipMessageKeysQuery, err = keyDB.encDB.Prepare(skipMessageKeysQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
+	if keyDB.cleanupMessageKeysQuery, err = keyDB.encDB.Prepare(cleanupMessageKeysQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
 	if keyDB.addHashChainEntryQuery, err = keyDB.encDB.Prepare(addHashChainEntryQuery); err != nil {
 		keyDB.encDB.Close()
 		return nil, err
@@ -331,6 +463,26 @@ func Open(dbname string, passphrase []byte) (*KeyDB, error) {
 		keyDB.encDB.Close()
 		return nil, err
 	}
+	if keyDB.getHashChainPosQuery, err = keyDB.encDB.Prepare(getHashChainPosQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
+	if keyDB.getHashChainDomainsQuery, err = keyDB.encDB.Prepare(getHashChainDomainsQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
+	if keyDB.getValidatedHCPosQuery, err = keyDB.encDB.Prepare(getValidatedHCPosQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
+	if keyDB.setValidatedHCPosQuery, err = keyDB.encDB.Prepare(setValidatedHCPosQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
+	if keyDB.delValidatedHCPosQuery, err = keyDB.encDB.Prepare(delValidatedHCPosQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
 	if keyDB.updateSessionStateQuery, err = keyDB.encDB.Prepare(updateSessionStateQuery); err != nil {
 		keyDB.encDB.Close()
 		return nil, err
@@ -471,30 +623,38 @@ func (keyDB *KeyDB) GetPrivateIdentitiesForDomain(domain string) ([]string, erro
 	return identities, nil
 }
 
-// GetPrivateUID gets a private uid for identity from keyDB.
-//
-// TODO: get all UID messages for given identity which are not expired.
-func (keyDB *KeyDB) GetPrivateUID(
+// getPrivateUID returns the most current private UID message for identity
+// from keyDB. If valid is true, only UID messages which are valid at the
+// current time are considered.
+func (keyDB *KeyDB) getPrivateUID(
 	identity string,
-	withPrivkeys bool,
+	withPrivkeys, valid bool,
 ) (*uid.Message, *uid.MessageReply, error) {
-	var (
-		uidJSON    string
-		sigPrivKey string
-		encPrivKey string
-		replyJSON  string
-	)
-	err := keyDB.getPrivateUIDQuery.QueryRow(identity).Scan(&uidJSON, &sigPrivKey, &encPrivKey, &replyJSON)
-	switch {
-	case err == sql.ErrNoRows:
-		return nil, nil, log.Errorf("keydb: no privkey for nym '%s' found", identity)
-	case err != nil:
+	rows, err := keyDB.getPrivateUIDQuery.Query(identity)
+	if err != nil {
 		return nil, nil, log.Error(err)
-	default:
+	}
+	defer rows.Close()
+	var found bool
+	now := times.Now()
+	for rows.Next() {
+		var (
+			uidJSON    string
+			sigPrivKey string
+			encPrivKey string
+			replyJSON  string
+		)
+		if err := rows.Scan(&uidJSON, &sigPrivKey, &encPrivKey, &replyJSON); err != nil {
+			return nil, nil, log.Error(err)
+		}
+		found = true
 		msg, err := uid.NewJSON(uidJSON)
 		if err != nil {
 			return nil, nil, err
 		}
+		if valid && !msg.ValidAt(now) {
+			continue
+		}
 		if err := msg.VerifySelfSig(); err != nil {
 			// if this fails something is seriously wrong
 			return nil, nil, log.Error(err)
@@ -516,6 +676,32 @@ func (keyDB *KeyDB) GetPrivateUID(
 		}
 		return msg, msgReply, nil
 	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, log.Error(err)
+	}
+	if found {
+		return nil, nil, log.Error(ErrNoValidUID)
+	}
+	return nil, nil, log.Errorf("keydb: no privkey for nym '%s' found", identity)
+}
+
+// GetPrivateUID gets the most current private uid for identity from keyDB
+// which is valid at the current time (see uid.Message.ValidAt).
+func (keyDB *KeyDB) GetPrivateUID(
+	identity string,
+	withPrivkeys bool,
+) (*uid.Message, *uid.MessageReply, error) {
+	return keyDB.getPrivateUID(identity, withPrivkeys, true)
+}
+
+// GetLatestPrivateUID gets the latest private uid for identity from keyDB,
+// regardless of its validity (for example, a generated, but not yet
+// registered update).
+func (keyDB *KeyDB) GetLatestPrivateUID(
+	identity string,
+	withPrivkeys bool,
+) (*uid.Message, *uid.MessageReply, error) {
+	return keyDB.getPrivateUID(identity, withPrivkeys, false)
 }
 
 // AddPrivateKeyInit adds a private KeyInit message and the corresponding
@@ -531,6 +717,7 @@ func (keyDB *KeyDB) AddPrivateKeyInit(
 		sigPubKey,
 		privateKey,
 		serverSignature,
+		ki.Fallback(),
 	)
 	if err != nil {
 		return err
@@ -539,6 +726,7 @@ func (keyDB *KeyDB) AddPrivateKeyInit(
 }
 
 // GetPrivateKeyInit returns the private KeyInit for the given pubKeyHash.
+// Consumed single-use KeyInits are not returned (sql.ErrNoRows).
 func (keyDB *KeyDB) GetPrivateKeyInit(
 	pubKeyHash string,
 ) (ki *uid.KeyInit, sigPubKey, privKey string, err error) {
@@ -556,6 +744,77 @@ func (keyDB *KeyDB) GetPrivateKeyInit(
 	}
 }
 
+// ConsumePrivateKeyInit marks the private KeyInit for the given pubKeyHash as
+// consumed at time now, if it is a single-use KeyInit. The private key of a
+// consumed KeyInit is destroyed. KeyInits which may serve as a fallback key
+// are not affected.
+func (keyDB *KeyDB) ConsumePrivateKeyInit(pubKeyHash string, now uint64) error {
+	if _, err := keyDB.consumeKeyInitQuery.Exec(now, pubKeyHash); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+func (keyDB *KeyDB) getKeyInits(
+	stmt *sql.Stmt,
+	sigKeyHash string,
+) ([]*uid.KeyInit, error) {
+	var kis []*uid.KeyInit
+	rows, err := stmt.Query(sigKeyHash)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var json string
+		if err := rows.Scan(&json); err != nil {
+			return nil, log.Error(err)
+		}
+		ki, err := uid.NewJSONKeyInit([]byte(json))
+		if err != nil {
+			return nil, err
+		}
+		kis = append(kis, ki)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	return kis, nil
+}
+
+// NumSingleUseKeyInits returns the number of single-use KeyInits for the
+// given sigKeyHash which have not been consumed and are still valid at time
+// now. Published KeyInits which have been fetched by peers, but not used yet,
+// are included.
+func (keyDB *KeyDB) NumSingleUseKeyInits(sigKeyHash string, now uint64) (int, error) {
+	kis, err := keyDB.getKeyInits(keyDB.getSingleUseKeyInitsQuery, sigKeyHash)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, ki := range kis {
+		if ki.NotAfter() > now {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// GetConsumedKeyInits returns all consumed single-use KeyInits for the given
+// sigKeyHash.
+func (keyDB *KeyDB) GetConsumedKeyInits(sigKeyHash string) ([]*uid.KeyInit, error) {
+	return keyDB.getKeyInits(keyDB.getConsumedKeyInitsQuery, sigKeyHash)
+}
+
+// DelConsumedKeyInits deletes all consumed single-use KeyInits for the given
+// sigKeyHash.
+func (keyDB *KeyDB) DelConsumedKeyInits(sigKeyHash string) error {
+	if _, err := keyDB.delConsumedKeyInitsQuery.Exec(sigKeyHash); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
 // AddPublicKeyInit adds a public KeyInit message to keyDB.
 func (keyDB *KeyDB) AddPublicKeyInit(ki *uid.KeyInit) error {
 	_, err := keyDB.addPublicKeyInitQuery.Exec(ki.SigKeyHash(), ki.JSON())
@@ -597,6 +856,35 @@ func (keyDB *KeyDB) AddPublicUID(msg *uid.Message, position uint64) error {
 	return nil
 }
 
+// AddPublicUIDs adds a chain of public UID messages and their hash chain
+// positions to keyDB. Either all UID messages are added or none.
+func (keyDB *KeyDB) AddPublicUIDs(msgs []*uid.Message, positions []uint64) error {
+	if len(msgs) != len(positions) {
+		return log.Error("keydb: len(msgs) != len(positions)")
+	}
+	tx, err := keyDB.encDB.Begin()
+	if err != nil {
+		return log.Error(err)
+	}
+	for i, msg := range msgs {
+		_, err := tx.Stmt(keyDB.addPublicUIDQuery).Exec(
+			msg.UIDContent.IDENTITY,
+			msg.UIDContent.MSGCOUNT,
+			positions[i],
+			msg.JSON(),
+		)
+		if err != nil {
+			tx.Rollback()
+			return log.Error(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	return nil
+}
+
 // GetPublicUID gets the public UID message from keyDB with the highest
 // position smaller or equal to maxpos.
 func (keyDB *KeyDB) GetPublicUID(
@@ -620,6 +908,35 @@ func (keyDB *KeyDB) GetPublicUID(
 	}
 }
 
+// GetPublicUIDByHash gets the public UID message of identity with the given
+// uidHash (see uid.Message.UIDHash) from keyDB.
+func (keyDB *KeyDB) GetPublicUIDByHash(
+	identity, uidHash string,
+) (msg *uid.Message, pos uint64, found bool, err error) {
+	rows, err := keyDB.getPublicUIDsQuery.Query(identity)
+	if err != nil {
+		return nil, 0, false, log.Error(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uidJSON string
+		if err := rows.Scan(&uidJSON, &pos); err != nil {
+			return nil, 0, false, log.Error(err)
+		}
+		msg, err = uid.NewJSON(uidJSON)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		if msg.UIDHash() == uidHash {
+			return msg, pos, true, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, false, log.Error(err)
+	}
+	return nil, 0, false, nil
+}
+
 // AddHashChainEntry adds the hash chain entry at position for the given
 // domain to keyDB.
 func (keyDB *KeyDB) AddHashChainEntry(
@@ -635,6 +952,33 @@ func (keyDB *KeyDB) AddHashChainEntry(
 	return nil
 }
 
+// AddHashChainEntries adds the hash chain entries starting at position start
+// for the given domain to keyDB. Either all entries are added or none.
+func (keyDB *KeyDB) AddHashChainEntries(
+	domain string,
+	start uint64,
+	entries []string,
+) error {
+	dmn := identity.MapDomain(domain)
+	tx, err := keyDB.encDB.Begin()
+	if err != nil {
+		return log.Error(err)
+	}
+	for i, entry := range entries {
+		_, err := tx.Stmt(keyDB.addHashChainEntryQuery).Exec(dmn,
+			start+uint64(i), entry)
+		if err != nil {
+			tx.Rollback()
+			return log.Error(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	return nil
+}
+
 // GetLastHashChainPos returns the last hash chain position for the given
 // domain from keydb.
 // The return value found indicates if a hash chain entry for domain exists.
@@ -686,11 +1030,96 @@ func (keyDB *KeyDB) GetLastHashChainEntry(domain string) (string, error) {
 	return entry, nil
 }
 
-// DelHashChain deletes the hash chain for the given domain.
+// GetHashChainPos returns the position of the given hash chain entry in the
+// hash chain for the given domain from keydb.
+// The return value found indicates if the entry exists.
+func (keyDB *KeyDB) GetHashChainPos(domain, entry string) (
+	pos uint64,
+	found bool,
+	err error,
+) {
+	dmn := identity.MapDomain(domain)
+	err = keyDB.getHashChainPosQuery.QueryRow(dmn, entry).Scan(&pos)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, false, nil
+	case err != nil:
+		return 0, false, log.Error(err)
+	default:
+		return pos, true, nil
+	}
+}
+
+// GetHashChainDomains returns the domains of all hash chains in keydb.
+func (keyDB *KeyDB) GetHashChainDomains() ([]string, error) {
+	var domains []string
+	rows, err := keyDB.getHashChainDomainsQuery.Query()
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var domain string
+		if err := rows.Scan(&domain); err != nil {
+			return nil, log.Error(err)
+		}
+		domains = append(domains, domain)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	return domains, nil
+}
+
+// GetValidatedHashChainPos returns the last validated hash chain position
+// for the given domain from keydb.
+// The return value found indicates if the hash chain has been validated.
+func (keyDB *KeyDB) GetValidatedHashChainPos(domain string) (
+	pos uint64,
+	found bool,
+	err error,
+) {
+	dmn := identity.MapDomain(domain)
+	err = keyDB.getValidatedHCPosQuery.QueryRow(dmn).Scan(&pos)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, false, nil
+	case err != nil:
+		return 0, false, log.Error(err)
+	default:
+		return pos, true, nil
+	}
+}
+
+// SetValidatedHashChainPos sets the last validated hash chain position for
+// the given domain in keydb.
+func (keyDB *KeyDB) SetValidatedHashChainPos(domain string, pos uint64) error {
+	dmn := identity.MapDomain(domain)
+	if _, err := keyDB.setValidatedHCPosQuery.Exec(dmn, pos); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+// DelHashChain deletes the hash chain (and its validation state) for the
+// given domain.
 func (keyDB *KeyDB) DelHashChain(domain string) error {
 	dmn := identity.MapDomain(domain)
-	if _, err := keyDB.delHashChainQuery.Exec(dmn); err != nil {
-		return err
+	tx, err := keyDB.encDB.Begin()
+	if err != nil {
+		return log.Error(err)
+	}
+	if _, err := tx.Stmt(keyDB.delHashChainQuery).Exec(dmn); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	if _, err := tx.Stmt(keyDB.delValidatedHCPosQuery).Exec(dmn); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return log.Error(err)
 	}
 	return nil
 }
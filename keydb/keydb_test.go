@@ -6,12 +6,14 @@ package keydb
 
 import (
 	"bytes"
+	"database/sql"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
 
 	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encdb"
 	"github.com/mutecomm/mute/keyserver/hashchain"
 	"github.com/mutecomm/mute/uid"
 	"github.com/mutecomm/mute/util"
@@ -88,12 +90,12 @@ func TestPrivateUID(t *testing.T) {
 	defer os.RemoveAll(tmpdir)
 	defer keyDB.Close()
 	alice, err := uid.Create("alice@mute.berlin", false, "", "", uid.Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
 	bob, err := uid.Create("bob@mute.one", false, "", "", uid.Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -169,6 +171,52 @@ func TestPrivateUID(t *testing.T) {
 	}
 }
 
+func TestPrivateUIDValidity(t *testing.T) {
+	tmpdir, keyDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer keyDB.Close()
+	a, err := uid.Create("alice@mute.berlin", false, "", "", uid.Strict,
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyDB.AddPrivateUID(a); err != nil {
+		t.Fatal(err)
+	}
+	// update which is not valid yet
+	up, err := a.Update(nil, uint64(times.ThirtyDaysLater()), 0, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyDB.AddPrivateUID(up); err != nil {
+		t.Fatal(err)
+	}
+	valid, _, err := keyDB.GetPrivateUID("alice@mute.berlin", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(valid.JSON(), a.JSON()) {
+		t.Error("should return currently valid UID")
+	}
+	latest, _, err := keyDB.GetLatestPrivateUID("alice@mute.berlin", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(latest.JSON(), up.JSON()) {
+		t.Error("should return latest UID")
+	}
+	// no valid UID
+	if err := keyDB.DelPrivateUID(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := keyDB.GetPrivateUID("alice@mute.berlin", false); err != ErrNoValidUID {
+		t.Error("should fail")
+	}
+}
+
 func TestPublicUID(t *testing.T) {
 	tmpdir, keyDB, err := createDB()
 	if err != nil {
@@ -177,12 +225,12 @@ func TestPublicUID(t *testing.T) {
 	defer os.RemoveAll(tmpdir)
 	defer keyDB.Close()
 	a1, err := uid.Create("alice@mute.berlin", false, "", "", uid.Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
 	a2, err := uid.Create("alice@mute.berlin", false, "", "", uid.Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -212,6 +260,63 @@ func TestPublicUID(t *testing.T) {
 	if pos != 20 {
 		t.Error("a2 position should be 20")
 	}
+	// add chain of UID messages
+	a3, err := a2.Update(nil, 0, 0, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a4, err := a3.Update(nil, 0, 0, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyDB.AddPublicUIDs([]*uid.Message{a3, a4}, []uint64{30}); err == nil {
+		t.Error("should fail")
+	}
+	err = keyDB.AddPublicUIDs([]*uid.Message{a3, a4}, []uint64{30, 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		msg *uid.Message
+		pos uint64
+	}{
+		{a2, 29},
+		{a3, 30},
+		{a4, 50},
+	} {
+		rA, pos, found, err := keyDB.GetPublicUID("alice@mute.berlin", test.pos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || !bytes.Equal(rA.JSON(), test.msg.JSON()) {
+			t.Errorf("wrong UID message for position %d (%d)", test.pos, pos)
+		}
+	}
+	// get UID messages by hash
+	for _, test := range []struct {
+		msg *uid.Message
+		pos uint64
+	}{
+		{a1, 10},
+		{a3, 30},
+		{a4, 40},
+	} {
+		rA, pos, found, err := keyDB.GetPublicUIDByHash("alice@mute.berlin",
+			test.msg.UIDHash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || !bytes.Equal(rA.JSON(), test.msg.JSON()) || pos != test.pos {
+			t.Errorf("wrong UID message for position %d (%d)", test.pos, pos)
+		}
+	}
+	_, _, found, err := keyDB.GetPublicUIDByHash("bob@mute.berlin", a1.UIDHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("UID message of other identity found")
+	}
 }
 
 func TestPrivateKeyInit(t *testing.T) {
@@ -222,7 +327,7 @@ func TestPrivateKeyInit(t *testing.T) {
 	defer os.RemoveAll(tmpdir)
 	defer keyDB.Close()
 	msg, err := uid.Create("keydb@mute.berlin", false, "", "", uid.Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -252,6 +357,152 @@ func TestPrivateKeyInit(t *testing.T) {
 	}
 }
 
+func TestSingleUseKeyInit(t *testing.T) {
+	tmpdir, keyDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer keyDB.Close()
+	msg, err := uid.Create("keydb@mute.berlin", false, "", "", uid.Strict,
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigKeyHash, err := msg.SigKeyHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := uint64(times.Now())
+	var pubKeyHashes []string
+	for _, fallback := range []bool{true, false, false} {
+		ki, pubKeyHash, privateKey, err := msg.KeyInit(0, now+times.Day,
+			now-times.Day, fallback, "mute.berlin", "", "", cipher.RandReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = keyDB.AddPrivateKeyInit(ki, pubKeyHash, msg.SigPubKey(),
+			privateKey, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubKeyHashes = append(pubKeyHashes, pubKeyHash)
+	}
+	n, err := keyDB.NumSingleUseKeyInits(sigKeyHash, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("wrong number of single-use KeyInits: %d", n)
+	}
+	n, err = keyDB.NumSingleUseKeyInits(sigKeyHash, now+times.Day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Error("expired KeyInits should not be counted")
+	}
+	// consume all KeyInits
+	for _, pubKeyHash := range pubKeyHashes {
+		if err := keyDB.ConsumePrivateKeyInit(pubKeyHash, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// fallback KeyInit is still available
+	if _, _, _, err := keyDB.GetPrivateKeyInit(pubKeyHashes[0]); err != nil {
+		t.Fatal(err)
+	}
+	// single-use KeyInits are gone
+	for _, pubKeyHash := range pubKeyHashes[1:] {
+		_, _, _, err := keyDB.GetPrivateKeyInit(pubKeyHash)
+		if err != sql.ErrNoRows {
+			t.Errorf("consumed KeyInit should not be returned: %v", err)
+		}
+	}
+	n, err = keyDB.NumSingleUseKeyInits(sigKeyHash, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Error("consumed KeyInits should not be counted")
+	}
+	kis, err := keyDB.GetConsumedKeyInits(sigKeyHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kis) != 2 {
+		t.Fatalf("wrong number of consumed KeyInits: %d", len(kis))
+	}
+	if err := keyDB.DelConsumedKeyInits(sigKeyHash); err != nil {
+		t.Fatal(err)
+	}
+	kis, err = keyDB.GetConsumedKeyInits(sigKeyHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kis) != 0 {
+		t.Error("consumed KeyInits should have been deleted")
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "keydb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	dbname := filepath.Join(tmpdir, "keydb")
+	passphrase := []byte(cipher.RandPass(cipher.RandReader))
+	if err := Create(dbname, passphrase, 64000); err != nil {
+		t.Fatal(err)
+	}
+	// downgrade to version 1
+	encDB, err := encdb.Open(dbname, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = encDB.Exec(`
+DROP TABLE PrivateKeyInits;
+CREATE TABLE PrivateKeyInits (
+  ID              INTEGER PRIMARY KEY,
+  SIGKEYHASH      TEXT    NOT NULL,
+  PUBKEYHASH      TEXT    NOT NULL,
+  KeyInit         TEXT    NOT NULL,
+  SigPubKey       TEXT    NOT NULL,
+  PRIVKEY         TEXT    NOT NULL,
+  ServerSignature TEXT    NOT NULL
+);
+DROP TABLE MessageKeys;
+CREATE TABLE MessageKeys (
+  ID        INTEGER PRIMARY KEY,
+  SessionID INTEGER NOT NULL,
+  Number    INTEGER NOT NULL,
+  Key       TEXT    NOT NULL,
+  Direction INTEGER NOT NULL
+);
+DROP TABLE ValidatedHashchains;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encDB.Exec(updateValueQuery, "1", DBVersion); err != nil {
+		t.Fatal(err)
+	}
+	encDB.Close()
+	// upgrade
+	keyDB, err := Open(dbname, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keyDB.Close()
+	version, err := keyDB.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != Version {
+		t.Errorf("wrong version after upgrade: %s", version)
+	}
+}
+
 func TestPublicKeyInit(t *testing.T) {
 	tmpdir, keyDB, err := createDB()
 	if err != nil {
@@ -260,7 +511,7 @@ func TestPublicKeyInit(t *testing.T) {
 	defer os.RemoveAll(tmpdir)
 	defer keyDB.Close()
 	msg, err := uid.Create("keydb@mute.berlin", false, "", "", uid.Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -345,9 +596,67 @@ func TestHashchain(t *testing.T) {
 	if err == nil {
 		t.Error("should fail")
 	}
+	pos, found, err = keyDB.GetHashChainPos("mute.berlin", testHashchain[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || pos != 2 {
+		t.Error("hash chain entry should be found at position 2")
+	}
+	_, found, err = keyDB.GetHashChainPos("gmail.rocks", testHashchain[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("entry should not exist")
+	}
+	if err := keyDB.AddHashChainEntries("gmail.rocks", 0, testHashchain[:2]); err != nil {
+		t.Fatal(err)
+	}
+	pos, found, err = keyDB.GetLastHashChainPos("gmail.rocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || pos != 1 {
+		t.Error("last pos should be 1")
+	}
+	domains, err := keyDB.GetHashChainDomains()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 2 || domains[0] != "gmail.rocks" ||
+		domains[1] != "mute.berlin" {
+		t.Error("wrong hash chain domains")
+	}
+	_, found, err = keyDB.GetValidatedHashChainPos("mute.berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("hash chain should not be validated")
+	}
+	for _, v := range []uint64{2, 3} {
+		if err := keyDB.SetValidatedHashChainPos("mute.berlin", v); err != nil {
+			t.Fatal(err)
+		}
+		pos, found, err = keyDB.GetValidatedHashChainPos("mute.berlin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || pos != v {
+			t.Errorf("validated pos should be %d", v)
+		}
+	}
 	if err := keyDB.DelHashChain("mute.berlin"); err != nil {
 		t.Fatal(err)
 	}
+	_, found, err = keyDB.GetValidatedHashChainPos("mute.berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("validated pos should be deleted with hash chain")
+	}
 	_, found, err = keyDB.GetLastHashChainPos("mute.berlin")
 	if err != nil {
 		t.Fatal(err)
@@ -52,7 +52,7 @@ func (keyDB *KeyDB) AddSession(
 		return log.Error(err)
 	default:
 		// update session
-		res, err = tx.Stmt(keyDB.updateSessionQuery).Exec(chainKey,
+		_, err = tx.Stmt(keyDB.updateSessionQuery).Exec(chainKey,
 			offset+uint64(len(send)), sessionKey)
 		if err != nil {
 			tx.Rollback()
@@ -61,7 +61,13 @@ func (keyDB *KeyDB) AddSession(
 	}
 
 	// get session ID
-	sessionID, err := res.LastInsertId()
+	// (LastInsertId() is only defined for new sessions)
+	var sessionID int64
+	if res != nil {
+		sessionID, err = res.LastInsertId()
+	} else {
+		err = tx.Stmt(keyDB.getSessionIDQuery).QueryRow(sessionKey).Scan(&sessionID)
+	}
 	if err != nil {
 		tx.Rollback()
 		return log.Error(err)
@@ -155,3 +161,36 @@ func (keyDB *KeyDB) DelMessageKey(
 	}
 	return nil
 }
+
+// SkipMessageKeys marks all unused receiver keys for the given sessionKey
+// with an index smaller than msgIndex as skipped, if they have not been
+// marked before. Skipped keys are deleted after cleanupTime (see
+// CleanupMessageKeys). The number of newly skipped keys is returned.
+func (keyDB *KeyDB) SkipMessageKeys(
+	sessionKey string,
+	msgIndex, cleanupTime uint64,
+) (uint64, error) {
+	var sessionID int64
+	err := keyDB.getSessionIDQuery.QueryRow(sessionKey).Scan(&sessionID)
+	if err != nil {
+		return 0, err
+	}
+	res, err := keyDB.skipMessageKeysQuery.Exec(cleanupTime, sessionID, msgIndex)
+	if err != nil {
+		return 0, log.Error(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, log.Error(err)
+	}
+	return uint64(n), nil
+}
+
+// CleanupMessageKeys deletes all skipped message keys with a cleanup time
+// before t.
+func (keyDB *KeyDB) CleanupMessageKeys(t uint64) error {
+	if _, err := keyDB.cleanupMessageKeysQuery.Exec(t); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
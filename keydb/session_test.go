@@ -111,3 +111,75 @@ func TestSessions(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestSkipMessageKeys(t *testing.T) {
+	tmpdir, keyDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer keyDB.Close()
+	sessionKey := base64.Encode(cipher.SHA512([]byte("key")))
+	rk := base64.Encode(cipher.SHA256([]byte("rootkey")))
+	master := make([]byte, 96)
+	if _, err := io.ReadFull(cipher.RandReader, master); err != nil {
+		t.Fatal(err)
+	}
+	kdf := hkdf.New(sha512.New, master, nil, nil)
+	chainKey := make([]byte, 32)
+	if _, err := io.ReadFull(kdf, chainKey); err != nil {
+		t.Fatal(err)
+	}
+	// add session and extend it (keys are derived on demand)
+	for i := 0; i < 2; i++ {
+		send, recv, err := deriveKeys(chainKey, kdf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = keyDB.AddSession(sessionKey, rk, base64.Encode(chainKey), send, recv)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the extended keys belong to the session
+	last := uint64(2*msg.NumOfFutureKeys - 1)
+	if _, err := keyDB.GetMessageKey(sessionKey, false, last); err != nil {
+		t.Fatal(err)
+	}
+	// key 0 is used, keys 1 and 2 are skipped
+	if err := keyDB.DelMessageKey(sessionKey, false, 0); err != nil {
+		t.Fatal(err)
+	}
+	n, err := keyDB.SkipMessageKeys(sessionKey, 3, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("wrong number of skipped keys: %d", n)
+	}
+	// skipped keys are only counted once
+	n, err = keyDB.SkipMessageKeys(sessionKey, 3, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("wrong number of skipped keys: %d", n)
+	}
+	// skipped keys stay usable until they are cleaned up
+	if err := keyDB.CleanupMessageKeys(10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keyDB.GetMessageKey(sessionKey, false, 1); err != nil {
+		t.Error(err)
+	}
+	if err := keyDB.CleanupMessageKeys(11); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keyDB.GetMessageKey(sessionKey, false, 1); err != sql.ErrNoRows {
+		t.Error("should fail with sql.ErrNoRows")
+	}
+	// sender keys are never skipped
+	if _, err := keyDB.GetMessageKey(sessionKey, true, 1); err != nil {
+		t.Error(err)
+	}
+}
@@ -7,7 +7,11 @@ package hashchain
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"io"
 
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/cipher/aes256"
 	"github.com/mutecomm/mute/encode/base64"
 	"github.com/mutecomm/mute/log"
 )
@@ -50,3 +54,59 @@ func SplitEntry(entry string) (hash, typ, nonce, hashID, crUID, uidIndex []byte,
 	}
 	return
 }
+
+// NewEntry creates a new base64 encoded key hashchain entry for the given
+// (mapped) identity, UIDHash, and UIDIndex. prevHash is the HASH(entry[n-1])
+// part of the previous entry or nil, if the new entry is the first one in the
+// chain. Necessary randomness is read from rand. Specification:
+// https://github.com/mutecomm/mute/blob/master/doc/keyserver.md#key-hashchain-operation
+func NewEntry(
+	identity string,
+	UIDHash, UIDIndex, prevHash []byte,
+	rand io.Reader,
+) (string, error) {
+	if len(UIDHash) != sha256.Size {
+		return "", log.Errorf("hashchain: UIDHash has wrong length %d", len(UIDHash))
+	}
+	if len(UIDIndex) != sha256.Size {
+		return "", log.Errorf("hashchain: UIDIndex has wrong length %d", len(UIDIndex))
+	}
+	if prevHash == nil {
+		prevHash = make([]byte, sha256.Size)
+	}
+	if len(prevHash) != sha256.Size {
+		return "", log.Errorf("hashchain: previous hash has wrong length %d", len(prevHash))
+	}
+	// Create random NONCE 64bit
+	nonce := make([]byte, 8)
+	if _, err := io.ReadFull(rand, nonce); err != nil {
+		return "", log.Error(err)
+	}
+	// Compute k1, k2 = CKDF(NONCE)
+	k1, k2 := cipher.CKDF(nonce)
+	// Create HASH(k1 | identity) = HashID
+	tmp := make([]byte, len(k1)+len(identity))
+	copy(tmp, k1)
+	copy(tmp[len(k1):], identity)
+	hashID := cipher.SHA256(tmp)
+	// Create HASH(k2 | identity) = IDKEY
+	tmp = make([]byte, len(k2)+len(identity))
+	copy(tmp, k2)
+	copy(tmp[len(k2):], identity)
+	IDKEY := cipher.SHA256(tmp)
+	// Create AES_256_CBC(IDKEY, UIDHash) = CrUID
+	crUID := aes256.CBCEncrypt(IDKEY, UIDHash, rand)
+	// HASH(entry[n]) := Hash(TYPE | NONCE | HashID | CrUID | UIDIndex | Hash(entry[n-1]))
+	e := make([]byte, EntryByteLen)
+	copy(e[32:], Type)
+	copy(e[33:], nonce)
+	copy(e[41:], hashID)
+	copy(e[73:], crUID)
+	copy(e[121:], UIDIndex)
+	h := make([]byte, EntryByteLen)
+	copy(h, e[32:])
+	copy(h[121:], prevHash)
+	copy(e, cipher.SHA256(h))
+	// Publish: HASH(entry[n]) | TYPE | NONCE | HashID | CrUID | UIDIndex
+	return base64.Encode(e), nil
+}
@@ -7,6 +7,9 @@ package hashchain
 import (
 	"bytes"
 	"testing"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/cipher/aes256"
 )
 
 func TestSplitEntry(t *testing.T) {
@@ -18,3 +21,48 @@ func TestSplitEntry(t *testing.T) {
 		t.Error("typ != 0x01")
 	}
 }
+
+func TestNewEntry(t *testing.T) {
+	UIDHash := cipher.SHA256([]byte("uid message"))
+	UIDIndex := cipher.SHA256(UIDHash)
+	first, err := NewEntry("alice@mute.berlin", UIDHash, UIDIndex, nil,
+		cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, _, nonce, hashID, crUID, uidIndex, err := SplitEntry(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(uidIndex, UIDIndex) {
+		t.Error("UIDIndex differs")
+	}
+	k1, k2 := cipher.CKDF(nonce)
+	if !bytes.Equal(hashID, cipher.SHA256(append(k1, []byte("alice@mute.berlin")...))) {
+		t.Error("HashID differs")
+	}
+	IDKEY := cipher.SHA256(append(k2, []byte("alice@mute.berlin")...))
+	if !bytes.Equal(aes256.CBCDecrypt(IDKEY, crUID), UIDHash) {
+		t.Error("CrUID does not decrypt to UIDHash")
+	}
+	second, err := NewEntry("bob@mute.berlin", UIDHash, UIDIndex, hash,
+		cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash2, typ, nonce, hashID, crUID, uidIndex, err := SplitEntry(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 0, EntryByteLen)
+	for _, b := range [][]byte{typ, nonce, hashID, crUID, uidIndex, hash} {
+		buf = append(buf, b...)
+	}
+	if !bytes.Equal(hash2, cipher.SHA256(buf)) {
+		t.Error("entry is not linked to previous entry")
+	}
+	if _, err := NewEntry("bob@mute.berlin", UIDHash, UIDIndex[1:], hash,
+		cipher.RandReader); err == nil {
+		t.Error("should fail")
+	}
+}
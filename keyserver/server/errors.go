@@ -0,0 +1,46 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+)
+
+// ErrUnknownSigPubKey is raised when a signature public key does not belong
+// to the current UID message of a registered identity.
+var ErrUnknownSigPubKey = errors.New("server: unknown signature public key")
+
+// ErrIdentityKnown is raised when a UID message is created for an identity
+// which has been registered already.
+var ErrIdentityKnown = errors.New("server: identity already registered")
+
+// ErrIdentityUnknown is raised when a UID message is updated for an identity
+// which has not been registered yet.
+var ErrIdentityUnknown = errors.New("server: identity not registered")
+
+// ErrWrongDomain is raised when an identity does not belong to the domain
+// served by the key server.
+var ErrWrongDomain = errors.New("server: identity domain not served by key server")
+
+// ErrReservedLocalpart is raised when a UID message claims a reserved
+// identity.
+var ErrReservedLocalpart = errors.New("server: identity is reserved")
+
+// ErrLastEntry is raised when the LASTENTRY of a UID message is not part of
+// the key hashchain.
+var ErrLastEntry = errors.New("server: LASTENTRY unknown")
+
+// ErrNoKeyInit is raised when no KeyInit message is available.
+var ErrNoKeyInit = errors.New("server: no KeyInit message available")
+
+// ErrNonce is raised when the nonce of a FlushKeyInit call is not fresh.
+var ErrNonce = errors.New("server: nonce is not fresh")
+
+// ErrChainLink is raised when the CHAINLINK of a UID message cannot be
+// verified by the key server.
+var ErrChainLink = errors.New("server: chain link cannot be verified")
+
+// ErrNoLink is raised when no AUTHORITATIVE link for a domain exists.
+var ErrNoLink = errors.New("server: no authoritative link for domain")
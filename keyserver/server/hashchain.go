@@ -0,0 +1,122 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net/http"
+
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid/identity"
+)
+
+// KeyHashchain implements the KeyHashchain JSON-RPC service.
+type KeyHashchain struct {
+	ks *KeyServer
+}
+
+// LastHashChainReply is the reply of KeyHashchain.FetchLastHashChain.
+type LastHashChainReply struct {
+	HCEntry string
+	HCPos   uint64
+}
+
+// FetchLastHashChain returns the last entry of the key hashchain and its
+// position.
+func (kh *KeyHashchain) FetchLastHashChain(
+	r *http.Request,
+	args *EmptyArgs,
+	reply *LastHashChainReply,
+) error {
+	pos, entry, found, err := kh.ks.st.lastHashChainEntry()
+	if err != nil {
+		return err
+	}
+	if !found {
+		return log.Error("server: key hashchain is empty")
+	}
+	reply.HCEntry = entry
+	reply.HCPos = pos
+	return nil
+}
+
+// FetchHashChainArgs are the arguments of KeyHashchain.FetchHashChain.
+type FetchHashChainArgs struct {
+	StartPosition uint64
+	EndPosition   uint64 // optional, defaults to StartPosition
+}
+
+// FetchHashChainReply is the reply of KeyHashchain.FetchHashChain.
+type FetchHashChainReply struct {
+	HCEntries  []string
+	HCFirstPos uint64
+}
+
+// FetchHashChain returns the key hashchain entries from StartPosition to
+// EndPosition (inclusive). EndPosition is truncated to the last position of
+// the key hashchain. If StartPosition does not exist yet, only the last entry
+// is returned (HCFirstPos is set accordingly).
+func (kh *KeyHashchain) FetchHashChain(
+	r *http.Request,
+	args *FetchHashChainArgs,
+	reply *FetchHashChainReply,
+) error {
+	last, _, found, err := kh.ks.st.lastHashChainEntry()
+	if err != nil {
+		return err
+	}
+	if !found {
+		return log.Error("server: key hashchain is empty")
+	}
+	start := args.StartPosition
+	if start > last {
+		// position does not exist yet -> return last entry
+		start = last
+	}
+	end := args.EndPosition
+	if end < start {
+		end = start
+	}
+	if end > last {
+		end = last
+	}
+	entries, err := kh.ks.st.hashChainEntries(start, end)
+	if err != nil {
+		return err
+	}
+	reply.HCEntries = entries
+	reply.HCFirstPos = start
+	return nil
+}
+
+// LookupUIDArgs are the arguments of KeyHashchain.LookupUID.
+type LookupUIDArgs struct {
+	Identity string
+}
+
+// LookupUIDReply is the reply of KeyHashchain.LookupUID.
+type LookupUIDReply struct {
+	HCPositions []uint64
+}
+
+// LookupUID returns all key hashchain positions for the given identity.
+func (kh *KeyHashchain) LookupUID(
+	r *http.Request,
+	args *LookupUIDArgs,
+	reply *LookupUIDReply,
+) error {
+	id, _, err := identity.MapPlus(args.Identity)
+	if err != nil {
+		return err
+	}
+	positions, err := kh.ks.st.lookupUID(id)
+	if err != nil {
+		return err
+	}
+	if len(positions) == 0 {
+		return log.Errorf("server: identity '%s' not found", id)
+	}
+	reply.HCPositions = positions
+	return nil
+}
@@ -0,0 +1,207 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/rand"
+	"math/big"
+	"net/http"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid"
+	"github.com/mutecomm/mute/util/times"
+)
+
+// NonceWindow defines the maximum number of seconds the nonce of a
+// FlushKeyInit call can differ from the current time.
+const NonceWindow = 5 * 60 // five minutes
+
+// KeyInitRepository implements the KeyInitRepository JSON-RPC service.
+type KeyInitRepository struct {
+	ks *KeyServer
+}
+
+// AddKeyInitArgs are the arguments of KeyInitRepository.AddKeyInit.
+type AddKeyInitArgs struct {
+	SigPubKey string
+	KeyInits  []*uid.KeyInit
+	Tokens    []string // payment tokens (ignored)
+}
+
+// AddKeyInitReply is the reply of KeyInitRepository.AddKeyInit.
+type AddKeyInitReply struct {
+	Signatures []string
+}
+
+// AddKeyInit adds the given KeyInit messages for SigPubKey to the KeyInit
+// repository and returns the server signatures on them.
+func (kir *KeyInitRepository) AddKeyInit(
+	r *http.Request,
+	args *AddKeyInitArgs,
+	reply *AddKeyInitReply,
+) error {
+	// SigPubKey must belong to the current UID message of an identity
+	msg, err := kir.ks.st.sigPubKeyUID(args.SigPubKey)
+	if err != nil {
+		return err
+	}
+	sigKeyHash, err := msg.SigKeyHash()
+	if err != nil {
+		return err
+	}
+	// verify all KeyInit messages before storing any of them
+	for _, ki := range args.KeyInits {
+		if ki == nil {
+			return log.Error("server: KeyInit missing")
+		}
+		if err := ki.Check(); err != nil {
+			return err
+		}
+		if ki.SigKeyHash() != sigKeyHash {
+			return log.Error("server: SIGKEYHASH does not match SigPubKey")
+		}
+		if err := ki.Verify([]string{kir.ks.domain}, args.SigPubKey); err != nil {
+			return err
+		}
+	}
+	for _, ki := range args.KeyInits {
+		if err := kir.ks.st.addKeyInit(ki); err != nil {
+			return err
+		}
+		reply.Signatures = append(reply.Signatures, ki.Sign(kir.ks.sigKey))
+	}
+	return nil
+}
+
+// FetchKeyInitArgs are the arguments of KeyInitRepository.FetchKeyInit.
+type FetchKeyInitArgs struct {
+	SigKeyHash string
+}
+
+// FetchKeyInitReply is the reply of KeyInitRepository.FetchKeyInit.
+type FetchKeyInitReply struct {
+	KeyInit string // JSON encoded KeyInit message
+}
+
+// biased returns true, if a random value 0 <= r < m is larger than the
+// remaining lifetime n.
+func biased(n, m uint64) (bool, error) {
+	if m == 0 {
+		return false, nil
+	}
+	r, err := rand.Int(cipher.RandReader, new(big.Int).SetUint64(m))
+	if err != nil {
+		return false, log.Error(err)
+	}
+	return r.Uint64() > n, nil
+}
+
+// FetchKeyInit returns a KeyInit message for the given SigKeyHash according
+// to the dispersing mechanism described in doc/keyserver.md.
+func (kir *KeyInitRepository) FetchKeyInit(
+	r *http.Request,
+	args *FetchKeyInitArgs,
+	reply *FetchKeyInitReply,
+) error {
+	kir.ks.mutex.Lock()
+	defer kir.ks.mutex.Unlock()
+	now := uint64(times.Now())
+	if err := kir.ks.st.delExpiredKeyInits(now); err != nil {
+		return err
+	}
+	entries, err := kir.ks.st.getKeyInits(args.SigKeyHash, now)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return log.Error(ErrNoKeyInit)
+	}
+	// no fallback: return the non-fallback key with the least remaining
+	// lifetime and delete it immediately
+	for _, e := range entries {
+		if !e.fallback {
+			if err := kir.ks.st.delKeyInit(e.id); err != nil {
+				return err
+			}
+			reply.KeyInit = e.keyInit
+			return nil
+		}
+	}
+	// fallback: select a random key, biased by remaining lifetime
+	var m uint64
+	for _, e := range entries {
+		if e.notafter-now > m {
+			m = e.notafter - now
+		}
+	}
+	selected := entries[0] // key with least remaining lifetime
+	for _, e := range entries {
+		ok, err := biased(e.notafter-now, m)
+		if err != nil {
+			return err
+		}
+		if ok {
+			selected = e
+			break
+		}
+	}
+	// delete fallback key only if other valid keys remain
+	if len(entries) > 1 {
+		del, err := biased(selected.notafter-now, m)
+		if err != nil {
+			return err
+		}
+		if del {
+			if err := kir.ks.st.delKeyInit(selected.id); err != nil {
+				return err
+			}
+		}
+	}
+	reply.KeyInit = selected.keyInit
+	return nil
+}
+
+// FlushKeyInitArgs are the arguments of KeyInitRepository.FlushKeyInit.
+type FlushKeyInitArgs struct {
+	SigPubKey           string
+	Nonce               uint64
+	Signature           string
+	SessionAnchorHashes []string // optional: only flush these KeyInits
+}
+
+// FlushKeyInit deletes all KeyInit messages for SigPubKey. If
+// SessionAnchorHashes is given, only the KeyInit messages with the
+// corresponding SESSIONANCHORHASH are deleted (e.g., consumed single-use
+// KeyInit messages). The call must be authenticated by a Signature over Nonce
+// (the current unixtime).
+func (kir *KeyInitRepository) FlushKeyInit(
+	r *http.Request,
+	args *FlushKeyInitArgs,
+	reply *EmptyArgs,
+) error {
+	if err := uid.VerifyNonce(args.SigPubKey, args.Nonce, args.Signature); err != nil {
+		return err
+	}
+	now := uint64(times.Now())
+	if args.Nonce+NonceWindow < now || args.Nonce > now+NonceWindow {
+		return log.Error(ErrNonce)
+	}
+	msg, err := kir.ks.st.sigPubKeyUID(args.SigPubKey)
+	if err != nil {
+		return err
+	}
+	sigKeyHash, err := msg.SigKeyHash()
+	if err != nil {
+		return err
+	}
+	kir.ks.mutex.Lock()
+	defer kir.ks.mutex.Unlock()
+	if len(args.SessionAnchorHashes) > 0 {
+		return kir.ks.st.flushKeyInitsByAnchor(sigKeyHash,
+			args.SessionAnchorHashes)
+	}
+	return kir.ks.st.flushKeyInits(sigKeyHash)
+}
@@ -0,0 +1,217 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net/http"
+
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid"
+	"github.com/mutecomm/mute/uid/identity"
+)
+
+// AddPeer makes the key server peer known. The key hashchains of peers can be
+// linked with the key hashchain of ks, AUTHORITATIVE chain links to peers are
+// verified by querying the peer directly. AddPeer must be called before ks
+// serves requests.
+func (ks *KeyServer) AddPeer(peer *KeyServer) {
+	if ks.peers == nil {
+		ks.peers = make(map[string]*KeyServer)
+	}
+	ks.peers[peer.domain] = peer
+}
+
+// peer returns the peer key server for the given URI.
+func (ks *KeyServer) peer(uri string) (*KeyServer, error) {
+	peer, ok := ks.peers[uri]
+	if !ok {
+		return nil, log.Errorf("server: unknown key hashchain URI: %s", uri)
+	}
+	return peer, nil
+}
+
+// verifyLast verifies that link.LAST is an entry of the key hashchains of all
+// peers in link.URI.
+func (ks *KeyServer) verifyLast(link *uid.ChainLink) error {
+	for _, uri := range link.URI {
+		peer, err := ks.peer(uri)
+		if err != nil {
+			return err
+		}
+		known, err := peer.st.hasHashChainEntry(link.LAST)
+		if err != nil {
+			return err
+		}
+		if !known {
+			return log.Error(ErrChainLink)
+		}
+	}
+	return nil
+}
+
+// verifyConnected verifies that msg is a connected identity of the current
+// UID message for link.IDENTITY on the peer key server which serves it.
+func (ks *KeyServer) verifyConnected(msg *uid.Message) error {
+	link := msg.UIDContent.CHAINLINK
+	_, domain, err := identity.Split(link.IDENTITY)
+	if err != nil {
+		return log.Error(err)
+	}
+	peer, err := ks.peer(domain)
+	if err != nil {
+		return err
+	}
+	origin, err := peer.st.getUID(link.IDENTITY)
+	if err != nil {
+		return err
+	}
+	if origin == nil {
+		return log.Error(ErrChainLink)
+	}
+	return msg.VerifyConnected(origin)
+}
+
+// verifyChainLink verifies the CHAINLINK of the UID message msg submitted by
+// a user (see "Linking chains and key repositories" in doc/keyserver.md).
+// AUTHORITATIVE links are only accepted via AddLink.
+func (ks *KeyServer) verifyChainLink(msg *uid.Message) error {
+	link := msg.UIDContent.CHAINLINK
+	switch link.Type() {
+	case uid.NoLink:
+		return nil
+	case uid.VerificationBinding:
+		if link.AUTHORITATIVE {
+			return ks.verifyLast(link)
+		}
+		return nil
+	case uid.ConnectedIdentity:
+		if link.AUTHORITATIVE {
+			if err := ks.verifyLast(link); err != nil {
+				return err
+			}
+			return ks.verifyConnected(msg)
+		}
+		// the identity must have been connected successfully before
+		prev, err := ks.st.getUIDs(msg.UIDContent.IDENTITY)
+		if err != nil {
+			return err
+		}
+		for _, p := range prev {
+			l := p.UIDContent.CHAINLINK
+			if l.Type() == uid.ConnectedIdentity && l.AUTHORITATIVE &&
+				l.IDENTITY == link.IDENTITY {
+				return nil
+			}
+		}
+		return log.Error(ErrChainLink)
+	default:
+		return log.Error(ErrChainLink)
+	}
+}
+
+// NewAuthoritativeLink returns a new AUTHORITATIVE link entry for the key
+// server ks which can be added to the key hashchain of another key server
+// with AddLink. lastEntry is the last key hashchain entry of the other key
+// server.
+func (ks *KeyServer) NewAuthoritativeLink(lastEntry string) (*uid.Message, error) {
+	_, last, _, err := ks.st.lastHashChainEntry()
+	if err != nil {
+		return nil, err
+	}
+	link := &uid.ChainLink{
+		URI:           []string{ks.domain},
+		LAST:          last,
+		AUTHORITATIVE: true,
+		DOMAINS:       []string{ks.domain},
+		IDENTITY:      ks.uid.UIDContent.IDENTITY,
+	}
+	return ks.uid.Connect(ks.uid.UIDContent.IDENTITY, lastEntry, link)
+}
+
+// AddLink adds the AUTHORITATIVE link entry msg (see NewAuthoritativeLink)
+// to the key hashchain. Calling AddLink represents the manual verification
+// of the key server operator, the key server signs the entry with its
+// signature key (LINKAUTHORITY).
+func (ks *KeyServer) AddLink(msg *uid.Message) (*uid.MessageReply, error) {
+	if err := msg.Check(); err != nil {
+		return nil, err
+	}
+	link := msg.UIDContent.CHAINLINK
+	if link.Type() != uid.AuthoritativeLink {
+		return nil, log.Error(ErrChainLink)
+	}
+	if err := msg.VerifySelfSig(); err != nil {
+		return nil, err
+	}
+	known, err := ks.st.hasHashChainEntry(msg.UIDContent.LASTENTRY)
+	if err != nil {
+		return nil, err
+	}
+	if !known {
+		return nil, log.Error(ErrLastEntry)
+	}
+	if err := ks.verifyLast(link); err != nil {
+		return nil, err
+	}
+	if err := ks.verifyConnected(msg); err != nil {
+		return nil, err
+	}
+	// DOMAINS made known by a link may not be claimed by future links
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	for _, domain := range link.DOMAINS {
+		if domain == ks.domain {
+			return nil, log.Error(ErrChainLink)
+		}
+		prev, _, err := ks.st.authoritativeLink(domain)
+		if err != nil {
+			return nil, err
+		}
+		if prev != nil {
+			return nil, log.Errorf("server: domain %s already linked", domain)
+		}
+	}
+	prev, err := ks.st.getUID(msg.UIDContent.IDENTITY)
+	if err != nil {
+		return nil, err
+	}
+	if prev != nil {
+		return nil, log.Error(ErrIdentityKnown)
+	}
+	if err := msg.SignLinkAuthority(ks.sigKey); err != nil {
+		return nil, err
+	}
+	return ks.addUID(msg)
+}
+
+// GetLinkArgs are the arguments of KeyRepository.GetLink.
+type GetLinkArgs struct {
+	Domain string
+}
+
+// GetLinkReply is the reply of KeyRepository.GetLink.
+type GetLinkReply struct {
+	Identity string
+	Position uint64
+}
+
+// GetLink returns the identity and position of the first AUTHORITATIVE entry
+// for the chain link to the given domain.
+func (kr *KeyRepository) GetLink(
+	r *http.Request,
+	args *GetLinkArgs,
+	reply *GetLinkReply,
+) error {
+	msg, pos, err := kr.ks.st.authoritativeLink(identity.MapDomain(args.Domain))
+	if err != nil {
+		return err
+	}
+	if msg == nil {
+		return log.Error(ErrNoLink)
+	}
+	reply.Identity = msg.UIDContent.IDENTITY
+	reply.Position = pos
+	return nil
+}
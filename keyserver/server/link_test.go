@@ -0,0 +1,157 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/uid"
+	"github.com/mutecomm/mute/util/jsonclient"
+)
+
+func TestLink(t *testing.T) {
+	tmpdir, ks, err := createServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer ks.Close()
+	peerdir, peer, err := createDomainServer("mute.one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(peerdir)
+	defer peer.Close()
+	ks.AddPeer(peer)
+	peer.AddPeer(ks)
+	srv := httptest.NewServer(ks)
+	defer srv.Close()
+	client, err := jsonclient.New(srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no link yet
+	content := map[string]interface{}{"Domain": "mute.one"}
+	if _, err := client.JSONRPCRequest("KeyRepository.GetLink", content); err == nil {
+		t.Error("should fail")
+	}
+
+	// AUTHORITATIVE link from peer
+	_, last, _, err := ks.st.lastHashChainEntry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := peer.NewAuthoritativeLink(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// AUTHORITATIVE links are not accepted from users
+	content = map[string]interface{}{"UIDMessage": link, "Token": ""}
+	if _, err := client.JSONRPCRequest("KeyRepository.CreateUID", content); err == nil {
+		t.Error("should fail")
+	}
+	msgReply, err := ks.AddLink(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := link.VerifyLinkAuthority(ks.SigPubKey()); err != nil {
+		t.Error(err)
+	}
+	if _, err := ks.AddLink(link); err == nil {
+		t.Error("domain should already be linked")
+	}
+	content = map[string]interface{}{"Domain": "mute.one"}
+	reply, err := client.JSONRPCRequest("KeyRepository.GetLink", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply["Identity"].(string) != "keyserver@mute.one" {
+		t.Error("wrong link identity")
+	}
+	if uint64(reply["Position"].(float64)) != msgReply.ENTRY.HASHCHAINPOS {
+		t.Error("wrong link position")
+	}
+
+	// connected identity: alice@mute.one is connected to alice@mute.berlin
+	_, last, _, err = ks.st.lastHashChainEntry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := uid.Create("alice@mute.berlin", false, "", "", uid.Strict,
+		last, nil, 0, 0, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.addUID(alice); err != nil {
+		t.Fatal(err)
+	}
+	_, last, _, err = ks.st.lastHashChainEntry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, peerLast, _, err := peer.st.lastHashChainEntry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	con, err := alice.Connect("alice@mute.one", peerLast, &uid.ChainLink{
+		URI:           []string{"mute.berlin"},
+		LAST:          last,
+		AUTHORITATIVE: true,
+		IDENTITY:      "alice@mute.berlin",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr := &KeyRepository{ks: peer}
+	if err := pr.CreateUID(nil, &UIDArgs{UIDMessage: con}, &UIDMessageReply{}); err != nil {
+		t.Fatal(err)
+	}
+	// non-authoritative update of the connected identity
+	up, err := con.Link(cipher.RandReader, &uid.ChainLink{
+		URI:      []string{"mute.berlin"},
+		LAST:     last,
+		IDENTITY: "alice@mute.berlin",
+	}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pr.UpdateUID(nil, &UIDArgs{UIDMessage: up}, &UIDMessageReply{}); err != nil {
+		t.Fatal(err)
+	}
+	// connecting to an unknown identity fails
+	bob, err := uid.Create("bob@mute.berlin", false, "", "", uid.Strict,
+		last, nil, 0, 0, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	con, err = bob.Connect("bob@mute.one", peerLast, &uid.ChainLink{
+		URI:           []string{"mute.berlin"},
+		LAST:          last,
+		AUTHORITATIVE: true,
+		IDENTITY:      "bob@mute.berlin",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pr.CreateUID(nil, &UIDArgs{UIDMessage: con}, &UIDMessageReply{}); err == nil {
+		t.Error("unknown identity should fail")
+	}
+	// non-authoritative connection without previous authoritative one fails
+	con, err = alice.Connect("carol@mute.one", peerLast, &uid.ChainLink{
+		URI:      []string{"mute.berlin"},
+		LAST:     last,
+		IDENTITY: "alice@mute.berlin",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pr.CreateUID(nil, &UIDArgs{UIDMessage: con}, &UIDMessageReply{}); err != ErrChainLink {
+		t.Error("should fail")
+	}
+}
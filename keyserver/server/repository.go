@@ -0,0 +1,225 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mutecomm/mute/keyserver/capabilities"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid"
+	"github.com/mutecomm/mute/uid/identity"
+	"github.com/mutecomm/mute/util/times"
+)
+
+// Rollover defines the maximum number of seconds the NOTAFTER field of a new
+// UID message can be in the future.
+const Rollover = uint64(365 * 24 * 60 * 60) // one year
+
+// methods contains all methods implemented by the key server.
+var methods = []string{
+	"KeyRepository.Capabilities",
+	"KeyRepository.FetchUID",
+	"KeyRepository.CreateUID",
+	"KeyRepository.UpdateUID",
+	"KeyRepository.GetLink",
+	"KeyHashchain.FetchHashChain",
+	"KeyHashchain.FetchLastHashChain",
+	"KeyHashchain.LookupUID",
+	"KeyInitRepository.AddKeyInit",
+	"KeyInitRepository.FetchKeyInit",
+	"KeyInitRepository.FlushKeyInit",
+}
+
+// EmptyArgs are the arguments of JSON-RPC methods without parameters.
+type EmptyArgs struct{}
+
+// KeyRepository implements the KeyRepository JSON-RPC service.
+type KeyRepository struct {
+	ks *KeyServer
+}
+
+// CapabilitiesReply is the reply of KeyRepository.Capabilities.
+type CapabilitiesReply struct {
+	CAPABILITIES *capabilities.Capabilities
+	SIGNATURE    string // signature over CAPABILITIES by key server
+}
+
+// Capabilities returns the capabilities of the key server.
+func (kr *KeyRepository) Capabilities(
+	r *http.Request,
+	args *EmptyArgs,
+	reply *CapabilitiesReply,
+) error {
+	_, entry, _, err := kr.ks.st.lastHashChainEntry()
+	if err != nil {
+		return err
+	}
+	caps := &capabilities.Capabilities{
+		METHODS:               methods,
+		DOMAINS:               []string{kr.ks.domain},
+		KEYREPOSITORYURIS:     []string{kr.ks.domain},
+		KEYINITREPOSITORYURIS: []string{kr.ks.domain},
+		KEYHASHCHAINURIS:      []string{kr.ks.domain},
+		KEYHASHCHAINENTRY:     entry,
+		SIGPUBKEYS:            []string{kr.ks.SigPubKey()},
+	}
+	jsn, err := json.Marshal(caps)
+	if err != nil {
+		return log.Error(err)
+	}
+	reply.CAPABILITIES = caps
+	reply.SIGNATURE = kr.ks.sign(jsn)
+	return nil
+}
+
+// FetchUIDArgs are the arguments of KeyRepository.FetchUID.
+type FetchUIDArgs struct {
+	UIDIndex string // base64 encoded
+}
+
+// UIDMessageReply is the reply of all KeyRepository methods which return a
+// UIDMessageReply.
+type UIDMessageReply struct {
+	UIDMessageReply *uid.MessageReply
+}
+
+// FetchUID returns the encrypted UID message reply specified by UIDIndex.
+func (kr *KeyRepository) FetchUID(
+	r *http.Request,
+	args *FetchUIDArgs,
+	reply *UIDMessageReply,
+) error {
+	msgReply, err := kr.ks.st.getUIDReply(args.UIDIndex)
+	if err != nil {
+		return err
+	}
+	reply.UIDMessageReply = msgReply
+	return nil
+}
+
+// UIDArgs are the arguments of KeyRepository.CreateUID and
+// KeyRepository.UpdateUID.
+type UIDArgs struct {
+	UIDMessage *uid.Message
+	Token      string // payment token (ignored)
+}
+
+// verify performs the key server checks which are common for created and
+// updated UID messages.
+func (kr *KeyRepository) verify(msg *uid.Message) error {
+	if msg == nil {
+		return log.Error("server: UIDMessage missing")
+	}
+	// verify that the UIDMessage is well-formed
+	if err := msg.Check(); err != nil {
+		return err
+	}
+	// verify that the domain of the IDENTITY is served
+	lp, domain, err := identity.Split(msg.UIDContent.IDENTITY)
+	if err != nil {
+		return log.Error(err)
+	}
+	if domain != kr.ks.domain {
+		return log.Error(ErrWrongDomain)
+	}
+	// verify that the localpart is allowed
+	if lp == "keyserver" {
+		return log.Error(ErrReservedLocalpart)
+	}
+	// verify self-signature
+	if err := msg.VerifySelfSig(); err != nil {
+		return err
+	}
+	// verify CHAINLINK
+	if err := kr.ks.verifyChainLink(msg); err != nil {
+		return err
+	}
+	// verify that LASTENTRY is valid for this keyserver
+	known, err := kr.ks.st.hasHashChainEntry(msg.UIDContent.LASTENTRY)
+	if err != nil {
+		return err
+	}
+	if !known {
+		return log.Error(ErrLastEntry)
+	}
+	// verify that NOTBEFORE and NOTAFTER are valid
+	now := uint64(times.Now())
+	if msg.UIDContent.NOTBEFORE >= msg.UIDContent.NOTAFTER {
+		return log.Error(uid.ErrInvalidTimes)
+	}
+	if msg.UIDContent.NOTAFTER < now {
+		return log.Error(uid.ErrExpired)
+	}
+	if msg.UIDContent.NOTAFTER > now+Rollover {
+		return log.Error(uid.ErrFuture)
+	}
+	return nil
+}
+
+// CreateUID adds the UID message to the key hashchain and key repository, if
+// the identity is not known yet.
+func (kr *KeyRepository) CreateUID(
+	r *http.Request,
+	args *UIDArgs,
+	reply *UIDMessageReply,
+) error {
+	msg := args.UIDMessage
+	if err := kr.verify(msg); err != nil {
+		return err
+	}
+	kr.ks.mutex.Lock()
+	defer kr.ks.mutex.Unlock()
+	prev, err := kr.ks.st.getUID(msg.UIDContent.IDENTITY)
+	if err != nil {
+		return err
+	}
+	if prev != nil {
+		return log.Error(ErrIdentityKnown)
+	}
+	if msg.UIDContent.MSGCOUNT != 0 {
+		return log.Error("server: MSGCOUNT of new UID message must be 0")
+	}
+	msgReply, err := kr.ks.addUID(msg)
+	if err != nil {
+		return err
+	}
+	reply.UIDMessageReply = msgReply
+	return nil
+}
+
+// UpdateUID updates the UID message for an identity, if the signatures on the
+// new UID message match the keys in the previous UID message.
+func (kr *KeyRepository) UpdateUID(
+	r *http.Request,
+	args *UIDArgs,
+	reply *UIDMessageReply,
+) error {
+	msg := args.UIDMessage
+	if err := kr.verify(msg); err != nil {
+		return err
+	}
+	kr.ks.mutex.Lock()
+	defer kr.ks.mutex.Unlock()
+	prev, err := kr.ks.st.getUID(msg.UIDContent.IDENTITY)
+	if err != nil {
+		return err
+	}
+	if prev == nil {
+		return log.Error(ErrIdentityUnknown)
+	}
+	// verify USERSIGNATURE or ESCROWSIGNATURE (also checks that MSGCOUNT was
+	// increased by one)
+	if err := msg.VerifyUserSig(prev); err != nil {
+		return err
+	}
+	msgReply, err := kr.ks.addUID(msg)
+	if err != nil {
+		return err
+	}
+	reply.UIDMessageReply = msgReply
+	return nil
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package server implements a local stand-in for the Mute key server.
+//
+// It implements the JSON-RPC API described in
+// https://github.com/mutecomm/mute/blob/master/doc/keyserver.md#api on top of
+// an encrypted database (see package encdb). The key server serves a single
+// domain and starts its key hashchain with its own self-signed UIDMessage
+// (identity keyserver@domain), which also contains the signature key used to
+// sign all replies.
+//
+// The stand-in is meant for running full mutecrypt/mutectrl flows against
+// localhost, it does not enforce payment tokens. Chain links (see
+// uid.ChainLink) can only be verified for key servers made known with
+// AddPeer.
+package server
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/rpc/v2"
+	"github.com/gorilla/rpc/v2/json2"
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/keyserver/hashchain"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid"
+	"github.com/mutecomm/mute/uid/identity"
+)
+
+// KeyServer is a local key server for a single domain.
+type KeyServer struct {
+	mutex  sync.Mutex // serializes all modifications of the key hashchain
+	st     *store
+	domain string
+	uid    *uid.Message          // UID message of the key server itself
+	sigKey *cipher.Ed25519Key    // signature key of the key server
+	peers  map[string]*KeyServer // linkable key servers (see AddPeer)
+	rpc    *rpc.Server
+}
+
+// Create creates a new key server database with the given dbname for the
+// given domain. It is encrypted by passphrase (processed by a KDF with iter
+// many iterations). Create generates the UID message of the key server and
+// adds it as the first entry to the key hashchain.
+func Create(dbname string, passphrase []byte, iter int, domain string) error {
+	dmn := identity.MapDomain(domain)
+	if err := createStore(dbname, passphrase, iter); err != nil {
+		return err
+	}
+	st, err := openStore(dbname, passphrase)
+	if err != nil {
+		return err
+	}
+	defer st.close()
+	// generate key server UID (the first entry in the hash chain has no
+	// LASTENTRY)
+	msg, err := uid.Create("keyserver@"+dmn, false, "", "", uid.Strict, "", nil, 0, 0,
+		cipher.RandReader)
+	if err != nil {
+		return err
+	}
+	if err := st.addValue(domainKey, dmn); err != nil {
+		return err
+	}
+	if err := st.addValue(uidKey, string(msg.JSON())); err != nil {
+		return err
+	}
+	if err := st.addValue(privSigKey, msg.PrivateSigKey()); err != nil {
+		return err
+	}
+	ks, err := newKeyServer(st)
+	if err != nil {
+		return err
+	}
+	_, err = ks.addUID(msg)
+	return err
+}
+
+// Open opens the key server database with dbname and passphrase and returns
+// the corresponding key server.
+func Open(dbname string, passphrase []byte) (*KeyServer, error) {
+	st, err := openStore(dbname, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	ks, err := newKeyServer(st)
+	if err != nil {
+		st.close()
+		return nil, err
+	}
+	return ks, nil
+}
+
+func newKeyServer(st *store) (*KeyServer, error) {
+	var ks KeyServer
+	var err error
+	ks.st = st
+	ks.domain, err = st.getValue(domainKey)
+	if err != nil {
+		return nil, err
+	}
+	jsn, err := st.getValue(uidKey)
+	if err != nil {
+		return nil, err
+	}
+	ks.uid, err = uid.NewJSON(jsn)
+	if err != nil {
+		return nil, err
+	}
+	privkey, err := st.getValue(privSigKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := ks.uid.SetPrivateSigKey(privkey); err != nil {
+		return nil, err
+	}
+	key, err := base64.Decode(privkey)
+	if err != nil {
+		return nil, err
+	}
+	pubkey, err := base64.Decode(ks.uid.SigPubKey())
+	if err != nil {
+		return nil, err
+	}
+	ks.sigKey = new(cipher.Ed25519Key)
+	if err := ks.sigKey.SetPrivateKey(key); err != nil {
+		return nil, err
+	}
+	if err := ks.sigKey.SetPublicKey(pubkey); err != nil {
+		return nil, err
+	}
+	// register JSON-RPC services
+	ks.rpc = rpc.NewServer()
+	ks.rpc.RegisterCodec(json2.NewCodec(), "application/json")
+	if err := ks.rpc.RegisterService(&KeyRepository{ks: &ks}, ""); err != nil {
+		return nil, log.Error(err)
+	}
+	if err := ks.rpc.RegisterService(&KeyHashchain{ks: &ks}, ""); err != nil {
+		return nil, log.Error(err)
+	}
+	if err := ks.rpc.RegisterService(&KeyInitRepository{ks: &ks}, ""); err != nil {
+		return nil, log.Error(err)
+	}
+	return &ks, nil
+}
+
+// Close the key server and the underlying database.
+func (ks *KeyServer) Close() error {
+	return ks.st.close()
+}
+
+// Domain returns the domain served by the key server.
+func (ks *KeyServer) Domain() string {
+	return ks.domain
+}
+
+// UID returns the UID message of the key server.
+func (ks *KeyServer) UID() *uid.Message {
+	return ks.uid
+}
+
+// SigPubKey returns the base64 encoded public signature key of the key
+// server.
+func (ks *KeyServer) SigPubKey() string {
+	return ks.uid.SigPubKey()
+}
+
+// ServeHTTP implements the http.Handler interface and answers JSON-RPC
+// requests.
+func (ks *KeyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ks.rpc.ServeHTTP(w, r)
+}
+
+// addUID adds the UID message msg to the key hashchain and the key
+// repository and returns the signed reply. The caller has to verify msg and
+// hold ks.mutex.
+func (ks *KeyServer) addUID(msg *uid.Message) (*uid.MessageReply, error) {
+	UIDHash, UIDIndex, UIDMessageEncrypted := msg.Encrypt()
+	// determine position and previous hash
+	var prevHash []byte
+	pos, entry, found, err := ks.st.lastHashChainEntry()
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		prevHash, _, _, _, _, _, err = hashchain.SplitEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		pos++
+	}
+	// hcEntry, hcPos = hashchain_append(Identity, UIDHash, UIDIndex)
+	hcEntry, err := hashchain.NewEntry(msg.UIDContent.IDENTITY, UIDHash,
+		UIDIndex, prevHash, cipher.RandReader)
+	if err != nil {
+		return nil, err
+	}
+	reply := uid.CreateReply(UIDMessageEncrypted, hcEntry, pos, ks.sigKey)
+	if err := ks.st.addUID(msg, base64.Encode(UIDIndex), reply); err != nil {
+		return nil, err
+	}
+	log.Infof("server: added UID message for '%s' at HC#%d",
+		msg.UIDContent.IDENTITY, pos)
+	return reply, nil
+}
+
+// sign signs the given message with the key server signature key and returns
+// the base64 encoded signature.
+func (ks *KeyServer) sign(message []byte) string {
+	return base64.Encode(ks.sigKey.Sign(message))
+}
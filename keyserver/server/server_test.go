@@ -0,0 +1,318 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/keyserver/hashchain"
+	"github.com/mutecomm/mute/uid"
+	"github.com/mutecomm/mute/util/jsonclient"
+	"github.com/mutecomm/mute/util/times"
+)
+
+func createServer() (string, *KeyServer, error) {
+	return createDomainServer("mute.berlin")
+}
+
+func createDomainServer(domain string) (string, *KeyServer, error) {
+	tmpdir, err := ioutil.TempDir("", "keyserver_test")
+	if err != nil {
+		return "", nil, err
+	}
+	dbname := filepath.Join(tmpdir, "keyserver")
+	passphrase := []byte("passphrase")
+	if err := Create(dbname, passphrase, 64, domain); err != nil {
+		os.RemoveAll(tmpdir)
+		return "", nil, err
+	}
+	ks, err := Open(dbname, passphrase)
+	if err != nil {
+		os.RemoveAll(tmpdir)
+		return "", nil, err
+	}
+	return tmpdir, ks, nil
+}
+
+// decodeReply decodes the given JSON-RPC reply field into v.
+func decodeReply(reply map[string]interface{}, field string, v interface{}) error {
+	jsn, err := json.Marshal(reply[field])
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(jsn, v)
+}
+
+func TestKeyServer(t *testing.T) {
+	tmpdir, ks, err := createServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer ks.Close()
+	srv := httptest.NewServer(ks)
+	defer srv.Close()
+	client, err := jsonclient.New(srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// capabilities
+	reply, err := client.JSONRPCRequest("KeyRepository.Capabilities", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var caps struct {
+		DOMAINS    []string
+		SIGPUBKEYS []string
+	}
+	if err := decodeReply(reply, "CAPABILITIES", &caps); err != nil {
+		t.Fatal(err)
+	}
+	if len(caps.DOMAINS) != 1 || caps.DOMAINS[0] != "mute.berlin" {
+		t.Errorf("wrong domains: %v", caps.DOMAINS)
+	}
+	if len(caps.SIGPUBKEYS) != 1 || caps.SIGPUBKEYS[0] != ks.SigPubKey() {
+		t.Error("wrong signature public key")
+	}
+
+	// last hashchain entry is the key server UID
+	reply, err = client.JSONRPCRequest("KeyHashchain.FetchLastHashChain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastEntry, ok := reply["HCEntry"].(string)
+	if !ok {
+		t.Fatal("HCEntry is not a string")
+	}
+	if reply["HCPos"].(float64) != 0 {
+		t.Errorf("HCPos should be 0")
+	}
+
+	// create UID
+	msg, err := uid.Create("alice@mute.berlin", false, "", "", uid.Strict,
+		lastEntry, nil, 0, 0, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := map[string]interface{}{"UIDMessage": msg, "Token": ""}
+	reply, err = client.JSONRPCRequest("KeyRepository.CreateUID", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgReply uid.MessageReply
+	if err := decodeReply(reply, "UIDMessageReply", &msgReply); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgReply.VerifySrvSig(msg, caps.SIGPUBKEYS[0]); err != nil {
+		t.Fatal(err)
+	}
+	if msgReply.ENTRY.HASHCHAINPOS != 1 {
+		t.Errorf("HASHCHAINPOS should be 1")
+	}
+	// creating the same identity again must fail
+	if _, err := client.JSONRPCRequest("KeyRepository.CreateUID", content); err == nil {
+		t.Error("identity should already be known")
+	}
+	// identities of other domains are rejected
+	other, err := uid.Create("bob@example.com", false, "", "", uid.Strict,
+		lastEntry, nil, 0, 0, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content = map[string]interface{}{"UIDMessage": other, "Token": ""}
+	if _, err := client.JSONRPCRequest("KeyRepository.CreateUID", content); err == nil {
+		t.Error("foreign domain should be rejected")
+	}
+
+	// fetch UID
+	_, UIDIndex, _ := msg.Encrypt()
+	content = map[string]interface{}{"UIDIndex": UIDIndex}
+	reply, err = client.JSONRPCRequest("KeyRepository.FetchUID", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetched uid.MessageReply
+	if err := decodeReply(reply, "UIDMessageReply", &fetched); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetched.VerifySrvSig(msg, caps.SIGPUBKEYS[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// update UID
+	up, err := msg.Update(nil, 0, 0, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content = map[string]interface{}{"UIDMessage": up, "Token": ""}
+	if _, err := client.JSONRPCRequest("KeyRepository.UpdateUID", content); err != nil {
+		t.Fatal(err)
+	}
+
+	// lookup UID
+	content = map[string]interface{}{"Identity": "alice@mute.berlin"}
+	reply, err = client.JSONRPCRequest("KeyHashchain.LookupUID", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	positions := reply["HCPositions"].([]interface{})
+	if len(positions) != 2 {
+		t.Fatalf("wrong number of positions: %d", len(positions))
+	}
+
+	// fetch complete hashchain and verify links
+	content = map[string]interface{}{"StartPosition": 0, "EndPosition": 2}
+	reply, err = client.JSONRPCRequest("KeyHashchain.FetchHashChain", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := reply["HCEntries"].([]interface{})
+	if len(entries) != 3 {
+		t.Fatalf("wrong number of entries: %d", len(entries))
+	}
+	var prev []byte
+	for i, e := range entries {
+		hash, TYPE, NONCE, HashID, CrUID, UIDIndex, err :=
+			hashchain.SplitEntry(e.(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 {
+			buf := make([]byte, 0, 153)
+			buf = append(buf, TYPE...)
+			buf = append(buf, NONCE...)
+			buf = append(buf, HashID...)
+			buf = append(buf, CrUID...)
+			buf = append(buf, UIDIndex...)
+			buf = append(buf, prev...)
+			if string(cipher.SHA256(buf)) != string(hash) {
+				t.Errorf("HC#%d: invalid link", i)
+			}
+		}
+		prev = hash
+	}
+	// positions which do not exist yet return the last entry
+	for _, start := range []int{2, 3, 100} {
+		content = map[string]interface{}{"StartPosition": start,
+			"EndPosition": start + 1}
+		reply, err = client.JSONRPCRequest("KeyHashchain.FetchHashChain", content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := reply["HCEntries"].([]interface{})
+		if len(last) != 1 || last[0] != entries[2] {
+			t.Errorf("start position %d: last entry not returned", start)
+		}
+		if reply["HCFirstPos"].(float64) != 2 {
+			t.Errorf("start position %d: HCFirstPos should be 2", start)
+		}
+	}
+
+	// add KeyInit
+	now := uint64(times.Now())
+	ki, _, _, err := up.KeyInit(0, now+times.Day, now-1, false,
+		"mute.berlin", "", "", cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content = map[string]interface{}{
+		"SigPubKey": up.UIDContent.SIGKEY.PUBKEY,
+		"KeyInits":  []*uid.KeyInit{ki},
+		"Tokens":    []string{""},
+	}
+	reply, err = client.JSONRPCRequest("KeyInitRepository.AddKeyInit", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigs := reply["Signatures"].([]interface{})
+	if len(sigs) != 1 {
+		t.Fatal("wrong number of signatures")
+	}
+	if err := ki.VerifySrvSig(sigs[0].(string), caps.SIGPUBKEYS[0]); err != nil {
+		t.Fatal(err)
+	}
+	// the key of the outdated UID message is not accepted anymore
+	content["SigPubKey"] = msg.UIDContent.SIGKEY.PUBKEY
+	if _, err := client.JSONRPCRequest("KeyInitRepository.AddKeyInit", content); err == nil {
+		t.Error("outdated SigPubKey should be rejected")
+	}
+
+	// fetch KeyInit (non-fallback keys are deleted after the first fetch)
+	sigKeyHash, err := up.SigKeyHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content = map[string]interface{}{"SigKeyHash": sigKeyHash}
+	reply, err = client.JSONRPCRequest("KeyInitRepository.FetchKeyInit", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply["KeyInit"].(string) != string(ki.JSON()) {
+		t.Error("fetched KeyInit differs")
+	}
+	if _, err := client.JSONRPCRequest("KeyInitRepository.FetchKeyInit", content); err == nil {
+		t.Error("KeyInit should have been deleted")
+	}
+
+	// flush single KeyInit
+	ki1, _, _, err := up.KeyInit(0, now+times.Day, now-1, false,
+		"mute.berlin", "", "", cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ki2, _, _, err := up.KeyInit(0, now+2*times.Day, now-1, false,
+		"mute.berlin", "", "", cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content = map[string]interface{}{
+		"SigPubKey": up.UIDContent.SIGKEY.PUBKEY,
+		"KeyInits":  []*uid.KeyInit{ki1, ki2},
+		"Tokens":    []string{"", ""},
+	}
+	if _, err := client.JSONRPCRequest("KeyInitRepository.AddKeyInit", content); err != nil {
+		t.Fatal(err)
+	}
+	nonce, signature := up.SignNonce()
+	content = map[string]interface{}{
+		"SigPubKey":           up.UIDContent.SIGKEY.PUBKEY,
+		"Nonce":               nonce,
+		"Signature":           signature,
+		"SessionAnchorHashes": []string{ki1.SessionAnchorHash()},
+	}
+	if _, err := client.JSONRPCRequest("KeyInitRepository.FlushKeyInit", content); err != nil {
+		t.Fatal(err)
+	}
+	content = map[string]interface{}{"SigKeyHash": sigKeyHash}
+	reply, err = client.JSONRPCRequest("KeyInitRepository.FetchKeyInit", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply["KeyInit"].(string) != string(ki2.JSON()) {
+		t.Error("flushed KeyInit should not be returned")
+	}
+
+	// flush KeyInit
+	nonce, signature = up.SignNonce()
+	content = map[string]interface{}{
+		"SigPubKey": up.UIDContent.SIGKEY.PUBKEY,
+		"Nonce":     nonce,
+		"Signature": signature,
+	}
+	if _, err := client.JSONRPCRequest("KeyInitRepository.FlushKeyInit", content); err != nil {
+		t.Fatal(err)
+	}
+	content["Nonce"] = nonce + 1
+	if _, err := client.JSONRPCRequest("KeyInitRepository.FlushKeyInit", content); err == nil {
+		t.Error("invalid nonce signature should fail")
+	}
+}
@@ -0,0 +1,561 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"database/sql"
+
+	"github.com/mutecomm/mute/encdb"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid"
+	"github.com/mutecomm/mute/util"
+)
+
+// Version is the current version of the key server database.
+const Version = "1"
+
+// Entries in KeyValueTable.
+const (
+	dbVersion  = "Version"    // version string of key server database
+	domainKey  = "Domain"     // domain served by key server
+	uidKey     = "UIDMessage" // UID message of key server
+	privSigKey = "SIGPRIVKEY" // private signature key of key server
+)
+
+const (
+	createQueryKeyValue = `
+CREATE TABLE KeyValueStore (
+  KeyEntry   TEXT NOT NULL UNIQUE,
+  ValueEntry TEXT NOT NULL
+);`
+	createQueryHashchain = `
+CREATE TABLE Hashchain (
+  Position INTEGER PRIMARY KEY, -- position of entry in key hashchain
+  Entry    TEXT    NOT NULL,    -- the key hashchain entry (base64 encoded)
+  IDENTITY TEXT    NOT NULL     -- identity the entry belongs to (never published)
+);`
+	createQueryUIDs = `
+CREATE TABLE UIDs (
+  ID              INTEGER PRIMARY KEY,
+  IDENTITY        TEXT    NOT NULL,
+  MSGCOUNT        INTEGER NOT NULL,
+  UIDIndex        TEXT    NOT NULL UNIQUE, -- base64 encoded
+  SIGPUBKEY       TEXT    NOT NULL,
+  UIDMessage      TEXT    NOT NULL,
+  UIDMessageReply TEXT    NOT NULL,
+  Position        INTEGER NOT NULL,
+  FOREIGN KEY(Position) REFERENCES Hashchain(Position)
+);`
+	createQueryKeyInits = `
+CREATE TABLE KeyInits (
+  ID         INTEGER PRIMARY KEY,
+  SIGKEYHASH TEXT    NOT NULL,
+  NOTAFTER   INTEGER NOT NULL,
+  NOTBEFORE  INTEGER NOT NULL,
+  FALLBACK   INTEGER NOT NULL, -- 1: KeyInit may serve as fallback key
+  KeyInit    TEXT    NOT NULL
+);`
+	updateValueQuery         = "UPDATE KeyValueStore SET ValueEntry=? WHERE KeyEntry=?;"
+	insertValueQuery         = "INSERT INTO KeyValueStore (KeyEntry, ValueEntry) VALUES (?, ?);"
+	getValueQuery            = "SELECT ValueEntry FROM KeyValueStore WHERE KeyEntry=?;"
+	addHashChainEntryQuery   = "INSERT INTO Hashchain (Position, Entry, IDENTITY) VALUES (?, ?, ?);"
+	getHashChainRangeQuery   = "SELECT Entry FROM Hashchain WHERE Position>=? AND Position<=? ORDER BY Position ASC;"
+	getLastHashChainQuery    = "SELECT Position, Entry FROM Hashchain ORDER BY Position DESC LIMIT 1;"
+	getHashChainEntryIDQuery = "SELECT Position FROM Hashchain WHERE Entry=?;"
+	lookupUIDQuery           = "SELECT Position FROM Hashchain WHERE IDENTITY=? ORDER BY Position ASC;"
+	addUIDQuery              = "INSERT INTO UIDs (IDENTITY, MSGCOUNT, UIDIndex, SIGPUBKEY, UIDMessage, UIDMessageReply, Position) VALUES (?, ?, ?, ?, ?, ?, ?);"
+	getUIDQuery              = "SELECT UIDMessage FROM UIDs WHERE IDENTITY=? ORDER BY MSGCOUNT DESC LIMIT 1;"
+	getUIDsQuery             = "SELECT UIDMessage FROM UIDs WHERE IDENTITY=? ORDER BY Position ASC;"
+	getKeyServerUIDsQuery    = "SELECT UIDMessage, Position FROM UIDs WHERE IDENTITY LIKE 'keyserver@%' ORDER BY Position ASC;"
+	getUIDReplyQuery         = "SELECT UIDMessageReply FROM UIDs WHERE UIDIndex=?;"
+	getSigPubKeyQuery        = "SELECT IDENTITY FROM UIDs WHERE SIGPUBKEY=? ORDER BY MSGCOUNT DESC LIMIT 1;"
+	addKeyInitQuery          = "INSERT INTO KeyInits (SIGKEYHASH, NOTAFTER, NOTBEFORE, FALLBACK, KeyInit) VALUES (?, ?, ?, ?, ?);"
+	getKeyInitsQuery         = "SELECT ID, NOTAFTER, FALLBACK, KeyInit FROM KeyInits WHERE SIGKEYHASH=? AND NOTBEFORE<=? AND NOTAFTER>? ORDER BY NOTAFTER ASC;"
+	delKeyInitQuery          = "DELETE FROM KeyInits WHERE ID=?;"
+	delExpiredKeyInitsQuery  = "DELETE FROM KeyInits WHERE NOTAFTER<=?;"
+	flushKeyInitsQuery       = "DELETE FROM KeyInits WHERE SIGKEYHASH=?;"
+	getAllKeyInitsQuery      = "SELECT ID, KeyInit FROM KeyInits WHERE SIGKEYHASH=?;"
+)
+
+// store is a handle for the encrypted database of the key server.
+type store struct {
+	encDB                    *sql.DB
+	updateValueQuery         *sql.Stmt
+	insertValueQuery         *sql.Stmt
+	getValueQuery            *sql.Stmt
+	addHashChainEntryQuery   *sql.Stmt
+	getHashChainRangeQuery   *sql.Stmt
+	getLastHashChainQuery    *sql.Stmt
+	getHashChainEntryIDQuery *sql.Stmt
+	lookupUIDQuery           *sql.Stmt
+	addUIDQuery              *sql.Stmt
+	getUIDQuery              *sql.Stmt
+	getUIDsQuery             *sql.Stmt
+	getKeyServerUIDsQuery    *sql.Stmt
+	getUIDReplyQuery         *sql.Stmt
+	getSigPubKeyQuery        *sql.Stmt
+	addKeyInitQuery          *sql.Stmt
+	getKeyInitsQuery         *sql.Stmt
+	delKeyInitQuery          *sql.Stmt
+	delExpiredKeyInitsQuery  *sql.Stmt
+	flushKeyInitsQuery       *sql.Stmt
+	getAllKeyInitsQuery      *sql.Stmt
+}
+
+// createStore creates a new key server database with the given dbname.
+// It is encrypted by passphrase (processed by a KDF with iter many iterations).
+func createStore(dbname string, passphrase []byte, iter int) error {
+	err := encdb.Create(dbname, passphrase, iter, []string{
+		createQueryKeyValue,
+		createQueryHashchain,
+		createQueryUIDs,
+		createQueryKeyInits,
+	})
+	if err != nil {
+		return err
+	}
+	st, err := openStore(dbname, passphrase)
+	if err != nil {
+		return err
+	}
+	defer st.close()
+	return st.addValue(dbVersion, Version)
+}
+
+// openStore opens the key server database with dbname and passphrase.
+func openStore(dbname string, passphrase []byte) (*store, error) {
+	var st store
+	var err error
+	// open database
+	st.encDB, err = encdb.Open(dbname, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	// prepare statements
+	if st.updateValueQuery, err = st.encDB.Prepare(updateValueQuery); err != nil {
+		st.encDB.Close()
+		return nil, err
+	}
+	if st.insertValueQuery, err = st.encDB.Prepare(insertValueQuery); err != nil {
+		st.encDB.Close()
+		return nil, err
+	}
+	if st.getValueQuery, err = st.encDB.Prepare(getValueQuery); err != nil {
+		st.encDB.Close()
+		return nil, err
+	}
+	if st.addHashChainEntryQuery, err = st.encDB.Prepare(addHashChainEntryQuery); err != nil {
+		st.encDB.Close()
+		return nil, err
+	}
+	if st.getHashChainRangeQuery, err = st.encDB.Prepare(getHashChainRangeQuery); err != nil {
+		st.encDB.Close()
+		return nil, err
+	}
+	if st.getLastHashChainQuery, err = st.encDB.Prepare(getLastHashChainQuery); err != nil {
+		st.encDB.Close()
+		return nil, err
+	}
+	if st.getHashChainEntryIDQuery, err = st.encDB.Prepare(getHashChainEntryIDQuery); err != nil {
+		st.encDB.Close()
+		return nil, err
+	}
+	if st.lookupUIDQuery, err = st.encDB.Prepare(lookupUIDQuery); err != nil {
+		st.encDB.Close()
+		return nil, err
+	}
+	if st.addUIDQuery, err = st.encDB.Prepare(addUIDQuery); err != nil {
+		st.encDB.Close()
+		return nil, err
+	}
+	if st.getUIDQuery, err = st.encDB.Prepare(getUIDQuery); err != nil {
+		st.encDB.Close()
+		return nil, err
+	}
+	if st.getUIDsQuery, err = st.encDB.Prepare(getUIDsQuery); err != nil {
+		st.encDB.Close()
+		return nil, err
+	}
+	if st.getKeyServerUIDsQuery, err = st.encDB.Prepare(getKeyServerUIDsQuery); err != nil {
+		st.encDB.Close()
+		return nil, err
+	}
+	if st.getUIDReplyQuery, err = st.encDB.Prepare(getUIDReplyQuery); err != nil {
+		st.encDB.Close()
+		return nil, err
+	}
+	if st.getSigPubKeyQuery, err = st.encDB.Prepare(getSigPubKeyQuery); err != nil {
+		st.encDB.Close()
+		return nil, err
+	}
+	if st.addKeyInitQuery, err = st.encDB.Prepare(addKeyInitQuery); err != nil {
+		st.encDB.Close()
+		return nil, err
+	}
+	if st.getKeyInitsQuery, err = st.encDB.Prepare(getKeyInitsQuery); err != nil {
+		st.encDB.Close()
+		return nil, err
+	}
+	if st.delKeyInitQuery, err = st.encDB.Prepare(delKeyInitQuery); err != nil {
+		st.encDB.Close()
+		return nil, err
+	}
+	if st.delExpiredKeyInitsQuery, err = st.encDB.Prepare(delExpiredKeyInitsQuery); err != nil {
+		st.encDB.Close()
+		return nil, err
+	}
+	if st.flushKeyInitsQuery, err = st.encDB.Prepare(flushKeyInitsQuery); err != nil {
+		st.encDB.Close()
+		return nil, err
+	}
+	if st.getAllKeyInitsQuery, err = st.encDB.Prepare(getAllKeyInitsQuery); err != nil {
+		st.encDB.Close()
+		return nil, err
+	}
+	return &st, nil
+}
+
+// close the key server database.
+func (st *store) close() error {
+	return st.encDB.Close()
+}
+
+// addValue adds a key-value pair to the key server database.
+func (st *store) addValue(key, value string) error {
+	if _, err := st.insertValueQuery.Exec(key, value); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+// getValue gets the value for the given key from the key server database.
+func (st *store) getValue(key string) (string, error) {
+	var value string
+	if err := st.getValueQuery.QueryRow(key).Scan(&value); err != nil {
+		return "", log.Error(err)
+	}
+	return value, nil
+}
+
+// lastHashChainEntry returns the last entry of the key hashchain and its
+// position. found is false, if the key hashchain is still empty.
+func (st *store) lastHashChainEntry() (
+	pos uint64,
+	entry string,
+	found bool,
+	err error,
+) {
+	err = st.getLastHashChainQuery.QueryRow().Scan(&pos, &entry)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, "", false, nil
+	case err != nil:
+		return 0, "", false, log.Error(err)
+	default:
+		return pos, entry, true, nil
+	}
+}
+
+// hashChainEntries returns the key hashchain entries from position start to
+// position end (inclusive).
+func (st *store) hashChainEntries(start, end uint64) ([]string, error) {
+	var entries []string
+	rows, err := st.getHashChainRangeQuery.Query(start, end)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry string
+		if err := rows.Scan(&entry); err != nil {
+			return nil, log.Error(err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	return entries, nil
+}
+
+// hasHashChainEntry returns true, if the given entry is part of the key
+// hashchain.
+func (st *store) hasHashChainEntry(entry string) (bool, error) {
+	var pos uint64
+	err := st.getHashChainEntryIDQuery.QueryRow(entry).Scan(&pos)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case err != nil:
+		return false, log.Error(err)
+	default:
+		return true, nil
+	}
+}
+
+// lookupUID returns all key hashchain positions for the given identity.
+func (st *store) lookupUID(identity string) ([]uint64, error) {
+	var positions []uint64
+	rows, err := st.lookupUIDQuery.Query(identity)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pos uint64
+		if err := rows.Scan(&pos); err != nil {
+			return nil, log.Error(err)
+		}
+		positions = append(positions, pos)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	return positions, nil
+}
+
+// addUID adds the UID message msg together with its hash chain entry (at
+// position pos) and the corresponding reply in a single transaction.
+func (st *store) addUID(
+	msg *uid.Message,
+	UIDIndex string,
+	reply *uid.MessageReply,
+) error {
+	tx, err := st.encDB.Begin()
+	if err != nil {
+		return log.Error(err)
+	}
+	_, err = tx.Stmt(st.addHashChainEntryQuery).Exec(reply.ENTRY.HASHCHAINPOS,
+		reply.ENTRY.HASHCHAINENTRY, msg.UIDContent.IDENTITY)
+	if err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	_, err = tx.Stmt(st.addUIDQuery).Exec(msg.UIDContent.IDENTITY,
+		msg.UIDContent.MSGCOUNT, UIDIndex, msg.SigPubKey(), msg.JSON(),
+		reply.JSON(), reply.ENTRY.HASHCHAINPOS)
+	if err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	return nil
+}
+
+// getUID returns the latest UID message for the given identity.
+// If no such UID message exists, nil is returned.
+func (st *store) getUID(identity string) (*uid.Message, error) {
+	var jsn string
+	err := st.getUIDQuery.QueryRow(identity).Scan(&jsn)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, log.Error(err)
+	default:
+		return uid.NewJSON(jsn)
+	}
+}
+
+// getUIDs returns all UID messages for the given identity (in hashchain
+// order).
+func (st *store) getUIDs(identity string) ([]*uid.Message, error) {
+	var msgs []*uid.Message
+	rows, err := st.getUIDsQuery.Query(identity)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var jsn string
+		if err := rows.Scan(&jsn); err != nil {
+			return nil, log.Error(err)
+		}
+		msg, err := uid.NewJSON(jsn)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	return msgs, nil
+}
+
+// authoritativeLink returns the first AUTHORITATIVE link entry which serves
+// the given domain and its hashchain position.
+// If no such entry exists, nil is returned.
+func (st *store) authoritativeLink(domain string) (*uid.Message, uint64, error) {
+	rows, err := st.getKeyServerUIDsQuery.Query()
+	if err != nil {
+		return nil, 0, log.Error(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			jsn string
+			pos uint64
+		)
+		if err := rows.Scan(&jsn, &pos); err != nil {
+			return nil, 0, log.Error(err)
+		}
+		msg, err := uid.NewJSON(jsn)
+		if err != nil {
+			return nil, 0, err
+		}
+		if msg.UIDContent.CHAINLINK.Serves(domain) {
+			return msg, pos, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, log.Error(err)
+	}
+	return nil, 0, nil
+}
+
+// getUIDReply returns the UIDMessageReply stored under the given UIDIndex.
+func (st *store) getUIDReply(UIDIndex string) (*uid.MessageReply, error) {
+	var jsn string
+	err := st.getUIDReplyQuery.QueryRow(UIDIndex).Scan(&jsn)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, log.Errorf("server: unknown UIDIndex %s", UIDIndex)
+	case err != nil:
+		return nil, log.Error(err)
+	default:
+		return uid.NewJSONReply(jsn)
+	}
+}
+
+// sigPubKeyUID returns the latest UID message of the identity which uses
+// sigPubKey as its current signature key.
+func (st *store) sigPubKeyUID(sigPubKey string) (*uid.Message, error) {
+	var identity string
+	err := st.getSigPubKeyQuery.QueryRow(sigPubKey).Scan(&identity)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, log.Error(ErrUnknownSigPubKey)
+	case err != nil:
+		return nil, log.Error(err)
+	}
+	// make sure sigPubKey is the key of the latest UID message
+	msg, err := st.getUID(identity)
+	if err != nil {
+		return nil, err
+	}
+	if msg.SigPubKey() != sigPubKey {
+		return nil, log.Error(ErrUnknownSigPubKey)
+	}
+	return msg, nil
+}
+
+// addKeyInit adds the given KeyInit message.
+func (st *store) addKeyInit(ki *uid.KeyInit) error {
+	_, err := st.addKeyInitQuery.Exec(ki.Contents.SIGKEYHASH,
+		ki.Contents.NOTAFTER, ki.Contents.NOTBEFORE, ki.Contents.FALLBACK,
+		ki.JSON())
+	if err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+// keyInitEntry describes a KeyInit message stored in the key server database.
+type keyInitEntry struct {
+	id       int64
+	notafter uint64
+	fallback bool
+	keyInit  string
+}
+
+// getKeyInits returns all KeyInit messages for the given sigKeyHash which are
+// valid at time now, ordered by their remaining lifetime.
+func (st *store) getKeyInits(sigKeyHash string, now uint64) ([]keyInitEntry, error) {
+	var entries []keyInitEntry
+	rows, err := st.getKeyInitsQuery.Query(sigKeyHash, now, now)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e keyInitEntry
+		if err := rows.Scan(&e.id, &e.notafter, &e.fallback, &e.keyInit); err != nil {
+			return nil, log.Error(err)
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	return entries, nil
+}
+
+// delKeyInit deletes the KeyInit message with the given id.
+func (st *store) delKeyInit(id int64) error {
+	if _, err := st.delKeyInitQuery.Exec(id); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+// delExpiredKeyInits deletes all KeyInit messages which have reached
+// NOTAFTER at time now.
+func (st *store) delExpiredKeyInits(now uint64) error {
+	if _, err := st.delExpiredKeyInitsQuery.Exec(now); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+// flushKeyInits deletes all KeyInit messages for the given sigKeyHash.
+func (st *store) flushKeyInits(sigKeyHash string) error {
+	if _, err := st.flushKeyInitsQuery.Exec(sigKeyHash); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+// flushKeyInitsByAnchor deletes the KeyInit messages for the given sigKeyHash
+// which have one of the given session anchor hashes.
+func (st *store) flushKeyInitsByAnchor(
+	sigKeyHash string,
+	sessionAnchorHashes []string,
+) error {
+	var ids []int64
+	rows, err := st.getAllKeyInitsQuery.Query(sigKeyHash)
+	if err != nil {
+		return log.Error(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id  int64
+			jsn string
+		)
+		if err := rows.Scan(&id, &jsn); err != nil {
+			return log.Error(err)
+		}
+		ki, err := uid.NewJSONKeyInit([]byte(jsn))
+		if err != nil {
+			return err
+		}
+		if util.ContainsString(sessionAnchorHashes, ki.SessionAnchorHash()) {
+			ids = append(ids, id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return log.Error(err)
+	}
+	for _, id := range ids {
+		if err := st.delKeyInit(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
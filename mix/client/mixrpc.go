@@ -5,18 +5,16 @@
 package client
 
 import (
-	"crypto/tls"
-	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"net/http"
 	"net/url"
 	"time"
 
 	"github.com/mutecomm/mute/mix/mixaddr"
 	"github.com/mutecomm/mute/mix/smtpclient"
+	"github.com/mutecomm/mute/util/transport"
 )
 
 // GetMixAddress is used to get the address of a mix rpc. It should only be
@@ -33,22 +31,16 @@ func getMixAddressReal(mixaddress string) (string, error) {
 	return address, nil
 }
 
-func getHTTPClient(cacert []byte) *http.Client {
-	tr := &http.Transport{}
-	if cacert != nil {
-		tr.TLSClientConfig = &tls.Config{RootCAs: x509.NewCertPool()}
-		tr.TLSClientConfig.RootCAs.AppendCertsFromPEM(cacert)
-	}
-	client := &http.Client{
-		Transport: tr,
-		Timeout:   time.Second * time.Duration(DefaultTimeOut),
-	}
-	return client
+func getHTTPClient(cacert []byte) (*transport.Client, error) {
+	return transport.New(cacert, time.Second*time.Duration(DefaultTimeOut))
 }
 
 // HTTPSGet executes a get call over HTTPs.
 func HTTPSGet(getURL string, cacert []byte) ([]byte, error) {
-	client := getHTTPClient(cacert)
+	client, err := getHTTPClient(cacert)
+	if err != nil {
+		return nil, err
+	}
 	resp, err := client.Get(getURL)
 	if err != nil {
 		return nil, err
@@ -63,7 +55,10 @@ func HTTPSGet(getURL string, cacert []byte) ([]byte, error) {
 
 // HTTPSPost executes a post call over HTTPs.
 func HTTPSPost(postValues url.Values, postURL string, cacert []byte) ([]byte, error) {
-	client := getHTTPClient(cacert)
+	client, err := getHTTPClient(cacert)
+	if err != nil {
+		return nil, err
+	}
 	resp, err := client.PostForm(postURL, postValues)
 	if err != nil {
 		return nil, err
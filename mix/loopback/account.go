@@ -0,0 +1,206 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package loopback
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"github.com/mutecomm/mute/serviceguard/common/walletauth"
+	"github.com/mutecomm/mute/util/times"
+)
+
+// checkToken verifies the base64 encoded authentication token and its
+// counter and returns the public key of the account. The caller has to hold
+// s.mutex.
+func (s *Server) checkToken(authToken string) (*[ed25519.PublicKeySize]byte, error) {
+	token, err := base64.StdEncoding.DecodeString(authToken)
+	if err != nil {
+		return nil, walletauth.ErrBadToken
+	}
+	pubkey, ltime, lcounter, err := walletauth.AuthToken(token).CheckToken()
+	if err != nil {
+		return nil, err
+	}
+	now := uint64(times.Now()) / walletauth.SkewWindow
+	if ltime+1 < now || ltime > now+1 {
+		return nil, walletauth.ErrBadToken
+	}
+	acc, ok := s.accounts[*pubkey]
+	if !ok {
+		acc = new(account)
+		s.accounts[*pubkey] = acc
+	}
+	if lcounter <= acc.lastCounter {
+		// format expected by walletauth.IsReplay
+		return nil, fmt.Errorf("ErrReplay: %d", acc.lastCounter)
+	}
+	acc.lastCounter = lcounter
+	return pubkey, nil
+}
+
+// auth verifies the authentication token and returns the corresponding
+// account, which must have been loaded. The caller has to hold s.mutex.
+func (s *Server) auth(authToken string) (*account, error) {
+	pubkey, err := s.checkToken(authToken)
+	if err != nil {
+		return nil, err
+	}
+	acc := s.accounts[*pubkey]
+	if acc.loadTime < times.Now() {
+		return nil, ErrNoAccount
+	}
+	return acc, nil
+}
+
+// AccountServer implements the AccountServer JSON-RPC service.
+type AccountServer struct {
+	s *Server
+}
+
+// AuthArgs are the arguments of JSON-RPC methods which only require
+// authentication.
+type AuthArgs struct {
+	AuthToken string
+}
+
+// LoadAccountArgs are the arguments of AccountServer.LoadAccount.
+type LoadAccountArgs struct {
+	AuthToken string
+	PayToken  string // ignored
+}
+
+// LoadAccountReply is the reply of AccountServer.LoadAccount.
+type LoadAccountReply struct {
+	Server string
+}
+
+// LoadAccount creates or extends the account of the authenticated key.
+func (as *AccountServer) LoadAccount(
+	r *http.Request,
+	args *LoadAccountArgs,
+	reply *LoadAccountReply,
+) error {
+	as.s.mutex.Lock()
+	defer as.s.mutex.Unlock()
+	pubkey, err := as.s.checkToken(args.AuthToken)
+	if err != nil {
+		return err
+	}
+	acc := as.s.accounts[*pubkey]
+	now := times.Now()
+	if acc.loadTime < now {
+		acc.loadTime = now
+	}
+	acc.loadTime += AccountDuration
+	reply.Server = as.s.accountServer
+	return nil
+}
+
+// DeleteAccountReply is the reply of AccountServer.DeleteAccount.
+type DeleteAccountReply struct {
+	Result bool
+}
+
+// DeleteAccount deletes the account of the authenticated key together with
+// all its messages.
+func (as *AccountServer) DeleteAccount(
+	r *http.Request,
+	args *AuthArgs,
+	reply *DeleteAccountReply,
+) error {
+	as.s.mutex.Lock()
+	defer as.s.mutex.Unlock()
+	acc, err := as.s.auth(args.AuthToken)
+	if err != nil {
+		return err
+	}
+	for _, msg := range acc.messages {
+		delete(as.s.revokeIDs, msg.revokeID)
+	}
+	// keep the counter to prevent replays
+	acc.loadTime = 0
+	acc.messages = nil
+	reply.Result = true
+	return nil
+}
+
+// AccountStatReply is the reply of AccountServer.AccountStat.
+type AccountStatReply struct {
+	LoadTime int64
+}
+
+// AccountStat returns the time until which the account is valid.
+func (as *AccountServer) AccountStat(
+	r *http.Request,
+	args *AuthArgs,
+	reply *AccountStatReply,
+) error {
+	as.s.mutex.Lock()
+	defer as.s.mutex.Unlock()
+	acc, err := as.s.auth(args.AuthToken)
+	if err != nil {
+		return err
+	}
+	reply.LoadTime = acc.loadTime
+	return nil
+}
+
+// ListMessagesArgs are the arguments of AccountServer.ListMessages.
+type ListMessagesArgs struct {
+	AuthToken       string
+	LastReceiveTime int64
+}
+
+// MessageMeta contains the metadata of a message.
+type MessageMeta struct {
+	MessageID       string // hex encoded
+	ReceiveTime     int64
+	ReceiveTimeNano int64
+	ReadTime        int64
+	UserKey         string // hex encoded
+}
+
+// ListMessagesReply is the reply of AccountServer.ListMessages.
+type ListMessagesReply struct {
+	Messages []MessageMeta
+}
+
+// ListMessages lists all messages of the account which have been received
+// after LastReceiveTime.
+func (as *AccountServer) ListMessages(
+	r *http.Request,
+	args *ListMessagesArgs,
+	reply *ListMessagesReply,
+) error {
+	as.s.mutex.Lock()
+	defer as.s.mutex.Unlock()
+	pubkey, err := as.s.checkToken(args.AuthToken)
+	if err != nil {
+		return err
+	}
+	acc := as.s.accounts[*pubkey]
+	if acc.loadTime < times.Now() {
+		return ErrNoAccount
+	}
+	for _, msg := range acc.messages {
+		if msg.receiveTime > args.LastReceiveTime {
+			reply.Messages = append(reply.Messages, MessageMeta{
+				MessageID:       hex.EncodeToString(msg.id),
+				ReceiveTime:     msg.receiveTime,
+				ReceiveTimeNano: msg.receiveTimeNano,
+				ReadTime:        msg.readTime,
+				UserKey:         hex.EncodeToString(pubkey[:]),
+			})
+		}
+	}
+	if len(reply.Messages) == 0 {
+		return ErrNothingFound
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package loopback implements a local stand-in for a Mute mix and account
+// server.
+//
+// The loopback server accepts client-mix messages (via SMTP or Receive),
+// unwraps them with the keys of its mixaddr.KeyList, stores the relayed
+// messages per mailbox and serves the account JSON-RPC calls and HTTPS
+// endpoints used by package mix/client. Messages are relayed immediately,
+// delays requested by senders are ignored and payment tokens are not
+// checked. It is meant for end-to-end tests without network access.
+package loopback
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/rpc/v2"
+	"github.com/gorilla/rpc/v2/json2"
+	"github.com/mutecomm/mute/mix/client"
+	"github.com/mutecomm/mute/mix/mixaddr"
+	"github.com/mutecomm/mute/mix/mixcrypt"
+	"github.com/mutecomm/mute/util/times"
+)
+
+var (
+	// ErrDuplicate is returned if a message has been received before.
+	ErrDuplicate = errors.New("loopback: duplicate message")
+	// ErrNoAccount is returned if a message is relayed to an unknown or
+	// expired account.
+	ErrNoAccount = errors.New("loopback: no such account")
+	// ErrNoMessage is returned if a message could not be found.
+	ErrNoMessage = errors.New("loopback: no such message")
+	// ErrNothingFound is returned by ListMessages if no new messages are
+	// available (same message as the production account server, the clients
+	// rely on it).
+	ErrNothingFound = errors.New("accountdb: Nothing found")
+)
+
+// Rand is the random source of this package.
+var Rand = mixaddr.Rand
+
+// KeyDuration is the lifetime of the mix keys in seconds.
+var KeyDuration = int64(7 * 24 * 60 * 60) // one week
+
+// AccountDuration is the number of seconds an account is extended by each
+// LoadAccount call.
+var AccountDuration = int64(30 * 24 * 60 * 60) // 30 days
+
+// message is a relayed message stored in a mailbox.
+type message struct {
+	id              []byte
+	receiveTime     int64
+	receiveTimeNano int64
+	readTime        int64
+	revokeID        string // hex encoded
+	mail            []byte // message as written by client.WriteMail
+}
+
+// account is a mailbox on the loopback server.
+type account struct {
+	loadTime    int64  // time until which the account is valid
+	lastCounter uint64 // last counter of an authentication token
+	messages    []*message
+}
+
+// Server is a loopback mix and account server.
+type Server struct {
+	mutex         sync.Mutex
+	keyList       *mixaddr.KeyList
+	accountServer string
+	accounts      map[[ed25519.PublicKeySize]byte]*account
+	unique        map[string]int64 // uniqueness hashes -> expire
+	revokeIDs     map[string]*message
+	mux           *http.ServeMux
+}
+
+// New returns a new loopback server. privkey is the signature key of the mix,
+// mixAddress the address the mix listens on (used as the recipient address
+// of client-mix messages), accountServer the name returned by LoadAccount,
+// and safedir the directory the mix keys are stored in.
+func New(
+	privkey *[ed25519.PrivateKeySize]byte,
+	mixAddress, accountServer, safedir string,
+) (*Server, error) {
+	s := &Server{
+		keyList:       mixaddr.New(privkey, mixAddress, KeyDuration, KeyDuration, safedir),
+		accountServer: accountServer,
+		accounts:      make(map[[ed25519.PublicKeySize]byte]*account),
+		unique:        make(map[string]int64),
+		revokeIDs:     make(map[string]*message),
+		mux:           http.NewServeMux(),
+	}
+	s.keyList.AddKey()
+	// register handlers
+	rpcServer := rpc.NewServer()
+	rpcServer.RegisterCodec(json2.NewCodec(), "application/json")
+	if err := rpcServer.RegisterService(&AccountServer{s: s}, ""); err != nil {
+		return nil, err
+	}
+	s.mux.Handle("/account", rpcServer)
+	s.mux.HandleFunc("/keys", s.keys)
+	s.mux.HandleFunc("/revoke", s.revoke)
+	s.mux.HandleFunc("/message", s.message)
+	return s, nil
+}
+
+// ServeHTTP implements the http.Handler interface and serves the endpoints
+// /keys, /revoke, /message and /account (JSON-RPC).
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Statement returns the current key statement of the mix.
+func (s *Server) Statement() *mixaddr.AddressStatement {
+	return s.keyList.GetStatement()
+}
+
+// Receive processes the client-mix message mail (as written by
+// client.WriteMail) and stores the relayed message in the mailbox of the
+// recipient.
+func (s *Server) Receive(mail []byte) error {
+	body, err := client.ReadMail(mail)
+	if err != nil {
+		return err
+	}
+	rs, err := mixcrypt.ReceiveMessage(s.keyList.GetPrivateKey, body)
+	if err != nil {
+		return err
+	}
+	relayed, address, err := rs.Send()
+	if err != nil {
+		return err
+	}
+	// mailbox addresses have the form hex(pubkey)@server
+	var pubkey [ed25519.PublicKeySize]byte
+	lp := address
+	if i := strings.Index(address, "@"); i >= 0 {
+		lp = address[:i]
+	}
+	pk, err := hex.DecodeString(lp)
+	if err != nil || len(pk) != ed25519.PublicKeySize {
+		return ErrNoAccount
+	}
+	copy(pubkey[:], pk)
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(Rand, id); err != nil {
+		return err
+	}
+	now := times.NowNano()
+	msg := &message{
+		id:              id,
+		receiveTime:     now / 1e9,
+		receiveTimeNano: now,
+		mail:            client.WriteMail(client.DefaultSender, address, relayed),
+	}
+	if rs.MixHeader.RevokeID != nil {
+		msg.revokeID = hex.EncodeToString(rs.MixHeader.RevokeID)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	acc, ok := s.accounts[pubkey]
+	if !ok || acc.loadTime < times.Now() {
+		return ErrNoAccount
+	}
+	// uniqueness checks
+	s.expireUnique()
+	for _, u := range rs.UniqueTest {
+		if _, ok := s.unique[string(u.Hash)]; ok {
+			return ErrDuplicate
+		}
+	}
+	for _, u := range rs.UniqueTest {
+		s.unique[string(u.Hash)] = u.Expire
+	}
+	acc.messages = append(acc.messages, msg)
+	if msg.revokeID != "" {
+		s.revokeIDs[msg.revokeID] = msg
+	}
+	return nil
+}
+
+// expireUnique removes expired uniqueness hashes. The caller has to hold
+// s.mutex.
+func (s *Server) expireUnique() {
+	now := times.Now()
+	for h, expire := range s.unique {
+		if expire < now {
+			delete(s.unique, h)
+		}
+	}
+}
+
+// keys serves the key statement of the mix.
+func (s *Server) keys(w http.ResponseWriter, r *http.Request) {
+	jsn, err := json.Marshal(s.keyList.GetStatement())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(jsn)
+}
+
+// revoke removes a message which has not been read yet from its mailbox.
+func (s *Server) revoke(w http.ResponseWriter, r *http.Request) {
+	revokeID := r.URL.Query().Get("revokeid")
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	msg, ok := s.revokeIDs[revokeID]
+	if !ok || msg.readTime != 0 {
+		io.WriteString(w, "ERROR: "+ErrNoMessage.Error())
+		return
+	}
+	delete(s.revokeIDs, revokeID)
+	for _, acc := range s.accounts {
+		for i, m := range acc.messages {
+			if m == msg {
+				acc.messages = append(acc.messages[:i], acc.messages[i+1:]...)
+				break
+			}
+		}
+	}
+	io.WriteString(w, "REVOKED")
+}
+
+// message serves a single message to the authenticated account owner.
+func (s *Server) message(w http.ResponseWriter, r *http.Request) {
+	messageID, err := hex.DecodeString(r.FormValue("messageid"))
+	if err != nil {
+		io.WriteString(w, "ERROR: "+err.Error())
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	acc, err := s.auth(r.FormValue("authtoken"))
+	if err != nil {
+		io.WriteString(w, "ERROR: "+err.Error())
+		return
+	}
+	for _, msg := range acc.messages {
+		if string(msg.id) == string(messageID) {
+			if msg.readTime == 0 {
+				msg.readTime = times.Now()
+			}
+			w.Write(msg.mail)
+			return
+		}
+	}
+	io.WriteString(w, "ERROR: "+ErrNoMessage.Error())
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package loopback
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/mutecomm/mute/mix/client"
+	"github.com/mutecomm/mute/mix/mixcrypt"
+	"github.com/mutecomm/mute/mix/nymaddr"
+	"github.com/mutecomm/mute/util/times"
+)
+
+func newKey(t *testing.T) *[ed25519.PrivateKeySize]byte {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var privkey [ed25519.PrivateKeySize]byte
+	copy(privkey[:], priv)
+	return &privkey
+}
+
+func TestLoopback(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "loopback_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	s, err := New(newKey(t), "mix@127.0.0.1", "127.0.0.1", tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// start HTTPS server and point the mix client to it
+	srv := httptest.NewTLSServer(s)
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacert := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: srv.Certificate().Raw,
+	})
+	oldRPCPort := client.RPCPort
+	oldDefaultAccountServer := client.DefaultAccountServer
+	oldGetMixAddress := client.GetMixAddress
+	defer func() {
+		client.RPCPort = oldRPCPort
+		client.DefaultAccountServer = oldDefaultAccountServer
+		client.GetMixAddress = oldGetMixAddress
+	}()
+	client.RPCPort = u.Port()
+	client.DefaultAccountServer = "127.0.0.1"
+	client.GetMixAddress = func(string) (string, error) { return u.Host, nil }
+
+	// start SMTP server with STARTTLS
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go s.ServeSMTP(l, &tls.Config{Certificates: srv.TLS.Certificates})
+	smtpPort := l.Addr().(*net.TCPAddr).Port
+
+	// create account
+	privkey := newKey(t)
+	server, err := client.PayAccount(privkey, []byte("token"), "", cacert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server != "127.0.0.1" {
+		t.Errorf("wrong server: %s", server)
+	}
+	loadTime, err := client.AccountStat(privkey, server, cacert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loadTime <= times.Now() {
+		t.Error("account not loaded")
+	}
+
+	// create nym address
+	stmt, err := client.GetMixKeys("mix@127.0.0.1", cacert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stmt.Verify() {
+		t.Fatal("key statement does not verify")
+	}
+	tmp := nymaddr.AddressTemplate{
+		Secret:        []byte("secret"),
+		MixCandidates: stmt.Addresses,
+		Expire:        times.Now() + 3600,
+	}
+	mailbox := []byte(hex.EncodeToString(privkey[32:]) + "@loopback.")
+	nymAddress, err := tmp.NewAddress(mailbox, []byte("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// send message
+	msg := make([]byte, mixcrypt.RelayMinSize)
+	if _, err := rand.Read(msg); err != nil {
+		t.Fatal(err)
+	}
+	mi := client.MessageInput{
+		NymAddress: nymAddress,
+		Message:    msg,
+		SMTPPort:   smtpPort,
+		SmartHost:  "127.0.0.1",
+		CACert:     cacert,
+	}
+	mo := mi.Create()
+	if mo.Error != nil {
+		t.Fatal(mo.Error)
+	}
+	if _, err := mo.Deliver(); err != nil {
+		t.Fatal(err)
+	}
+
+	// fetch message
+	messages, err := client.ListMessages(privkey, 0, server, cacert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("wrong number of messages: %d", len(messages))
+	}
+	enc, err := client.FetchMessage(privkey, messages[0].MessageID, server,
+		cacert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, nym, err := mixcrypt.ReceiveFromMix(tmp, mailbox, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dec, msg) {
+		t.Error("messages differ")
+	}
+	if !bytes.Equal(nym[:5], []byte("alice")) {
+		t.Error("wrong nym")
+	}
+	_, err = client.ListMessages(privkey, messages[0].ReceiveTime, server,
+		cacert)
+	if err == nil || err.Error() != ErrNothingFound.Error() {
+		t.Errorf("should fail with %s", ErrNothingFound)
+	}
+
+	// read messages cannot be revoked
+	if _, err := client.RevokeMessage(mo.RevokeID, "mix@127.0.0.1", cacert); err == nil {
+		t.Error("revoking read message should fail")
+	}
+
+	// delete account
+	if err := client.DeleteAccount(privkey, server, cacert); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.AccountStat(privkey, server, cacert); err == nil {
+		t.Error("account should be deleted")
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package loopback
+
+import (
+	"crypto/tls"
+	"net"
+	"net/textproto"
+	"strings"
+)
+
+// ServeSMTP accepts SMTP connections on listener l and passes all received
+// mails to Receive. If tlsConfig is not nil, STARTTLS is offered.
+// ServeSMTP returns when l is closed.
+func (s *Server) ServeSMTP(l net.Listener, tlsConfig *tls.Config) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleSMTP(conn, tlsConfig)
+	}
+}
+
+// handleSMTP implements the server side of a minimal SMTP session.
+func (s *Server) handleSMTP(conn net.Conn, tlsConfig *tls.Config) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 loopback ESMTP")
+	var rcpt bool
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(line)
+		if i := strings.IndexAny(cmd, " :"); i >= 0 {
+			cmd = cmd[:i]
+		}
+		switch cmd {
+		case "EHLO":
+			if tlsConfig != nil {
+				tp.PrintfLine("250-loopback")
+				tp.PrintfLine("250 STARTTLS")
+			} else {
+				tp.PrintfLine("250 loopback")
+			}
+		case "HELO":
+			tp.PrintfLine("250 loopback")
+		case "STARTTLS":
+			if tlsConfig == nil {
+				tp.PrintfLine("502 STARTTLS not supported")
+				continue
+			}
+			tp.PrintfLine("220 ready to start TLS")
+			tlsConn := tls.Server(conn, tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			tp = textproto.NewConn(conn)
+			rcpt = false
+		case "MAIL":
+			rcpt = false
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			rcpt = true
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			if !rcpt {
+				tp.PrintfLine("503 need RCPT first")
+				continue
+			}
+			tp.PrintfLine("354 end data with <CR><LF>.<CR><LF>")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			rcpt = false
+			if err := s.Receive(data); err != nil {
+				tp.PrintfLine("554 %s", err)
+				continue
+			}
+			tp.PrintfLine("250 OK")
+		case "RSET":
+			rcpt = false
+			tp.PrintfLine("250 OK")
+		case "NOOP":
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("500 unknown command")
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msg
+
+import (
+	"crypto/cipher"
+
+	"github.com/mutecomm/mute/cipher/aes256"
+	"github.com/mutecomm/mute/cipher/salsa20"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid"
+	"github.com/mutecomm/mute/util"
+)
+
+// ciphersuite defines the symmetric encryption of a ciphersuite (the other
+// primitives are the same for all supported ciphersuites).
+type ciphersuite struct {
+	stream func(key, iv []byte) cipher.Stream // 32 byte key, 16 byte iv
+}
+
+// ciphersuites is the registry of all ciphersuites supported for message
+// encryption.
+var ciphersuites = map[string]*ciphersuite{
+	uid.DefaultCiphersuite:  {stream: aes256.CTRStream},
+	uid.XSalsa20Ciphersuite: {stream: salsa20.Stream},
+}
+
+// NegotiateCiphersuite returns the ciphersuite to use for messages from
+// sender to recipient. That is, the ciphersuite most preferred by the
+// recipient which is also advertised by the sender and supported by this
+// implementation.
+func NegotiateCiphersuite(sender, recipient *uid.Message) (string, error) {
+	senderSuites := sender.Ciphersuites()
+	for _, suite := range recipient.Ciphersuites() {
+		if ciphersuites[suite] != nil && util.ContainsString(senderSuites, suite) {
+			return suite, nil
+		}
+	}
+	return "", log.Error(ErrNoCiphersuite)
+}
+
+// getCiphersuite returns the registered ciphersuite with the given name, if
+// it has been advertised by the recipient UID message.
+func getCiphersuite(recipient *uid.Message, name string) (*ciphersuite, error) {
+	if !util.ContainsString(recipient.Ciphersuites(), name) {
+		return nil, log.Error(ErrCiphersuiteNotAdvertised)
+	}
+	suite := ciphersuites[name]
+	if suite == nil {
+		return nil, log.Error(ErrUnknownCiphersuite)
+	}
+	return suite, nil
+}
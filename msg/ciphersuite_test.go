@@ -0,0 +1,91 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msg
+
+import (
+	"testing"
+
+	"github.com/mutecomm/mute/msg/session/memstore"
+	"github.com/mutecomm/mute/uid"
+)
+
+func TestNegotiateCiphersuite(t *testing.T) {
+	aliceUID, _ := createStatusUID(t, "alice@mute.berlin")
+	bobUID, _ := createStatusUID(t, "bob@mute.berlin")
+	// default preferences
+	suite, err := NegotiateCiphersuite(aliceUID, bobUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if suite != uid.DefaultCiphersuite {
+		t.Errorf("wrong ciphersuite: %s", suite)
+	}
+	// the preferences of the recipient count
+	bobUID.UIDContent.PREFERENCES.CIPHERSUITES = []string{
+		"UNKNOWN",
+		uid.XSalsa20Ciphersuite,
+		uid.DefaultCiphersuite,
+	}
+	suite, err = NegotiateCiphersuite(aliceUID, bobUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if suite != uid.XSalsa20Ciphersuite {
+		t.Errorf("wrong ciphersuite: %s", suite)
+	}
+	// no ciphersuites means default ciphersuite
+	aliceUID.UIDContent.PREFERENCES.CIPHERSUITES = nil
+	suite, err = NegotiateCiphersuite(aliceUID, bobUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if suite != uid.DefaultCiphersuite {
+		t.Errorf("wrong ciphersuite: %s", suite)
+	}
+	// no common ciphersuite
+	bobUID.UIDContent.PREFERENCES.CIPHERSUITES = []string{uid.XSalsa20Ciphersuite}
+	if _, err := NegotiateCiphersuite(aliceUID, bobUID); err != ErrNoCiphersuite {
+		t.Errorf("should fail with ErrNoCiphersuite: %v", err)
+	}
+}
+
+func TestCiphersuites(t *testing.T) {
+	alice := "alice@mute.berlin"
+	aliceUID, _ := createStatusUID(t, alice)
+	bob := "bob@mute.berlin"
+	bobUID, bobKE := createStatusUID(t, bob)
+
+	// Bob prefers XSalsa20
+	bobUID.UIDContent.PREFERENCES.CIPHERSUITES = []string{
+		uid.XSalsa20Ciphersuite,
+		uid.DefaultCiphersuite,
+	}
+	bobKeyStore := memstore.New()
+	bobKeyStore.AddPrivateKeyEntry(bobKE)
+	encMsg := encryptStatus(t, aliceUID, bobUID, memstoreWith(bob, bobKE),
+		"XSalsa20", StatusOK)
+	_, content, _, err := decryptStatus(t, bobUID, bobKeyStore, encMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != "XSalsa20" {
+		t.Fatal("wrong message")
+	}
+
+	// Bob rejects ciphersuites he didn't advertise
+	advertised := *bobUID
+	advertised.UIDContent.PREFERENCES.CIPHERSUITES = []string{
+		uid.XSalsa20Ciphersuite,
+	}
+	encMsg = encryptStatus(t, aliceUID, &advertised, memstoreWith(bob, bobKE),
+		"rejected", StatusOK)
+	bobUID.UIDContent.PREFERENCES.CIPHERSUITES = []string{
+		uid.DefaultCiphersuite,
+	}
+	_, _, _, err = decryptStatus(t, bobUID, bobKeyStore, encMsg)
+	if err != ErrCiphersuiteNotAdvertised {
+		t.Errorf("should fail with ErrCiphersuiteNotAdvertised: %v", err)
+	}
+}
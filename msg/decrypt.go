@@ -13,18 +13,18 @@ import (
 	"io"
 
 	"github.com/mutecomm/mute/cipher"
-	"github.com/mutecomm/mute/cipher/aes256"
 	"github.com/mutecomm/mute/encode/base64"
 	"github.com/mutecomm/mute/log"
-	"github.com/mutecomm/mute/msg/mime"
 	"github.com/mutecomm/mute/msg/session"
 	"github.com/mutecomm/mute/uid"
+	"github.com/mutecomm/mute/util/times"
 )
 
 func rootKeyAgreementRecipient(
 	senderHeaderPub *[32]byte,
 	senderIdentity, recipientIdentity string,
 	senderSession, senderID, recipientKI, recipientID *uid.KeyEntry,
+	staticKey bool,
 	previousRootKeyHash *[64]byte,
 	numOfKeys uint64,
 	keyStore session.Store,
@@ -43,8 +43,14 @@ func rootKeyAgreementRecipient(
 	log.Debugf("recipientKeyInitPub:  %s", base64.Encode(recipientKeyInitPub[:]))
 
 	// check keys to prevent reflection attacks and replays
+	// (static key sessions use the identity key as KeyInit key, which is
+	// only allowed for recipients with an optional PFS preference)
+	k4 := recipientKeyInitPub
+	if staticKey {
+		k4 = nil
+	}
 	err := checkKeys(senderHeaderPub, senderIdentityPub, senderSessionPub,
-		recipientIdentityPub, recipientKeyInitPub)
+		recipientIdentityPub, k4)
 	if err != nil {
 		return err
 	}
@@ -85,13 +91,23 @@ func rootKeyAgreementRecipient(
 
 // DecryptArgs contains all arguments for a message decryption.
 type DecryptArgs struct {
-	Writer     io.Writer      // decrypted message is written here
-	Identities []*uid.Message // list of recipient UID messages
-	PreHeader  []byte         // preHeader read with ReadFirstOuterHeader()
-	Reader     io.Reader      // data to decrypt is read here (not base64 encoded)
-	NumOfKeys  uint64         // number of generated sessions keys (default: NumOfFutureKeys)
-	Rand       io.Reader      // random source
-	KeyStore   session.Store  // for managing session keys
+	Writer         io.Writer      // decrypted message is written here
+	Identities     []*uid.Message // list of recipient UID messages
+	PreHeader      []byte         // preHeader read with ReadFirstOuterHeader()
+	Reader         io.Reader      // data to decrypt is read here (not base64 encoded)
+	NumOfKeys      uint64         // number of generated sessions keys (default: NumOfFutureKeys)
+	MaxSkippedKeys uint64         // max. number of skipped message keys (default: MaxSkippedKeys)
+	Rand           io.Reader      // random source
+	KeyStore       session.Store  // for managing session keys
+}
+
+// Sender contains the sender UID message of a decrypted message. It can be
+// verified against the local key hash chain, instead of requesting it from
+// the key server (which would reveal who is writing to us).
+type Sender struct {
+	UID              *uid.Message // sender UID message from the header
+	UIDIndex         []byte       // UIDIndex = SHA256(SHA256(UIDMessage))
+	LastKeychainHash string       // last hash chain entry known to the sender
 }
 
 // Decrypt decrypts a message with the argument given in args.
@@ -99,21 +115,45 @@ type DecryptArgs struct {
 // If the message was signed and the signature could be verified successfully
 // the base64 encoded signature is returned. If the message was signed and the
 // signature could not be verfied an error is returned.
-func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
+// The status code of the message is returned. Messages with StatusReset or
+// StatusError are empty, they reset the session state with the sender to the
+// session started by the message.
+// If the session of the message is unknown, ErrStatusError (or
+// ErrStatusReset for messages with StatusError) is returned together with the
+// senderID. Such a message cannot be authenticated (the senderID might be
+// forged) and the session state is left unchanged. The caller must not reply
+// automatically, but can reset the session with the sender by sending an
+// (empty) message with StatusReset.
+// The session state is only changed after the message has been authenticated.
+// Messages can be decrypted out of order, the message keys of skipped
+// messages are retained for CleanupTime. The number of messages which have
+// been skipped for the first time by this message is returned as lost, the
+// skipped messages are possibly lost (or just delayed).
+// The sender UID message contained in the message is returned as senderUID.
+func Decrypt(args *DecryptArgs) (
+	senderID, sig string,
+	status StatusCode,
+	lost uint64,
+	senderUID *Sender,
+	err error,
+) {
 	log.Debug("msg.Decrypt()")
 
 	// set default
 	if args.NumOfKeys == 0 {
 		args.NumOfKeys = NumOfFutureKeys
 	}
+	if args.MaxSkippedKeys == 0 {
+		args.MaxSkippedKeys = MaxSkippedKeys
+	}
 
 	// read pre-header
 	ph, err := readPreHeader(bytes.NewBuffer(args.PreHeader))
 	if err != nil {
-		return "", "", err
+		return "", "", 0, 0, nil, err
 	}
 	if ph.LengthSenderHeaderPub != 32 {
-		return "", "", log.Errorf("msg: ph.LengthSenderHeaderPub != 32")
+		return "", "", 0, 0, nil, log.Errorf("msg: ph.LengthSenderHeaderPub != 32")
 	}
 	var senderHeaderPub [32]byte
 	copy(senderHeaderPub[:], ph.SenderHeaderPub)
@@ -121,22 +161,31 @@ func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
 	// read header packet
 	oh, err := readOuterHeader(args.Reader)
 	if err != nil {
-		return "", "", err
+		return "", "", 0, 0, nil, err
 	}
 	if oh.Type != encryptedHeader {
-		return "", "", log.Error(ErrNotEncryptedHeader)
+		return "", "", 0, 0, nil, log.Error(ErrNotEncryptedHeader)
 	}
 	count := uint32(1)
 	if oh.PacketCount != count {
-		return "", "", log.Error(ErrWrongCount)
+		return "", "", 0, 0, nil, log.Error(ErrWrongCount)
 	}
 	count++
 	identity, h, err := readHeader(&senderHeaderPub, args.Identities,
 		bytes.NewBuffer(oh.inner))
 	if err != nil {
-		return "", "", err
+		return "", "", 0, 0, nil, err
+	}
+	if h.Status > StatusError {
+		return "", "", 0, 0, nil, log.Error(ErrUnknownStatus)
+	}
+	// only accept ciphersuites we advertised
+	suite, err := getCiphersuite(identity, h.Ciphersuite)
+	if err != nil {
+		return "", "", 0, 0, nil, err
 	}
 	senderID = h.SenderIdentity
+	status = h.Status
 	recipientID := identity.PubKey()
 
 	log.Debugf("senderID:    %s", h.SenderIdentityPub.HASH)
@@ -164,27 +213,59 @@ func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
 		h.SenderIdentityPub.PublicKey32())
 	ss, err := args.KeyStore.GetSessionState(sessionStateKey)
 	if err != nil {
-		return "", "", err
+		return "", "", 0, 0, nil, err
+	}
+	if ss != nil {
+		// work on a copy, the header has not been authenticated yet
+		state := *ss
+		ss = &state
 	}
 	sessionKey := session.CalcKey(recipientID.HASH, h.SenderIdentityPub.HASH,
 		h.RecipientTempHash, h.SenderSessionPub.HASH)
 
+	// the session state is only changed after the message has been
+	// authenticated (see HMAC verification below)
+	var (
+		setSessionState   bool // store ss
+		consumeKeyInit    bool // delete single-use KeyInit message
+		delPrivSessionKey bool // delete private session key
+	)
+
+	if h.Status != StatusOK && !args.KeyStore.HasSession(sessionKey) {
+		// the sender reset the session -> pick up the session started by the
+		// sender (replaces the session state)
+		log.Debugf("session reset by sender (status=%s)", h.Status)
+		ss = nil
+	}
+
 	if !args.KeyStore.HasSession(sessionKey) { // session unknown
 		// try to start session from KeyInit message
-		recipientKI, err := args.KeyStore.GetPrivateKeyEntry(h.RecipientTempHash)
-		if err != nil && err != session.ErrNoKeyEntry {
-			return "", "", err
+		var recipientKI *uid.KeyEntry
+		staticKey := h.RecipientTempHash == recipientID.HASH
+		if staticKey {
+			// message was encrypted to the static key of the recipient,
+			// which is only allowed with an optional PFS preference
+			if identity.PFSPreference() != uid.Optional {
+				return senderID, "", 0, 0, nil, log.Error(ErrStaticKey)
+			}
+			recipientKI = recipientID
+		} else {
+			recipientKI, err = args.KeyStore.GetPrivateKeyEntry(h.RecipientTempHash)
+			if err != nil && err != session.ErrNoKeyEntry {
+				return "", "", 0, 0, nil, err
+			}
 		}
-		if err != session.ErrNoKeyEntry { // KeyInit message found
+		if recipientKI != nil { // KeyInit message (or static key) found
 			// root key agreement
 			err = rootKeyAgreementRecipient(&senderHeaderPub, sender, recipient,
 				&h.SenderSessionPub, &h.SenderIdentityPub, recipientKI, recipientID,
-				nil, args.NumOfKeys, args.KeyStore)
+				staticKey, nil, args.NumOfKeys, args.KeyStore)
 			if err != nil {
-				return "", "", err
+				return "", "", 0, 0, nil, err
 			}
 
-			// TODO: delete single-use KeyInit message
+			// delete single-use KeyInit message (after authentication)
+			consumeKeyInit = !staticKey
 
 			// use the 'smaller' session as the definite one
 			// TODO: h.SenderSessionPub.HASH < ss.SenderSessionPub.HASH
@@ -192,26 +273,26 @@ func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
 				// create next session key
 				var nextSenderSession uid.KeyEntry
 				if err := nextSenderSession.InitDHKey(args.Rand); err != nil {
-					return "", "", err
+					return "", "", 0, 0, nil, err
 				}
 				// store next session key
 				err := addSessionKey(args.KeyStore, &nextSenderSession)
 				if err != nil {
-					return "", "", err
+					return "", "", 0, 0, nil, err
 				}
 				// if we already got h.NextSenderSessionPub prepare next session
 				if h.NextSenderSessionPub != nil {
 					previousRootKeyHash, err := args.KeyStore.GetRootKeyHash(sessionKey)
 					if err != nil {
-						return "", "", err
+						return "", "", 0, 0, nil, err
 					}
 					// root key agreement
 					err = rootKeyAgreementSender(&senderHeaderPub, recipient,
 						sender, &nextSenderSession, recipientID,
-						h.NextSenderSessionPub, &h.SenderIdentityPub,
+						h.NextSenderSessionPub, &h.SenderIdentityPub, false,
 						previousRootKeyHash, args.NumOfKeys, args.KeyStore)
 					if err != nil {
-						return "", "", err
+						return "", "", 0, 0, nil, err
 					}
 				}
 				// set session state
@@ -226,18 +307,25 @@ func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
 					NymAddress:                  h.NymAddress,
 					KeyInitSession:              false,
 				}
-				err = args.KeyStore.SetSessionState(sessionStateKey, ss)
-				if err != nil {
-					return "", "", err
-				}
+				setSessionState = true
 			}
 		} else { // no KeyInit message found
-			// TODO: ???
+			// the session cannot be started and the message cannot be
+			// authenticated, leave the session state alone
+			switch h.Status {
+			case StatusOK:
+				return senderID, "", 0, 0, nil, log.Error(ErrStatusError)
+			case StatusError:
+				return senderID, "", 0, 0, nil, log.Error(ErrStatusReset)
+			default:
+				return "", "", 0, 0, nil, log.Error(ErrUnknownSession)
+			}
 		}
 	} else { // session known
 		log.Debug("session known")
 		// check if session state reflects that session
-		if h.RecipientTempHash == ss.SenderSessionPub.HASH &&
+		// (the session state might have been deleted, see ErrStatusError)
+		if ss != nil && h.RecipientTempHash == ss.SenderSessionPub.HASH &&
 			h.SenderSessionPub.HASH == ss.RecipientTemp.HASH {
 			log.Debug("session state reflects that session")
 			if h.NextSenderSessionPub != nil {
@@ -251,30 +339,31 @@ func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
 				// ours immediately
 				if ss.NextSenderSessionPub == nil {
 					// prepare upcoming session, but do not switch to it yet
-					nextSenderSession, err := setNextSenderSessionPub(args.KeyStore, ss,
-						sessionStateKey, args.Rand)
+					var nextSenderSession uid.KeyEntry
+					if err := nextSenderSession.InitDHKey(args.Rand); err != nil {
+						return "", "", 0, 0, nil, err
+					}
+					err := addSessionKey(args.KeyStore, &nextSenderSession)
 					if err != nil {
-						return "", "", err
+						return "", "", 0, 0, nil, err
 					}
+					ss.NextSenderSessionPub = &nextSenderSession
+					setSessionState = true
 					previousRootKeyHash, err := args.KeyStore.GetRootKeyHash(sessionKey)
 					if err != nil {
-						return "", "", err
+						return "", "", 0, 0, nil, err
 					}
 					// root key agreement
 					err = rootKeyAgreementSender(&senderHeaderPub, recipient,
-						sender, nextSenderSession, recipientID,
-						h.NextSenderSessionPub, &h.SenderIdentityPub,
+						sender, &nextSenderSession, recipientID,
+						h.NextSenderSessionPub, &h.SenderIdentityPub, false,
 						previousRootKeyHash, args.NumOfKeys, args.KeyStore)
 					if err != nil {
-						return "", "", err
+						return "", "", 0, 0, nil, err
 					}
 					if ss.NextRecipientSessionPubSeen == nil {
 						// save h.NextSenderSessionPub, if necessary
 						ss.NextRecipientSessionPubSeen = h.NextSenderSessionPub
-						err := args.KeyStore.SetSessionState(sessionStateKey, ss)
-						if err != nil {
-							return "", "", err
-						}
 					}
 				} else if h.NextRecipientSessionPubSeen != nil &&
 					h.NextRecipientSessionPubSeen.HASH == ss.NextSenderSessionPub.HASH {
@@ -282,19 +371,19 @@ func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
 					nextSenderSession, err := getSessionKey(args.KeyStore,
 						ss.NextSenderSessionPub.HASH)
 					if err != nil {
-						return "", "", err
+						return "", "", 0, 0, nil, err
 					}
 					previousRootKeyHash, err := args.KeyStore.GetRootKeyHash(sessionKey)
 					if err != nil {
-						return "", "", err
+						return "", "", 0, 0, nil, err
 					}
 					// root key agreement
 					err = rootKeyAgreementRecipient(&senderHeaderPub, sender,
 						recipient, h.NextSenderSessionPub, &h.SenderIdentityPub,
-						nextSenderSession, recipientID, previousRootKeyHash,
+						nextSenderSession, recipientID, false, previousRootKeyHash,
 						args.NumOfKeys, args.KeyStore)
 					if err != nil {
-						return "", "", err
+						return "", "", 0, 0, nil, err
 					}
 					// store new session state
 					ss = &session.State{
@@ -308,15 +397,12 @@ func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
 						NymAddress:                  h.NymAddress,
 						KeyInitSession:              false,
 					}
-					err = args.KeyStore.SetSessionState(sessionStateKey, ss)
-					if err != nil {
-						return "", "", err
-					}
+					setSessionState = true
 				}
 			}
 		} else {
 			// check if session matches next session
-			if ss.NextSenderSessionPub != nil &&
+			if ss != nil && ss.NextSenderSessionPub != nil &&
 				ss.NextRecipientSessionPubSeen != nil &&
 				ss.NextSenderSessionPub.HASH == h.RecipientTempHash &&
 				ss.NextRecipientSessionPubSeen.HASH == h.SenderSessionPub.HASH {
@@ -332,50 +418,49 @@ func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
 					NymAddress:                  h.NymAddress,
 					KeyInitSession:              false,
 				}
-				err = args.KeyStore.SetSessionState(sessionStateKey, ss)
-				if err != nil {
-					return "", "", err
-				}
+				setSessionState = true
 			}
 		}
 		// a message with this session key has been decrypted -> delete key
-		if err := args.KeyStore.DelPrivSessionKey(h.RecipientTempHash); err != nil {
-			return "", "", err
-		}
+		// (after authentication)
+		delPrivSessionKey = true
 	}
 
 	// make sure we got enough message keys
+	// (additional keys are only stored after authentication, otherwise forged
+	// messages could fill the key store)
 	n, err := args.KeyStore.NumMessageKeys(sessionKey)
 	if err != nil {
-		return "", "", err
+		return "", "", 0, 0, nil, err
 	}
+	var moreKeys *messageKeys
 	if h.SenderMessageCount >= n {
-		// generate more message keys
-		log.Debugf("generate more message keys (h.SenderMessageCount=%d, n=%d)",
+		// derive more message keys
+		log.Debugf("derive more message keys (h.SenderMessageCount=%d, n=%d)",
 			h.SenderMessageCount, n)
+		// prevent denial of service attack by very large h.SenderMessageCount
+		if h.SenderMessageCount-n >= args.MaxSkippedKeys {
+			return "", "", 0, 0, nil, log.Error(ErrTooManySkippedKeys)
+		}
 		chainKey, err := args.KeyStore.GetChainKey(sessionKey)
 		if err != nil {
-			return "", "", err
-		}
-		// prevent denial of service attack by very large h.SenderMessageCount
-		numOfKeys := h.SenderMessageCount / args.NumOfKeys
-		if h.SenderMessageCount%args.NumOfKeys > 0 {
-			numOfKeys++
+			return "", "", 0, 0, nil, err
 		}
+		// the keys are derived from the chain key after the last n keys,
+		// derive the keys up to h.SenderMessageCount (in multiples of
+		// args.NumOfKeys)
+		numOfKeys := (h.SenderMessageCount - n) / args.NumOfKeys
+		numOfKeys++
 		numOfKeys *= args.NumOfKeys
-		if numOfKeys > mime.MaxMsgSize/MaxContentLength+NumOfFutureKeys {
-			return "", "",
-				log.Errorf("msg: requested number of message keys too large")
-		}
 		log.Debugf("numOfKeys=%d", numOfKeys)
 		var recipientPub *[32]byte
-		if h.RecipientTempHash == ss.SenderSessionPub.HASH {
+		if ss != nil && h.RecipientTempHash == ss.SenderSessionPub.HASH {
 			recipientPub = ss.SenderSessionPub.PublicKey32()
 		} else {
 			log.Debug("different session")
 			recipientKI, err := args.KeyStore.GetPrivateKeyEntry(h.RecipientTempHash)
 			if err != nil && err != session.ErrNoKeyEntry {
-				return "", "", err
+				return "", "", 0, 0, nil, err
 			}
 			if err != session.ErrNoKeyEntry {
 				recipientPub = recipientKI.PublicKey32()
@@ -383,78 +468,79 @@ func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
 				recipientKE, err := getSessionKey(args.KeyStore,
 					h.RecipientTempHash)
 				if err != nil {
-					return "", "", err
+					return "", "", 0, 0, nil, err
 				}
 				recipientPub = recipientKE.PublicKey32()
 			}
 		}
-		err = generateMessageKeys(sender, recipient, h.SenderIdentityPub.HASH,
+		moreKeys = deriveMessageKeys(sender, recipient, h.SenderIdentityPub.HASH,
 			recipientID.HASH, chainKey, true,
-			h.SenderSessionPub.PublicKey32(), recipientPub, numOfKeys,
-			args.KeyStore)
-		if err != nil {
-			return "", "", err
-		}
+			h.SenderSessionPub.PublicKey32(), recipientPub, numOfKeys)
 	}
 
 	// get message key
-	messageKey, err := args.KeyStore.GetMessageKey(sessionKey, false,
-		h.SenderMessageCount)
+	var messageKey *[64]byte
+	if moreKeys != nil {
+		messageKey, err = moreKeys.recipientKey(h.SenderMessageCount - n)
+	} else {
+		messageKey, err = args.KeyStore.GetMessageKey(sessionKey, false,
+			h.SenderMessageCount)
+	}
 	if err != nil {
-		return "", "", err
+		return "", "", 0, 0, nil, err
 	}
 
 	// derive symmetric keys
 	cryptoKey, hmacKey, err := deriveSymmetricKeys(messageKey)
 	if err != nil {
-		return "", "", err
+		return "", "", 0, 0, nil, err
 	}
 
 	// read crypto setup packet
 	oh, err = readOuterHeader(args.Reader)
 	if err != nil {
-		return "", "", err
+		return "", "", 0, 0, nil, err
 	}
 	if oh.Type != cryptoSetup {
-		return "", "", log.Error(ErrNotCryptoSetup)
+		return "", "", 0, 0, nil, log.Error(ErrNotCryptoSetup)
 	}
 	if oh.PacketCount != count {
-		return "", "", log.Error(ErrWrongCount)
+		return "", "", 0, 0, nil, log.Error(ErrWrongCount)
 	}
 	count++
 	if oh.PLen != aes.BlockSize {
-		return "", "", log.Error(ErrWrongCryptoSetup)
+		return "", "", 0, 0, nil, log.Error(ErrWrongCryptoSetup)
 	}
 	iv := oh.inner
 
 	// start HMAC calculation
 	mac := hmac.New(sha512.New, hmacKey)
 	if err := oh.write(mac, true); err != nil {
-		return "", "", err
+		return "", "", 0, 0, nil, err
 	}
 
 	// actual decryption
 	oh, err = readOuterHeader(args.Reader)
 	if err != nil {
-		return "", "", err
+		return "", "", 0, 0, nil, err
 	}
 	if oh.Type != encryptedPacket {
-		return "", "", log.Error(ErrNotEncryptedPacket)
+		return "", "", 0, 0, nil, log.Error(ErrNotEncryptedPacket)
 	}
 	if oh.PacketCount != count {
-		return "", "", log.Error(ErrWrongCount)
+		return "", "", 0, 0, nil, log.Error(ErrWrongCount)
 	}
 	count++
 	ciphertext := oh.inner
 	plaintext := make([]byte, len(ciphertext))
-	stream := aes256.CTRStream(cryptoKey, iv)
+	stream := suite.stream(cryptoKey, iv)
 	stream.XORKeyStream(plaintext, ciphertext)
 	ih, err := readInnerHeader(bytes.NewBuffer(plaintext))
 	if err != nil {
-		return "", "", err
+		return "", "", 0, 0, nil, err
 	}
 	if ih.Type&dataType == 0 {
-		return "", "", log.Error(ErrNotData)
+		return "", "", 0, 0, nil, log.Error(ErrNotData)
 	}
 	var contentHash []byte
 	if ih.Type&signType != 0 {
@@ -462,12 +548,12 @@ func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
 		contentHash = cipher.SHA512(ih.content)
 	}
 	if _, err := args.Writer.Write(ih.content); err != nil {
-		return "", "", log.Error(err)
+		return "", "", 0, 0, nil, log.Error(err)
 	}
 
 	// continue HMAC calculation
 	if err := oh.write(mac, true); err != nil {
-		return "", "", err
+		return "", "", 0, 0, nil, err
 	}
 
 	// verify signature
@@ -475,19 +561,19 @@ func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
 	if contentHash != nil {
 		oh, err = readOuterHeader(args.Reader)
 		if err != nil {
-			return "", "", err
+			return "", "", 0, 0, nil, err
 		}
 		if oh.Type != encryptedPacket {
-			return "", "", log.Error(ErrNotEncryptedPacket)
+			return "", "", 0, 0, nil, log.Error(ErrNotEncryptedPacket)
 		}
 		if oh.PacketCount != count {
-			return "", "", log.Error(ErrWrongCount)
+			return "", "", 0, 0, nil, log.Error(ErrWrongCount)
 		}
 		count++
 
 		// continue HMAC calculation
 		if err := oh.write(mac, true); err != nil {
-			return "", "", err
+			return "", "", 0, 0, nil, err
 		}
 
 		ciphertext = oh.inner
@@ -495,33 +581,33 @@ func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
 		stream.XORKeyStream(plaintext, ciphertext)
 		ih, err = readInnerHeader(bytes.NewBuffer(plaintext))
 		if err != nil {
-			return "", "", err
+			return "", "", 0, 0, nil, err
 		}
 		if ih.Type&signatureType == 0 {
-			return "", "", log.Error(ErrNotSignaturePacket)
+			return "", "", 0, 0, nil, log.Error(ErrNotSignaturePacket)
 		}
 
 		if len(ih.content) != ed25519.SignatureSize {
-			return "", "", log.Error(ErrWrongSignatureLength)
+			return "", "", 0, 0, nil, log.Error(ErrWrongSignatureLength)
 		}
 
 		copy(sigBuf[:], ih.content)
 	} else {
 		oh, err = readOuterHeader(args.Reader)
 		if err != nil {
-			return "", "", err
+			return "", "", 0, 0, nil, err
 		}
 		if oh.Type != encryptedPacket {
-			return "", "", log.Error(ErrNotEncryptedPacket)
+			return "", "", 0, 0, nil, log.Error(ErrNotEncryptedPacket)
 		}
 		if oh.PacketCount != count {
-			return "", "", log.Error(ErrWrongCount)
+			return "", "", 0, 0, nil, log.Error(ErrWrongCount)
 		}
 		count++
 
 		// continue HMAC calculation
 		if err := oh.write(mac, true); err != nil {
-			return "", "", err
+			return "", "", 0, 0, nil, err
 		}
 
 		ciphertext = oh.inner
@@ -529,22 +615,32 @@ func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
 		stream.XORKeyStream(plaintext, ciphertext)
 		ih, err = readInnerHeader(bytes.NewBuffer(plaintext))
 		if err != nil {
-			return "", "", err
+			return "", "", 0, 0, nil, err
 		}
 		if ih.Type&paddingType == 0 {
-			return "", "", log.Error(ErrNotPaddingPacket)
+			return "", "", 0, 0, nil, log.Error(ErrNotPaddingPacket)
 		}
 	}
 	// get processed sender UID
 	uidRes := <-res
 	if uidRes.err != nil {
-		return "", "", uidRes.err
+		return "", "", 0, 0, nil, uidRes.err
+	}
+	// the sender UID message must belong to the sender identity (key)
+	if uidRes.msg.Identity() != h.SenderIdentity ||
+		uidRes.msg.PubKey().HASH != h.SenderIdentityPub.HASH {
+		return "", "", 0, 0, nil, log.Error(ErrSenderUIDMismatch)
+	}
+	senderUID = &Sender{
+		UID:              uidRes.msg,
+		UIDIndex:         uidRes.uidIndex,
+		LastKeychainHash: h.SenderLastKeychainHash,
 	}
 
 	// verify signature, if necessary
 	if contentHash != nil {
 		if !ed25519.Verify(uidRes.msg.PublicSigKey32()[:], contentHash, sigBuf[:]) {
-			return "", "", log.Error(ErrInvalidSignature)
+			return "", "", 0, 0, nil, log.Error(ErrInvalidSignature)
 		}
 		// encode signature to base64 as return value
 		sig = base64.Encode(sigBuf[:])
@@ -553,29 +649,66 @@ func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
 	// read HMAC packet
 	oh, err = readOuterHeader(args.Reader)
 	if err != nil {
-		return "", "", err
+		return "", "", 0, 0, nil, err
 	}
 	if oh.Type != hmacPacket {
-		return "", "", log.Error(ErrNotHMACPacket)
+		return "", "", 0, 0, nil, log.Error(ErrNotHMACPacket)
 	}
 	if oh.PacketCount != count {
-		return "", "", log.Error(ErrWrongCount)
+		return "", "", 0, 0, nil, log.Error(ErrWrongCount)
 	}
 	count++
 	if err := oh.write(mac, false); err != nil {
-		return "", "", err
+		return "", "", 0, 0, nil, err
 	}
 	sum := mac.Sum(nil)
 	log.Debugf("HMAC:       %s", base64.Encode(sum))
 
 	if !hmac.Equal(sum, oh.inner) {
-		return "", "", log.Error(ErrHMACsDiffer)
+		return "", "", 0, 0, nil, log.Error(ErrHMACsDiffer)
+	}
+
+	// the message has been authenticated -> update session state
+	if setSessionState {
+		if err := args.KeyStore.SetSessionState(sessionStateKey, ss); err != nil {
+			return "", "", 0, 0, nil, err
+		}
+	}
+	if consumeKeyInit {
+		err := args.KeyStore.ConsumePrivateKeyEntry(h.RecipientTempHash)
+		if err != nil {
+			return "", "", 0, 0, nil, err
+		}
+	}
+	if delPrivSessionKey {
+		if err := args.KeyStore.DelPrivSessionKey(h.RecipientTempHash); err != nil {
+			return "", "", 0, 0, nil, err
+		}
+	}
+	if moreKeys != nil {
+		if err := moreKeys.store(args.KeyStore); err != nil {
+			return "", "", 0, 0, nil, err
+		}
 	}
 
 	// delete message key
 	err = args.KeyStore.DelMessageKey(sessionKey, false, h.SenderMessageCount)
 	if err != nil {
-		return "", "", err
+		return "", "", 0, 0, nil, err
+	}
+
+	// retain keys of skipped messages and remove expired ones
+	now := uint64(times.Now())
+	lost, err = args.KeyStore.SkipMessageKeys(sessionKey, h.SenderMessageCount,
+		now+CleanupTime)
+	if err != nil {
+		return "", "", 0, 0, nil, err
+	}
+	if lost > 0 {
+		log.Debugf("%d message(s) possibly lost", lost)
+	}
+	if err := args.KeyStore.CleanupMessageKeys(now); err != nil {
+		return "", "", 0, 0, nil, err
 	}
 
 	return
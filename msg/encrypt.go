@@ -16,7 +16,6 @@ import (
 	"math/big"
 
 	"github.com/mutecomm/mute/cipher"
-	"github.com/mutecomm/mute/cipher/aes256"
 	"github.com/mutecomm/mute/encode/base64"
 	"github.com/mutecomm/mute/log"
 	"github.com/mutecomm/mute/msg/padding"
@@ -28,6 +27,7 @@ func rootKeyAgreementSender(
 	senderHeaderPub *[32]byte,
 	senderIdentity, recipientIdentity string,
 	senderSession, senderID, recipientKI, recipientID *uid.KeyEntry,
+	staticKey bool,
 	previousRootKeyHash *[64]byte,
 	numOfKeys uint64,
 	keyStore session.Store,
@@ -45,8 +45,14 @@ func rootKeyAgreementSender(
 	log.Debugf("recipientKeyInitPub:  %s", base64.Encode(recipientKeyInitPub[:]))
 
 	// check keys to prevent reflection attacks and replays
+	// (static key sessions use the identity key as KeyInit key, which is
+	// only allowed for recipients with an optional PFS preference)
+	k4 := recipientKeyInitPub
+	if staticKey {
+		k4 = nil
+	}
 	err := checkKeys(senderHeaderPub, senderIdentityPub, senderSessionPub,
-		recipientIdentityPub, recipientKeyInitPub)
+		recipientIdentityPub, k4)
 	if err != nil {
 		return err
 	}
@@ -114,6 +120,13 @@ func Encrypt(args *EncryptArgs) (nymAddress string, err error) {
 		args.AvgSessionSize = AverageSessionSize
 	}
 
+	// negotiate ciphersuite
+	ciphersuite, err := NegotiateCiphersuite(args.From, args.To)
+	if err != nil {
+		return "", err
+	}
+	log.Debugf("ciphersuite: %s", ciphersuite)
+
 	// create sender key
 	senderHeaderKey, err := cipher.Curve25519Generate(cipher.RandReader)
 	if err != nil {
@@ -155,8 +168,19 @@ func Encrypt(args *EncryptArgs) (nymAddress string, err error) {
 		// no session found -> start first session
 		log.Debug("no session found -> start first session")
 		var recipientTemp *uid.KeyEntry
+		var staticKey bool
 		recipientTemp, nymAddress, err = args.KeyStore.GetPublicKeyEntry(args.To)
-		if err != nil {
+		if err == session.ErrNoKeyEntry {
+			// no KeyInit message available -> use static key of recipient,
+			// if the PFS preference of the recipient allows it
+			if args.To.PFSPreference() != uid.Optional {
+				return "", log.Error(ErrNoKeyInit)
+			}
+			log.Debug("no KeyInit found -> use static key")
+			recipientTemp = args.To.PubKey()
+			nymAddress = args.To.NymAddress()
+			staticKey = true
+		} else if err != nil {
 			return "", err
 		}
 		// create session key
@@ -171,8 +195,8 @@ func Encrypt(args *EncryptArgs) (nymAddress string, err error) {
 		// root key agreement
 		err = rootKeyAgreementSender(senderHeaderKey.PublicKey(),
 			args.From.Identity(), args.To.Identity(), &senderSession,
-			args.From.PubKey(), recipientTemp, args.To.PubKey(), nil,
-			args.NumOfKeys, args.KeyStore)
+			args.From.PubKey(), recipientTemp, args.To.PubKey(), staticKey,
+			nil, args.NumOfKeys, args.KeyStore)
 		if err != nil {
 			return "", err
 		}
@@ -219,7 +243,7 @@ func Encrypt(args *EncryptArgs) (nymAddress string, err error) {
 	log.Debugf("ss.SenderSessionCount: %d", ss.SenderSessionCount)
 	log.Debugf("ss.SenderMessageCount: %d", ss.SenderMessageCount)
 	log.Debugf("ss.RecipientTempHash:  %s", ss.RecipientTemp.HASH)
-	h, err := newHeader(args.From, args.To, ss.RecipientTemp.HASH,
+	h, err := newHeader(args.From, args.To, ciphersuite, ss.RecipientTemp.HASH,
 		&ss.SenderSessionPub, ss.NextSenderSessionPub,
 		ss.NextRecipientSessionPubSeen, args.NymAddress, ss.SenderSessionCount,
 		ss.SenderMessageCount, args.SenderLastKeychainHash, args.Rand,
@@ -344,7 +368,7 @@ func Encrypt(args *EncryptArgs) (nymAddress string, err error) {
 	if err := ih.write(&buf); err != nil {
 		return "", err
 	}
-	stream := aes256.CTRStream(cryptoKey, iv)
+	stream := ciphersuites[ciphersuite].stream(cryptoKey, iv)
 	stream.XORKeyStream(buf.Bytes(), buf.Bytes())
 	oh = newOuterHeader(encryptedPacket, count, buf.Bytes())
 	if err := oh.write(wc, true); err != nil {
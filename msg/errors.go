@@ -57,4 +57,47 @@ var ErrNotData = errors.New("msg: expected inner data header")
 var ErrReflection = errors.New("msg: reflection attack detected")
 
 // ErrStatusError is raised when a decryption operation lead to a StatusCode StatusError.
+// That is, the session of the message is unknown and the session with the
+// sender could be restarted with a message with StatusError. The message
+// has not been authenticated.
 var ErrStatusError = errors.New("msg: StatusCode == StatusError")
+
+// ErrStatusReset is raised when a decryption operation lead to a StatusCode
+// StatusReset. That is, a message with StatusError could not be decrypted and
+// the sender should be sent a message with StatusReset.
+var ErrStatusReset = errors.New("msg: StatusCode == StatusReset")
+
+// ErrUnknownSession is raised when the session of a message with StatusReset
+// is unknown (no further status message is sent to prevent loops).
+var ErrUnknownSession = errors.New("msg: session unknown")
+
+// ErrUnknownStatus is raised when a message header has an unknown status
+// code.
+var ErrUnknownStatus = errors.New("msg: unknown status code")
+
+// ErrStaticKey is raised when a message was encrypted to the static key of a
+// recipient whose PFS preference is not optional.
+var ErrStaticKey = errors.New("msg: static key message refused (PFS preference not optional)")
+
+// ErrNoKeyInit is raised when no KeyInit message is available for a recipient
+// whose PFS preference is not optional.
+var ErrNoKeyInit = errors.New("msg: no KeyInit message for recipient (PFS preference not optional)")
+
+// ErrNoCiphersuite is raised when sender and recipient do not have a
+// supported ciphersuite in common.
+var ErrNoCiphersuite = errors.New("msg: no common ciphersuite")
+
+// ErrCiphersuiteNotAdvertised is raised when a message uses a ciphersuite
+// which has not been advertised by the recipient.
+var ErrCiphersuiteNotAdvertised = errors.New("msg: ciphersuite not advertised by recipient")
+
+// ErrUnknownCiphersuite is raised when a message uses an unknown ciphersuite.
+var ErrUnknownCiphersuite = errors.New("msg: unknown ciphersuite")
+
+// ErrTooManySkippedKeys is raised when decrypting a message would require to
+// skip more message keys than allowed (see DecryptArgs.MaxSkippedKeys).
+var ErrTooManySkippedKeys = errors.New("msg: too many skipped message keys")
+
+// ErrSenderUIDMismatch is raised when the sender UID message contained in a
+// message does not match the sender identity or the sender identity key.
+var ErrSenderUIDMismatch = errors.New("msg: sender UID message does not match sender")
@@ -23,22 +23,47 @@ import (
 )
 
 // lengthEncryptedHeader defines the length of an encrypted header.
-// This must always be the same in all messages! 5852 + 1316 = 7168.
+// This must always be the same in all messages! 5906 + 1262 = 7168.
 const lengthEncryptedHeader = 7168
 
 // Some wiggle room which can be taken out of padding if the need arises.
-const wiggleRoom = 1316
+const wiggleRoom = 1262
 
 // StatusCode is the type of header status codes.
 type StatusCode uint8
 
 // Possible header status codes.
 const (
-	StatusOK    = 0
-	StatusReset = 1
-	StatusError = 2
+	StatusOK    StatusCode = 0
+	StatusReset StatusCode = 1
+	StatusError StatusCode = 2
 )
 
+var statusCodes = []string{
+	"ok",
+	"reset",
+	"error",
+}
+
+// String returns the string representation of statusCode.
+func (statusCode StatusCode) String() string {
+	if int(statusCode) >= len(statusCodes) {
+		return "unknown"
+	}
+	return statusCodes[statusCode]
+}
+
+// ParseStatusCode returns the status code for the string representation s
+// (see StatusCode.String).
+func ParseStatusCode(s string) (StatusCode, error) {
+	for i, statusCode := range statusCodes {
+		if s == statusCode {
+			return StatusCode(i), nil
+		}
+	}
+	return 0, log.Errorf("msg: unknown status code: %s", s)
+}
+
 type header struct {
 	Ciphersuite                 string        // ciphersuite to use (header encryption is always NaCL)
 	RecipientPubHash            string        // SHA512(RecipientIdentityPub)
@@ -67,6 +92,7 @@ type headerPacket struct {
 
 func newHeader(
 	sender, recipient *uid.Message,
+	ciphersuite string,
 	recipientTempHash string,
 	senderSessionPub, nextSenderSessionPub,
 	nextRecipientSessionPubSeen *uid.KeyEntry,
@@ -81,7 +107,7 @@ func newHeader(
 			senderLastKeychainHash, hashchain.EntryBase64Len, len(senderLastKeychainHash))
 	}
 	h := &header{
-		Ciphersuite:                 uid.DefaultCiphersuite, // at the moment we only support one ciphersuite
+		Ciphersuite:                 ciphersuite,
 		RecipientPubHash:            recipient.PubHash(),
 		RecipientTempHash:           recipientTempHash,
 		SenderIdentity:              sender.Identity(),
@@ -102,6 +128,11 @@ func newHeader(
 
 	// calculate padding length
 	padLen := wiggleRoom
+	// pad ciphersuite (no ciphersuite is longer than the default one)
+	if len(h.Ciphersuite) > len(uid.DefaultCiphersuite) {
+		return nil, log.Error("msg: ciphersuite is too long")
+	}
+	padLen += len(uid.DefaultCiphersuite) - len(h.Ciphersuite)
 	// pad sender identity
 	if len(h.SenderIdentity) > identity.MaxLen {
 		return nil, log.Error("msg: sender identity is too long")
@@ -12,42 +12,26 @@ import (
 	"github.com/frankbraun/codechain/util/bzero"
 	"github.com/mutecomm/mute/cipher"
 	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/log"
 	"github.com/mutecomm/mute/msg/session"
 	"golang.org/x/crypto/hkdf"
 )
 
 // checkKeys checks that the keys kh, k1, k2, k3, and k4 are pairwise different to
 // prevent possible reflection attacks and replays.
+// k4 is nil for sessions which are started with the static key of the
+// recipient (which is k3 in this case).
 func checkKeys(kh, k1, k2, k3, k4 *[32]byte) error {
-	if bytes.Equal(kh[:], k1[:]) {
-		return ErrReflection
+	keys := []*[32]byte{kh, k1, k2, k3}
+	if k4 != nil {
+		keys = append(keys, k4)
 	}
-	if bytes.Equal(kh[:], k2[:]) {
-		return ErrReflection
-	}
-	if bytes.Equal(kh[:], k3[:]) {
-		return ErrReflection
-	}
-	if bytes.Equal(kh[:], k4[:]) {
-		return ErrReflection
-	}
-	if bytes.Equal(k1[:], k2[:]) {
-		return ErrReflection
-	}
-	if bytes.Equal(k1[:], k3[:]) {
-		return ErrReflection
-	}
-	if bytes.Equal(k1[:], k4[:]) {
-		return ErrReflection
-	}
-	if bytes.Equal(k2[:], k3[:]) {
-		return ErrReflection
-	}
-	if bytes.Equal(k2[:], k4[:]) {
-		return ErrReflection
-	}
-	if bytes.Equal(k3[:], k4[:]) {
-		return ErrReflection
+	for i := 0; i < len(keys); i++ {
+		for j := i + 1; j < len(keys); j++ {
+			if bytes.Equal(keys[i][:], keys[j][:]) {
+				return ErrReflection
+			}
+		}
 	}
 	return nil
 }
@@ -77,21 +61,47 @@ func deriveRootKey(
 	return &rootKey, nil
 }
 
-// generateMessageKeys generates the next numOfKeys many session keys from
+// messageKeys contains message keys derived by deriveMessageKeys which have
+// not been stored yet.
+type messageKeys struct {
+	sessionKey  string
+	rootKeyHash string
+	chainKey    string
+	send        []string
+	recv        []string
+}
+
+// store stores the message keys in keyStore.
+func (mk *messageKeys) store(keyStore session.Store) error {
+	return keyStore.StoreSession(mk.sessionKey, mk.rootKeyHash, mk.chainKey,
+		mk.send, mk.recv)
+}
+
+// recipientKey returns the decoded recipient key with index i.
+func (mk *messageKeys) recipientKey(i uint64) (*[64]byte, error) {
+	k, err := base64.Decode(mk.recv[i])
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	var messageKey [64]byte
+	copy(messageKey[:], k)
+	return &messageKey, nil
+}
+
+// deriveMessageKeys derives the next numOfKeys many session keys from
 // from rootKey for given senderIdentity and recipientIdentity.
-// If recipientKeys is true the generated sender and receiver keys are stored in
-// reverse order.
-// It uses senderSessionPub and recipientPub in the process and calls
-// keyStore.StoresSession and keyStore.SetSessionState to store the result.
-func generateMessageKeys(
+// If recipientKeys is true the derived sender and receiver keys are returned
+// in reverse order.
+// It uses senderSessionPub and recipientPub in the process. The keys are not
+// stored (see generateMessageKeys).
+func deriveMessageKeys(
 	senderIdentity, recipientIdentity string,
 	senderIdentityPubkeyHash, recipientIdentityPubkeyHash string,
 	rootKey *[32]byte,
 	recipientKeys bool,
 	senderSessionPub, recipientPub *[32]byte,
 	numOfKeys uint64,
-	keyStore session.Store,
-) error {
+) *messageKeys {
 	var (
 		identities string
 		send       []string
@@ -133,7 +143,7 @@ func generateMessageKeys(
 		send, recv = recv, send
 	}
 
-	// store session
+	// session key
 	var sessionKey string
 	if recipientKeys {
 		key := recipientIdentityPubkeyHash
@@ -148,13 +158,32 @@ func generateMessageKeys(
 		key += base64.Encode(cipher.SHA512(recipientPub[:]))
 		sessionKey = base64.Encode(cipher.SHA512([]byte(key)))
 	}
-	err := keyStore.StoreSession(sessionKey, rootKeyHash,
-		base64.Encode(chainKey), send, recv)
-	if err != nil {
-		return err
+
+	return &messageKeys{
+		sessionKey:  sessionKey,
+		rootKeyHash: rootKeyHash,
+		chainKey:    base64.Encode(chainKey),
+		send:        send,
+		recv:        recv,
 	}
+}
 
-	return nil
+// generateMessageKeys generates the next numOfKeys many session keys from
+// from rootKey for given senderIdentity and recipientIdentity (see
+// deriveMessageKeys) and calls keyStore.StoresSession to store the result.
+func generateMessageKeys(
+	senderIdentity, recipientIdentity string,
+	senderIdentityPubkeyHash, recipientIdentityPubkeyHash string,
+	rootKey *[32]byte,
+	recipientKeys bool,
+	senderSessionPub, recipientPub *[32]byte,
+	numOfKeys uint64,
+	keyStore session.Store,
+) error {
+	mk := deriveMessageKeys(senderIdentity, recipientIdentity,
+		senderIdentityPubkeyHash, recipientIdentityPubkeyHash, rootKey,
+		recipientKeys, senderSessionPub, recipientPub, numOfKeys)
+	return mk.store(keyStore)
 }
 
 // deriveSymmetricKeys derives the symmetric cryptoKey and hmacKey from the
@@ -104,7 +104,8 @@ func multipartMIME(
 			}
 		}
 		mh.Add("Content-Transfer-Encoding", "base64")
-		mh.Add("Content-Disposition", "attachment; filename="+base)
+		mh.Add("Content-Disposition", mime.FormatMediaType("attachment",
+			map[string]string{"filename": base}))
 		if attachment.Inline {
 			mh.Add("Content-Disposition", "inline")
 		}
@@ -157,53 +158,126 @@ func New(
 	return nil
 }
 
-// EncodeChunks splits a MIME encoded message msg into multiple chunks of
-// given size many bytes.
+// writeChunk writes the chunk piece of count many chunks containing part to
+// w.
+func writeChunk(
+	w io.Writer,
+	header Header,
+	part string,
+	piece, count uint64,
+) error {
+	writer := multipart.NewWriter(w)
+	err := mailHeader(w, header, "", writer.Boundary())
+	if err != nil {
+		return log.Error(err)
+	}
+	mh := make(textproto.MIMEHeader)
+	mh.Add("Content-Type",
+		fmt.Sprintf("chunked; piece=%d; count=%d; chunkid=%q", piece,
+			count, header.MessageID))
+	mh.Add("Content-Transfer-Encoding", "base64")
+	chunkWriter, err := writer.CreatePart(mh)
+	if err != nil {
+		return log.Error(err)
+	}
+	if _, err := io.WriteString(chunkWriter, part); err != nil {
+		return log.Error(err)
+	}
+	if err := writer.Close(); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+// EncodeChunks splits a MIME encoded message msg into multiple chunks. Each
+// chunk (including its envelope) is at most size many bytes long.
 func EncodeChunks(
 	header Header,
 	msg string,
 	size uint64,
 ) (chunks []string, err error) {
 	msgLen := uint64(len(msg))
-	numOfChunks := msgLen / size
-	if msgLen%size > 0 {
-		numOfChunks++
+	if msgLen == 0 {
+		return nil, nil
 	}
+	// The envelope length depends on the number of chunks (the length of the
+	// piece and count parameters), increase the number until it fits.
 	var chunk bytes.Buffer
-	for i := uint64(0); i < numOfChunks; i++ {
+	var partSize uint64
+	numOfChunks := uint64(1)
+	for {
 		chunk.Reset()
-		writer := multipart.NewWriter(&chunk)
-		err := mailHeader(&chunk, header, "", writer.Boundary())
+		err := writeChunk(&chunk, header, "", numOfChunks, numOfChunks)
 		if err != nil {
-			return nil, log.Error(err)
+			return nil, err
 		}
-
-		mh := make(textproto.MIMEHeader)
-		mh.Add("Content-Type",
-			fmt.Sprintf("chunked; piece=%d; count=%d; chunkid=%q", i+1,
-				numOfChunks, header.MessageID))
-		mh.Add("Content-Transfer-Encoding", "base64")
-		chunkWriter, err := writer.CreatePart(mh)
-		if err != nil {
-			return nil, log.Error(err)
+		envLen := uint64(chunk.Len())
+		if envLen >= size {
+			return nil, log.Errorf("mime: chunk size %d too small for envelope",
+				size)
+		}
+		partSize = size - envLen
+		n := msgLen / partSize
+		if msgLen%partSize > 0 {
+			n++
+		}
+		if n <= numOfChunks {
+			numOfChunks = n
+			break
 		}
-		// TODO: take envelope length into consideration for length calculation
-		end := (i + 1) * size
+		numOfChunks = n
+	}
+	for i := uint64(0); i < numOfChunks; i++ {
+		chunk.Reset()
+		end := (i + 1) * partSize
 		if end > msgLen {
 			end = msgLen
 		}
-		_, err = io.WriteString(chunkWriter, msg[i*size:end])
+		err := writeChunk(&chunk, header, msg[i*partSize:end], i+1,
+			numOfChunks)
 		if err != nil {
-			return nil, log.Error(err)
-		}
-		if err := writer.Close(); err != nil {
-			return nil, log.Error(err)
+			return nil, err
 		}
 		chunks = append(chunks, chunk.String())
 	}
 	return
 }
 
+// IsMIME returns true, if the message msg has the MIME header written by New
+// (a 'MIME-Version' of 1.0 and a multipart 'Content-Type'). Otherwise false
+// is returned and msg should be treated as plain text.
+func IsMIME(msg string) bool {
+	m, err := mail.ReadMessage(strings.NewReader(msg))
+	if err != nil {
+		return false
+	}
+	if m.Header.Get("MIME-Version") != "1.0" {
+		return false
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/mixed" &&
+		params["boundary"] != ""
+}
+
+// IsChunk returns true, if the MIME encoded message msg is a chunk (as
+// returned by EncodeChunks). Otherwise false is returned.
+func IsChunk(msg string) bool {
+	m, err := mail.ReadMessage(strings.NewReader(msg))
+	if err != nil {
+		return false
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		return false
+	}
+	p, err := multipart.NewReader(m.Body, params["boundary"]).NextPart()
+	if err != nil {
+		return false
+	}
+	mediaType, _, err = mime.ParseMediaType(p.Header.Get("Content-Type"))
+	return err == nil && mediaType == "chunked"
+}
+
 // DecodeChunk decodes the given chunk.
 func DecodeChunk(chunk string) (
 	header *Header,
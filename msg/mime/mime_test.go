@@ -178,6 +178,20 @@ func TestNew(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	if !IsMIME(email.String()) {
+		t.Error("MIME message not detected")
+	}
+	plain := []string{
+		msgs.Message1,
+		"From: alice@mute.berlin\r\n\r\nplain text",
+		"From: alice@mute.berlin\r\nMIME-Version: 1.0\r\n" +
+			"Content-Type: text/plain\r\n\r\nplain text",
+	}
+	for _, msg := range plain {
+		if IsMIME(msg) {
+			t.Errorf("plain text detected as MIME: %q", msg)
+		}
+	}
 }
 
 func TestChunks(t *testing.T) {
@@ -208,7 +222,7 @@ func TestChunks(t *testing.T) {
 				Inline:   true,
 			},
 			{
-				Filename:    "quote2.txt",
+				Filename:    "quote 2.txt",
 				Reader:      bytes.NewBufferString(msgs.Message2),
 				ContentType: "application/octet-stream",
 			},
@@ -220,8 +234,17 @@ func TestChunks(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	if IsChunk(msg.String()) {
+		t.Error("msg is not a chunk")
+	}
 	var res bytes.Buffer
 	for i, chunk := range chunks {
+		if len(chunk) > 2000 {
+			t.Errorf("len(chunk) = %d > 2000", len(chunk))
+		}
+		if !IsChunk(chunk) {
+			t.Error("chunk not detected")
+		}
 		h, part, piece, count, err := DecodeChunk(chunk)
 		if err != nil {
 			t.Fatal(err)
@@ -278,8 +301,8 @@ func TestChunks(t *testing.T) {
 	}
 	// check attachment 2
 	att2 := attachments[1]
-	if att2.Filename != "quote2.txt" {
-		t.Error("att2.Filename != \"quote2.txt\"")
+	if att2.Filename != "quote 2.txt" {
+		t.Error("att2.Filename != \"quote 2.txt\"")
 	}
 	if att2.ContentType != "application/octet-stream" {
 		t.Error("att2.ContentType != \"application/octet-stream\"")
@@ -6,6 +6,10 @@
 // https://github.com/mutecomm/mute/blob/master/doc/messages.md
 package msg
 
+import (
+	"github.com/mutecomm/mute/msg/mime"
+)
+
 // Version is the current version number of Mute messages.
 const Version = 1
 
@@ -16,6 +20,11 @@ const DefaultCiphersuite = "CURVE25519 XSALSA20 POLY1305"
 // are precomputed.
 const NumOfFutureKeys = 50
 
+// MaxSkippedKeys defines the default maximum number of message keys which are
+// skipped in a session to decrypt a message received out of order. That is,
+// the maximum gap in the message count of a session which is tolerated.
+const MaxSkippedKeys = mime.MaxMsgSize/MaxContentLength + NumOfFutureKeys
+
 // AverageSessionSize defines the average session size. That is, the number of
 // keys used in a session before a new session is started.
 // For every encrypted message there is the probability of
@@ -37,12 +37,12 @@ func encrypt(sign bool, flipUIDs bool) (
 	err error,
 ) {
 	sender, err = uid.Create("alice@mute.berlin", false, "", "", uid.Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		return
 	}
 	recipient, err = uid.Create("bob@mute.berlin", false, "", "", uid.Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		return
 	}
@@ -109,7 +109,7 @@ func decrypt(sender, recipient *uid.Message, r io.Reader, recipientTemp *uid.Key
 		Rand:       cipher.RandReader,
 		KeyStore:   ms,
 	}
-	_, sig, err := Decrypt(args)
+	_, sig, _, _, _, err := Decrypt(args)
 	if err != nil {
 		return err
 	}
@@ -128,7 +128,7 @@ func decrypt(sender, recipient *uid.Message, r io.Reader, recipientTemp *uid.Key
 		}
 		var sigBuf [ed25519.SignatureSize]byte
 		copy(sigBuf[:], decSig)
-		if !ed25519.Verify(sender.PublicSigKey32(), contentHash, &sigBuf) {
+		if !ed25519.Verify(sender.PublicSigKey32()[:], contentHash, sigBuf[:]) {
 			return errors.New("signature verification failed")
 		}
 	}
@@ -243,13 +243,13 @@ func TestMaxContentLength(t *testing.T) {
 func TestMaxMessageLength(t *testing.T) {
 	alice := "alice@mute.berlin"
 	aliceUID, err := uid.Create(alice, false, "", "", uid.Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
 	bob := "bob@mute.berlin"
 	bobUID, err := uid.Create(bob, false, "", "", uid.Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -309,7 +309,7 @@ func TestMaxMessageLength(t *testing.T) {
 		Rand:       cipher.RandReader,
 		KeyStore:   bobKeyStore,
 	}
-	_, _, err = Decrypt(decryptArgs)
+	_, _, _, _, _, err = Decrypt(decryptArgs)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -321,13 +321,13 @@ func TestMaxMessageLength(t *testing.T) {
 func TestReflection(t *testing.T) {
 	alice := "alice@mute.berlin"
 	aliceUID, err := uid.Create(alice, false, "", "", uid.Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
 	bob := "bob@mute.berlin"
 	bobUID, err := uid.Create(bob, false, "", "", uid.Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -40,7 +40,7 @@ func TestEncrypteHeaderSizeAndPadding(t *testing.T) {
 	t.Parallel()
 	// setup UIDs and stuff
 	aliceUID, err := uid.Create("alice@mute.berlin", false, "", "", uid.Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -55,7 +55,7 @@ func TestEncrypteHeaderSizeAndPadding(t *testing.T) {
 		t.Fatal(err)
 	}
 	bobUID, err := uid.Create("bob@mute.berlin", false, "", "", uid.Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -70,7 +70,7 @@ func TestEncrypteHeaderSizeAndPadding(t *testing.T) {
 	}
 
 	// create unencrypted header
-	h, err := newHeader(aliceUID, bobUID, bobKE.HASH, aliceKE, nil, nil, "", 0, 0,
+	h, err := newHeader(aliceUID, bobUID, uid.DefaultCiphersuite, bobKE.HASH, aliceKE, nil, nil, "", 0, 0,
 		hashchain.TestEntry, cipher.RandReader, StatusOK)
 	if err != nil {
 		t.Fatal(err)
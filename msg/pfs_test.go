@@ -0,0 +1,115 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msg
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/keyserver/hashchain"
+	"github.com/mutecomm/mute/msg/session/memstore"
+	"github.com/mutecomm/mute/uid"
+)
+
+func createPFSUID(
+	t *testing.T,
+	id string,
+	pfsPreference uid.PFSPreference,
+) *uid.Message {
+	msg, err := uid.Create(id, false, "mixaddress", "nymaddress", pfsPreference,
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestPFSPreference(t *testing.T) {
+	alice := "alice@mute.berlin"
+	aliceUID, aliceKE := createStatusUID(t, alice)
+	bob := "bob@mute.berlin"
+	for _, pref := range []uid.PFSPreference{uid.Mandatory, uid.Strict, uid.Optional} {
+		bobUID := createPFSUID(t, bob, pref)
+		// Alice has no KeyInit message for Bob
+		aliceKeyStore := memstore.New()
+		aliceKeyStore.AddPrivateKeyEntry(aliceKE)
+		var encMsg bytes.Buffer
+		args := &EncryptArgs{
+			Writer:                 &encMsg,
+			From:                   aliceUID,
+			To:                     bobUID,
+			SenderLastKeychainHash: hashchain.TestEntry,
+			Reader:                 bytes.NewBufferString("1"),
+			Rand:                   cipher.RandReader,
+			KeyStore:               aliceKeyStore,
+		}
+		nymAddress, err := Encrypt(args)
+		if pref != uid.Optional {
+			if err != ErrNoKeyInit {
+				t.Fatalf("%s: should fail with ErrNoKeyInit: %v", pref, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nymAddress != "nymaddress" {
+			t.Fatal("wrong nymaddress")
+		}
+		bobKeyStore := memstore.New()
+		_, content, status, err := decryptStatus(t, bobUID, bobKeyStore, &encMsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content != "1" || status != StatusOK {
+			t.Fatal("wrong message")
+		}
+		// Bob replies within the established session
+		bobKeyStore.AddPublicKeyEntry(alice, aliceKE)
+		reply := encryptStatus(t, bobUID, aliceUID, bobKeyStore, "2", StatusOK)
+		_, content, _, err = decryptStatus(t, aliceUID, aliceKeyStore, reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content != "2" {
+			t.Fatal("wrong reply")
+		}
+	}
+
+	// recipients with a non-optional PFS preference refuse static key messages
+	for _, pref := range []uid.PFSPreference{uid.Mandatory, uid.Strict} {
+		bobUID := createPFSUID(t, bob, uid.Optional)
+		encMsg := encryptStatus(t, aliceUID, bobUID, memstore.New(), "3",
+			StatusOK)
+		bobUID.UIDContent.PREFERENCES.FORWARDSEC = pref.String()
+		_, _, _, err := decryptStatus(t, bobUID, memstore.New(), encMsg)
+		if err != ErrStaticKey {
+			t.Errorf("%s: should fail with ErrStaticKey: %v", pref, err)
+		}
+	}
+
+	// the identity key is never accepted as a KeyInit key from the key
+	// store, not even for recipients with an optional PFS preference
+	for _, pref := range []uid.PFSPreference{uid.Mandatory, uid.Strict, uid.Optional} {
+		bobUID := createPFSUID(t, bob, pref)
+		aliceKeyStore := memstore.New()
+		aliceKeyStore.AddPrivateKeyEntry(aliceKE)
+		aliceKeyStore.AddPublicKeyEntry(bob, bobUID.PubKey())
+		var encMsg bytes.Buffer
+		args := &EncryptArgs{
+			Writer:                 &encMsg,
+			From:                   aliceUID,
+			To:                     bobUID,
+			SenderLastKeychainHash: hashchain.TestEntry,
+			Reader:                 bytes.NewBufferString("4"),
+			Rand:                   cipher.RandReader,
+			KeyStore:               aliceKeyStore,
+		}
+		if _, err := Encrypt(args); err != ErrReflection {
+			t.Errorf("%s: should fail with ErrReflection: %v", pref, err)
+		}
+	}
+}
@@ -17,6 +17,7 @@ type memSession struct {
 	chainKey    string
 	send        []string
 	recv        []string
+	skipped     map[uint64]uint64 // index of skipped recv key -> cleanup time
 }
 
 type sessionKey struct {
@@ -28,6 +29,7 @@ type sessionKey struct {
 // MemStore implements the KeyStore interface in memory.
 type MemStore struct {
 	privateKeyEntryMap map[string]*uid.KeyEntry
+	singleUseMap       map[string]bool
 	publicKeyEntryMap  map[string]*uid.KeyEntry
 	sessionStates      map[string]*session.State
 	sessions           map[string]*memSession
@@ -39,6 +41,7 @@ type MemStore struct {
 func New() *MemStore {
 	return &MemStore{
 		privateKeyEntryMap: make(map[string]*uid.KeyEntry),
+		singleUseMap:       make(map[string]bool),
 		publicKeyEntryMap:  make(map[string]*uid.KeyEntry),
 		sessionStates:      make(map[string]*session.State),
 		sessions:           make(map[string]*memSession),
@@ -56,6 +59,13 @@ func (ms *MemStore) AddPrivateKeyEntry(ke *uid.KeyEntry) {
 	ms.privateKeyEntryMap[ke.HASH] = ke
 }
 
+// AddSingleUseKeyEntry adds private KeyEntry from a single-use KeyInit message
+// to memory store.
+func (ms *MemStore) AddSingleUseKeyEntry(ke *uid.KeyEntry) {
+	ms.privateKeyEntryMap[ke.HASH] = ke
+	ms.singleUseMap[ke.HASH] = true
+}
+
 // AddPublicKeyEntry adds public KeyEntry from identity to memory store.
 func (ms *MemStore) AddPublicKeyEntry(identity string, ke *uid.KeyEntry) {
 	ms.publicKeyEntryMap[identity] = ke
@@ -94,6 +104,7 @@ func (ms *MemStore) StoreSession(
 			chainKey:    chainKey,
 			send:        send,
 			recv:        recv,
+			skipped:     make(map[uint64]uint64),
 		}
 		ms.sessionKey = sessionKey
 	} else {
@@ -121,6 +132,15 @@ func (ms *MemStore) GetPrivateKeyEntry(pubKeyHash string) (*uid.KeyEntry, error)
 	return ke, nil
 }
 
+// ConsumePrivateKeyEntry implemented in memory.
+func (ms *MemStore) ConsumePrivateKeyEntry(pubKeyHash string) error {
+	if ms.singleUseMap[pubKeyHash] {
+		delete(ms.privateKeyEntryMap, pubKeyHash)
+		delete(ms.singleUseMap, pubKeyHash)
+	}
+	return nil
+}
+
 // GetPublicKeyEntry implemented in memory.
 func (ms *MemStore) GetPublicKeyEntry(uidMsg *uid.Message) (*uid.KeyEntry, string, error) {
 	ke, ok := ms.publicKeyEntryMap[uidMsg.Identity()]
@@ -239,6 +259,41 @@ func (ms *MemStore) DelMessageKey(
 	return nil
 }
 
+// SkipMessageKeys implemented in memory.
+func (ms *MemStore) SkipMessageKeys(
+	sessionKey string,
+	msgIndex, cleanupTime uint64,
+) (uint64, error) {
+	s, ok := ms.sessions[sessionKey]
+	if !ok {
+		return 0, log.Errorf("memstore: no session found for %s", sessionKey)
+	}
+	var n uint64
+	for i := uint64(0); i < msgIndex && i < uint64(len(s.recv)); i++ {
+		if s.recv[i] == "" {
+			continue // key already used
+		}
+		if _, ok := s.skipped[i]; !ok {
+			s.skipped[i] = cleanupTime
+			n++
+		}
+	}
+	return n, nil
+}
+
+// CleanupMessageKeys implemented in memory.
+func (ms *MemStore) CleanupMessageKeys(t uint64) error {
+	for _, s := range ms.sessions {
+		for i, cleanupTime := range s.skipped {
+			if cleanupTime < t {
+				s.recv[i] = ""
+				delete(s.skipped, i)
+			}
+		}
+	}
+	return nil
+}
+
 // AddSessionKey implemented in memory.
 func (ms *MemStore) AddSessionKey(
 	hash, json, privKey string,
@@ -20,7 +20,7 @@ import (
 func TestKeyEntry(t *testing.T) {
 	ms := New()
 	uidMsg, err := uid.Create("alice@mute.berlin", false, "", "", uid.Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -54,7 +54,7 @@ func TestKeyEntry(t *testing.T) {
 		t.Error("entry != ke")
 	}
 	uidMsg, err = uid.Create("trent@mute.berlin", false, "", "", uid.Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -143,6 +143,67 @@ func TestSessionStore(t *testing.T) {
 	}
 }
 
+func TestSkipMessageKeys(t *testing.T) {
+	ms := New()
+	var send, recv []string
+	for i := 0; i < 4; i++ {
+		key, err := genMessageKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		send = append(send, base64.Encode(key[:]))
+		recv = append(recv, base64.Encode(key[:]))
+	}
+	sessionKey := base64.Encode(cipher.SHA512([]byte("sessionkey")))
+	err := ms.StoreSession(sessionKey,
+		base64.Encode(cipher.SHA512([]byte("rootkey"))),
+		base64.Encode(cipher.SHA512([]byte("chainkey"))), send, recv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.DelMessageKey(sessionKey, false, 0); err != nil {
+		t.Fatal(err)
+	}
+	// key 0 is used, keys 1 and 2 are skipped
+	n, err := ms.SkipMessageKeys(sessionKey, 3, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("wrong number of skipped keys: %d", n)
+	}
+	// skipped keys are only counted once
+	n, err = ms.SkipMessageKeys(sessionKey, 3, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("wrong number of skipped keys: %d", n)
+	}
+	// skipped keys stay usable until they are cleaned up
+	if err := ms.CleanupMessageKeys(10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms.GetMessageKey(sessionKey, false, 1); err != nil {
+		t.Error(err)
+	}
+	if err := ms.CleanupMessageKeys(11); err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(1); i < 3; i++ {
+		_, err := ms.GetMessageKey(sessionKey, false, i)
+		if err != session.ErrMessageKeyUsed {
+			t.Error("should fail with session.ErrMessageKeyUsed")
+		}
+	}
+	if _, err := ms.GetMessageKey(sessionKey, false, 3); err != nil {
+		t.Error(err)
+	}
+	if _, err := ms.SkipMessageKeys("unknown", 1, 0); err == nil {
+		t.Error("should fail")
+	}
+}
+
 func TestSessionState(t *testing.T) {
 	ms := New()
 	ss := &session.State{
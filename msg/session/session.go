@@ -80,6 +80,11 @@ type Store interface {
 	// message with the given pubKeyHash.
 	// If no such KeyEntry is available, ErrNoKeyEntry is returned.
 	GetPrivateKeyEntry(pubKeyHash string) (*uid.KeyEntry, error)
+	// ConsumePrivateKeyEntry marks the private KeyEntry contained in the
+	// KeyInit message with the given pubKeyHash as consumed. The private keys
+	// of single-use KeyInit messages are destroyed and not returned by
+	// GetPrivateKeyEntry anymore, fallback KeyInit messages stay usable.
+	ConsumePrivateKeyEntry(pubKeyHash string) error
 	// GetPrivateKeyInit returns a public KeyEntry and NYMADDRESS contained in
 	// the KeyInit message for the given uidMsg.
 	// If no such KeyEntry is available, ErrNoKeyEntry is returned.
@@ -97,6 +102,14 @@ type Store interface {
 	// DelMessageKey deleted the message key with index msgIndex. If sender is
 	// true the sender key is deleted, otherwise the recipient key.
 	DelMessageKey(sessionKey string, sender bool, msgIndex uint64) error
+	// SkipMessageKeys marks all unused recipient keys of the session with an
+	// index smaller than msgIndex as skipped, if they have not been marked
+	// before. Skipped keys remain usable until cleanupTime (see
+	// CleanupMessageKeys). The number of newly skipped keys is returned.
+	SkipMessageKeys(sessionKey string, msgIndex, cleanupTime uint64) (uint64, error)
+	// CleanupMessageKeys deletes all skipped message keys with a cleanup time
+	// before t.
+	CleanupMessageKeys(t uint64) error
 
 	// AddSessionKey adds a session key.
 	AddSessionKey(hash, json, privKey string, cleanupTime uint64) error
@@ -120,7 +120,7 @@ func generateRun(numOfOps int) ([]*operation, error) {
 func testRun(r []*operation) error {
 	alice := "alice@mute.berlin"
 	aliceUID, err := uid.Create(alice, false, "", "", uid.Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		return err
 	}
@@ -137,7 +137,7 @@ func testRun(r []*operation) error {
 
 	bob := "bob@mute.berlin"
 	bobUID, err := uid.Create(bob, false, "", "", uid.Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		return err
 	}
@@ -261,7 +261,7 @@ func testRun(r []*operation) error {
 					Rand:       cipher.RandReader,
 					KeyStore:   bobKeyStore,
 				}
-				_, _, err = msg.Decrypt(decryptArgs)
+				_, _, _, _, _, err = msg.Decrypt(decryptArgs)
 				if err != nil {
 					return err
 				}
@@ -295,7 +295,7 @@ func testRun(r []*operation) error {
 					Rand:       cipher.RandReader,
 					KeyStore:   aliceKeyStore,
 				}
-				_, _, err = msg.Decrypt(decryptArgs)
+				_, _, _, _, _, err = msg.Decrypt(decryptArgs)
 				if err != nil {
 					return err
 				}
@@ -0,0 +1,112 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msg
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/keyserver/hashchain"
+	"github.com/mutecomm/mute/msg/session"
+	"github.com/mutecomm/mute/msg/session/memstore"
+	"github.com/mutecomm/mute/uid"
+)
+
+func decryptSkipped(
+	t *testing.T,
+	to *uid.Message,
+	keyStore *memstore.MemStore,
+	encMsg string,
+) (content string, lost uint64, err error) {
+	var res bytes.Buffer
+	input := base64.NewDecoder(bytes.NewBufferString(encMsg))
+	_, preHeader, err := ReadFirstOuterHeader(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := &DecryptArgs{
+		Writer:         &res,
+		Identities:     []*uid.Message{to},
+		PreHeader:      preHeader,
+		Reader:         input,
+		NumOfKeys:      2,
+		MaxSkippedKeys: 3,
+		Rand:           cipher.RandReader,
+		KeyStore:       keyStore,
+	}
+	_, _, _, lost, _, err = Decrypt(args)
+	return res.String(), lost, err
+}
+
+func TestSkippedMessages(t *testing.T) {
+	aliceUID, aliceKE := createStatusUID(t, "alice@mute.berlin")
+	bob := "bob@mute.berlin"
+	bobUID, bobKE := createStatusUID(t, bob)
+
+	// Alice sends eight messages to Bob in the same session
+	aliceKeyStore := memstoreWith(bob, bobKE)
+	aliceKeyStore.AddPrivateKeyEntry(aliceKE)
+	var encMsgs []string
+	for i := 0; i < 8; i++ {
+		var encMsg bytes.Buffer
+		args := &EncryptArgs{
+			Writer:                 &encMsg,
+			From:                   aliceUID,
+			To:                     bobUID,
+			SenderLastKeychainHash: hashchain.TestEntry,
+			Reader:                 bytes.NewBufferString(strconv.Itoa(i)),
+			NumOfKeys:              2,
+			Rand:                   cipher.RandReader,
+			KeyStore:               aliceKeyStore,
+		}
+		if _, err := Encrypt(args); err != nil {
+			t.Fatal(err)
+		}
+		encMsgs = append(encMsgs, encMsg.String())
+	}
+
+	// Bob receives them out of order and with gaps
+	bobKeyStore := memstore.New()
+	bobKeyStore.AddPrivateKeyEntry(bobKE)
+	for _, test := range []struct {
+		msg    int
+		forged bool
+		lost   uint64
+		err    error
+	}{
+		{0, false, 0, nil},
+		{3, true, 0, ErrHMACsDiffer},         // keys derived, but not stored
+		{6, true, 0, ErrTooManySkippedKeys},  // forgeries do not move window
+		{3, false, 2, nil},                   // 1 and 2 skipped
+		{1, false, 0, nil},                   // delayed message
+		{7, false, 0, ErrTooManySkippedKeys}, // gap too large
+		{6, false, 2, nil},                   // 4 and 5 skipped (2 was already)
+		{2, false, 0, nil},                   // delayed message
+		{7, false, 0, nil},                   // gap not too large anymore
+		{3, false, 0, session.ErrMessageKeyUsed},
+	} {
+		encMsg := encMsgs[test.msg]
+		if test.forged {
+			encMsg = tamper(t, []byte(encMsg)).String()
+		}
+		content, lost, err := decryptSkipped(t, bobUID, bobKeyStore, encMsg)
+		if err != test.err {
+			t.Fatalf("message %d: unexpected error: %v", test.msg, err)
+		}
+		if err != nil {
+			continue
+		}
+		if content != strconv.Itoa(test.msg) {
+			t.Errorf("message %d: wrong content: %s", test.msg, content)
+		}
+		if lost != test.lost {
+			t.Errorf("message %d: wrong number of lost messages: %d",
+				test.msg, lost)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msg
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/keyserver/hashchain"
+	"github.com/mutecomm/mute/msg/session"
+	"github.com/mutecomm/mute/msg/session/memstore"
+	"github.com/mutecomm/mute/uid"
+	"github.com/mutecomm/mute/util/times"
+)
+
+func createStatusUID(t *testing.T, id string) (*uid.Message, *uid.KeyEntry) {
+	msg, err := uid.Create(id, false, "", "", uid.Strict,
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := uint64(times.Now())
+	ki, _, privateKey, err := msg.KeyInit(1, now+times.Day, now-times.Day,
+		false, "mute.berlin", "", "", cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ke, err := ki.KeyEntryECDHE25519(msg.SigPubKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ke.SetPrivateKey(privateKey); err != nil {
+		t.Fatal(err)
+	}
+	return msg, ke
+}
+
+func memstoreWith(identity string, ke *uid.KeyEntry) *memstore.MemStore {
+	ms := memstore.New()
+	ms.AddPublicKeyEntry(identity, ke)
+	return ms
+}
+
+func encryptStatus(
+	t *testing.T,
+	from, to *uid.Message,
+	keyStore *memstore.MemStore,
+	content string,
+	statusCode StatusCode,
+) *bytes.Buffer {
+	var encMsg bytes.Buffer
+	args := &EncryptArgs{
+		Writer:                 &encMsg,
+		From:                   from,
+		To:                     to,
+		SenderLastKeychainHash: hashchain.TestEntry,
+		Reader:                 bytes.NewBufferString(content),
+		Rand:                   cipher.RandReader,
+		KeyStore:               keyStore,
+		StatusCode:             statusCode,
+	}
+	if _, err := Encrypt(args); err != nil {
+		t.Fatal(err)
+	}
+	return &encMsg
+}
+
+func decryptStatus(
+	t *testing.T,
+	to *uid.Message,
+	keyStore *memstore.MemStore,
+	encMsg *bytes.Buffer,
+) (senderID, content string, status StatusCode, err error) {
+	var res bytes.Buffer
+	input := base64.NewDecoder(encMsg)
+	_, preHeader, err := ReadFirstOuterHeader(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := &DecryptArgs{
+		Writer:     &res,
+		Identities: []*uid.Message{to},
+		PreHeader:  preHeader,
+		Reader:     input,
+		Rand:       cipher.RandReader,
+		KeyStore:   keyStore,
+	}
+	senderID, _, status, _, _, err = Decrypt(args)
+	return senderID, res.String(), status, err
+}
+
+func TestStatusCode(t *testing.T) {
+	for _, code := range []StatusCode{StatusOK, StatusReset, StatusError} {
+		parsed, err := ParseStatusCode(code.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed != code {
+			t.Errorf("status code %d not parsed correctly", code)
+		}
+	}
+	if _, err := ParseStatusCode("unknown"); err == nil {
+		t.Error("should fail")
+	}
+}
+
+func TestSessionReset(t *testing.T) {
+	alice := "alice@mute.berlin"
+	aliceUID, aliceKE := createStatusUID(t, alice)
+	bob := "bob@mute.berlin"
+	bobUID, bobKE := createStatusUID(t, bob)
+
+	// start session from Alice to Bob
+	aliceKeyStore := memstore.New()
+	aliceKeyStore.AddPublicKeyEntry(bob, bobKE)
+	aliceKeyStore.AddPrivateKeyEntry(aliceKE)
+	bobKeyStore := memstore.New()
+	bobKeyStore.AddPrivateKeyEntry(bobKE)
+	encMsg := encryptStatus(t, aliceUID, bobUID, aliceKeyStore, "1", StatusOK)
+	_, content, status, err := decryptStatus(t, bobUID, bobKeyStore, encMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != "1" || status != StatusOK {
+		t.Fatal("wrong message")
+	}
+
+	// Bob loses all his session keys (and his KeyInit)
+	bobKeyStore = memstore.New()
+	bobKeyStore.AddPublicKeyEntry(alice, aliceKE)
+	encMsg = encryptStatus(t, aliceUID, bobUID, aliceKeyStore, "2", StatusOK)
+	senderID, _, _, err := decryptStatus(t, bobUID, bobKeyStore, encMsg)
+	if err != ErrStatusError {
+		t.Fatalf("should fail with ErrStatusError: %v", err)
+	}
+	if senderID != alice {
+		t.Fatal("wrong sender ID")
+	}
+
+	// Bob replies with StatusError, Alice resets her session state
+	encMsg = encryptStatus(t, bobUID, aliceUID, bobKeyStore, "", StatusError)
+	_, content, status, err = decryptStatus(t, aliceUID, aliceKeyStore, encMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != "" || status != StatusError {
+		t.Fatal("wrong status message")
+	}
+
+	// Alice uses the new session
+	encMsg = encryptStatus(t, aliceUID, bobUID, aliceKeyStore, "3", StatusOK)
+	_, content, status, err = decryptStatus(t, bobUID, bobKeyStore, encMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != "3" || status != StatusOK {
+		t.Fatal("wrong message")
+	}
+
+	// StatusError messages which cannot be decrypted lead to StatusReset
+	bobKeyStore = memstore.New()
+	encMsg = encryptStatus(t, aliceUID, bobUID, memstoreWith(bob, bobKE), "",
+		StatusError)
+	if _, _, _, err := decryptStatus(t, bobUID, bobKeyStore, encMsg); err != ErrStatusReset {
+		t.Errorf("should fail with ErrStatusReset: %v", err)
+	}
+	// StatusReset messages which cannot be decrypted are dropped
+	encMsg = encryptStatus(t, aliceUID, bobUID, memstoreWith(bob, bobKE), "",
+		StatusReset)
+	if _, _, _, err := decryptStatus(t, bobUID, bobKeyStore, encMsg); err != ErrUnknownSession {
+		t.Errorf("should fail with ErrUnknownSession: %v", err)
+	}
+}
+
+func TestSingleUseKeyInit(t *testing.T) {
+	alice := "alice@mute.berlin"
+	aliceUID, _ := createStatusUID(t, alice)
+	bob := "bob@mute.berlin"
+	bobUID, bobKE := createStatusUID(t, bob)
+
+	// start session from Alice to Bob with single-use KeyInit
+	aliceKeyStore := memstoreWith(bob, bobKE)
+	bobKeyStore := memstore.New()
+	bobKeyStore.AddSingleUseKeyEntry(bobKE)
+	// a message which cannot be authenticated does not consume the KeyInit
+	encMsg := encryptStatus(t, aliceUID, bobUID, memstoreWith(bob, bobKE), "0",
+		StatusOK)
+	_, _, _, err := decryptStatus(t, bobUID, bobKeyStore, tamper(t, encMsg.Bytes()))
+	if err != ErrHMACsDiffer {
+		t.Fatalf("should fail with ErrHMACsDiffer: %v", err)
+	}
+	for _, content := range []string{"1", "2"} {
+		encMsg := encryptStatus(t, aliceUID, bobUID, aliceKeyStore, content,
+			StatusOK)
+		_, res, _, err := decryptStatus(t, bobUID, bobKeyStore, encMsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != content {
+			t.Fatal("wrong message")
+		}
+	}
+
+	// the KeyInit cannot be used to start another session
+	encMsg = encryptStatus(t, aliceUID, bobUID, memstoreWith(bob, bobKE), "3",
+		StatusOK)
+	_, _, _, err = decryptStatus(t, bobUID, bobKeyStore, encMsg)
+	if err != ErrStatusError {
+		t.Errorf("should fail with ErrStatusError: %v", err)
+	}
+}
+
+func TestSenderUID(t *testing.T) {
+	aliceUID, _ := createStatusUID(t, "alice@mute.berlin")
+	bob := "bob@mute.berlin"
+	bobUID, bobKE := createStatusUID(t, bob)
+	encMsg := encryptStatus(t, aliceUID, bobUID, memstoreWith(bob, bobKE),
+		"sender", StatusOK)
+	bobKeyStore := memstore.New()
+	bobKeyStore.AddPrivateKeyEntry(bobKE)
+	var res bytes.Buffer
+	input := base64.NewDecoder(encMsg)
+	_, preHeader, err := ReadFirstOuterHeader(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := &DecryptArgs{
+		Writer:     &res,
+		Identities: []*uid.Message{bobUID},
+		PreHeader:  preHeader,
+		Reader:     input,
+		Rand:       cipher.RandReader,
+		KeyStore:   bobKeyStore,
+	}
+	_, _, _, _, senderUID, err := Decrypt(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(senderUID.UID.JSON(), aliceUID.JSON()) {
+		t.Error("sender UID messages differ")
+	}
+	_, UIDIndex, _ := aliceUID.Encrypt()
+	if !bytes.Equal(senderUID.UIDIndex, UIDIndex) {
+		t.Error("UIDIndex differs")
+	}
+	if senderUID.LastKeychainHash != hashchain.TestEntry {
+		t.Error("wrong last keychain hash")
+	}
+}
+
+// tamper returns a copy of the encrypted message encMsg with a modified HMAC.
+func tamper(t *testing.T, encMsg []byte) *bytes.Buffer {
+	dec, err := base64.Decode(string(encMsg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec[len(dec)-1] ^= 0x01
+	return bytes.NewBufferString(base64.Encode(dec))
+}
+
+func TestUnauthenticatedStatus(t *testing.T) {
+	alice := "alice@mute.berlin"
+	aliceUID, aliceKE := createStatusUID(t, alice)
+	bob := "bob@mute.berlin"
+	bobUID, bobKE := createStatusUID(t, bob)
+
+	// start session from Alice to Bob
+	aliceKeyStore := memstoreWith(bob, bobKE)
+	aliceKeyStore.AddPrivateKeyEntry(aliceKE)
+	bobKeyStore := memstore.New()
+	bobKeyStore.AddPrivateKeyEntry(bobKE)
+	encMsg := encryptStatus(t, aliceUID, bobUID, aliceKeyStore, "1", StatusOK)
+	if _, _, _, err := decryptStatus(t, bobUID, bobKeyStore, encMsg); err != nil {
+		t.Fatal(err)
+	}
+	stateKey := session.CalcStateKey(bobUID.PubKey().PublicKey32(),
+		aliceUID.PubKey().PublicKey32())
+	ss, err := bobKeyStore.GetSessionState(stateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a StatusReset message which cannot be authenticated does not change
+	// the session state
+	encMsg = encryptStatus(t, aliceUID, bobUID, aliceKeyStore, "", StatusReset)
+	_, _, _, err = decryptStatus(t, bobUID, bobKeyStore, tamper(t, encMsg.Bytes()))
+	if err != ErrHMACsDiffer {
+		t.Fatalf("should fail with ErrHMACsDiffer: %v", err)
+	}
+	state, err := bobKeyStore.GetSessionState(stateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != ss || state.SenderSessionPub.HASH != ss.SenderSessionPub.HASH ||
+		state.RecipientTemp.HASH != ss.RecipientTemp.HASH {
+		t.Fatal("session state changed by unauthenticated message")
+	}
+
+	// an authenticated StatusReset message resets the session state
+	encMsg = encryptStatus(t, aliceUID, bobUID, aliceKeyStore, "", StatusReset)
+	_, _, status, err := decryptStatus(t, bobUID, bobKeyStore, encMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != StatusReset {
+		t.Fatal("wrong status")
+	}
+	state, err = bobKeyStore.GetSessionState(stateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.RecipientTemp.HASH == ss.RecipientTemp.HASH {
+		t.Error("session state not reset")
+	}
+}
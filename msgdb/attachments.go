@@ -0,0 +1,81 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"database/sql"
+
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid/identity"
+)
+
+// Attachment is a file attached to a message.
+type Attachment struct {
+	AttachID int64  // the attachment ID (set by GetAttachments)
+	Filename string // original filename of attachment
+	Data     []byte // the actual attachment data (nil, if deleted)
+}
+
+// addAttachments adds the given attachments for message msgNum of nym self
+// within transaction tx.
+func (msgDB *MsgDB) addAttachments(
+	tx *sql.Tx,
+	self, msgNum int64,
+	attachments []*Attachment,
+) error {
+	for _, attachment := range attachments {
+		_, err := tx.Stmt(msgDB.addAttachmentQuery).Exec(self, msgNum,
+			attachment.Filename, attachment.Data)
+		if err != nil {
+			return log.Error(err)
+		}
+	}
+	return nil
+}
+
+// GetAttachments returns all attachments of the message from user myID with
+// the given msgNum.
+func (msgDB *MsgDB) GetAttachments(
+	myID string,
+	msgNum int64,
+) ([]*Attachment, error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return nil, log.Error(err)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return nil, log.Error(err)
+	}
+	rows, err := msgDB.getAttachmentsQuery.Query(self, msgNum)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	var attachments []*Attachment
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			attachID int64
+			filename string
+			data     []byte
+			deleted  int64
+		)
+		err = rows.Scan(&attachID, &filename, &data, &deleted)
+		if err != nil {
+			return nil, log.Error(err)
+		}
+		if deleted > 0 {
+			data = nil
+		}
+		attachments = append(attachments, &Attachment{
+			AttachID: attachID,
+			Filename: filename,
+			Data:     data,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	return attachments, nil
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"database/sql"
+
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid/identity"
+)
+
+// AddChunk removes the entry with index iqIdx from inqueue and adds the
+// decrypted chunk (piece of count many chunks of the message with messageID)
+// to msgDB. The verified permanent signature sig of chunk is stored as well
+// (if any), together with the uidHash of the sender UID message used for it.
+// If the chunk is malformed (invalid piece number or a count which differs
+// from the other chunks of the message) ErrInvalidChunk is returned and the
+// inqueue entry is left untouched.
+func (msgDB *MsgDB) AddChunk(
+	iqIdx int64,
+	messageID string,
+	piece, count uint64,
+	chunk, sig, uidHash string,
+) error {
+	if piece < 1 || piece > count {
+		log.Warnf("msgdb: invalid chunk %d of %d", piece, count)
+		return ErrInvalidChunk
+	}
+	var mID int64
+	var cID int64
+	var date int64
+	err := msgDB.getInQueueIDsQuery.QueryRow(iqIdx).Scan(&mID, &cID, &date)
+	if err != nil {
+		return log.Error(err)
+	}
+	var total uint64
+	err = msgDB.getChunkCountQuery.QueryRow(mID, messageID).Scan(&total)
+	switch {
+	case err == sql.ErrNoRows:
+		// first chunk of message
+	case err != nil:
+		return log.Error(err)
+	case total != count:
+		log.Warnf("msgdb: chunk count %d of %s differs from %d", count,
+			messageID, total)
+		return ErrInvalidChunk
+	}
+	tx, err := msgDB.encDB.Begin()
+	if err != nil {
+		return log.Error(err)
+	}
+	_, err = tx.Stmt(msgDB.addChunkQuery).Exec(mID, messageID, piece, count,
+		date, chunk, sig, uidHash)
+	if err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	if _, err := tx.Stmt(msgDB.removeInQueueQuery).Exec(iqIdx); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	return nil
+}
+
+// GetChunks returns the chunks of the message with messageID for user myID
+// in order, if all chunks have been received. Otherwise nil is returned.
+// sigs contains the permanent signatures of the chunks (with an empty
+// Signature for unsigned chunks). The returned date is the time the last
+// chunk was received.
+func (msgDB *MsgDB) GetChunks(myID, messageID string) (
+	chunks []string,
+	sigs []*Signature,
+	date int64,
+	err error,
+) {
+	if err := identity.IsMapped(myID); err != nil {
+		return nil, nil, 0, log.Error(err)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return nil, nil, 0, log.Error(err)
+	}
+	rows, err := msgDB.getChunksQuery.Query(self, messageID)
+	if err != nil {
+		return nil, nil, 0, log.Error(err)
+	}
+	defer rows.Close()
+	var total uint64
+	for rows.Next() {
+		var (
+			piece   uint64
+			count   uint64
+			d       int64
+			chunk   string
+			sig     string
+			uidHash string
+		)
+		err := rows.Scan(&piece, &count, &d, &chunk, &sig, &uidHash)
+		if err != nil {
+			return nil, nil, 0, log.Error(err)
+		}
+		if total == 0 {
+			total = count
+		} else if count != total {
+			// cannot be reassembled, leave it for ExpireChunks
+			log.Warnf("msgdb: inconsistent chunk count for %s", messageID)
+			return nil, nil, 0, nil
+		}
+		if piece <= uint64(len(chunks)) {
+			continue // duplicate piece
+		}
+		if piece != uint64(len(chunks))+1 {
+			return nil, nil, 0, nil // piece missing
+		}
+		chunks = append(chunks, chunk)
+		sigs = append(sigs, &Signature{
+			Content:   chunk,
+			Signature: sig,
+			UIDHash:   uidHash,
+		})
+		if d > date {
+			date = d
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, 0, log.Error(err)
+	}
+	if uint64(len(chunks)) != total {
+		return nil, nil, 0, nil
+	}
+	return chunks, sigs, date, nil
+}
+
+// DelChunks deletes all chunks of the message with messageID for user myID.
+func (msgDB *MsgDB) DelChunks(myID, messageID string) error {
+	if err := identity.IsMapped(myID); err != nil {
+		return log.Error(err)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return log.Error(err)
+	}
+	if _, err := msgDB.delChunksQuery.Exec(self, messageID); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+// ExpireChunks deletes all chunks which have been received before date.
+func (msgDB *MsgDB) ExpireChunks(date int64) error {
+	if _, err := msgDB.expireChunksQuery.Exec(date); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
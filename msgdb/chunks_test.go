@@ -0,0 +1,280 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encdb"
+	"github.com/mutecomm/mute/util/times"
+)
+
+func TestChunks(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	b := "bob@mute.berlin"
+	if err := msgDB.AddNym(a, a, ""); err != nil {
+		t.Fatal(err)
+	}
+	now := times.Now()
+	parts := []string{"first", "second", "third"}
+	// add chunks out of order and one piece twice
+	for _, piece := range []uint64{3, 1, 3} {
+		if err := msgDB.AddInQueue(a, "", now, "chunk"); err != nil {
+			t.Fatal(err)
+		}
+		iqIdx, _, _, _, _, err := msgDB.GetInQueue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = msgDB.AddChunk(iqIdx, "msgid", piece, 3, parts[piece-1], "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := msgDB.AddChunk(1, "msgid", 4, 3, "invalid", "", ""); err != ErrInvalidChunk {
+		t.Errorf("should fail with ErrInvalidChunk: %v", err)
+	}
+	// count differs from the other chunks
+	if err := msgDB.AddInQueue(a, "", now, "chunk"); err != nil {
+		t.Fatal(err)
+	}
+	iqIdx, _, _, _, _, err := msgDB.GetInQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddChunk(iqIdx, "msgid", 2, 4, "invalid", "", ""); err != ErrInvalidChunk {
+		t.Errorf("should fail with ErrInvalidChunk: %v", err)
+	}
+	// the inqueue entry is left for the caller to discard
+	if err := msgDB.DelInQueue(iqIdx); err != nil {
+		t.Fatal(err)
+	}
+	// incomplete
+	res, _, _, err := msgDB.GetChunks(a, "msgid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != nil {
+		t.Error("chunks should be incomplete")
+	}
+	// complete
+	if err := msgDB.AddInQueue(a, "", now+1, "chunk"); err != nil {
+		t.Fatal(err)
+	}
+	iqIdx, _, _, _, _, err = msgDB.GetInQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddChunk(iqIdx, "msgid", 2, 3, parts[1], "", ""); err != nil {
+		t.Fatal(err)
+	}
+	res, sigs, date, err := msgDB.GetChunks(a, "msgid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(res, "") != strings.Join(parts, "") {
+		t.Error("wrong reassembly")
+	}
+	if len(sigs) != len(parts) || sigs[1].Content != parts[1] ||
+		sigs[1].Signature != "" {
+		t.Error("wrong signatures")
+	}
+	if date != now+1 {
+		t.Error("date != now+1")
+	}
+	// inqueue is empty
+	iqIdx, _, _, _, _, err = msgDB.GetInQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iqIdx != 0 {
+		t.Error("inqueue should be empty")
+	}
+	// other users do not see the chunks
+	if err := msgDB.AddNym(b, b, ""); err != nil {
+		t.Fatal(err)
+	}
+	res, _, _, err = msgDB.GetChunks(b, "msgid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != nil {
+		t.Error("chunks of other user visible")
+	}
+	// delete
+	if err := msgDB.DelChunks(a, "msgid"); err != nil {
+		t.Fatal(err)
+	}
+	res, _, _, err = msgDB.GetChunks(a, "msgid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != nil {
+		t.Error("chunks not deleted")
+	}
+	// expire
+	if err := msgDB.AddInQueue(a, "", now, "chunk"); err != nil {
+		t.Fatal(err)
+	}
+	iqIdx, _, _, _, _, err = msgDB.GetInQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddChunk(iqIdx, "msgid", 1, 1, parts[0], "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.ExpireChunks(now); err != nil {
+		t.Fatal(err)
+	}
+	res, _, _, err = msgDB.GetChunks(a, "msgid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res == nil {
+		t.Error("chunk expired too early")
+	}
+	if err := msgDB.ExpireChunks(now + 1); err != nil {
+		t.Fatal(err)
+	}
+	res, _, _, err = msgDB.GetChunks(a, "msgid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != nil {
+		t.Error("chunk not expired")
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "msgdb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	dbname := filepath.Join(tmpdir, "msgdb")
+	passphrase := []byte(cipher.RandPass(cipher.RandReader))
+	if err := Create(dbname, passphrase, 64000); err != nil {
+		t.Fatal(err)
+	}
+	// downgrade to version 1
+	encDB, err := encdb.Open(dbname, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = encDB.Exec(`
+DROP TABLE MessageIndex;
+DROP TABLE Signatures;
+DROP TABLE OutQueue;
+DROP TABLE Attachments;
+DROP TABLE Messages;
+CREATE TABLE Messages (
+  MsgID       INTEGER PRIMARY KEY,
+  Self        INTEGER NOT NULL,
+  Peer        INTEGER NOT NULL,
+  Direction   INTEGER NOT NULL,
+  ToSend      INTEGER NOT NULL,
+  Sent        INTEGER NOT NULL,
+  "From"      TEXT    NOT NULL,
+  "To"        TEXT    NOT NULL,
+  Date        INTEGER NOT NULL,
+  Subject     TEXT,
+  Message     TEXT,
+  Sign        INTEGER NOT NULL,
+  MinDelay    INTEGER NOT NULL,
+  MaxDelay    INTEGER NOT NULL,
+  Read        INTEGER NOT NULL,
+  Star        INTEGER NOT NULL,
+  FOREIGN KEY(Self) REFERENCES Nyms(UID) ON DELETE CASCADE,
+  FOREIGN KEY(Peer) REFERENCES Contacts(UID)
+);
+CREATE TABLE Attachments (
+  AttachID INTEGER PRIMARY KEY,
+  Self     INTEGER NOT NULL,
+  Msg      INTEGER NOT NULL,
+  Filename TEXT    NOT NULL,
+  Data     BLOB,
+  Deleted  INTEGER NOT NULL,
+  FOREIGN KEY(Self) REFERENCES Nyms(UID) ON DELETE CASCADE,
+  FOREIGN KEY(Msg) REFERENCES Messages(MsgID)
+);
+CREATE TABLE OutQueue (
+  OQIdx      INTEGER PRIMARY KEY,
+  Self       INTEGER NOT NULL,
+  MsgID      INTEGER NOT NULL,
+  Msg        TEXT    NOT NULL,
+  NymAddress TEXT    NOT NULL,
+  MinDelay   INTEGER NOT NULL,
+  MaxDelay   INTEGER NOT NULL,
+  Envelope   INTEGER NOT NULL,
+  Resend     INTEGER NOT NULL,
+  FOREIGN KEY(Self) REFERENCES Nyms(UID) ON DELETE CASCADE
+  FOREIGN KEY(MsgID) REFERENCES Messages(MsgID) ON DELETE CASCADE
+);
+DROP TABLE Chunks;
+CREATE TABLE Chunks (
+  ChunkID   INTEGER PRIMARY KEY,
+  Self      INTEGER NOT NULL,
+  MessageID TEXT    NOT NULL,
+  Piece     INTEGER NOT NULL,
+  Count     INTEGER NOT NULL,
+  Date      INTEGER NOT NULL,
+  FOREIGN KEY(Self) REFERENCES Nyms(UID) ON DELETE CASCADE
+);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encDB.Exec(updateValueQuery, "1", DBVersion); err != nil {
+		t.Fatal(err)
+	}
+	encDB.Close()
+	// upgrade
+	msgDB, err := Open(dbname, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer msgDB.Close()
+	version, err := msgDB.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != Version {
+		t.Errorf("version != %s", Version)
+	}
+	// backup of version 1 has been created
+	if _, err := os.Stat(encdb.BackupName(dbname, 1) + encdb.DBSuffix); err != nil {
+		t.Error(err)
+	}
+	a := "alice@mute.berlin"
+	if err := msgDB.AddNym(a, a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddInQueue(a, "", times.Now(), "chunk"); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddChunk(1, "msgid", 1, 1, "part", "sig", "uidhash"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := msgDB.numberOfSignatures(); err != nil || n != 0 {
+		t.Error("signatures table missing")
+	}
+	_, sigs, _, err := msgDB.GetChunks(a, "msgid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sigs) != 1 || sigs[0].Signature != "sig" || sigs[0].UIDHash != "uidhash" {
+		t.Error("wrong chunk signature")
+	}
+}
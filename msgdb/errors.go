@@ -10,3 +10,7 @@ import (
 
 // ErrNilMessageID is returned if the messageID argument is nil.
 var ErrNilMessageID = errors.New("msgdb: messageID nil")
+
+// ErrInvalidChunk is returned if a chunk has an invalid piece number or a
+// count which differs from the other chunks of the same message.
+var ErrInvalidChunk = errors.New("msgdb: invalid chunk")
@@ -0,0 +1,198 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"database/sql"
+
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid/identity"
+)
+
+// Folder represents the different message folders.
+type Folder int64
+
+const (
+	// AllFolders represents all messages (except trashed ones).
+	AllFolders Folder = iota
+	// Inbox represents received messages which are neither archived nor in
+	// trash.
+	Inbox
+	// Archive represents archived messages which are not in trash.
+	Archive
+	// Trash represents messages in trash.
+	Trash
+	// Starred represents starred messages which are not in trash.
+	Starred
+	// Sent represents sent messages which are neither archived nor in
+	// trash.
+	Sent
+)
+
+// ParseFolder parses the given folder name (inbox, archive, trash, starred,
+// or sent). The empty name refers to AllFolders.
+func ParseFolder(name string) (Folder, error) {
+	switch name {
+	case "":
+		return AllFolders, nil
+	case "inbox":
+		return Inbox, nil
+	case "archive":
+		return Archive, nil
+	case "trash":
+		return Trash, nil
+	case "starred":
+		return Starred, nil
+	case "sent":
+		return Sent, nil
+	}
+	return 0, log.Errorf("msgdb: unknown folder '%s'", name)
+}
+
+// Contains returns true, if the message with the given msgID is contained in
+// folder.
+func (folder Folder) Contains(msgID *MsgID) bool {
+	switch folder {
+	case AllFolders:
+		return !msgID.Trashed
+	case Inbox:
+		return msgID.Incoming && !msgID.Archived && !msgID.Trashed
+	case Archive:
+		return msgID.Archived && !msgID.Trashed
+	case Trash:
+		return msgID.Trashed
+	case Starred:
+		return msgID.Starred && !msgID.Trashed
+	case Sent:
+		return !msgID.Incoming && !msgID.Archived && !msgID.Trashed
+	}
+	return false
+}
+
+// GetFolder returns all message IDs (sqlite row IDs) for the user ID myID in
+// the given folder.
+func (msgDB *MsgDB) GetFolder(myID string, folder Folder) ([]*MsgID, error) {
+	msgIDs, err := msgDB.GetMsgIDs(myID)
+	if err != nil {
+		return nil, err
+	}
+	var ids []*MsgID
+	for _, msgID := range msgIDs {
+		if folder.Contains(msgID) {
+			ids = append(ids, msgID)
+		}
+	}
+	return ids, nil
+}
+
+// setMsgFlag executes the given update query stmt with args for the message
+// with the given msgNum of user myID.
+func (msgDB *MsgDB) setMsgFlag(
+	stmt *sql.Stmt,
+	myID string,
+	msgNum int64,
+	args ...interface{},
+) error {
+	if err := identity.IsMapped(myID); err != nil {
+		return log.Error(err)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return log.Error(err)
+	}
+	res, err := stmt.Exec(append(args, msgNum, self)...)
+	if err != nil {
+		return log.Error(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return log.Error(err)
+	}
+	if n < 1 {
+		return log.Errorf("msgdb: unknown msgnum %d for user ID %s",
+			msgNum, myID)
+	}
+	return nil
+}
+
+// StarMessage stars (or unstars) the message from user myID with the given
+// msgNum.
+func (msgDB *MsgDB) StarMessage(myID string, msgNum int64, star bool) error {
+	var s int64
+	if star {
+		s = 1
+	}
+	return msgDB.setMsgFlag(msgDB.starMsgQuery, myID, msgNum, s)
+}
+
+// ArchiveMessage moves the message from user myID with the given msgNum to
+// the archive.
+func (msgDB *MsgDB) ArchiveMessage(myID string, msgNum int64) error {
+	return msgDB.setMsgFlag(msgDB.archiveMsgQuery, myID, msgNum)
+}
+
+// TrashMessage moves the message from user myID with the given msgNum to
+// trash at time now. Messages already in trash cannot be trashed again.
+func (msgDB *MsgDB) TrashMessage(myID string, msgNum, now int64) error {
+	return msgDB.setMsgFlag(msgDB.trashMsgQuery, myID, msgNum, now)
+}
+
+// RestoreMessage restores the message from user myID with the given msgNum
+// from the archive or trash.
+func (msgDB *MsgDB) RestoreMessage(myID string, msgNum int64) error {
+	return msgDB.setMsgFlag(msgDB.restoreMsgQuery, myID, msgNum)
+}
+
+// PurgeTrash permanently deletes all messages of user myID which have been
+// moved to trash before the given time. It returns the number of deleted
+// messages.
+func (msgDB *MsgDB) PurgeTrash(myID string, before int64) (int64, error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return 0, log.Error(err)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return 0, log.Error(err)
+	}
+	tx, err := msgDB.encDB.Begin()
+	if err != nil {
+		return 0, log.Error(err)
+	}
+	rows, err := tx.Stmt(msgDB.getTrashedMsgsQuery).Query(self, before)
+	if err != nil {
+		tx.Rollback()
+		return 0, log.Error(err)
+	}
+	var msgNums []int64
+	for rows.Next() {
+		var msgNum int64
+		if err := rows.Scan(&msgNum); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return 0, log.Error(err)
+		}
+		msgNums = append(msgNums, msgNum)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		tx.Rollback()
+		return 0, log.Error(err)
+	}
+	rows.Close()
+	var purged int64
+	for _, msgNum := range msgNums {
+		n, err := msgDB.delMessage(tx, self, msgNum)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		purged += n
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return 0, log.Error(err)
+	}
+	return purged, nil
+}
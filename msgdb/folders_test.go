@@ -0,0 +1,156 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mutecomm/mute/def"
+	"github.com/mutecomm/mute/util/times"
+)
+
+func folderMsgNums(t *testing.T, msgDB *MsgDB, myID string, folder Folder) []int64 {
+	ids, err := msgDB.GetFolder(myID, folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgNums []int64
+	for _, id := range ids {
+		msgNums = append(msgNums, id.MsgID)
+	}
+	return msgNums
+}
+
+func equalMsgNums(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFolders(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	b := "bob@mute.berlin"
+	if err := msgDB.AddNym(a, a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddNym(b, b, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddContact(a, b, b, "", WhiteList); err != nil {
+		t.Fatal(err)
+	}
+	now := times.Now()
+	for i, sent := range []bool{true, false, false, true} {
+		err = msgDB.AddMessage(a, b, now+int64(i), sent, "msg", "", "", nil,
+			nil, false, def.MinDelay, def.MaxDelay)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := msgDB.StarMessage(a, 2, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.StarMessage(a, 4, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.StarMessage(a, 4, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.ArchiveMessage(a, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.TrashMessage(a, 4, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.TrashMessage(a, 4, now+10); err == nil {
+		t.Error("should fail")
+	}
+	// messages of other users cannot be changed
+	if err := msgDB.TrashMessage(b, 1, now); err == nil {
+		t.Error("should fail")
+	}
+	if err := msgDB.ArchiveMessage(a, 5); err == nil {
+		t.Error("should fail")
+	}
+	for _, test := range []struct {
+		folder  Folder
+		msgNums []int64
+	}{
+		{AllFolders, []int64{1, 2, 3}},
+		{Inbox, []int64{2}},
+		{Archive, []int64{3}},
+		{Trash, []int64{4}},
+		{Starred, []int64{2}},
+		{Sent, []int64{1}},
+	} {
+		msgNums := folderMsgNums(t, msgDB, a, test.folder)
+		if !equalMsgNums(msgNums, test.msgNums) {
+			t.Errorf("folder %d: wrong messages: %v", test.folder, msgNums)
+		}
+	}
+	// restore
+	if err := msgDB.RestoreMessage(a, 3); err != nil {
+		t.Fatal(err)
+	}
+	if msgNums := folderMsgNums(t, msgDB, a, Inbox); !equalMsgNums(msgNums, []int64{2, 3}) {
+		t.Errorf("wrong inbox: %v", msgNums)
+	}
+	// purge trash
+	if err := msgDB.TrashMessage(a, 1, now+20); err != nil {
+		t.Fatal(err)
+	}
+	n, err := msgDB.PurgeTrash(a, now+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("wrong number of purged messages: %d", n)
+	}
+	if msgNums := folderMsgNums(t, msgDB, a, Trash); !equalMsgNums(msgNums, []int64{1}) {
+		t.Errorf("wrong trash: %v", msgNums)
+	}
+	num, err := msgDB.numberOfMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != 3 {
+		t.Errorf("num != 3 == %d", num)
+	}
+}
+
+func TestParseFolder(t *testing.T) {
+	for name, folder := range map[string]Folder{
+		"":        AllFolders,
+		"inbox":   Inbox,
+		"archive": Archive,
+		"trash":   Trash,
+		"starred": Starred,
+		"sent":    Sent,
+	} {
+		f, err := ParseFolder(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f != folder {
+			t.Errorf("wrong folder for '%s': %d", name, f)
+		}
+	}
+	if _, err := ParseFolder("unknown"); err == nil {
+		t.Error("should fail")
+	}
+}
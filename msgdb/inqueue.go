@@ -82,9 +82,15 @@ func (msgDB *MsgDB) SetInQueue(iqIdx int64, msg string) error {
 }
 
 // RemoveInQueue remove the entry with index iqIdx from inqueue and adds the
-// descrypted message plainMsg to msgDB (if drop is not true).
+// descrypted message plainMsg (with the given messageID and inReplyTo)
+// together with the given attachments and (verified) permanent signatures to
+// msgDB (if drop is not true).
 func (msgDB *MsgDB) RemoveInQueue(
-	iqIdx int64, plainMsg, fromID string,
+	iqIdx int64,
+	plainMsg, messageID, inReplyTo string,
+	attachments []*Attachment,
+	signatures []*Signature,
+	fromID string,
 	drop bool,
 ) error {
 	if err := identity.IsMapped(fromID); err != nil {
@@ -110,16 +116,40 @@ func (msgDB *MsgDB) RemoveInQueue(
 		tx.Rollback()
 		return log.Error(err)
 	}
-	// TODO: handle signatures
 	parts := strings.SplitN(plainMsg, "\n", 2)
 	subject := parts[0]
+	var signed int64
+	if len(signatures) > 0 {
+		signed = 1
+	}
 	if !drop {
-		_, err = tx.Stmt(msgDB.addMsgQuery).Exec(mID, cID, 0, 0, 0, fromID,
-			to, date, subject, plainMsg, 0, 0, 0)
+		res, err := tx.Stmt(msgDB.addMsgQuery).Exec(mID, cID, 0, 0, 0, fromID,
+			to, date, subject, plainMsg, signed, 0, 0, signed, messageID,
+			inReplyTo)
+		if err != nil {
+			tx.Rollback()
+			return log.Error(err)
+		}
+		msgNum, err := res.LastInsertId()
 		if err != nil {
 			tx.Rollback()
 			return log.Error(err)
 		}
+		err = msgDB.indexMessage(tx, msgNum, subject, plainMsg)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = msgDB.addAttachments(tx, mID, msgNum, attachments)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = msgDB.addSignatures(tx, mID, msgNum, signatures)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
 	}
 	if _, err := tx.Stmt(msgDB.removeInQueueQuery).Exec(iqIdx); err != nil {
 		tx.Rollback()
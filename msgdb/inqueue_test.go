@@ -55,7 +55,8 @@ func TestInQueue(t *testing.T) {
 	if err := msgDB.SetInQueue(iqIdx, "encrypted1"); err != nil {
 		t.Fatal(err)
 	}
-	if err := msgDB.RemoveInQueue(iqIdx, "plaintext1", b, false); err != nil {
+	err = msgDB.RemoveInQueue(iqIdx, "plaintext1", "", "", nil, nil, b, false)
+	if err != nil {
 		t.Fatal(err)
 	}
 	iqIdx, myID, contactID, msg2, env, err := msgDB.GetInQueue()
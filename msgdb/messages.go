@@ -12,13 +12,19 @@ import (
 	"github.com/mutecomm/mute/uid/identity"
 )
 
-// AddMessage adds message between selfID and peerID to msgDB. If sent is
-// true, it is a sent message. Otherwise a received message.
+// AddMessage adds message between selfID and peerID to msgDB together with
+// the given attachments. If sent is true, it is a sent message. Otherwise a
+// received message. The permanent signatures of a received message must
+// have been verified by the caller, the message is marked as signed and
+// verified, if there are any. messageID and inReplyTo are the message ID of
+// the message and the message ID of the message it replies to (if any).
 func (msgDB *MsgDB) AddMessage(
 	selfID, peerID string,
 	date int64,
 	sent bool,
-	message string,
+	message, messageID, inReplyTo string,
+	attachments []*Attachment,
+	signatures []*Signature,
 	sign bool,
 	minDelay, maxDelay int32,
 ) error {
@@ -45,9 +51,14 @@ func (msgDB *MsgDB) AddMessage(
 		d = 1
 	}
 	var s int64
+	var v int64
 	if sign {
 		s = 1
 	}
+	if len(signatures) > 0 {
+		s = 1
+		v = 1
+	}
 	var from string
 	var to string
 	if sent {
@@ -59,9 +70,35 @@ func (msgDB *MsgDB) AddMessage(
 	}
 	parts := strings.SplitN(message, "\n", 2)
 	subject := parts[0]
-	_, err = msgDB.addMsgQuery.Exec(self, peer, d, d, 0, from, to, date,
-		subject, message, s, minDelay, maxDelay)
+	tx, err := msgDB.encDB.Begin()
+	if err != nil {
+		return log.Error(err)
+	}
+	res, err := tx.Stmt(msgDB.addMsgQuery).Exec(self, peer, d, d, 0, from, to,
+		date, subject, message, s, minDelay, maxDelay, v, messageID, inReplyTo)
+	if err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	msgNum, err := res.LastInsertId()
 	if err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	if err := msgDB.indexMessage(tx, msgNum, subject, message); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := msgDB.addAttachments(tx, self, msgNum, attachments); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := msgDB.addSignatures(tx, self, msgNum, signatures); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
 		return log.Error(err)
 	}
 	return nil
@@ -154,64 +191,99 @@ func (msgDB *MsgDB) DelMessage(myID string, msgNum int64) error {
 	if err := identity.IsMapped(myID); err != nil {
 		return log.Error(err)
 	}
-	var self int
+	var self int64
 	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
 		return log.Error(err)
 	}
-	res, err := msgDB.delMsgQuery.Exec(msgNum, self)
+	tx, err := msgDB.encDB.Begin()
 	if err != nil {
 		return log.Error(err)
 	}
-	n, err := res.RowsAffected()
+	n, err := msgDB.delMessage(tx, self, msgNum)
 	if err != nil {
-		return log.Error(err)
+		tx.Rollback()
+		return err
 	}
 	if n < 1 {
+		tx.Rollback()
 		return log.Errorf("msgdb: unknown msgnum %d for user ID %s",
 			msgNum, myID)
 	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
 	return nil
 }
 
-// MsgID is the info type that is returned by GetMsgIDs.
-type MsgID struct {
-	MsgID    int64  // the message ID
-	From     string // sender
-	To       string // recipient
-	Incoming bool   // an incoming message, outgoing otherwise
-	Sent     bool   // outgoing message has been sent
-	Date     int64
-	Subject  string
-	Read     bool
-}
-
-// GetMsgIDs returns all message IDs (sqlite row IDs) for the user ID myID.
-func (msgDB *MsgDB) GetMsgIDs(myID string) ([]*MsgID, error) {
-	if err := identity.IsMapped(myID); err != nil {
-		return nil, log.Error(err)
+// delMessage deletes the message with the given msgNum of user self
+// (together with its attachments and signatures) in transaction tx. It
+// returns the number of deleted messages.
+func (msgDB *MsgDB) delMessage(tx *sql.Tx, self, msgNum int64) (int64, error) {
+	if _, err := tx.Stmt(msgDB.delAttachmentsQuery).Exec(msgNum, self); err != nil {
+		return 0, log.Error(err)
 	}
-	var uid int
-	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&uid); err != nil {
-		return nil, log.Error(err)
+	if _, err := tx.Stmt(msgDB.delSignaturesQuery).Exec(msgNum, self); err != nil {
+		return 0, log.Error(err)
 	}
-	rows, err := msgDB.getMsgsQuery.Query(uid)
+	// the index entry has to be removed before the indexed message
+	if _, err := tx.Stmt(msgDB.delMsgIndexQuery).Exec(msgNum, self); err != nil {
+		return 0, log.Error(err)
+	}
+	res, err := tx.Stmt(msgDB.delMsgQuery).Exec(msgNum, self)
 	if err != nil {
-		return nil, log.Error(err)
+		return 0, log.Error(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, log.Error(err)
 	}
+	return n, nil
+}
+
+// MsgID is the info type that is returned by GetMsgIDs.
+type MsgID struct {
+	MsgID     int64  // the message ID
+	From      string // sender
+	To        string // recipient
+	Incoming  bool   // an incoming message, outgoing otherwise
+	Sent      bool   // outgoing message has been sent
+	Date      int64
+	Subject   string
+	Read      bool
+	Signed    bool   // message is (to be) permanently signed
+	Verified  bool   // permanent signature(s) of message have been verified
+	MessageID string // unique message ID ("" if unknown)
+	InReplyTo string // message ID of the message this message replies to
+	Starred   bool   // message is starred
+	Archived  bool   // message is archived
+	Trashed   bool   // message is in trash
+}
+
+// scanMsgIDs scans the given rows of a getMsgsQuery or getThreadQuery.
+func scanMsgIDs(rows *sql.Rows) ([]*MsgID, error) {
 	var msgIDs []*MsgID
 	defer rows.Close()
 	for rows.Next() {
 		var (
-			id      int64
-			from    string
-			to      string
-			d       int64
-			s       int64
-			date    int64
-			subject string
-			r       int64
+			id        int64
+			from      string
+			to        string
+			d         int64
+			s         int64
+			date      int64
+			subject   string
+			r         int64
+			sign      int64
+			v         int64
+			messageID string
+			inReplyTo string
+			star      int64
+			archive   int64
+			trash     int64
 		)
-		err = rows.Scan(&id, &from, &to, &d, &s, &date, &subject, &r)
+		err := rows.Scan(&id, &from, &to, &d, &s, &date, &subject, &r, &sign,
+			&v, &messageID, &inReplyTo, &star, &archive, &trash)
 		if err != nil {
 			return nil, log.Error(err)
 		}
@@ -230,14 +302,21 @@ func (msgDB *MsgDB) GetMsgIDs(myID string) ([]*MsgID, error) {
 			read = true
 		}
 		msgIDs = append(msgIDs, &MsgID{
-			MsgID:    id,
-			From:     from,
-			To:       to,
-			Incoming: incoming,
-			Sent:     sent,
-			Date:     date,
-			Subject:  subject,
-			Read:     read,
+			MsgID:     id,
+			From:      from,
+			To:        to,
+			Incoming:  incoming,
+			Sent:      sent,
+			Date:      date,
+			Subject:   subject,
+			Read:      read,
+			Signed:    sign > 0,
+			Verified:  v > 0,
+			MessageID: messageID,
+			InReplyTo: inReplyTo,
+			Starred:   star > 0,
+			Archived:  archive > 0,
+			Trashed:   trash > 0,
 		})
 	}
 	if err := rows.Err(); err != nil {
@@ -246,6 +325,85 @@ func (msgDB *MsgDB) GetMsgIDs(myID string) ([]*MsgID, error) {
 	return msgIDs, nil
 }
 
+// GetMsgIDs returns all message IDs (sqlite row IDs) for the user ID myID.
+func (msgDB *MsgDB) GetMsgIDs(myID string) ([]*MsgID, error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return nil, log.Error(err)
+	}
+	var uid int
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&uid); err != nil {
+		return nil, log.Error(err)
+	}
+	rows, err := msgDB.getMsgsQuery.Query(uid)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	return scanMsgIDs(rows)
+}
+
+// GetThread returns the message IDs (sqlite row IDs) of the whole
+// conversation between the user ID myID and contactID, ordered by date.
+func (msgDB *MsgDB) GetThread(myID, contactID string) ([]*MsgID, error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return nil, log.Error(err)
+	}
+	if err := identity.IsMapped(contactID); err != nil {
+		return nil, log.Error(err)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return nil, log.Error(err)
+	}
+	var peer int64
+	err := msgDB.getContactUIDQuery.QueryRow(self, contactID).Scan(&peer)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, log.Errorf("msgdb: unknown contact %s for user ID %s",
+			contactID, myID)
+	case err != nil:
+		return nil, log.Error(err)
+	}
+	rows, err := msgDB.getThreadQuery.Query(self, peer)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	return scanMsgIDs(rows)
+}
+
+// GetMessageThreadIDs returns the peer, the message ID, and the ID of the
+// message it replies to for the message from user myID with the given
+// msgNum.
+func (msgDB *MsgDB) GetMessageThreadIDs(
+	myID string,
+	msgNum int64,
+) (peerID, messageID, inReplyTo string, err error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return "", "", "", log.Error(err)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return "", "", "", log.Error(err)
+	}
+	var (
+		s    int64
+		peer int64
+	)
+	err = msgDB.getMsgThreadIDsQuery.QueryRow(msgNum).Scan(&s, &peer,
+		&messageID, &inReplyTo)
+	switch {
+	case err == sql.ErrNoRows || (err == nil && s != self):
+		return "", "", "", log.Errorf("msgdb: unknown msgnum %d for user ID %s",
+			msgNum, myID)
+	case err != nil:
+		return "", "", "", log.Error(err)
+	}
+	err = msgDB.getContactMappedQuery.QueryRow(self, peer).Scan(&peerID)
+	if err != nil {
+		return "", "", "", log.Error(err)
+	}
+	return
+}
+
 // GetUndeliveredMessage returns the oldest undelivered message for myID from
 // msgDB.
 func (msgDB *MsgDB) GetUndeliveredMessage(myID string) (
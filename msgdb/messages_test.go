@@ -39,12 +39,12 @@ func TestMessages(t *testing.T) {
 		t.Errorf("num != 0 == %d", num)
 	}
 	now := times.Now()
-	err = msgDB.AddMessage(a, b, now, true, "ping", false,
+	err = msgDB.AddMessage(a, b, now, true, "ping", "", "", nil, nil, false,
 		def.MinDelay, def.MaxDelay)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = msgDB.AddMessage(a, b, now, false, "pong", false,
+	err = msgDB.AddMessage(a, b, now, false, "pong", "", "", nil, nil, false,
 		def.MinDelay, def.MaxDelay)
 	if err != nil {
 		t.Fatal(err)
@@ -120,3 +120,74 @@ func TestMessages(t *testing.T) {
 		t.Fatal("should fail")
 	}
 }
+
+func TestThread(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	b := "bob@mute.berlin"
+	c := "carol@mute.berlin"
+	if err := msgDB.AddNym(a, a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddContact(a, b, b, "", WhiteList); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddContact(a, c, c, "", WhiteList); err != nil {
+		t.Fatal(err)
+	}
+	now := times.Now()
+	msgs := []struct {
+		peer      string
+		date      int64
+		sent      bool
+		messageID string
+		inReplyTo string
+	}{
+		{b, now, true, "id1", ""},
+		{c, now + 1, true, "id2", ""},
+		{b, now + 3, true, "id3", "id4"},
+		{b, now + 2, false, "id4", "id1"},
+	}
+	for _, m := range msgs {
+		err = msgDB.AddMessage(a, m.peer, m.date, m.sent, "subject", m.messageID,
+			m.inReplyTo, nil, nil, false, def.MinDelay, def.MaxDelay)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// thread is ordered by date
+	ids, err := msgDB.GetThread(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 {
+		t.Fatalf("len(ids) != 3 == %d", len(ids))
+	}
+	for i, id := range []int64{1, 4, 3} {
+		if ids[i].MsgID != id {
+			t.Errorf("ids[%d].MsgID != %d == %d", i, id, ids[i].MsgID)
+		}
+	}
+	if ids[1].MessageID != "id4" || ids[1].InReplyTo != "id1" {
+		t.Errorf("wrong thread IDs: %s, %s", ids[1].MessageID, ids[1].InReplyTo)
+	}
+	if _, err := msgDB.GetThread(a, "dave@mute.berlin"); err == nil {
+		t.Error("should fail")
+	}
+	// thread IDs of single message
+	peer, messageID, inReplyTo, err := msgDB.GetMessageThreadIDs(a, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer != b || messageID != "id3" || inReplyTo != "id4" {
+		t.Errorf("wrong thread IDs: %s, %s, %s", peer, messageID, inReplyTo)
+	}
+	if _, _, _, err := msgDB.GetMessageThreadIDs(a, 5); err == nil {
+		t.Error("should fail")
+	}
+}
@@ -9,16 +9,17 @@ import (
 	"database/sql"
 
 	"github.com/mutecomm/mute/encdb"
+	"github.com/mutecomm/mute/log"
 )
 
 // Version is the current msgdb version.
-const Version = "1"
+const Version = "9"
 
 // Entries in KeyValueTable.
 const (
-	DBVersion = "Version"   // version string of msgdb
-	WalletKey = "WalletKey" // 64-byte private Ed25519 wallet key, base64 encoded
-	ActiveUID = "ActiveUID" // the active UID
+	DBVersion = encdb.VersionKey // version string of msgdb
+	WalletKey = "WalletKey"      // 64-byte private Ed25519 wallet key, base64 encoded
+	ActiveUID = "ActiveUID"      // the active UID
 )
 
 const (
@@ -67,14 +68,6 @@ CREATE TABLE Accounts (
   UNIQUE     (MyID, ContactID),  -- only one account per pair
   FOREIGN KEY(MyID) REFERENCES Nyms(UID) ON DELETE CASCADE
 );`
-	/*
-	   TODO: add
-
-	   Message-ID  TEXT    NOT NULL, -- a unique message ID for sender (must start with 'nym-')
-	   In-Reply-To TEXT,             -- message ID of the message this message is a reply to, if any
-	   Archive     INTEGER NOT NULL, -- 1: message is archived
-	   Trash       INTEGER NOT NULL, -- 1: message is deleted
-	*/
 	createQueryMessages = `
 CREATE TABLE Messages (
   MsgID       INTEGER PRIMARY KEY, -- TODO: rename to MsgNum
@@ -95,7 +88,12 @@ CREATE TABLE Messages (
   MinDelay    INTEGER NOT NULL, -- minimum delay of message
   MaxDelay    INTEGER NOT NULL, -- maximum delay of message
   Read        INTEGER NOT NULL, -- 0: message is new, 1: message read
-  Star        INTEGER NOT NULL,
+  Star        INTEGER NOT NULL, -- 1: message is starred
+  Verified    INTEGER NOT NULL DEFAULT 0, -- 1: permanent signature(s) verified
+  MessageID   TEXT    NOT NULL DEFAULT '', -- unique message ID (see msgid.Generate), '' if unknown
+  InReplyTo   TEXT    NOT NULL DEFAULT '', -- message ID of the message this message is a reply to, if any
+  Archive     INTEGER NOT NULL DEFAULT 0, -- 1: message is archived
+  Trash       INTEGER NOT NULL DEFAULT 0, -- time the message was moved to trash (0: not in trash)
   FOREIGN KEY(Self) REFERENCES Nyms(UID) ON DELETE CASCADE,
   FOREIGN KEY(Peer) REFERENCES Contacts(UID)
 );`
@@ -118,19 +116,34 @@ CREATE TABLE Chunks (
   Piece     INTEGER NOT NULL, -- piece m of n chunks
   Count     INTEGER NOT NULL, -- total number of chunks (n)
   Date      INTEGER NOT NULL, -- time when the chunk was received from muteaccd
+  Data      TEXT    NOT NULL, -- the decrypted chunk
+  Signature TEXT    NOT NULL, -- base64 encoded permanent signature of chunk (if any)
+  UIDHash   TEXT    NOT NULL DEFAULT '', -- hash of the sender UID message used for the signature
   FOREIGN KEY(Self) REFERENCES Nyms(UID) ON DELETE CASCADE
+);`
+	createQuerySignatures = `
+CREATE TABLE Signatures (
+  SigID     INTEGER PRIMARY KEY,
+  Self      INTEGER NOT NULL, -- foreign key to Nyms table
+  Msg       INTEGER NOT NULL, -- foreign key to Messages table
+  Content   TEXT    NOT NULL, -- the signed (decrypted) content of the message or chunk
+  Signature TEXT    NOT NULL, -- base64 encoded permanent signature of Content
+  UIDHash   TEXT    NOT NULL DEFAULT '', -- hash of the sender UID message used for the signature ('' if unknown)
+  FOREIGN KEY(Self) REFERENCES Nyms(UID) ON DELETE CASCADE,
+  FOREIGN KEY(Msg) REFERENCES Messages(MsgID)
 );`
 	createQueryOutQueue = ` 
  CREATE TABLE OutQueue (
   OQIdx      INTEGER PRIMARY KEY,
   Self       INTEGER NOT NULL, -- foreign key to Nyms table
-  MsgID      INTEGER NOT NULL, -- message ID of the corresponding plain text message
+  MsgID      INTEGER,          -- message ID of the corresponding plain text message (NULL for status messages)
   Msg        TEXT    NOT NULL, -- encrypted message in the outqueue
   NymAddress TEXT    NOT NULL, -- nymaddress to send message to
   MinDelay   INTEGER NOT NULL, -- minimum delay of message
   MaxDelay   INTEGER NOT NULL, -- maximum delay of message
   Envelope   INTEGER NOT NULL, -- 0: basic encrypted message, 1: with envelope and ready to send
   Resend     INTEGER NOT NULL, -- 0: process message normally, 1: message needs resend
+  EncMsg     TEXT    NOT NULL DEFAULT '', -- encrypted message, if Msg contains its envelope ('' otherwise)
   FOREIGN KEY(Self) REFERENCES Nyms(UID) ON DELETE CASCADE
   FOREIGN KEY(MsgID) REFERENCES Messages(MsgID) ON DELETE CASCADE
 );`
@@ -151,6 +164,17 @@ CREATE TABLE MessageIDCache(
   ContactID INTEGER NOT NULL, -- optional contact ID of this account (0 == undefined)
   MessageID TEXT    NOT NULL, -- server messageID (from muteaccd)
   FOREIGN KEY(MyID) REFERENCES Nyms(UID) ON DELETE CASCADE
+);`
+	// The full-text index uses FTS4, because go-sqlcipher is built without
+	// SQLITE_ENABLE_FTS5 (only FTS3/FTS4 are compiled in). The external
+	// content table keeps the index small, it is maintained explicitly (see
+	// addMsgIndexQuery, delMsgIndexQuery, and rebuildMsgIndexQuery).
+	createQueryMessageIndex = `
+CREATE VIRTUAL TABLE MessageIndex USING fts4(
+  content="Messages", -- external content table, docid is Messages.MsgID
+  Subject,
+  Message,
+  tokenize=unicode61
 );`
 	updateValueQuery            = "UPDATE KeyValueStore SET ValueEntry=? WHERE KeyEntry=?;"
 	insertValueQuery            = "INSERT INTO KeyValueStore (KeyEntry, ValueEntry) VALUES (?, ?);"
@@ -175,14 +199,38 @@ CREATE TABLE MessageIDCache(
 	getAccountQuery             = "SELECT PrivKey, Server, Secret, MinDelay, MaxDelay, LastMsgTime FROM Accounts WHERE MyID=? AND ContactID=?;"
 	getAccountsQuery            = "SELECT ContactID FROM Accounts WHERE MyID=?;"
 	getAccountTimeQuery         = "SELECT LoadTime FROM Accounts WHERE MyID=? AND ContactID=?;"
-	addMsgQuery                 = "INSERT INTO Messages (Self, Peer, Direction, ToSend, Sent, \"From\", \"To\", Date, Subject, Message, Sign, MinDelay, MaxDelay, Read, Star) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0, 0);"
+	addMsgQuery                 = "INSERT INTO Messages (Self, Peer, Direction, ToSend, Sent, \"From\", \"To\", Date, Subject, Message, Sign, MinDelay, MaxDelay, Read, Star, Verified, MessageID, InReplyTo) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0, 0, ?, ?, ?);"
 	delMsgQuery                 = "DELETE FROM Messages WHERE MsgID=? AND Self=?;"
 	getMsgQuery                 = "SELECT Self, Peer, Direction, Date, Message FROM Messages WHERE MsgID=?;"
 	readMsgQuery                = "UPDATE Messages SET Read=1 WHERE MsgID=?;"
-	getMsgsQuery                = "SELECT MsgID, \"From\", \"To\", Direction, Sent, Date, Subject, Read FROM Messages WHERE Self=?;"
+	getMsgsQuery                = "SELECT MsgID, \"From\", \"To\", Direction, Sent, Date, Subject, Read, Sign, Verified, MessageID, InReplyTo, Star, Archive, Trash FROM Messages WHERE Self=?;"
+	getThreadQuery              = "SELECT MsgID, \"From\", \"To\", Direction, Sent, Date, Subject, Read, Sign, Verified, MessageID, InReplyTo, Star, Archive, Trash FROM Messages WHERE Self=? AND Peer=? ORDER BY Date ASC, MsgID ASC;"
+	getMsgThreadIDsQuery        = "SELECT Self, Peer, MessageID, InReplyTo FROM Messages WHERE MsgID=?;"
+	starMsgQuery                = "UPDATE Messages SET Star=? WHERE MsgID=? AND Self=?;"
+	archiveMsgQuery             = "UPDATE Messages SET Archive=1 WHERE MsgID=? AND Self=?;"
+	trashMsgQuery               = "UPDATE Messages SET Trash=? WHERE MsgID=? AND Self=? AND Trash=0;"
+	restoreMsgQuery             = "UPDATE Messages SET Archive=0, Trash=0 WHERE MsgID=? AND Self=?;"
+	getTrashedMsgsQuery         = "SELECT MsgID FROM Messages WHERE Self=? AND Trash>0 AND Trash<?;"
+	addMsgIndexQuery            = "INSERT INTO MessageIndex (docid, Subject, Message) VALUES (?, ?, ?);"
+	delMsgIndexQuery            = "DELETE FROM MessageIndex WHERE docid IN (SELECT MsgID FROM Messages WHERE MsgID=? AND Self=?);"
+	rebuildMsgIndexQuery        = "INSERT INTO MessageIndex (MessageIndex) VALUES ('rebuild');"
+	searchMsgsQuery             = "SELECT Messages.MsgID, Messages.\"From\", Messages.\"To\", Messages.Direction, Messages.Sent, Messages.Date, Messages.Subject, Messages.Read, Messages.Sign, Messages.Verified, Messages.MessageID, Messages.InReplyTo, Messages.Star, Messages.Archive, Messages.Trash FROM Messages JOIN MessageIndex ON Messages.MsgID=MessageIndex.docid WHERE MessageIndex MATCH ? AND Messages.Self=? AND (?='' OR Messages.\"From\"=?) AND Messages.Date>=? AND (?=0 OR Messages.Date<=?) AND Messages.Trash=0 ORDER BY Messages.Date ASC, Messages.MsgID ASC;"
 	getUndeliveredMsgQuery      = "SELECT MsgID, Peer, Message, Sign, MinDelay, MaxDelay FROM Messages WHERE Self=? AND ToSend=1 ORDER BY MsgID ASC LIMIT 1;"
 	updateDeliveryMsgQuery      = "UPDATE Messages SET ToSend=? WHERE MsgID=?;"
 	updateMsgDateQuery          = "UPDATE Messages SET Date=?, Sent=1 WHERE MsgID=?;"
+	addAttachmentQuery          = "INSERT INTO Attachments (Self, Msg, Filename, Data, Deleted) VALUES (?, ?, ?, ?, 0);"
+	getAttachmentsQuery         = "SELECT AttachID, Filename, Data, Deleted FROM Attachments WHERE Self=? AND Msg=? ORDER BY AttachID ASC;"
+	delAttachmentsQuery         = "DELETE FROM Attachments WHERE Msg=? AND Self=?;"
+	addChunkQuery               = "INSERT INTO Chunks (Self, MessageID, Piece, Count, Date, Data, Signature, UIDHash) VALUES (?, ?, ?, ?, ?, ?, ?, ?);"
+	getChunksQuery              = "SELECT Piece, Count, Date, Data, Signature, UIDHash FROM Chunks WHERE Self=? AND MessageID=? ORDER BY Piece ASC;"
+	getChunkCountQuery          = "SELECT Count FROM Chunks WHERE Self=? AND MessageID=? LIMIT 1;"
+	delChunksQuery              = "DELETE FROM Chunks WHERE Self=? AND MessageID=?;"
+	expireChunksQuery           = "DELETE FROM Chunks WHERE Date<?;"
+	addSignatureQuery           = "INSERT INTO Signatures (Self, Msg, Content, Signature, UIDHash) VALUES (?, ?, ?, ?, ?);"
+	getSignaturesQuery          = "SELECT Content, Signature, UIDHash FROM Signatures WHERE Self=? AND Msg=? ORDER BY SigID ASC;"
+	delSignaturesQuery          = "DELETE FROM Signatures WHERE Msg=? AND Self=?;"
+	getMsgSignQuery             = "SELECT Self, Peer, Verified FROM Messages WHERE MsgID=?;"
+	setMsgVerifiedQuery         = "UPDATE Messages SET Verified=? WHERE MsgID=?;"
 	getUpkeepAllQuery           = "SELECT UpkeepAll FROM Nyms WHERE MappedID=?;"
 	setUpkeepAllQuery           = "UPDATE Nyms SET UpkeepAll=? WHERE MappedID=?;"
 	getUpkeepAccountsQuery      = "SELECT UpkeepAccounts FROM Nyms WHERE MappedID=?;"
@@ -190,8 +238,11 @@ CREATE TABLE MessageIDCache(
 	addOutQueueQuery            = "INSERT INTO OutQueue (Self, MsgID, Msg, NymAddress, MinDelay, MaxDelay, Envelope, Resend) VALUES (?, ?, ?, ?, ?, ?, 0, 0);"
 	getOutQueueQuery            = "SELECT OQIdx, Msg, NymAddress, MinDelay, MaxDelay, Envelope FROM OutQueue WHERE Self=? AND Resend=0 ORDER BY OQIdx ASC LIMIT 1;"
 	getOutQueueMsgIDQuery       = "SELECT MsgID FROM OutQueue WHERE OQIdx=?;"
-	setOutQueueQuery            = "UPDATE OutQueue SET Msg=?, Envelope=1 WHERE OQIdx=?;"
+	setOutQueueQuery            = "UPDATE OutQueue SET EncMsg=Msg, Msg=?, Envelope=1 WHERE OQIdx=?;"
+	retractOutQueueQuery        = "UPDATE OutQueue SET Msg=EncMsg, EncMsg='', Envelope=0 WHERE OQIdx=? AND EncMsg!='';"
 	removeOutQueueQuery         = "DELETE FROM OutQueue WHERE OQIdx=?;"
+	removeOutQueueMsgQuery      = "DELETE FROM OutQueue WHERE MsgID=?;"
+	countOutQueueMsgQuery       = "SELECT COUNT(*) FROM OutQueue WHERE MsgID=?;"
 	setResendOutQueueQuery      = "UPDATE OutQueue SET Resend=1 WHERE OQIdx=?;"
 	clearResendOutQueueQuery    = "UPDATE OutQueue SET Resend=0 WHERE Self=? AND Resend=1;"
 	addInQueueQuery             = "INSERT INTO InQueue (MyID, ContactID, Date, Msg, Envelope) VALUES (?, ?, ?, ?, 1);"
@@ -236,9 +287,33 @@ type MsgDB struct {
 	getMsgQuery                 *sql.Stmt
 	readMsgQuery                *sql.Stmt
 	getMsgsQuery                *sql.Stmt
+	getThreadQuery              *sql.Stmt
+	getMsgThreadIDsQuery        *sql.Stmt
+	starMsgQuery                *sql.Stmt
+	archiveMsgQuery             *sql.Stmt
+	trashMsgQuery               *sql.Stmt
+	restoreMsgQuery             *sql.Stmt
+	getTrashedMsgsQuery         *sql.Stmt
+	addMsgIndexQuery            *sql.Stmt
+	delMsgIndexQuery            *sql.Stmt
+	rebuildMsgIndexQuery        *sql.Stmt
+	searchMsgsQuery             *sql.Stmt
 	getUndeliveredMsgQuery      *sql.Stmt
 	updateDeliveryMsgQuery      *sql.Stmt
 	updateMsgDateQuery          *sql.Stmt
+	addAttachmentQuery          *sql.Stmt
+	getAttachmentsQuery         *sql.Stmt
+	delAttachmentsQuery         *sql.Stmt
+	addChunkQuery               *sql.Stmt
+	getChunksQuery              *sql.Stmt
+	getChunkCountQuery          *sql.Stmt
+	delChunksQuery              *sql.Stmt
+	expireChunksQuery           *sql.Stmt
+	addSignatureQuery           *sql.Stmt
+	getSignaturesQuery          *sql.Stmt
+	delSignaturesQuery          *sql.Stmt
+	getMsgSignQuery             *sql.Stmt
+	setMsgVerifiedQuery         *sql.Stmt
 	getUpkeepAllQuery           *sql.Stmt
 	setUpkeepAllQuery           *sql.Stmt
 	getUpkeepAccountsQuery      *sql.Stmt
@@ -247,7 +322,10 @@ type MsgDB struct {
 	getOutQueueQuery            *sql.Stmt
 	getOutQueueMsgIDQuery       *sql.Stmt
 	setOutQueueQuery            *sql.Stmt
+	retractOutQueueQuery        *sql.Stmt
 	removeOutQueueQuery         *sql.Stmt
+	removeOutQueueMsgQuery      *sql.Stmt
+	countOutQueueMsgQuery       *sql.Stmt
 	setResendOutQueueQuery      *sql.Stmt
 	clearResendOutQueueQuery    *sql.Stmt
 	addInQueueQuery             *sql.Stmt
@@ -272,9 +350,11 @@ func Create(dbname string, passphrase []byte, iter int) error {
 		createQueryMessages,
 		createQueryAttachments,
 		createQueryChunks,
+		createQuerySignatures,
 		createQueryOutQueue,
 		createQueryInQueue,
 		createMessageIDCache,
+		createQueryMessageIndex,
 	})
 	if err != nil {
 		return err
@@ -296,6 +376,139 @@ func (msgDB *MsgDB) Version() (string, error) {
 	return version, nil
 }
 
+// migrations contains the schema migrations of msgdb (see encdb.Migrate).
+// The queries of a migration are frozen, they must not refer to the table
+// definitions above (which describe the current schema).
+var migrations = []encdb.Migration{
+	{
+		Version:     2,
+		Description: "chunk data",
+		Queries: []string{
+			"ALTER TABLE Chunks ADD COLUMN Data TEXT NOT NULL DEFAULT '';",
+		},
+	},
+	{
+		Version:     3,
+		Description: "permanent signatures",
+		Queries: []string{
+			"ALTER TABLE Chunks ADD COLUMN Signature TEXT NOT NULL DEFAULT '';",
+			"ALTER TABLE Messages ADD COLUMN Verified INTEGER NOT NULL DEFAULT 0;",
+			`
+CREATE TABLE Signatures (
+  SigID     INTEGER PRIMARY KEY,
+  Self      INTEGER NOT NULL, -- foreign key to Nyms table
+  Msg       INTEGER NOT NULL, -- foreign key to Messages table
+  Content   TEXT    NOT NULL, -- the signed (decrypted) content of the message or chunk
+  Signature TEXT    NOT NULL, -- base64 encoded permanent signature of Content
+  FOREIGN KEY(Self) REFERENCES Nyms(UID) ON DELETE CASCADE,
+  FOREIGN KEY(Msg) REFERENCES Messages(MsgID)
+);`,
+		},
+	},
+	{
+		Version:     4,
+		Description: "status messages in outqueue (MsgID can be NULL)",
+		Queries: []string{
+			"ALTER TABLE OutQueue RENAME TO OutQueueOld;",
+			`
+CREATE TABLE OutQueue (
+  OQIdx      INTEGER PRIMARY KEY,
+  Self       INTEGER NOT NULL, -- foreign key to Nyms table
+  MsgID      INTEGER,          -- message ID of the corresponding plain text message (NULL for status messages)
+  Msg        TEXT    NOT NULL, -- encrypted message in the outqueue
+  NymAddress TEXT    NOT NULL, -- nymaddress to send message to
+  MinDelay   INTEGER NOT NULL, -- minimum delay of message
+  MaxDelay   INTEGER NOT NULL, -- maximum delay of message
+  Envelope   INTEGER NOT NULL, -- 0: basic encrypted message, 1: with envelope and ready to send
+  Resend     INTEGER NOT NULL, -- 0: process message normally, 1: message needs resend
+  FOREIGN KEY(Self) REFERENCES Nyms(UID) ON DELETE CASCADE
+  FOREIGN KEY(MsgID) REFERENCES Messages(MsgID) ON DELETE CASCADE
+);`,
+			"INSERT INTO OutQueue (OQIdx, Self, MsgID, Msg, NymAddress, MinDelay, MaxDelay, Envelope, Resend) SELECT OQIdx, Self, MsgID, Msg, NymAddress, MinDelay, MaxDelay, Envelope, Resend FROM OutQueueOld;",
+			"DROP TABLE OutQueueOld;",
+		},
+	},
+	{
+		Version:     5,
+		Description: "message threading",
+		Queries: []string{
+			"ALTER TABLE Messages ADD COLUMN MessageID TEXT NOT NULL DEFAULT '';",
+			"ALTER TABLE Messages ADD COLUMN InReplyTo TEXT NOT NULL DEFAULT '';",
+		},
+	},
+	{
+		Version:     6,
+		Description: "archive and trash folders",
+		Queries: []string{
+			"ALTER TABLE Messages ADD COLUMN Archive INTEGER NOT NULL DEFAULT 0;",
+			"ALTER TABLE Messages ADD COLUMN Trash INTEGER NOT NULL DEFAULT 0;",
+		},
+	},
+	{
+		Version:     7,
+		Description: "full-text search",
+		// FTS4, go-sqlcipher is built without FTS5 (see
+		// createQueryMessageIndex)
+		Queries: []string{
+			`
+CREATE VIRTUAL TABLE MessageIndex USING fts4(
+  content="Messages", -- external content table, docid is Messages.MsgID
+  Subject,
+  Message,
+  tokenize=unicode61
+);`,
+			"INSERT INTO MessageIndex (MessageIndex) VALUES ('rebuild');",
+		},
+	},
+	{
+		Version:     8,
+		Description: "sender UID messages of permanent signatures",
+		Queries: []string{
+			"ALTER TABLE Chunks ADD COLUMN UIDHash TEXT NOT NULL DEFAULT '';",
+			"ALTER TABLE Signatures ADD COLUMN UIDHash TEXT NOT NULL DEFAULT '';",
+		},
+	},
+	{
+		Version:     9,
+		Description: "encrypted messages of envelopes in outqueue",
+		Queries: []string{
+			"ALTER TABLE OutQueue ADD COLUMN EncMsg TEXT NOT NULL DEFAULT '';",
+		},
+	},
+}
+
+// migrate migrates the message database encDB with dbname to the current
+// Version.
+func migrate(dbname string, encDB *sql.DB) error {
+	pending, err := encdb.Pending(encDB, migrations)
+	if err != nil {
+		return log.Error(err)
+	}
+	for _, migration := range pending {
+		log.Infof("msgdb: migrate to version %d (%s)", migration.Version,
+			migration.Description)
+	}
+	if err := encdb.Migrate(dbname, encDB, migrations); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+// PendingMigrations returns the migrations which have not been applied to
+// the message database with dbname yet, without applying them.
+func PendingMigrations(dbname string, passphrase []byte) ([]encdb.Migration, error) {
+	encDB, err := encdb.Open(dbname, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer encDB.Close()
+	pending, err := encdb.Pending(encDB, migrations)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	return pending, nil
+}
+
 // Open opens the message database with dbname and passphrase.
 func Open(dbname string, passphrase []byte) (*MsgDB, error) {
 	var msgDB MsgDB
@@ -305,6 +518,11 @@ func Open(dbname string, passphrase []byte) (*MsgDB, error) {
 	if err != nil {
 		return nil, err
 	}
+	// migrate database, if necessary
+	if err := migrate(dbname, msgDB.encDB); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
 	// prepare statements
 	if msgDB.updateValueQuery, err = msgDB.encDB.Prepare(updateValueQuery); err != nil {
 		msgDB.encDB.Close()
@@ -418,6 +636,50 @@ func Open(dbname string, passphrase []byte) (*MsgDB, error) {
 		msgDB.encDB.Close()
 		return nil, err
 	}
+	if msgDB.getThreadQuery, err = msgDB.encDB.Prepare(getThreadQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.getMsgThreadIDsQuery, err = msgDB.encDB.Prepare(getMsgThreadIDsQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.starMsgQuery, err = msgDB.encDB.Prepare(starMsgQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.archiveMsgQuery, err = msgDB.encDB.Prepare(archiveMsgQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.trashMsgQuery, err = msgDB.encDB.Prepare(trashMsgQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.restoreMsgQuery, err = msgDB.encDB.Prepare(restoreMsgQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.getTrashedMsgsQuery, err = msgDB.encDB.Prepare(getTrashedMsgsQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.addMsgIndexQuery, err = msgDB.encDB.Prepare(addMsgIndexQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.delMsgIndexQuery, err = msgDB.encDB.Prepare(delMsgIndexQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.rebuildMsgIndexQuery, err = msgDB.encDB.Prepare(rebuildMsgIndexQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.searchMsgsQuery, err = msgDB.encDB.Prepare(searchMsgsQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
 	if msgDB.getUndeliveredMsgQuery, err = msgDB.encDB.Prepare(getUndeliveredMsgQuery); err != nil {
 		msgDB.encDB.Close()
 		return nil, err
@@ -430,6 +692,58 @@ func Open(dbname string, passphrase []byte) (*MsgDB, error) {
 		msgDB.encDB.Close()
 		return nil, err
 	}
+	if msgDB.addAttachmentQuery, err = msgDB.encDB.Prepare(addAttachmentQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.getAttachmentsQuery, err = msgDB.encDB.Prepare(getAttachmentsQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.delAttachmentsQuery, err = msgDB.encDB.Prepare(delAttachmentsQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.addChunkQuery, err = msgDB.encDB.Prepare(addChunkQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.getChunksQuery, err = msgDB.encDB.Prepare(getChunksQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.getChunkCountQuery, err = msgDB.encDB.Prepare(getChunkCountQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.delChunksQuery, err = msgDB.encDB.Prepare(delChunksQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.expireChunksQuery, err = msgDB.encDB.Prepare(expireChunksQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.addSignatureQuery, err = msgDB.encDB.Prepare(addSignatureQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.getSignaturesQuery, err = msgDB.encDB.Prepare(getSignaturesQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.delSignaturesQuery, err = msgDB.encDB.Prepare(delSignaturesQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.getMsgSignQuery, err = msgDB.encDB.Prepare(getMsgSignQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.setMsgVerifiedQuery, err = msgDB.encDB.Prepare(setMsgVerifiedQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
 	if msgDB.getUpkeepAllQuery, err = msgDB.encDB.Prepare(getUpkeepAllQuery); err != nil {
 		msgDB.encDB.Close()
 		return nil, err
@@ -462,10 +776,22 @@ func Open(dbname string, passphrase []byte) (*MsgDB, error) {
 		msgDB.encDB.Close()
 		return nil, err
 	}
+	if msgDB.retractOutQueueQuery, err = msgDB.encDB.Prepare(retractOutQueueQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
 	if msgDB.removeOutQueueQuery, err = msgDB.encDB.Prepare(removeOutQueueQuery); err != nil {
 		msgDB.encDB.Close()
 		return nil, err
 	}
+	if msgDB.removeOutQueueMsgQuery, err = msgDB.encDB.Prepare(removeOutQueueMsgQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.countOutQueueMsgQuery, err = msgDB.encDB.Prepare(countOutQueueMsgQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
 	if msgDB.setResendOutQueueQuery, err = msgDB.encDB.Prepare(setResendOutQueueQuery); err != nil {
 		msgDB.encDB.Close()
 		return nil, err
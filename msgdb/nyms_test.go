@@ -126,12 +126,12 @@ func TestDeleteNym(t *testing.T) {
 		t.Fatal(err)
 	}
 	now := times.Now()
-	err = msgDB.AddMessage(a, b, now, true, "ping", false,
+	err = msgDB.AddMessage(a, b, now, true, "ping", "", "", nil, nil, false,
 		def.MinDelay, def.MaxDelay)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = msgDB.AddMessage(a, b, now, false, "pong", false,
+	err = msgDB.AddMessage(a, b, now, false, "pong", "", "", nil, nil, false,
 		def.MinDelay, def.MaxDelay)
 	if err != nil {
 		t.Fatal(err)
@@ -13,6 +13,8 @@ import (
 
 // AddOutQueue adds the encrypted message encMsg corresponding to the the
 // plain text message with msgID to the outqueue.
+// A msgID of 0 denotes a status message without corresponding plain text
+// message (see msg.StatusCode).
 func (msgDB *MsgDB) AddOutQueue(
 	myID string,
 	msgID int64,
@@ -30,11 +32,17 @@ func (msgDB *MsgDB) AddOutQueue(
 	if err != nil {
 		return log.Error(err)
 	}
-	if _, err := tx.Stmt(msgDB.updateDeliveryMsgQuery).Exec(0, msgID); err != nil {
-		tx.Rollback()
-		return log.Error(err)
+	var mMsgID sql.NullInt64
+	if msgID != 0 {
+		_, err := tx.Stmt(msgDB.updateDeliveryMsgQuery).Exec(0, msgID)
+		if err != nil {
+			tx.Rollback()
+			return log.Error(err)
+		}
+		mMsgID.Int64 = msgID
+		mMsgID.Valid = true
 	}
-	_, err = tx.Stmt(msgDB.addOutQueueQuery).Exec(mID, msgID, encMsg,
+	_, err = tx.Stmt(msgDB.addOutQueueQuery).Exec(mID, mMsgID, encMsg,
 		nymaddress, minDelay, maxDelay)
 	if err != nil {
 		tx.Rollback()
@@ -79,7 +87,7 @@ func (msgDB *MsgDB) GetOutQueue(myID string) (
 }
 
 // SetOutQueue replaces the encrypted message corresponding to oqIdx with the
-// envelope message envMsg.
+// envelope message envMsg. The encrypted message is kept for RetractOutQueue.
 func (msgDB *MsgDB) SetOutQueue(oqIdx int64, envMsg string) error {
 	if _, err := msgDB.setOutQueueQuery.Exec(envMsg, oqIdx); err != nil {
 		return log.Error(err)
@@ -88,30 +96,42 @@ func (msgDB *MsgDB) SetOutQueue(oqIdx int64, envMsg string) error {
 }
 
 // RemoveOutQueue remove the message corresponding to oqIdx from the outqueue
-// and sets the send time of the corresponding message to date.
+// and sets the send time of the corresponding message to date, if it was the
+// last entry (chunk) of that message in the outqueue.
 func (msgDB *MsgDB) RemoveOutQueue(oqIdx, date int64) error {
 	tx, err := msgDB.encDB.Begin()
 	if err != nil {
 		return log.Error(err)
 	}
-	var msgID int64
+	var msgID sql.NullInt64
 	// get corresponding msgID
 	err = tx.Stmt(msgDB.getOutQueueMsgIDQuery).QueryRow(oqIdx).Scan(&msgID)
 	if err != nil {
 		tx.Rollback()
 		return log.Error(err)
 	}
-	// set date for message
-	_, err = tx.Stmt(msgDB.updateMsgDateQuery).Exec(date, msgID)
-	if err != nil {
-		tx.Rollback()
-		return log.Error(err)
-	}
 	// remove entry from outqueue
 	if _, err := tx.Stmt(msgDB.removeOutQueueQuery).Exec(oqIdx); err != nil {
 		tx.Rollback()
 		return log.Error(err)
 	}
+	// status messages have no corresponding message
+	if msgID.Valid {
+		var n int64
+		err = tx.Stmt(msgDB.countOutQueueMsgQuery).QueryRow(msgID.Int64).Scan(&n)
+		if err != nil {
+			tx.Rollback()
+			return log.Error(err)
+		}
+		if n == 0 {
+			// set date for message
+			_, err = tx.Stmt(msgDB.updateMsgDateQuery).Exec(date, msgID.Int64)
+			if err != nil {
+				tx.Rollback()
+				return log.Error(err)
+			}
+		}
+	}
 	if err := tx.Commit(); err != nil {
 		tx.Rollback()
 		return log.Error(err)
@@ -119,31 +139,64 @@ func (msgDB *MsgDB) RemoveOutQueue(oqIdx, date int64) error {
 	return nil
 }
 
-// RetractOutQueue retract the message corresponding to oqIdx from the outqueue
-// and sets the corresponding message to 'ToSend' again.
+// RetractOutQueue retracts the envelope of the message corresponding to oqIdx
+// from the outqueue and restores the encrypted message, so that a new envelope
+// is created for it. Other chunks of the message are not affected, chunks
+// which have already been sent are not sent again.
+// Envelopes created without keeping the encrypted message (before version 9)
+// cannot be restored. Such a message is removed (including all other chunks
+// of the message) from the outqueue and the corresponding message is set to
+// 'ToSend' again.
 func (msgDB *MsgDB) RetractOutQueue(oqIdx int64) error {
 	tx, err := msgDB.encDB.Begin()
 	if err != nil {
 		return log.Error(err)
 	}
-	var msgID int64
-	// get corresponding msgID
-	err = tx.Stmt(msgDB.getOutQueueMsgIDQuery).QueryRow(oqIdx).Scan(&msgID)
+	res, err := tx.Stmt(msgDB.retractOutQueueQuery).Exec(oqIdx)
 	if err != nil {
 		tx.Rollback()
 		return log.Error(err)
 	}
-	// set date for message
-	_, err = tx.Stmt(msgDB.updateDeliveryMsgQuery).Exec(1, msgID)
+	n, err := res.RowsAffected()
 	if err != nil {
 		tx.Rollback()
 		return log.Error(err)
 	}
-	// remove entry from outqueue
-	if _, err := tx.Stmt(msgDB.removeOutQueueQuery).Exec(oqIdx); err != nil {
+	if n > 0 {
+		if err := tx.Commit(); err != nil {
+			tx.Rollback()
+			return log.Error(err)
+		}
+		return nil
+	}
+	var msgID sql.NullInt64
+	// get corresponding msgID
+	err = tx.Stmt(msgDB.getOutQueueMsgIDQuery).QueryRow(oqIdx).Scan(&msgID)
+	if err != nil {
 		tx.Rollback()
 		return log.Error(err)
 	}
+	if msgID.Valid {
+		// set date for message
+		_, err = tx.Stmt(msgDB.updateDeliveryMsgQuery).Exec(1, msgID.Int64)
+		if err != nil {
+			tx.Rollback()
+			return log.Error(err)
+		}
+		// remove entries from outqueue
+		_, err := tx.Stmt(msgDB.removeOutQueueMsgQuery).Exec(msgID.Int64)
+		if err != nil {
+			tx.Rollback()
+			return log.Error(err)
+		}
+	} else {
+		// status messages are only removed from the outqueue, they have to be
+		// recreated anyway
+		if _, err := tx.Stmt(msgDB.removeOutQueueQuery).Exec(oqIdx); err != nil {
+			tx.Rollback()
+			return log.Error(err)
+		}
+	}
 	if err := tx.Commit(); err != nil {
 		tx.Rollback()
 		return log.Error(err)
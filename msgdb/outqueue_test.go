@@ -28,7 +28,7 @@ func TestOutQueue(t *testing.T) {
 		t.Fatal(err)
 	}
 	now := times.Now()
-	err = msgDB.AddMessage(a, b, now, true, "ping", false,
+	err = msgDB.AddMessage(a, b, now, true, "ping", "", "", nil, nil, false,
 		def.MinDelay, def.MaxDelay)
 	if err != nil {
 		t.Fatal(err)
@@ -164,3 +164,147 @@ func TestOutQueue(t *testing.T) {
 		t.Error("envelope should be empty")
 	}
 }
+
+func TestOutQueueChunks(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	b := "bob@mute.berlin"
+	if err := msgDB.AddNym(a, a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddContact(a, b, b, "Bob", WhiteList); err != nil {
+		t.Fatal(err)
+	}
+	now := times.Now()
+	err = msgDB.AddMessage(a, b, now, true, "ping", "", "", nil, nil, false,
+		def.MinDelay, def.MaxDelay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// add two chunks to outqueue
+	for _, chunk := range []string{"chunk1", "chunk2"} {
+		err = msgDB.AddOutQueue(a, 1, chunk, "nymaddress", def.MinDelay,
+			def.MaxDelay)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// retract without envelope removes all chunks
+	oqIdx, _, _, _, _, _, err := msgDB.GetOutQueue(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.RetractOutQueue(oqIdx); err != nil {
+		t.Fatal(err)
+	}
+	oqIdx, _, _, _, _, _, err = msgDB.GetOutQueue(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oqIdx != 0 {
+		t.Error("outqueue should be empty")
+	}
+	// add two chunks to outqueue (again)
+	for _, chunk := range []string{"chunk1", "chunk2"} {
+		err = msgDB.AddOutQueue(a, 1, chunk, "nymaddress", def.MinDelay,
+			def.MaxDelay)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// message is only sent after the last chunk has been removed
+	for i := 0; i < 2; i++ {
+		oqIdx, _, _, _, _, _, err := msgDB.GetOutQueue(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := msgDB.SetOutQueue(oqIdx, "envelope"); err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			// retracting the envelope of the second chunk restores it,
+			// the already sent first chunk is not sent again
+			if err := msgDB.RetractOutQueue(oqIdx); err != nil {
+				t.Fatal(err)
+			}
+			_, peer, _, _, _, _, err := msgDB.GetUndeliveredMessage(a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if peer != "" {
+				t.Error("message should not be set to 'ToSend'")
+			}
+			idx, enc, _, _, _, envelope, err := msgDB.GetOutQueue(a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if idx != oqIdx || enc != "chunk2" || envelope {
+				t.Error("encrypted chunk not restored")
+			}
+		}
+		if err := msgDB.RemoveOutQueue(oqIdx, now); err != nil {
+			t.Fatal(err)
+		}
+		ids, err := msgDB.GetMsgIDs(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids[0].Sent != (i == 1) {
+			t.Errorf("wrong sent status after chunk %d", i+1)
+		}
+	}
+}
+
+func TestOutQueueStatus(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	if err := msgDB.AddNym(a, a, ""); err != nil {
+		t.Fatal(err)
+	}
+	// add status messages (without corresponding message) to outqueue
+	for _, status := range []string{"status1", "status2"} {
+		err = msgDB.AddOutQueue(a, 0, status, "nymaddress", def.MinDelay,
+			def.MaxDelay)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// retract only removes a single status message
+	oqIdx, enc, _, _, _, _, err := msgDB.GetOutQueue(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enc != "status1" {
+		t.Error("wrong status message")
+	}
+	if err := msgDB.RetractOutQueue(oqIdx); err != nil {
+		t.Fatal(err)
+	}
+	oqIdx, enc, _, _, _, _, err = msgDB.GetOutQueue(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enc != "status2" {
+		t.Error("wrong status message")
+	}
+	if err := msgDB.RemoveOutQueue(oqIdx, times.Now()); err != nil {
+		t.Fatal(err)
+	}
+	oqIdx, _, _, _, _, _, err = msgDB.GetOutQueue(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oqIdx != 0 {
+		t.Error("outqueue should be empty")
+	}
+}
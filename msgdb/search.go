@@ -0,0 +1,63 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"database/sql"
+
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid/identity"
+)
+
+// indexMessage adds the message with the given msgNum, subject, and message
+// body to the full-text index in transaction tx.
+func (msgDB *MsgDB) indexMessage(
+	tx *sql.Tx,
+	msgNum int64,
+	subject, message string,
+) error {
+	_, err := tx.Stmt(msgDB.addMsgIndexQuery).Exec(msgNum, subject, message)
+	if err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+// Search returns the message IDs (sqlite row IDs) of all messages of user
+// myID (except trashed ones) whose subject or body matches the full-text
+// query (see the SQLite FTS4 MATCH syntax). If fromID is not empty, only
+// messages from fromID are returned. If since (or until) is not 0, only
+// messages with a date not before since (or not after until) are returned.
+func (msgDB *MsgDB) Search(
+	myID, query, fromID string,
+	since, until int64,
+) ([]*MsgID, error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return nil, log.Error(err)
+	}
+	if fromID != "" {
+		if err := identity.IsMapped(fromID); err != nil {
+			return nil, log.Error(err)
+		}
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return nil, log.Error(err)
+	}
+	rows, err := msgDB.searchMsgsQuery.Query(query, self, fromID, fromID,
+		since, until, until)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	return scanMsgIDs(rows)
+}
+
+// RebuildIndex rebuilds the full-text index of all messages.
+func (msgDB *MsgDB) RebuildIndex() error {
+	if _, err := msgDB.rebuildMsgIndexQuery.Exec(); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
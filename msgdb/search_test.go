@@ -0,0 +1,127 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mutecomm/mute/def"
+)
+
+func searchMsgNums(
+	t *testing.T,
+	msgDB *MsgDB,
+	myID, query, fromID string,
+	since, until int64,
+) []int64 {
+	ids, err := msgDB.Search(myID, query, fromID, since, until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgNums []int64
+	for _, id := range ids {
+		msgNums = append(msgNums, id.MsgID)
+	}
+	return msgNums
+}
+
+func TestSearch(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	b := "bob@mute.berlin"
+	c := "carol@mute.berlin"
+	if err := msgDB.AddNym(a, a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddNym(b, b, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddContact(a, b, b, "", WhiteList); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddContact(a, c, c, "", WhiteList); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddContact(b, a, a, "", WhiteList); err != nil {
+		t.Fatal(err)
+	}
+	msgs := []struct {
+		self    string
+		peer    string
+		date    int64
+		sent    bool
+		message string
+	}{
+		{a, b, 10, true, "Meeting\nLet's meet on Monday."},       // 1
+		{a, b, 20, false, "Re: Meeting\nMonday is fine."},        // 2
+		{a, c, 30, false, "Holidays\nGreetings from the beach!"}, // 3
+		{b, a, 40, false, "Meeting\nLet's meet on Monday."},      // 4
+	}
+	for _, m := range msgs {
+		err := msgDB.AddMessage(m.self, m.peer, m.date, m.sent, m.message,
+			"", "", nil, nil, false, def.MinDelay, def.MaxDelay)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, test := range []struct {
+		query   string
+		from    string
+		since   int64
+		until   int64
+		msgNums []int64
+	}{
+		{"meeting", "", 0, 0, []int64{1, 2}},
+		{"monday", "", 0, 0, []int64{1, 2}},
+		{"subject:holidays", "", 0, 0, []int64{3}},
+		{"beach", "", 0, 0, []int64{3}},
+		{"beach", b, 0, 0, nil},
+		{"monday", b, 0, 0, []int64{2}},
+		{"monday", "", 15, 0, []int64{2}},
+		{"monday", "", 0, 15, []int64{1}},
+		{"mee*", "", 0, 0, []int64{1, 2}},
+		{"unknown", "", 0, 0, nil},
+	} {
+		msgNums := searchMsgNums(t, msgDB, a, test.query, test.from,
+			test.since, test.until)
+		if !equalMsgNums(msgNums, test.msgNums) {
+			t.Errorf("search '%s': wrong messages: %v", test.query, msgNums)
+		}
+	}
+	// deleted messages are removed from the index
+	if err := msgDB.DelMessage(a, 1); err != nil {
+		t.Fatal(err)
+	}
+	if msgNums := searchMsgNums(t, msgDB, a, "meeting", "", 0, 0); !equalMsgNums(msgNums, []int64{2}) {
+		t.Errorf("wrong messages after delete: %v", msgNums)
+	}
+	if msgNums := searchMsgNums(t, msgDB, b, "meeting", "", 0, 0); !equalMsgNums(msgNums, []int64{4}) {
+		t.Errorf("wrong messages for other user: %v", msgNums)
+	}
+	// trashed messages are not found
+	if err := msgDB.TrashMessage(a, 2, 50); err != nil {
+		t.Fatal(err)
+	}
+	if msgNums := searchMsgNums(t, msgDB, a, "meeting", "", 0, 0); msgNums != nil {
+		t.Errorf("trashed message found: %v", msgNums)
+	}
+	// rebuild index
+	if err := msgDB.RebuildIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if msgNums := searchMsgNums(t, msgDB, a, "beach", "", 0, 0); !equalMsgNums(msgNums, []int64{3}) {
+		t.Errorf("wrong messages after rebuild: %v", msgNums)
+	}
+	// malformed queries fail
+	if _, err := msgDB.Search(a, "\"unbalanced", "", 0, 0); err == nil {
+		t.Error("should fail")
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"database/sql"
+
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid/identity"
+)
+
+// Signature is a permanent signature of a received message (or of one chunk
+// of it).
+type Signature struct {
+	Content   string // the signed (decrypted) content
+	Signature string // base64 encoded permanent signature of Content
+	UIDHash   string // hash of the sender UID message used for the signature ("" if unknown)
+}
+
+// addSignatures adds the given signatures for message msgNum of nym self
+// within transaction tx.
+func (msgDB *MsgDB) addSignatures(
+	tx *sql.Tx,
+	self, msgNum int64,
+	signatures []*Signature,
+) error {
+	for _, sig := range signatures {
+		_, err := tx.Stmt(msgDB.addSignatureQuery).Exec(self, msgNum,
+			sig.Content, sig.Signature, sig.UIDHash)
+		if err != nil {
+			return log.Error(err)
+		}
+	}
+	return nil
+}
+
+// GetSignatures returns the peer and all permanent signatures of the message
+// from user myID with the given msgNum. verified denotes whether the
+// signatures have been verified.
+func (msgDB *MsgDB) GetSignatures(myID string, msgNum int64) (
+	peerID string,
+	signatures []*Signature,
+	verified bool,
+	err error,
+) {
+	if err := identity.IsMapped(myID); err != nil {
+		return "", nil, false, log.Error(err)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return "", nil, false, log.Error(err)
+	}
+	var (
+		s    int64
+		peer int64
+		v    int64
+	)
+	err = msgDB.getMsgSignQuery.QueryRow(msgNum).Scan(&s, &peer, &v)
+	switch {
+	case err == sql.ErrNoRows || (err == nil && s != self):
+		return "", nil, false, log.Errorf("msgdb: unknown msgnum %d for user ID %s",
+			msgNum, myID)
+	case err != nil:
+		return "", nil, false, log.Error(err)
+	}
+	err = msgDB.getContactMappedQuery.QueryRow(self, peer).Scan(&peerID)
+	if err != nil {
+		return "", nil, false, log.Error(err)
+	}
+	rows, err := msgDB.getSignaturesQuery.Query(self, msgNum)
+	if err != nil {
+		return "", nil, false, log.Error(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var content, sig, uidHash string
+		if err := rows.Scan(&content, &sig, &uidHash); err != nil {
+			return "", nil, false, log.Error(err)
+		}
+		signatures = append(signatures, &Signature{
+			Content:   content,
+			Signature: sig,
+			UIDHash:   uidHash,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return "", nil, false, log.Error(err)
+	}
+	return peerID, signatures, v > 0, nil
+}
+
+// SetVerified sets the verification status of the permanent signatures of
+// the message with the given msgNum.
+func (msgDB *MsgDB) SetVerified(msgNum int64, verified bool) error {
+	var v int64
+	if verified {
+		v = 1
+	}
+	if _, err := msgDB.setMsgVerifiedQuery.Exec(v, msgNum); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+// numberOfSignatures returns the number of signatures in msgDB.
+func (msgDB *MsgDB) numberOfSignatures() (int64, error) {
+	var num int64
+	err := msgDB.encDB.QueryRow("SELECT COUNT(*) FROM Signatures;").Scan(&num)
+	if err != nil {
+		return 0, err
+	}
+	return num, nil
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mutecomm/mute/util/times"
+)
+
+func TestSignatures(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	b := "bob@mute.berlin"
+	if err := msgDB.AddNym(a, a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddContact(a, b, b, "", WhiteList); err != nil {
+		t.Fatal(err)
+	}
+	// unsigned message
+	if err := msgDB.AddInQueue(a, "", times.Now(), "enc1"); err != nil {
+		t.Fatal(err)
+	}
+	iqIdx, _, _, _, _, err := msgDB.GetInQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = msgDB.RemoveInQueue(iqIdx, "plain1", "", "", nil, nil, b, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// signed message
+	if err := msgDB.AddInQueue(a, "", times.Now(), "enc2"); err != nil {
+		t.Fatal(err)
+	}
+	iqIdx, _, _, _, _, err = msgDB.GetInQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigs := []*Signature{{Content: "plain2", Signature: "sig", UIDHash: "uidhash"}}
+	err = msgDB.RemoveInQueue(iqIdx, "plain2", "", "", nil, sigs, b, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgIDs, err := msgDB.GetMsgIDs(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgIDs) != 2 {
+		t.Fatal("len(msgIDs) != 2")
+	}
+	if msgIDs[0].Signed || msgIDs[0].Verified {
+		t.Error("first message should be unsigned")
+	}
+	if !msgIDs[1].Signed || !msgIDs[1].Verified {
+		t.Error("second message should be signed and verified")
+	}
+	peer, res, verified, err := msgDB.GetSignatures(a, msgIDs[1].MsgID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer != b {
+		t.Errorf("peer != %s", b)
+	}
+	if !verified {
+		t.Error("signature should be verified")
+	}
+	if len(res) != 1 || *res[0] != *sigs[0] {
+		t.Error("wrong signatures")
+	}
+	// set verified
+	if err := msgDB.SetVerified(msgIDs[1].MsgID, false); err != nil {
+		t.Fatal(err)
+	}
+	_, _, verified, err = msgDB.GetSignatures(a, msgIDs[1].MsgID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified {
+		t.Error("signature should not be verified")
+	}
+	// unknown message
+	if _, _, _, err := msgDB.GetSignatures(a, 3); err == nil {
+		t.Error("should fail")
+	}
+	// deleting the message deletes the signatures
+	if err := msgDB.DelMessage(a, msgIDs[1].MsgID); err != nil {
+		t.Fatal(err)
+	}
+	n, err := msgDB.numberOfSignatures()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Error("signatures not deleted")
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uid
+
+import (
+	"io"
+	"sort"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/keyserver/hashchain"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid/identity"
+	"github.com/mutecomm/mute/util"
+)
+
+// MaxChainLinkURIs is the maximum number of URIs in a chain link, except for
+// AUTHORITATIVE links. It limits the space for preimage attacks.
+const MaxChainLinkURIs = 5
+
+// LinkType describes the purpose of a chain link.
+type LinkType int
+
+const (
+	// NoLink denotes a UID message without chain link.
+	NoLink LinkType = iota
+	// VerificationBinding binds the last entry of a foreign key hashchain
+	// into the key hashchain of the UID message.
+	VerificationBinding
+	// ConnectedIdentity connects the identity of the UID message with its
+	// identity in a foreign key hashchain.
+	ConnectedIdentity
+	// AuthoritativeLink makes the domains served by a foreign key server
+	// known (a connected identity of the foreign key server itself).
+	AuthoritativeLink
+)
+
+var linkTypes = []string{
+	"none",
+	"verification binding",
+	"connected identity",
+	"authoritative link",
+}
+
+// String returns the string representation of linkType.
+func (linkType LinkType) String() string {
+	return linkTypes[linkType]
+}
+
+// ChainLink links the key hashchain of a UID message with a foreign key
+// hashchain (see "Linking chains and key repositories" in doc/keyserver.md).
+type ChainLink struct {
+	URI           []string // URI(s) of the foreign key hashchain
+	LAST          string   // last entry of the foreign key hashchain
+	AUTHORITATIVE bool
+	DOMAINS       []string // list of domains that are served currently
+	IDENTITY      string   // own Identity in the foreign key hashchain
+}
+
+// Type returns the link type of link (a nil link has type NoLink).
+func (link *ChainLink) Type() LinkType {
+	switch {
+	case link == nil || len(link.URI) == 0:
+		return NoLink
+	case len(link.DOMAINS) > 0:
+		return AuthoritativeLink
+	case link.IDENTITY != "":
+		return ConnectedIdentity
+	default:
+		return VerificationBinding
+	}
+}
+
+// check that link is well-formed.
+func (link *ChainLink) check() error {
+	if link == nil {
+		return nil
+	}
+	if len(link.URI) == 0 {
+		// everything else must be zero-value
+		if link.LAST != "" || link.AUTHORITATIVE || len(link.DOMAINS) > 0 ||
+			link.IDENTITY != "" {
+			return log.Error(ErrChainLink)
+		}
+		return nil
+	}
+	linkType := link.Type()
+	if linkType != AuthoritativeLink && len(link.URI) > MaxChainLinkURIs {
+		return log.Errorf("uid: CHAINLINK.URI must not contain more than %d entries",
+			MaxChainLinkURIs)
+	}
+	// URIs must be ordered lexicographically (and unique)
+	if !sort.StringsAreSorted(link.URI) {
+		return log.Error("uid: CHAINLINK.URI must be ordered lexicographically")
+	}
+	for i, uri := range link.URI {
+		if uri == "" {
+			return log.Error("uid: empty CHAINLINK.URI entry")
+		}
+		if i > 0 && link.URI[i-1] == uri {
+			return log.Errorf("uid: duplicate CHAINLINK.URI entry: %s", uri)
+		}
+	}
+	// LAST must be a valid hashchain entry
+	if _, _, _, _, _, _, err := hashchain.SplitEntry(link.LAST); err != nil {
+		return err
+	}
+	if link.IDENTITY != "" {
+		if err := identity.IsMapped(link.IDENTITY); err != nil {
+			return log.Error(err)
+		}
+	}
+	if linkType == AuthoritativeLink {
+		if !link.AUTHORITATIVE {
+			return log.Error("uid: CHAINLINK.DOMAINS must be zero unless AUTHORITATIVE")
+		}
+		if link.IDENTITY == "" {
+			return log.Error("uid: CHAINLINK.IDENTITY of AUTHORITATIVE link missing")
+		}
+		for i, domain := range link.DOMAINS {
+			if domain == "" || identity.MapDomain(domain) != domain {
+				return log.Errorf("uid: invalid CHAINLINK.DOMAINS entry: %q",
+					domain)
+			}
+			if util.ContainsString(link.DOMAINS[:i], domain) {
+				return log.Errorf("uid: duplicate CHAINLINK.DOMAINS entry: %s",
+					domain)
+			}
+		}
+	}
+	return nil
+}
+
+// Serves returns true, if link is an AUTHORITATIVE link which makes the given
+// domain known.
+func (link *ChainLink) Serves(domain string) bool {
+	if link.Type() != AuthoritativeLink {
+		return false
+	}
+	return util.ContainsString(link.DOMAINS, domain)
+}
+
+// Link generates an updated version of the given UID message which contains
+// the chain link link (see Update).
+func (msg *Message) Link(
+	rand io.Reader,
+	link *ChainLink,
+	notbefore, notafter uint64,
+) (*Message, error) {
+	if err := link.check(); err != nil {
+		return nil, err
+	}
+	up, err := msg.Update(nil, notbefore, notafter, rand)
+	if err != nil {
+		return nil, err
+	}
+	up.UIDContent.CHAINLINK = link
+	// sign again, the content has changed
+	selfsig := up.UIDContent.SIGKEY.ed25519Key.Sign(up.UIDContent.JSON())
+	up.SELFSIGNATURE = base64.Encode(selfsig)
+	prevsig := msg.UIDContent.SIGKEY.ed25519Key.Sign(up.UIDContent.JSON())
+	up.USERSIGNATURE = base64.Encode(prevsig)
+	return up, nil
+}
+
+// Connect creates a new UID message for userID (usually on another domain)
+// which is connected to the given UID message. That is, it uses the same
+// keys and its chain link (of type ConnectedIdentity or AuthoritativeLink)
+// points to the identity of msg. lastEntry is the last known key hashchain
+// entry of the key server userID is registered with.
+func (msg *Message) Connect(
+	userID, lastEntry string,
+	link *ChainLink,
+) (*Message, error) {
+	linkType := link.Type()
+	if linkType != ConnectedIdentity && linkType != AuthoritativeLink {
+		return nil, log.Errorf("uid: cannot connect identity with %s", linkType)
+	}
+	if link.IDENTITY != msg.UIDContent.IDENTITY {
+		return nil, log.Error(ErrChainLink)
+	}
+	if err := link.check(); err != nil {
+		return nil, err
+	}
+	if err := identity.IsMapped(userID); err != nil {
+		return nil, log.Error(err)
+	}
+	lp, domain, _ := identity.Split(userID)
+	if lp != "keyserver" || lastEntry != "" {
+		if _, _, _, _, _, _, err := hashchain.SplitEntry(lastEntry); err != nil {
+			return nil, err
+		}
+	}
+	var con Message
+	// copy
+	con = *msg
+	con.UIDContent.MSGCOUNT = 0 // this is the first UIDMessage for userID
+	con.UIDContent.IDENTITY = userID
+	con.UIDContent.LASTENTRY = lastEntry
+	con.UIDContent.REPOURIS = []string{domain}
+	con.UIDContent.CHAINLINK = link
+	con.ESCROWSIGNATURE = ""
+	con.USERSIGNATURE = ""
+	con.LINKAUTHORITY = ""
+	selfsig := con.UIDContent.SIGKEY.ed25519Key.Sign(con.UIDContent.JSON())
+	con.SELFSIGNATURE = base64.Encode(selfsig)
+	return &con, nil
+}
+
+// VerifyConnected verifies that the UID message is a valid connected identity
+// (or AUTHORITATIVE link) of origin, the current UID message of the connected
+// identity in the foreign key hashchain. That is, SIGKEY and SIGESCROW must be
+// the same.
+func (msg *Message) VerifyConnected(origin *Message) error {
+	link := msg.UIDContent.CHAINLINK
+	linkType := link.Type()
+	if linkType != ConnectedIdentity && linkType != AuthoritativeLink {
+		return log.Error(ErrChainLink)
+	}
+	if link.IDENTITY != origin.UIDContent.IDENTITY {
+		return log.Error(ErrChainLink)
+	}
+	if msg.UIDContent.SIGKEY.PUBKEY != origin.UIDContent.SIGKEY.PUBKEY {
+		return log.Error(ErrChainLink)
+	}
+	escrow := msg.UIDContent.SIGESCROW
+	originEscrow := origin.UIDContent.SIGESCROW
+	if (escrow == nil) != (originEscrow == nil) ||
+		(escrow != nil && escrow.PUBKEY != originEscrow.PUBKEY) {
+		return log.Error(ErrChainLink)
+	}
+	return nil
+}
+
+// SignLinkAuthority signs the UIDContent of an AUTHORITATIVE link entry with
+// the given key of the destination key server and sets LINKAUTHORITY.
+func (msg *Message) SignLinkAuthority(key *cipher.Ed25519Key) error {
+	if msg.UIDContent.CHAINLINK.Type() != AuthoritativeLink {
+		return log.Error(ErrChainLink)
+	}
+	msg.LINKAUTHORITY = base64.Encode(key.Sign(msg.UIDContent.JSON()))
+	return nil
+}
+
+// VerifyLinkAuthority verifies that LINKAUTHORITY is a valid signature over
+// UIDContent by sigPubKey of the destination key server.
+func (msg *Message) VerifyLinkAuthority(sigPubKey string) error {
+	if msg.UIDContent.CHAINLINK.Type() != AuthoritativeLink {
+		return log.Error(ErrChainLink)
+	}
+	sig, err := base64.Decode(msg.LINKAUTHORITY)
+	if err != nil {
+		return err
+	}
+	pubKey, err := base64.Decode(sigPubKey)
+	if err != nil {
+		return err
+	}
+	var ed25519Key cipher.Ed25519Key
+	if err := ed25519Key.SetPublicKey(pubKey); err != nil {
+		return err
+	}
+	if !ed25519Key.Verify(msg.UIDContent.JSON(), sig) {
+		return log.Error(ErrInvalidLinkAuthority)
+	}
+	return nil
+}
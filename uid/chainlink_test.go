@@ -0,0 +1,192 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uid
+
+import (
+	"testing"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/keyserver/hashchain"
+)
+
+func TestChainLinkCheck(t *testing.T) {
+	tests := []struct {
+		link     *ChainLink
+		linkType LinkType
+		valid    bool
+	}{
+		{nil, NoLink, true},
+		{&ChainLink{}, NoLink, true},
+		{&ChainLink{LAST: hashchain.TestEntry}, NoLink, false},
+		{&ChainLink{URI: []string{"mute.one"}, LAST: hashchain.TestEntry},
+			VerificationBinding, true},
+		{&ChainLink{URI: []string{"mute.one"}}, VerificationBinding, false},
+		{&ChainLink{URI: []string{"mute.one", "mute.berlin"},
+			LAST: hashchain.TestEntry}, VerificationBinding, false},
+		{&ChainLink{URI: []string{"a", "b", "c", "d", "e", "f"},
+			LAST: hashchain.TestEntry}, VerificationBinding, false},
+		{&ChainLink{URI: []string{"mute.one"}, LAST: hashchain.TestEntry,
+			IDENTITY: "alice@mute.one"}, ConnectedIdentity, true},
+		{&ChainLink{URI: []string{"mute.one"}, LAST: hashchain.TestEntry,
+			IDENTITY: "Alice@mute.one"}, ConnectedIdentity, false},
+		{&ChainLink{URI: []string{"mute.one"}, LAST: hashchain.TestEntry,
+			AUTHORITATIVE: true, DOMAINS: []string{"mute.one"},
+			IDENTITY: "keyserver@mute.one"}, AuthoritativeLink, true},
+		{&ChainLink{URI: []string{"mute.one"}, LAST: hashchain.TestEntry,
+			DOMAINS: []string{"mute.one"}, IDENTITY: "keyserver@mute.one"},
+			AuthoritativeLink, false},
+		{&ChainLink{URI: []string{"mute.one"}, LAST: hashchain.TestEntry,
+			AUTHORITATIVE: true, DOMAINS: []string{"mute.one", "mute.one"},
+			IDENTITY: "keyserver@mute.one"}, AuthoritativeLink, false},
+	}
+	for i, test := range tests {
+		if test.link.Type() != test.linkType {
+			t.Errorf("test %d: link type %s != %s", i, test.link.Type(),
+				test.linkType)
+		}
+		err := test.link.check()
+		if test.valid && err != nil {
+			t.Errorf("test %d: %s", i, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("test %d: should fail", i)
+		}
+	}
+}
+
+func TestLink(t *testing.T) {
+	msg, err := Create("alice@mute.berlin", false, "", "", Strict,
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := &ChainLink{URI: []string{"mute.one"}, LAST: hashchain.TestEntry}
+	up, err := msg.Link(cipher.RandReader, link, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := up.Check(); err != nil {
+		t.Error(err)
+	}
+	if err := up.VerifySelfSig(); err != nil {
+		t.Error(err)
+	}
+	if err := up.VerifyUserSig(msg); err != nil {
+		t.Error(err)
+	}
+	// the link is not carried over
+	up2, err := up.Update(nil, 0, 0, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up2.UIDContent.CHAINLINK != nil {
+		t.Error("CHAINLINK should not be carried over")
+	}
+	// invalid link
+	link = &ChainLink{URI: []string{"mute.one"}}
+	if _, err := msg.Link(cipher.RandReader, link, 0, 0); err == nil {
+		t.Error("should fail")
+	}
+}
+
+func TestConnect(t *testing.T) {
+	msg, err := Create("alice@mute.berlin", false, "", "", Strict,
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := &ChainLink{
+		URI:      []string{"mute.berlin"},
+		LAST:     hashchain.TestEntry,
+		IDENTITY: "alice@mute.berlin",
+	}
+	con, err := msg.Connect("alice@mute.one", hashchain.TestEntry, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := con.Check(); err != nil {
+		t.Error(err)
+	}
+	if err := con.VerifySelfSig(); err != nil {
+		t.Error(err)
+	}
+	if con.UIDContent.REPOURIS[0] != "mute.one" {
+		t.Error("wrong REPOURIS")
+	}
+	if err := con.VerifyConnected(msg); err != nil {
+		t.Error(err)
+	}
+	// the original message is not connected
+	if err := msg.VerifyConnected(con); err != ErrChainLink {
+		t.Error("should fail")
+	}
+	// different keys
+	other, err := Create("alice@mute.berlin", false, "", "", Strict,
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := con.VerifyConnected(other); err != ErrChainLink {
+		t.Error("should fail")
+	}
+	// link must point to msg
+	link.IDENTITY = "bob@mute.berlin"
+	if _, err := msg.Connect("alice@mute.one", hashchain.TestEntry, link); err != ErrChainLink {
+		t.Error("should fail")
+	}
+	// verification bindings cannot connect identities
+	link.IDENTITY = ""
+	if _, err := msg.Connect("alice@mute.one", hashchain.TestEntry, link); err == nil {
+		t.Error("should fail")
+	}
+}
+
+func TestLinkAuthority(t *testing.T) {
+	srv, err := Create("keyserver@mute.one", false, "", "", Strict, "", nil,
+		0, 0, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := &ChainLink{
+		URI:           []string{"mute.one"},
+		LAST:          hashchain.TestEntry,
+		AUTHORITATIVE: true,
+		DOMAINS:       []string{"mute.one"},
+		IDENTITY:      "keyserver@mute.one",
+	}
+	con, err := srv.Connect("keyserver@mute.one", hashchain.TestEntry, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !link.Serves("mute.one") || link.Serves("mute.berlin") {
+		t.Error("wrong served domains")
+	}
+	key, err := cipher.Ed25519Generate(cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := con.SignLinkAuthority(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := con.Check(); err != nil {
+		t.Error(err)
+	}
+	pubKey := base64.Encode(key.PublicKey()[:])
+	if err := con.VerifyLinkAuthority(pubKey); err != nil {
+		t.Error(err)
+	}
+	if err := con.VerifyLinkAuthority(srv.SigPubKey()); err != ErrInvalidLinkAuthority {
+		t.Error("should fail")
+	}
+	// LINKAUTHORITY only for AUTHORITATIVE links
+	if err := srv.SignLinkAuthority(key); err != ErrChainLink {
+		t.Error("should fail")
+	}
+	srv.LINKAUTHORITY = con.LINKAUTHORITY
+	if err := srv.Check(); err == nil {
+		t.Error("should fail")
+	}
+}
@@ -20,6 +20,21 @@ var ErrInvalidSelfSig = errors.New("uid: self-signature invalid")
 // invalid.
 var ErrInvalidUserSig = errors.New("uid: user-signature invalid")
 
+// ErrInvalidEscrowSig is raised when the escrow signature of an UID message
+// is invalid.
+var ErrInvalidEscrowSig = errors.New("uid: escrow signature invalid")
+
+// ErrEscrowChanged is raised when the SIGESCROW of an UID message has been
+// changed without escrow signature.
+var ErrEscrowChanged = errors.New("uid: SIGESCROW changed without escrow signature")
+
+// ErrNoEscrow is raised when an UID message without SIGESCROW should be
+// recovered.
+var ErrNoEscrow = errors.New("uid: UID message has no SIGESCROW")
+
+// ErrEscrowKey is raised when a private escrow key does not match SIGESCROW.
+var ErrEscrowKey = errors.New("uid: private escrow key does not match SIGESCROW")
+
 // ErrInvalidNonceSig is raised when the nonce signature created by a UID
 // message is invalid.
 var ErrInvalidNonceSig = errors.New("uid: nonce signature invalid")
@@ -35,6 +50,10 @@ var ErrInvalidSrvSig = errors.New("uid: server-signature invalid (keyserver keys
 // ErrInvalidTimes is raised when NOTAFTER and NOTBEFORE are invalid.
 var ErrInvalidTimes = errors.New("uid: key init NOTBEFORE must be smaller than NOTAFTER")
 
+// ErrInvalidValidity is raised when NOTAFTER and NOTBEFORE of an UID message
+// are invalid.
+var ErrInvalidValidity = errors.New("uid: NOTBEFORE must be smaller than NOTAFTER")
+
 // ErrExpired is raised when NOTAFTER has expired.
 var ErrExpired = errors.New("uid: NOTAFTER has expired")
 
@@ -58,3 +77,11 @@ var ErrSessionAnchor = errors.New("uid: SESSIONANCHORHASH does not match decrypt
 // ErrKeyEntryNotFound is raised when a KeyEntry for a given function is
 // not found.
 var ErrKeyEntryNotFound = errors.New("uid: KeyEntry not found")
+
+// ErrChainLink is raised when the CHAINLINK of a UID message is invalid or
+// does not match the linked UID message.
+var ErrChainLink = errors.New("uid: CHAINLINK invalid")
+
+// ErrInvalidLinkAuthority is raised when the LINKAUTHORITY signature of an
+// UID message is invalid.
+var ErrInvalidLinkAuthority = errors.New("uid: link authority signature invalid")
@@ -25,6 +25,21 @@ import (
 // All valid ciphersuite strings are predefined and contain only upper-case letters.
 const DefaultCiphersuite string = "NACL HKDF AES256-CTR SHA512-HMAC ED25519 ECDHE25519"
 
+// XSalsa20Ciphersuite defines an alternative ciphersuite for message
+// encryption, which equals DefaultCiphersuite, except for:
+//   Symmetric encryption: XSalsa20
+// Keys are always generated for DefaultCiphersuite, they can be used with both
+// ciphersuites.
+const XSalsa20Ciphersuite string = "NACL HKDF XSALSA20 SHA512-HMAC ED25519 ECDHE25519"
+
+// Ciphersuites lists all supported ciphersuites for message encryption,
+// ordered from most preferred to least preferred.
+// No ciphersuite string must be longer than DefaultCiphersuite (see msg).
+var Ciphersuites = []string{
+	DefaultCiphersuite,
+	XSalsa20Ciphersuite,
+}
+
 // A KeyEntry describes a key in Mute.
 type KeyEntry struct {
 	CIPHERSUITE   string // ciphersuite for which the key may be used. Example: "NACL HKDF AES-CTR256 SHA512-HMAC ED25519 ECDHE25519"
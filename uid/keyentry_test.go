@@ -18,7 +18,7 @@ import (
 func TestKeyEntry(t *testing.T) {
 	// create UID message
 	msg, err := Create("alice@mute.berlin", false, "", "", Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
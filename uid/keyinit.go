@@ -110,6 +110,24 @@ func (ki *KeyInit) SigKeyHash() string {
 	return ki.Contents.SIGKEYHASH
 }
 
+// SessionAnchorHash returns the session anchor hash of the KeyInit message.
+// It uniquely identifies the KeyInit message.
+func (ki *KeyInit) SessionAnchorHash() string {
+	return ki.Contents.SESSIONANCHORHASH
+}
+
+// Fallback returns true, if the KeyInit message may serve as a fallback key.
+// KeyInit messages without fallback are single-use.
+func (ki *KeyInit) Fallback() bool {
+	return ki.Contents.FALLBACK
+}
+
+// NotAfter returns the time after which the KeyInit message should not be
+// used anymore.
+func (ki *KeyInit) NotAfter() uint64 {
+	return ki.Contents.NOTAFTER
+}
+
 // SessionAnchor returns the decrypted and verified session anchor for KeyInit.
 func (ki *KeyInit) SessionAnchor(sigPubKey string) (*SessionAnchor, error) {
 	// SIGKEYHASH corresponds to the SIGKEY of the Identity
@@ -263,7 +281,8 @@ func (msg *Message) sessionAnchor(
 // notafter is the unixtime after which the key(s) should not be used anymore.
 // notbefore is the unixtime before which the key(s) should not be used yet.
 // fallback determines if the key may serve as a fallback key.
-// repoURI is URI of the corresponding KeyInit repository.
+// repoURI is URI of the corresponding KeyInit repository (one of the
+// UIDContent.REPOURIS of msg).
 // Necessary randomness is read from rand.
 func (msg *Message) KeyInit(
 	msgcount, notafter, notbefore uint64,
@@ -297,11 +316,10 @@ func (msg *Message) KeyInit(
 	}
 	keyInit.Contents.SIGKEYHASH = base64.Encode(cipher.SHA512(keyHash))
 
-	// make sure REPOURIS is set to the first REPOURI of UIDContent.REPOURIS
-	// TODO: support different KeyInit repository configurations
-	if repoURI != msg.UIDContent.REPOURIS[0] {
-		return nil, "", "",
-			log.Error("uri: repoURI differs from msg.UIDContent.REPOURIS[0]")
+	// make sure REPOURI is one of UIDContent.REPOURIS
+	if !util.ContainsString(msg.UIDContent.REPOURIS, repoURI) {
+		log.Error(ErrRepoURI)
+		return nil, "", "", ErrRepoURI
 	}
 	keyInit.Contents.REPOURI = repoURI
 
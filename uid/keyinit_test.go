@@ -19,7 +19,7 @@ import (
 
 func TestKeyInitSuccess(t *testing.T) {
 	msg, err := Create("test@mute.berlin", false, "", "", Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -67,9 +67,58 @@ func TestKeyInitSuccess(t *testing.T) {
 	}
 }
 
+func TestKeyInitRepoURIs(t *testing.T) {
+	repoURIs := []string{"mute.one", "mute.berlin"}
+	msg, err := Create("test@mute.berlin", false, "", "", Strict,
+		hashchain.TestEntry, repoURIs, 0, 0, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.Check(); err != nil {
+		t.Error(err)
+	}
+	for _, repoURI := range repoURIs {
+		ki, _, _, err := msg.KeyInit(0, uint64(times.NinetyDaysLater()), 0,
+			false, repoURI, "", "", cipher.RandReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ki.Verify(msg.UIDContent.REPOURIS, msg.UIDContent.SIGKEY.PUBKEY)
+		if err != nil {
+			t.Error(err)
+		}
+		if err := ki.Verify([]string{"other"}, msg.UIDContent.SIGKEY.PUBKEY); err != ErrRepoURI {
+			t.Error("should fail")
+		}
+	}
+	_, _, _, err = msg.KeyInit(0, uint64(times.NinetyDaysLater()), 0, false,
+		"mute.two", "", "", cipher.RandReader)
+	if err != ErrRepoURI {
+		t.Error("should fail")
+	}
+	// the domain of the identity must be included
+	if _, err := Create("test@mute.berlin", false, "", "", Strict,
+		hashchain.TestEntry, []string{"mute.one"}, 0, 0, cipher.RandReader); err == nil {
+		t.Error("should fail")
+	}
+	// no duplicates
+	if _, err := msg.Update([]string{"mute.berlin",
+		"mute.berlin"}, 0, 0, cipher.RandReader); err == nil {
+		t.Error("should fail")
+	}
+	// update keeps repository URIs
+	up, err := msg.Update(nil, 0, 0, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(up.UIDContent.REPOURIS) != len(repoURIs) {
+		t.Error("repository URIs not kept")
+	}
+}
+
 func TestExpired(t *testing.T) {
 	msg, err := Create("test@mute.berlin", false, "", "", Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -91,7 +140,7 @@ func TestExpired(t *testing.T) {
 
 func TestKeyInitFailure(t *testing.T) {
 	msg, err := Create("test@mute.berlin", false, "", "", Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -128,12 +177,12 @@ func TestKeyInitFailure(t *testing.T) {
 
 func TestVerifyFailure(t *testing.T) {
 	msg, err := Create("test@mute.berlin", false, "", "", Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
 	other, err := Create("other@mute.berlin", false, "", "", Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -186,7 +235,7 @@ func TestVerifyFailure(t *testing.T) {
 
 func TestVerifySrvSigfailure(t *testing.T) {
 	msg, err := Create("test@mute.berlin", false, "", "", Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -225,7 +274,7 @@ func TestVerifySrvSigfailure(t *testing.T) {
 func TestSessionAnchor(t *testing.T) {
 	// create UID message
 	msg, err := Create("alice@mute.berlin", false, "", "", Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
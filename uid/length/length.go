@@ -21,5 +21,6 @@ const MaxMixAddress = 254
 // The maximum length of a unencoded nym address is 1176. 4*(1176/3) = 1568.
 const MaxNymAddress = 1568
 
-// MaxUIDMessage defines the maximum length of a JSON encoded UIDMessage.
-const MaxUIDMessage = 2004
+// MaxUIDMessage defines the maximum length of a JSON encoded UIDMessage
+// (which advertises all ciphersuites in uid.Ciphersuites).
+const MaxUIDMessage = 2056
@@ -41,11 +41,11 @@ func TestNil(t *testing.T) {
 func TestUIDMessage(t *testing.T) {
 	id := strings.Repeat("lp", 32) + "@" + strings.Repeat("x", 185) + ".one"
 	uid, err := uid.Create(id, true, "", "", uid.Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
-	uid, err = uid.Update(cipher.RandReader)
+	uid, err = uid.Update(nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -11,7 +11,6 @@ import (
 	"crypto/sha256"
 	"encoding/json"
 	"io"
-	"reflect"
 
 	"github.com/fatih/structs"
 	"github.com/mutecomm/mute/cipher"
@@ -21,6 +20,7 @@ import (
 	"github.com/mutecomm/mute/keyserver/hashchain"
 	"github.com/mutecomm/mute/log"
 	"github.com/mutecomm/mute/uid/identity"
+	"github.com/mutecomm/mute/util"
 	"github.com/mutecomm/mute/util/times"
 )
 
@@ -32,8 +32,8 @@ import (
 //   - UIDContent.PREFERENCES.FORWARDSEC must be "strict".
 //   - UIDContent.PUBKEYS contains exactly one ECDHE25519 key for the default ciphersuite.
 //   - UIDContent.SIGESCROW must be zero-value.
-//   - UIDContent.REPOURIS contains one entry which is the domain of UIDContent.IDENTITY.
-//   - UIDContent.CHAINLINK must be zero-value.
+//   - UIDContent.REPOURIS contains the domain of UIDContent.IDENTITY.
+//   - UIDContent.CHAINLINK is optional (see ChainLink).
 //
 // For KeyInit:
 //
@@ -41,6 +41,26 @@ import (
 //
 const ProtocolVersion = "1.0"
 
+// ProtocolVersionEscrow defines the version of the protocol which supports
+// signature escrow keys. Version 1.1 equals version 1.0, except for:
+//
+// For UIDMessage:
+//
+//   - UIDContent.SIGESCROW can contain an ED25519 key for the default ciphersuite.
+//   - ESCROWSIGNATURE can be set instead of USERSIGNATURE (see Recover).
+const ProtocolVersionEscrow = "1.1"
+
+// ProtocolVersionPFS defines the version of the protocol which supports
+// configurable PFS preferences. Version 1.2 equals version 1.1, except for:
+//
+// For UIDMessage:
+//
+//   - UIDContent.PREFERENCES.FORWARDSEC can be "mandatory", "strict", or
+//     "optional".
+//   - UIDContent.MIXADDRESS and UIDContent.NYMADDRESS can be set, if
+//     UIDContent.PREFERENCES.FORWARDSEC is "optional".
+const ProtocolVersionPFS = "1.2"
+
 // PFSPreference represents a perfect forward secrecy (PFS) preference.
 type PFSPreference int
 
@@ -64,19 +84,21 @@ func (pfsPreference PFSPreference) String() string {
 	return pfsPreferences[pfsPreference]
 }
 
+// ParsePFSPreference parses the string representation of a PFS preference.
+func ParsePFSPreference(s string) (PFSPreference, error) {
+	for i, pref := range pfsPreferences {
+		if s == pref {
+			return PFSPreference(i), nil
+		}
+	}
+	return 0, log.Errorf("uid: unknown PFS preference: %s", s)
+}
+
 type preferences struct {
 	FORWARDSEC   string   // forward security preference
 	CIPHERSUITES []string // list of ciphersuites, ordered from most preferred to least preferred.
 }
 
-type chainlink struct {
-	URI           []string // URI(s) of the foreign key hashchain
-	LAST          string   // last entry of the foreign key hashchain
-	AUTHORITATIVE bool
-	DOMAINS       []string // list of domains that are served currently
-	IDENTITY      string   // own Identity in the foreign key hashchain
-}
-
 type uidContent struct {
 	VERSION     string      // the protocol version
 	MSGCOUNT    uint64      // must increase for each message
@@ -91,7 +113,7 @@ type uidContent struct {
 	LASTENTRY   string      // last known key hashchain entry
 	REPOURIS    []string    // URIs of KeyInit Repositories to publish KeyInit messages
 	PREFERENCES preferences // PFS preference
-	CHAINLINK   *chainlink  // used only for "linking chains and key repositories"
+	CHAINLINK   *ChainLink  // used only for "linking chains and key repositories"
 }
 
 // Message is a UIDMessage to be sent from user to key server.
@@ -123,9 +145,51 @@ type MessageReply struct {
 	SERVERSIGNATURE string // signature over Entry by keyserver's signature key
 }
 
+// checkValidity checks the validity window given by notbefore and notafter
+// and returns the NOTAFTER value to use (one year from now, if notafter is 0).
+func checkValidity(notbefore, notafter uint64) (uint64, error) {
+	if notafter == 0 {
+		notafter = uint64(times.OneYearLater())
+	}
+	if notbefore >= notafter {
+		return 0, log.Error(ErrInvalidValidity)
+	}
+	if notafter < uint64(times.Now()) {
+		return 0, log.Error(ErrExpired)
+	}
+	return notafter, nil
+}
+
+// checkRepoURIs checks that the KeyInit repository URIs repoURIs contain
+// the given domain and no duplicates.
+func checkRepoURIs(domain string, repoURIs []string) error {
+	for i, repoURI := range repoURIs {
+		if repoURI == "" {
+			return log.Error("uid: empty KeyInit repository URI")
+		}
+		if util.ContainsString(repoURIs[:i], repoURI) {
+			return log.Errorf("uid: duplicate KeyInit repository URI: %s", repoURI)
+		}
+	}
+	if !util.ContainsString(repoURIs, domain) {
+		return log.Errorf("uid: KeyInit repository URIs must contain domain %s",
+			domain)
+	}
+	return nil
+}
+
 // Create creates a new UID message for the given userID and self-signs it.
-// It automatically creates all necessary keys. If sigescrow is true,  an
-// escrow key is included in the created UID message.
+// It automatically creates all necessary keys. If sigescrow is true, an
+// escrow key is included in the created UID message (which requires
+// ProtocolVersionEscrow). The private escrow key is not stored anywhere else
+// and must be saved offline (see PrivateEscrowKey).
+// pfsPreference defines how senders have to establish a session. A
+// pfsPreference other than Strict requires ProtocolVersionPFS. mixaddress and
+// nymaddress are only used if pfsPreference is Optional.
+// repoURIs are the URIs of the KeyInit repositories KeyInit messages are
+// published to (if repoURIs is empty, only the domain of userID is used).
+// The UID message is valid from notbefore until notafter (if notafter is 0,
+// it is valid for one year).
 // Necessary randomness is read from rand.
 func Create(
 	userID string,
@@ -133,6 +197,8 @@ func Create(
 	mixaddress, nymaddress string,
 	pfsPreference PFSPreference,
 	lastEntry string,
+	repoURIs []string,
+	notbefore, notafter uint64,
 	rand io.Reader,
 ) (*Message, error) {
 	var msg Message
@@ -141,10 +207,20 @@ func Create(
 	if err := identity.IsMapped(userID); err != nil {
 		return nil, log.Error(err)
 	}
-	msg.UIDContent.VERSION = ProtocolVersion
-	msg.UIDContent.MSGCOUNT = 0                            // this is the first UIDMessage
-	msg.UIDContent.NOTAFTER = uint64(times.OneYearLater()) // TODO: make this settable!
-	msg.UIDContent.NOTBEFORE = 0                           // TODO: make this settable
+	notafter, err = checkValidity(notbefore, notafter)
+	if err != nil {
+		return nil, err
+	}
+	if pfsPreference != Strict {
+		msg.UIDContent.VERSION = ProtocolVersionPFS
+	} else if sigescrow {
+		msg.UIDContent.VERSION = ProtocolVersionEscrow
+	} else {
+		msg.UIDContent.VERSION = ProtocolVersion
+	}
+	msg.UIDContent.MSGCOUNT = 0 // this is the first UIDMessage
+	msg.UIDContent.NOTAFTER = notafter
+	msg.UIDContent.NOTBEFORE = notbefore
 	if pfsPreference == Optional {
 		msg.UIDContent.MIXADDRESS = mixaddress
 		msg.UIDContent.NYMADDRESS = nymaddress
@@ -177,14 +253,18 @@ func Create(
 	}
 	msg.UIDContent.LASTENTRY = lastEntry
 
-	// set REPOURIS to the domain of UIDContent.IDENTITY
-	// TODO: support different KeyInit repository configurations
-	msg.UIDContent.REPOURIS = []string{domain}
+	// set REPOURIS (default: the domain of UIDContent.IDENTITY)
+	if len(repoURIs) == 0 {
+		repoURIs = []string{domain}
+	}
+	if err := checkRepoURIs(domain, repoURIs); err != nil {
+		return nil, err
+	}
+	msg.UIDContent.REPOURIS = repoURIs
 
 	msg.UIDContent.PREFERENCES.FORWARDSEC = pfsPreference.String()
-	msg.UIDContent.PREFERENCES.CIPHERSUITES = []string{DefaultCiphersuite}
-
-	// TODO: CHAINLINK (later protocol version)
+	msg.UIDContent.PREFERENCES.CIPHERSUITES = make([]string, len(Ciphersuites))
+	copy(msg.UIDContent.PREFERENCES.CIPHERSUITES, Ciphersuites)
 
 	// theses signatures are always empty for messages the first UIDMessage
 	msg.ESCROWSIGNATURE = ""
@@ -193,27 +273,25 @@ func Create(
 	selfsig := msg.UIDContent.SIGKEY.ed25519Key.Sign(msg.UIDContent.JSON())
 	msg.SELFSIGNATURE = base64.Encode(selfsig)
 
-	// TODO: LINKAUTHORITY
-
 	return &msg, nil
 }
 
-func (msg *Message) checkV1_0() error {
-	// UIDContent.PREFERENCES.FORWARDSEC must be "strict"
+// checkStrict makes sure UIDContent.PREFERENCES.FORWARDSEC is "strict"
+// (required before ProtocolVersionPFS).
+func (msg *Message) checkStrict() error {
 	strict := Strict.String()
 	if msg.UIDContent.PREFERENCES.FORWARDSEC != strict {
 		return log.Errorf("uid: FORWARDSEC must be %q", strict)
 	}
-	// UIDContent.PUBKEYS contains exactly one ECDHE25519 key for the default
-	// ciphersuite
-	if len(msg.UIDContent.PUBKEYS) != 1 {
-		return log.Error("uid: UIDContent.PUBKEYS must contain exactly one key")
-	}
-	if msg.UIDContent.PUBKEYS[0].CIPHERSUITE != DefaultCiphersuite {
-		return log.Error("uid: UIDContent.PUBKEYS[0].CIPHERSUITE != DefaultCiphersuite")
+	return nil
+}
+
+func (msg *Message) checkV1_0() error {
+	if err := msg.checkStrict(); err != nil {
+		return err
 	}
-	if msg.UIDContent.PUBKEYS[0].FUNCTION != "ECDHE25519" {
-		return log.Error("uid: UIDContent.PUBKEYS[0].FUNCTION != \"ECDHE25519\"")
+	if err := msg.checkV1(); err != nil {
+		return err
 	}
 	// UIDContent.SIGESCROW must be zero-value.
 	if msg.UIDContent.SIGESCROW != nil {
@@ -224,27 +302,84 @@ func (msg *Message) checkV1_0() error {
 			return log.Error("uid: UIDContent.SIGESCROW must be zero-value")
 		}
 	}
-	// UIDContent.REPOURIS contains one entry which is the domain of
-	// UIDContent.IDENTITY
-	_, domain, _ := identity.Split(msg.UIDContent.IDENTITY)
-	if len(msg.UIDContent.REPOURIS) != 1 ||
-		msg.UIDContent.REPOURIS[0] != domain {
-		return log.Error("uid: UIDContent.REPOURIS must contain one entry (domain of identity)")
+	// ESCROWSIGNATURE must be zero-value.
+	if msg.ESCROWSIGNATURE != "" {
+		return log.Error("uid: ESCROWSIGNATURE must be zero-value")
+	}
+	return nil
+}
+
+func (msg *Message) checkV1_1() error {
+	if err := msg.checkStrict(); err != nil {
+		return err
 	}
+	return msg.checkEscrow()
+}
 
-	// UIDContent.CHAINLINK must be zero-value
-	if msg.UIDContent.CHAINLINK != nil {
-		if !reflect.DeepEqual(msg.UIDContent.CHAINLINK, chainlink{}) {
-			return log.Error("uid: UIDContent.CHAINLINK must be zero-value")
+func (msg *Message) checkV1_2() error {
+	// UIDContent.PREFERENCES.FORWARDSEC can be any PFS preference
+	_, err := ParsePFSPreference(msg.UIDContent.PREFERENCES.FORWARDSEC)
+	if err != nil {
+		return err
+	}
+	return msg.checkEscrow()
+}
+
+// checkEscrow contains the checks which are common to all 1.x versions which
+// support signature escrow keys (1.1 and later).
+func (msg *Message) checkEscrow() error {
+	if err := msg.checkV1(); err != nil {
+		return err
+	}
+	// UIDContent.SIGESCROW can contain an ED25519 key for the default
+	// ciphersuite
+	if escrow := msg.UIDContent.SIGESCROW; escrow != nil {
+		if escrow.CIPHERSUITE != DefaultCiphersuite {
+			return log.Error("uid: UIDContent.SIGESCROW.CIPHERSUITE != DefaultCiphersuite")
+		}
+		if escrow.FUNCTION != "ED25519" {
+			return log.Error("uid: UIDContent.SIGESCROW.FUNCTION != \"ED25519\"")
 		}
+		pubKey, err := base64.Decode(escrow.PUBKEY)
+		if err != nil {
+			return err
+		}
+		if escrow.HASH != base64.Encode(cipher.SHA512(pubKey)) {
+			return log.Error("uid: SHA512(UIDContent.SIGESCROW.PUBKEY) != UIDContent.SIGESCROW.HASH")
+		}
+	} else if msg.ESCROWSIGNATURE != "" {
+		return log.Error("uid: ESCROWSIGNATURE requires UIDContent.SIGESCROW")
+	}
+	return nil
+}
+
+// checkV1 contains the checks which are common to all 1.x versions.
+func (msg *Message) checkV1() error {
+	// UIDContent.PUBKEYS contains exactly one ECDHE25519 key for the default
+	// ciphersuite
+	if len(msg.UIDContent.PUBKEYS) != 1 {
+		return log.Error("uid: UIDContent.PUBKEYS must contain exactly one key")
+	}
+	if msg.UIDContent.PUBKEYS[0].CIPHERSUITE != DefaultCiphersuite {
+		return log.Error("uid: UIDContent.PUBKEYS[0].CIPHERSUITE != DefaultCiphersuite")
+	}
+	if msg.UIDContent.PUBKEYS[0].FUNCTION != "ECDHE25519" {
+		return log.Error("uid: UIDContent.PUBKEYS[0].FUNCTION != \"ECDHE25519\"")
+	}
+	// UIDContent.REPOURIS contains the domain of UIDContent.IDENTITY
+	_, domain, _ := identity.Split(msg.UIDContent.IDENTITY)
+	if err := checkRepoURIs(domain, msg.UIDContent.REPOURIS); err != nil {
+		return err
 	}
 	return nil
 }
 
 // Check that the content of the UID message is consistent with it's version.
 func (msg *Message) Check() error {
-	// we only support version 1.0 at this stage
-	if msg.UIDContent.VERSION != "1.0" {
+	// we only support versions 1.0, 1.1, and 1.2 at this stage
+	if msg.UIDContent.VERSION != ProtocolVersion &&
+		msg.UIDContent.VERSION != ProtocolVersionEscrow &&
+		msg.UIDContent.VERSION != ProtocolVersionPFS {
 		return log.Errorf("uid: unknown UIDContent.VERSION: %s",
 			msg.UIDContent.VERSION)
 	}
@@ -284,8 +419,22 @@ func (msg *Message) Check() error {
 	if msg.ESCROWSIGNATURE != "" && msg.USERSIGNATURE != "" {
 		return log.Error("uid: USERSIGNATURE and ESCROWSIGNATURE cannot be set at the same time")
 	}
+	// check CHAINLINK, LINKAUTHORITY must be zero unless an authoritative link
+	link := msg.UIDContent.CHAINLINK
+	if err := link.check(); err != nil {
+		return err
+	}
+	if msg.LINKAUTHORITY != "" && link.Type() != AuthoritativeLink {
+		return log.Error("uid: LINKAUTHORITY must be zero unless an AUTHORITATIVE link")
+	}
 
-	// version 1.0 specific checks
+	// version specific checks
+	switch msg.UIDContent.VERSION {
+	case ProtocolVersionEscrow:
+		return msg.checkV1_1()
+	case ProtocolVersionPFS:
+		return msg.checkV1_2()
+	}
 	return msg.checkV1_0()
 }
 
@@ -305,6 +454,12 @@ func (msg *Message) Encrypt() (UIDHash, UIDIndex []byte, UIDMessageEncrypted str
 	return
 }
 
+// UIDHash returns the base64 encoded UIDHash = sha256(UIDMessage) of the UID
+// message msg.
+func (msg *Message) UIDHash() string {
+	return base64.Encode(cipher.SHA256(msg.JSON()))
+}
+
 // Identity returns the identity of the UID message msg.
 func (msg *Message) Identity() string {
 	return msg.UIDContent.IDENTITY
@@ -335,6 +490,33 @@ func (msg *Message) PubKey() *KeyEntry {
 	return &msg.UIDContent.PUBKEYS[0]
 }
 
+// PFSPreference returns the PFS preference of the given UID message.
+// Unknown preferences are treated as Strict.
+func (msg *Message) PFSPreference() PFSPreference {
+	pfsPreference, err := ParsePFSPreference(msg.UIDContent.PREFERENCES.FORWARDSEC)
+	if err != nil {
+		return Strict
+	}
+	return pfsPreference
+}
+
+// Ciphersuites returns the ciphersuites advertised by the given UID message,
+// ordered from most preferred to least preferred. If the UID message doesn't
+// advertise any ciphersuites, only DefaultCiphersuite is returned.
+func (msg *Message) Ciphersuites() []string {
+	if len(msg.UIDContent.PREFERENCES.CIPHERSUITES) == 0 {
+		return []string{DefaultCiphersuite}
+	}
+	return msg.UIDContent.PREFERENCES.CIPHERSUITES
+}
+
+// NymAddress returns the nymaddress of the given UID message, which can be
+// used to deliver messages to the static key (only set if the PFS preference
+// is Optional).
+func (msg *Message) NymAddress() string {
+	return msg.UIDContent.NYMADDRESS
+}
+
 // PublicKey decodes the 32-byte public key from the given UID message and
 // returns it.
 func (msg *Message) PublicKey() (*[32]byte, error) {
@@ -462,12 +644,25 @@ func (msg *Message) VerifySelfSig() error {
 }
 
 // VerifyUserSig verifies that the user-signature of UIDMessage is valid.
+// If ESCROWSIGNATURE is set instead, it verifies the escrow signature with the
+// SIGESCROW key of preMsg. SIGESCROW can only be changed with a valid escrow
+// signature.
 func (msg *Message) VerifyUserSig(preMsg *Message) error {
 	var ed25519Key cipher.Ed25519Key
 	// check message counter
 	if preMsg.UIDContent.MSGCOUNT+1 != msg.UIDContent.MSGCOUNT {
 		return log.Error(ErrIncrement)
 	}
+	if msg.ESCROWSIGNATURE != "" {
+		if msg.USERSIGNATURE != "" {
+			return log.Error("uid: USERSIGNATURE and ESCROWSIGNATURE cannot be set at the same time")
+		}
+		return msg.verifyEscrowSig(preMsg)
+	}
+	// changing SIGESCROW requires ESCROWSIGNATURE
+	if !escrowEqual(msg.UIDContent.SIGESCROW, preMsg.UIDContent.SIGESCROW) {
+		return log.Error(ErrEscrowChanged)
+	}
 	// get content
 	content := msg.UIDContent.JSON()
 	// get self-signature
@@ -490,6 +685,45 @@ func (msg *Message) VerifyUserSig(preMsg *Message) error {
 	return nil
 }
 
+// verifyEscrowSig verifies that the escrow signature of UIDMessage is valid
+// for the SIGESCROW key of preMsg.
+func (msg *Message) verifyEscrowSig(preMsg *Message) error {
+	var ed25519Key cipher.Ed25519Key
+	if preMsg.UIDContent.SIGESCROW == nil {
+		return log.Error(ErrInvalidEscrowSig)
+	}
+	// get escrow signature
+	escrowsig, err := base64.Decode(msg.ESCROWSIGNATURE)
+	if err != nil {
+		return err
+	}
+	// create ed25519 key
+	pubKey, err := base64.Decode(preMsg.UIDContent.SIGESCROW.PUBKEY)
+	if err != nil {
+		return err
+	}
+	if err := ed25519Key.SetPublicKey(pubKey); err != nil {
+		return err
+	}
+	// verify escrow signature
+	if !ed25519Key.Verify(msg.UIDContent.JSON(), escrowsig) {
+		return log.Error(ErrInvalidEscrowSig)
+	}
+	return nil
+}
+
+// escrowEqual returns true, if the escrow key entries a and b are equal.
+// A nil entry equals a zero-value entry.
+func escrowEqual(a, b *KeyEntry) bool {
+	if a == nil {
+		a = new(KeyEntry)
+	}
+	if b == nil {
+		b = new(KeyEntry)
+	}
+	return KeyEntryEqual(a, b)
+}
+
 // PrivateSigKey returns the base64 encoded private signature key of the UID
 // message.
 func (msg *Message) PrivateSigKey() string {
@@ -556,6 +790,13 @@ func (msg *Message) Localpart() string {
 	return lp
 }
 
+// ValidAt returns true, if the UID message is valid at time t (that is,
+// NOTBEFORE <= t < NOTAFTER).
+func (msg *Message) ValidAt(t int64) bool {
+	return msg.UIDContent.NOTBEFORE <= uint64(t) &&
+		uint64(t) < msg.UIDContent.NOTAFTER
+}
+
 // Domain returns the domain of the uid identity.
 func (msg *Message) Domain() string {
 	_, domain, err := identity.Split(msg.UIDContent.IDENTITY)
@@ -568,17 +809,42 @@ func (msg *Message) Domain() string {
 
 // Update generates an updated version of the given UID message, signs it with
 // the private signature key, and returns it.
-func (msg *Message) Update(rand io.Reader) (*Message, error) {
+// If repoURIs is not empty, the KeyInit repository URIs are replaced.
+// CHAINLINK and LINKAUTHORITY are not carried over (see Link).
+// The updated UID message is valid from notbefore until notafter (if notafter
+// is 0, it is valid for one year).
+func (msg *Message) Update(
+	repoURIs []string,
+	notbefore, notafter uint64,
+	rand io.Reader,
+) (*Message, error) {
+	notafter, err := checkValidity(notbefore, notafter)
+	if err != nil {
+		return nil, err
+	}
 	var up Message
 	// copy
 	up = *msg
 	// increase counter
 	up.UIDContent.MSGCOUNT++
+	// set KeyInit repository URIs
+	if len(repoURIs) > 0 {
+		if err := checkRepoURIs(msg.Domain(), repoURIs); err != nil {
+			return nil, err
+		}
+		up.UIDContent.REPOURIS = repoURIs
+	}
+	// set validity
+	up.UIDContent.NOTBEFORE = notbefore
+	up.UIDContent.NOTAFTER = notafter
+	// links only apply to the UID message they were made for
+	up.UIDContent.CHAINLINK = nil
+	up.LINKAUTHORITY = ""
 	// update signature key
 	if err := up.UIDContent.SIGKEY.initSigKey(rand); err != nil {
 		return nil, err
 	}
-	err := up.UIDContent.PUBKEYS[0].setPrivateKey(msg.UIDContent.PUBKEYS[0].PrivateKey32()[:])
+	err = up.UIDContent.PUBKEYS[0].setPrivateKey(msg.UIDContent.PUBKEYS[0].PrivateKey32()[:])
 	if err != nil {
 		return nil, err
 	}
@@ -591,6 +857,76 @@ func (msg *Message) Update(rand io.Reader) (*Message, error) {
 	return &up, nil
 }
 
+// Recover generates a new version of the given UID message after the loss of
+// its private SIGKEY. All keys except SIGESCROW are replaced and the new UID
+// message is signed with the private escrow key escrowKey (base64 encoded)
+// instead of the previous SIGKEY (ESCROWSIGNATURE).
+// The recovered UID message is valid from notbefore until notafter (if
+// notafter is 0, it is valid for one year).
+func (msg *Message) Recover(
+	rand io.Reader,
+	escrowKey string,
+	notbefore, notafter uint64,
+) (*Message, error) {
+	if msg.UIDContent.VERSION == ProtocolVersion ||
+		msg.UIDContent.SIGESCROW == nil {
+		return nil, log.Error(ErrNoEscrow)
+	}
+	notafter, err := checkValidity(notbefore, notafter)
+	if err != nil {
+		return nil, err
+	}
+	// make sure the private escrow key matches SIGESCROW
+	// (an Ed25519 private key contains the public key in its second half)
+	privKey, err := base64.Decode(escrowKey)
+	if err != nil {
+		return nil, err
+	}
+	var escrow cipher.Ed25519Key
+	if err := escrow.SetPrivateKey(privKey); err != nil {
+		return nil, err
+	}
+	if base64.Encode(privKey[32:]) != msg.UIDContent.SIGESCROW.PUBKEY {
+		return nil, log.Error(ErrEscrowKey)
+	}
+	var rec Message
+	// copy
+	rec = *msg
+	// increase counter
+	rec.UIDContent.MSGCOUNT++
+	// set validity
+	rec.UIDContent.NOTBEFORE = notbefore
+	rec.UIDContent.NOTAFTER = notafter
+	// links only apply to the UID message they were made for
+	rec.UIDContent.CHAINLINK = nil
+	rec.LINKAUTHORITY = ""
+	// replace signature and encryption keys
+	if err := rec.UIDContent.SIGKEY.initSigKey(rand); err != nil {
+		return nil, err
+	}
+	rec.UIDContent.PUBKEYS = make([]KeyEntry, 1)
+	if err := rec.UIDContent.PUBKEYS[0].InitDHKey(rand); err != nil {
+		return nil, err
+	}
+	// self-signature
+	selfsig := rec.UIDContent.SIGKEY.ed25519Key.Sign(rec.UIDContent.JSON())
+	rec.SELFSIGNATURE = base64.Encode(selfsig)
+	// sign with escrow key
+	rec.USERSIGNATURE = ""
+	escrowsig := escrow.Sign(rec.UIDContent.JSON())
+	rec.ESCROWSIGNATURE = base64.Encode(escrowsig)
+	return &rec, nil
+}
+
+// PrivateEscrowKey returns the base64 encoded private escrow key of a newly
+// created UID message (see Create).
+func (msg *Message) PrivateEscrowKey() string {
+	if msg.UIDContent.SIGESCROW == nil {
+		panic(log.Critical("uid: no escrow key"))
+	}
+	return msg.UIDContent.SIGESCROW.PrivateKey()
+}
+
 // SignNonce signs the current time as nonce and returns it.
 func (msg *Message) SignNonce() (nonce uint64, signature string) {
 	nonce = uint64(times.Now())
@@ -12,11 +12,12 @@ import (
 	"github.com/mutecomm/mute/cipher"
 	"github.com/mutecomm/mute/encode/base64"
 	"github.com/mutecomm/mute/keyserver/hashchain"
+	"github.com/mutecomm/mute/util/times"
 )
 
 func TestUIDMessage(t *testing.T) {
 	uid, err := Create("test@mute.berlin", false, "", "", Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -56,7 +57,7 @@ func TestUIDMessage(t *testing.T) {
 	if err := jsnUID.SetPrivateSigKey("!"); err == nil {
 		t.Error("should fail")
 	}
-	up, err := uid.Update(cipher.RandReader)
+	up, err := uid.Update(nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -67,29 +68,29 @@ func TestUIDMessage(t *testing.T) {
 
 func TestIncrementCheck(t *testing.T) {
 	uid, err := Create("test@mute.berlin", false, "", "", Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
-	up, err := uid.Update(cipher.RandReader)
+	up, err := uid.Update(nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
-	up2, err := up.Update(cipher.RandReader)
+	up2, err := up.Update(nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if err := up2.VerifyUserSig(uid); err != ErrIncrement {
 		t.Error("should fail")
 	}
-	if _, err := uid.Update(cipher.RandFail); err == nil {
+	if _, err := uid.Update(nil, 0, 0, cipher.RandFail); err == nil {
 		t.Error("should fail")
 	}
 }
 
 func TestSelfSig(t *testing.T) {
 	uid, err := Create("test@mute.berlin", false, "", "", Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -110,11 +111,11 @@ func TestSelfSig(t *testing.T) {
 
 func TestUserSig(t *testing.T) {
 	uid, err := Create("test@mute.berlin", false, "", "", Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
-	up, err := uid.Update(cipher.RandReader)
+	up, err := uid.Update(nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -134,19 +135,163 @@ func TestUserSig(t *testing.T) {
 }
 
 func TestEscrow(t *testing.T) {
-	if _, err := Create("test@mute.berlin", true, "", "", Strict,
-		hashchain.TestEntry, cipher.RandReader); err != nil {
+	msg, err := Create("test@mute.berlin", true, "", "", Strict,
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.UIDContent.VERSION != ProtocolVersionEscrow {
+		t.Error("wrong version")
+	}
+	if err := msg.Check(); err != nil {
+		t.Fatal(err)
+	}
+	escrowKey := msg.PrivateEscrowKey()
+	// normal update keeps SIGESCROW
+	up, err := msg.Update(nil, 0, 0, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := up.VerifyUserSig(msg); err != nil {
+		t.Error(err)
+	}
+	// recover with escrow key
+	rec, err := up.Recover(cipher.RandReader, escrowKey, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Check(); err != nil {
+		t.Error(err)
+	}
+	if err := rec.VerifySelfSig(); err != nil {
+		t.Error(err)
+	}
+	if err := rec.VerifyUserSig(up); err != nil {
+		t.Error(err)
+	}
+	if rec.UIDContent.SIGKEY.PUBKEY == up.UIDContent.SIGKEY.PUBKEY ||
+		rec.UIDContent.PUBKEYS[0].PUBKEY == up.UIDContent.PUBKEYS[0].PUBKEY {
+		t.Error("keys not replaced")
+	}
+	// wrong escrow key
+	other, err := Create("test@mute.berlin", true, "", "", Strict,
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := up.Recover(cipher.RandReader, other.PrivateEscrowKey(), 0, 0); err != ErrEscrowKey {
+		t.Error("should fail")
+	}
+	// escrow signature of wrong key
+	rec.UIDContent.SIGESCROW = other.UIDContent.SIGESCROW
+	if err := rec.VerifyUserSig(up); err != ErrInvalidEscrowSig {
+		t.Error("should fail")
+	}
+	// SIGESCROW cannot be changed without escrow signature
+	up2, err := up.Update(nil, 0, 0, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up2.UIDContent.SIGESCROW = other.UIDContent.SIGESCROW
+	up2.USERSIGNATURE = base64.Encode(up.UIDContent.SIGKEY.ed25519Key.Sign(up2.UIDContent.JSON()))
+	if err := up2.VerifyUserSig(up); err != ErrEscrowChanged {
+		t.Error("should fail")
+	}
+	// UID messages without escrow key cannot be recovered
+	noEscrow, err := Create("test@mute.berlin", false, "", "", Strict,
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := noEscrow.Recover(cipher.RandReader, escrowKey, 0, 0); err != ErrNoEscrow {
+		t.Error("should fail")
+	}
+	// version 1.0 does not allow escrow
+	msg.UIDContent.VERSION = ProtocolVersion
+	if err := msg.Check(); err == nil {
+		t.Error("should fail")
+	}
+}
+
+func TestPFSPreference(t *testing.T) {
+	for _, pref := range []PFSPreference{Mandatory, Strict, Optional} {
+		parsed, err := ParsePFSPreference(pref.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed != pref {
+			t.Errorf("PFS preference %s not parsed correctly", pref)
+		}
+		msg, err := Create("test@mute.berlin", false, "mix", "nym", pref,
+			hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := msg.Check(); err != nil {
+			t.Fatal(err)
+		}
+		if msg.PFSPreference() != pref {
+			t.Errorf("wrong PFS preference %s", msg.PFSPreference())
+		}
+		if pref == Strict {
+			if msg.UIDContent.VERSION != ProtocolVersion {
+				t.Error("wrong version")
+			}
+		} else if msg.UIDContent.VERSION != ProtocolVersionPFS {
+			t.Error("wrong version")
+		}
+		if pref == Optional {
+			if msg.NymAddress() != "nym" || msg.UIDContent.MIXADDRESS != "mix" {
+				t.Error("addresses not set")
+			}
+		} else if msg.NymAddress() != "" || msg.UIDContent.MIXADDRESS != "" {
+			t.Error("addresses must not be set")
+		}
+		if pref != Strict {
+			// version 1.0 and 1.1 require a strict PFS preference
+			msg.UIDContent.VERSION = ProtocolVersionEscrow
+			if err := msg.Check(); err == nil {
+				t.Error("should fail")
+			}
+		}
+	}
+	if _, err := ParsePFSPreference("unknown"); err == nil {
+		t.Error("should fail")
+	}
+	// escrow keys are supported in version 1.2
+	msg, err := Create("test@mute.berlin", true, "", "", Mandatory,
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.Check(); err != nil {
+		t.Fatal(err)
+	}
+	up, err := msg.Update(nil, 0, 0, cipher.RandReader)
+	if err != nil {
 		t.Fatal(err)
 	}
+	rec, err := up.Recover(cipher.RandReader, msg.PrivateEscrowKey(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Check(); err != nil {
+		t.Error(err)
+	}
+	// unknown PFS preferences are rejected
+	msg.UIDContent.PREFERENCES.FORWARDSEC = "unknown"
+	if err := msg.Check(); err == nil {
+		t.Error("should fail")
+	}
 }
 
 func TestCreateFail(t *testing.T) {
 	if _, err := Create("test@mute.berlin", false, "", "", Strict,
-		hashchain.TestEntry, cipher.RandFail); err == nil {
+		hashchain.TestEntry, nil, 0, 0, cipher.RandFail); err == nil {
 		t.Error("should fail")
 	}
 	if _, err := Create("test@mute.berlin", true, "", "", Strict,
-		hashchain.TestEntry, io.LimitReader(cipher.RandReader, 1)); err == nil {
+		hashchain.TestEntry, nil, 0, 0, io.LimitReader(cipher.RandReader, 1)); err == nil {
 		t.Error("should fail")
 	}
 	if _, err := NewJSON(""); err == nil {
@@ -157,9 +302,52 @@ func TestCreateFail(t *testing.T) {
 	}
 }
 
+func TestValidity(t *testing.T) {
+	now := times.Now()
+	notbefore := uint64(now + 60)
+	notafter := uint64(times.ThirtyDaysLater())
+	uid, err := Create("test@mute.berlin", false, "", "", Strict,
+		hashchain.TestEntry, nil, notbefore, notafter, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid.UIDContent.NOTBEFORE != notbefore ||
+		uid.UIDContent.NOTAFTER != notafter {
+		t.Error("validity not set")
+	}
+	if uid.ValidAt(now) {
+		t.Error("UID should not be valid yet")
+	}
+	if !uid.ValidAt(now + 60) {
+		t.Error("UID should be valid")
+	}
+	if uid.ValidAt(int64(notafter)) {
+		t.Error("UID should have expired")
+	}
+	// update uses default validity of one year
+	up, err := uid.Update(nil, 0, 0, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up.UIDContent.NOTBEFORE != 0 || up.UIDContent.NOTAFTER <= notafter {
+		t.Error("wrong validity of update")
+	}
+	if err := up.VerifyUserSig(uid); err != nil {
+		t.Error(err)
+	}
+	// invalid windows
+	if _, err := uid.Update(nil, notafter, notafter, cipher.RandReader); err != ErrInvalidValidity {
+		t.Error("should fail")
+	}
+	if _, err := Create("test@mute.berlin", false, "", "", Strict,
+		hashchain.TestEntry, nil, 0, uint64(now-1), cipher.RandReader); err != ErrExpired {
+		t.Error("should fail")
+	}
+}
+
 func TestUIDMessageReply(t *testing.T) {
 	uid, err := Create("alice@mute.berlin", false, "", "", Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -226,7 +414,7 @@ func TestUIDMessageReply(t *testing.T) {
 
 func TestNonceSignature(t *testing.T) {
 	msg, err := Create("test@mute.berlin", false, "", "", Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -247,7 +435,7 @@ func TestNonceSignature(t *testing.T) {
 
 func TestSigKeyHash(t *testing.T) {
 	msg, err := Create("alice@mute.berlin", false, "", "", Strict,
-		hashchain.TestEntry, cipher.RandReader)
+		hashchain.TestEntry, nil, 0, 0, cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
 	}
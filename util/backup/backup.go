@@ -0,0 +1,188 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package backup implements authenticated and passphrase-encrypted backup
+// archives.
+//
+// Format of an encrypted archive:
+//
+//	magic (8 bytes, "MUTEBAK1")
+//	number of iterations for PBKDF2 (8 bytes)
+//	creation time of the archive (8 bytes, Unix time)
+//	salt for PBKDF2 (32 bytes)
+//	IV for AES-256 in CTR mode (16 bytes)
+//	AES-256 encrypted tar archive
+//	HMAC-SHA512 of all of the above (64 bytes)
+//
+// PBKDF2 (with SHA-256) derives 64 bytes from the passphrase, the first 32
+// bytes are the AES-256 key and the last 32 bytes the HMAC key.
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/cipher/aes256"
+	"github.com/mutecomm/mute/encdb"
+	"github.com/mutecomm/mute/encode"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const magic = "MUTEBAK1"
+
+// headerSize is the size of the unencrypted archive header.
+const headerSize = len(magic) + 8 + 8 + 32
+
+// MaxIterations is the maximum number of PBKDF2 iterations of an archive.
+// Decrypt runs PBKDF2 before the archive can be authenticated, the limit
+// prevents forged archives from keeping it busy for a long time.
+const MaxIterations = 16 * encdb.KDFIterations
+
+var (
+	// ErrFormat is returned if data is not an encrypted backup archive.
+	ErrFormat = errors.New("backup: not a backup archive")
+	// ErrAuth is returned if an encrypted archive cannot be authenticated
+	// (wrong passphrase or corrupted archive).
+	ErrAuth = errors.New("backup: authentication failed (wrong passphrase or corrupted archive)")
+	// ErrName is returned for files with invalid names (absolute paths or
+	// paths outside of the archive).
+	ErrName = errors.New("backup: invalid file name")
+)
+
+// File is a file contained in a backup archive.
+type File struct {
+	Name string // slash separated path relative to the archive root
+	Data []byte // file contents
+}
+
+// Archive is a backup archive.
+type Archive struct {
+	Created int64   // creation time of the archive (Unix time)
+	Files   []*File // files contained in the archive
+}
+
+// checkName makes sure that name is a relative path within the archive.
+func checkName(name string) error {
+	if name == "" || path.IsAbs(name) || strings.Contains(name, "\\") ||
+		path.Clean(name) != name || name == ".." ||
+		strings.HasPrefix(name, "../") {
+		return ErrName
+	}
+	return nil
+}
+
+// deriveKeys derives the encryption and HMAC keys from passphrase.
+func deriveKeys(passphrase, salt []byte, iter int) (encKey, macKey []byte) {
+	dk := pbkdf2.Key(passphrase, salt, iter, 64, sha256.New)
+	return dk[:32], dk[32:]
+}
+
+// Encrypt returns archive a encrypted with passphrase (processed by PBKDF2
+// with iter many iterations).
+func (a *Archive) Encrypt(passphrase []byte, iter int, rand io.Reader) ([]byte, error) {
+	if iter < 1 || iter > MaxIterations {
+		return nil, errors.New("backup: invalid iter value")
+	}
+	// create tar archive
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, file := range a.Files {
+		if err := checkName(file.Name); err != nil {
+			return nil, err
+		}
+		hdr := &tar.Header{
+			Name: file.Name,
+			Mode: 0600,
+			Size: int64(len(file.Data)),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(file.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	// encrypt
+	var salt = make([]byte, 32)
+	if _, err := io.ReadFull(rand, salt); err != nil {
+		return nil, err
+	}
+	encKey, macKey := deriveKeys(passphrase, salt, iter)
+	var out bytes.Buffer
+	out.WriteString(magic)
+	out.Write(encode.ToByte8(uint64(iter)))
+	out.Write(encode.ToByte8(uint64(a.Created)))
+	out.Write(salt)
+	out.Write(aes256.CTREncrypt(encKey, buf.Bytes(), rand))
+	// authenticate
+	out.Write(cipher.HMAC(macKey, out.Bytes()))
+	return out.Bytes(), nil
+}
+
+// Decrypt decrypts and authenticates the encrypted archive data with
+// passphrase.
+func Decrypt(data, passphrase []byte) (*Archive, error) {
+	if len(data) < headerSize+aes.BlockSize+sha512.Size ||
+		string(data[:len(magic)]) != magic {
+		return nil, ErrFormat
+	}
+	iter := encode.ToUint64(data[len(magic) : len(magic)+8])
+	if iter < 1 || iter > MaxIterations {
+		return nil, ErrFormat
+	}
+	created := encode.ToUint64(data[len(magic)+8 : len(magic)+16])
+	salt := data[len(magic)+16 : headerSize]
+	encKey, macKey := deriveKeys(passphrase, salt, int(iter))
+	// authenticate
+	macOffset := len(data) - sha512.Size
+	if !hmac.Equal(cipher.HMAC(macKey, data[:macOffset]), data[macOffset:]) {
+		return nil, ErrAuth
+	}
+	// decrypt
+	plaintext := aes256.CTRDecrypt(encKey, data[headerSize:macOffset])
+	a := &Archive{Created: int64(created)}
+	tr := tar.NewReader(bytes.NewReader(plaintext))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := checkName(hdr.Name); err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		a.Files = append(a.Files, &File{Name: hdr.Name, Data: content})
+	}
+	return a, nil
+}
+
+// File returns the file with the given name from archive a (or nil, if it
+// doesn't exist).
+func (a *Archive) File(name string) *File {
+	for _, file := range a.Files {
+		if file.Name == name {
+			return file
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encode"
+)
+
+var passphrase = []byte("passphrase")
+
+const iter = 4096
+
+func testArchive() *Archive {
+	return &Archive{
+		Created: 1234567890,
+		Files: []*File{
+			{Name: "msgs.db", Data: []byte("message database")},
+			{Name: "config/mute.berlin", Data: []byte("{}")},
+			{Name: "empty", Data: nil},
+		},
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	a := testArchive()
+	enc, err := a.Encrypt(passphrase, iter, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(enc, []byte("message database")) {
+		t.Error("archive not encrypted")
+	}
+	dec, err := Decrypt(enc, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec.Created != a.Created {
+		t.Errorf("wrong creation time: %d", dec.Created)
+	}
+	if len(dec.Files) != len(a.Files) {
+		t.Fatalf("wrong number of files: %d", len(dec.Files))
+	}
+	for i, file := range a.Files {
+		if dec.Files[i].Name != file.Name ||
+			!bytes.Equal(dec.Files[i].Data, file.Data) {
+			t.Errorf("file %d differs", i)
+		}
+	}
+	if f := dec.File("config/mute.berlin"); f == nil || string(f.Data) != "{}" {
+		t.Error("File() failed")
+	}
+	if dec.File("unknown") != nil {
+		t.Error("File() should return nil")
+	}
+}
+
+func TestDecryptFailures(t *testing.T) {
+	enc, err := testArchive().Encrypt(passphrase, iter, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// wrong passphrase
+	if _, err := Decrypt(enc, []byte("wrong")); err != ErrAuth {
+		t.Errorf("should fail with ErrAuth: %v", err)
+	}
+	// modified ciphertext
+	mod := append([]byte(nil), enc...)
+	mod[headerSize+20] ^= 0x01
+	if _, err := Decrypt(mod, passphrase); err != ErrAuth {
+		t.Errorf("should fail with ErrAuth: %v", err)
+	}
+	// modified creation time
+	mod = append([]byte(nil), enc...)
+	mod[len(magic)+15] ^= 0x01
+	if _, err := Decrypt(mod, passphrase); err != ErrAuth {
+		t.Errorf("should fail with ErrAuth: %v", err)
+	}
+	// too many iterations (rejected before PBKDF2 is run)
+	mod = append([]byte(nil), enc...)
+	copy(mod[len(magic):], encode.ToByte8(2147483647))
+	if _, err := Decrypt(mod, passphrase); err != ErrFormat {
+		t.Errorf("should fail with ErrFormat: %v", err)
+	}
+	if _, err := testArchive().Encrypt(passphrase, MaxIterations+1, rand.Reader); err == nil {
+		t.Error("should fail")
+	}
+	// no archive
+	if _, err := Decrypt([]byte("no archive"), passphrase); err != ErrFormat {
+		t.Errorf("should fail with ErrFormat: %v", err)
+	}
+	// random reader fails
+	if _, err := testArchive().Encrypt(passphrase, iter, cipher.RandFail); err == nil {
+		t.Error("should fail")
+	}
+}
+
+func TestInvalidNames(t *testing.T) {
+	for _, name := range []string{
+		"",
+		"/etc/passwd",
+		"..",
+		"../msgs.db",
+		"config/../../msgs.db",
+		"./msgs.db",
+		"config\\msgs.db",
+	} {
+		a := &Archive{Files: []*File{{Name: name}}}
+		if _, err := a.Encrypt(passphrase, iter, rand.Reader); err != ErrName {
+			t.Errorf("name '%s' should fail with ErrName: %v", name, err)
+		}
+	}
+}
@@ -7,13 +7,13 @@ package jsonclient
 
 import (
 	"bytes"
-	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"net/http"
 	"net/url"
 
 	"github.com/gorilla/rpc/v2/json2"
+	"github.com/mutecomm/mute/util/transport"
 )
 
 var (
@@ -23,28 +23,30 @@ var (
 
 // URLClient is a client for JSON-RPC over HTTPS calls.
 type URLClient struct {
-	transport *http.Transport
-	curl      string
+	client *transport.Client
+	curl   string
 }
 
 // New creates a new JSON-RPC over HTTPS client which uses the given
 // certificate file to communicate with the server if the scheme of the URL is
 // https.
 func New(URL string, cert []byte) (*URLClient, error) {
-	var pool *x509.CertPool
-	transport := new(http.Transport)
 	urlparsed, err := url.Parse(URL)
 	if err != nil {
 		return nil, err
 	}
+	var cacert []byte
 	if urlparsed.Scheme == "https" {
-		pool = x509.NewCertPool()
-		if !pool.AppendCertsFromPEM(cert) {
+		if !x509.NewCertPool().AppendCertsFromPEM(cert) {
 			return nil, ErrCertLoad
 		}
-		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		cacert = cert
 	}
-	return &URLClient{transport: transport, curl: URL}, nil
+	client, err := transport.New(cacert, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &URLClient{client: client, curl: URL}, nil
 }
 
 // JSONRPCRequest calls the given method via JSON-RPC over HTTPS.
@@ -58,8 +60,6 @@ func (c *URLClient) JSONRPCRequest(method string, args interface{}) (map[string]
 	if err != nil {
 		return nil, err
 	}
-	// create new client with activated TLS
-	client := &http.Client{Transport: c.transport}
 	body := bytes.NewBuffer(buf)
 	// make HTTP request
 	request, err := http.NewRequest("POST", c.curl, body)
@@ -68,7 +68,7 @@ func (c *URLClient) JSONRPCRequest(method string, args interface{}) (map[string]
 	}
 	defer request.Body.Close()
 	request.Header.Set("Content-Type", "application/json")
-	resp, err := client.Do(request)
+	resp, err := c.client.Do(request)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,304 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package transport implements the HTTP transport used by all Mute clients.
+//
+// The transport can be replaced, for example by a SOCKS5 dialer to connect
+// via Tor or by an in-memory transport for tests.
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"github.com/mutecomm/mute/log"
+	"golang.org/x/net/proxy"
+)
+
+var (
+	// ErrCertLoad signals a loading error of the certificate.
+	ErrCertLoad = errors.New("transport: certificate load failed")
+	// ErrNoBody is returned if a request with body cannot be retried.
+	ErrNoBody = errors.New("transport: request body cannot be resent")
+)
+
+// DefaultTimeout is the default timeout for HTTP requests.
+var DefaultTimeout = 30 * time.Second
+
+// DefaultRetries is the default number of retries for failed HTTP requests.
+var DefaultRetries = 0
+
+// Default is the transport used for all new clients. If it is nil, direct
+// network connections are used.
+var Default Transport
+
+var (
+	pinsMutex sync.RWMutex
+	pins      = make(map[string][]byte)
+)
+
+// Pin pins the CA certificate cacert for the service at host: TLS certificates
+// of host are only accepted, if they are signed by cacert (regardless of the
+// CA certificate the client has been created with). If host starts with a dot,
+// all subdomains of host are pinned. A nil cacert removes the pin.
+func Pin(host string, cacert []byte) {
+	pinsMutex.Lock()
+	defer pinsMutex.Unlock()
+	if cacert == nil {
+		delete(pins, host)
+	} else {
+		pins[host] = cacert
+	}
+}
+
+// PinnedCACert returns the CA certificate pinned for host (or nil).
+func PinnedCACert(host string) []byte {
+	pinsMutex.RLock()
+	defer pinsMutex.RUnlock()
+	if cacert, ok := pins[host]; ok {
+		return cacert
+	}
+	for pin, cacert := range pins {
+		if strings.HasPrefix(pin, ".") && strings.HasSuffix(host, pin) {
+			return cacert
+		}
+	}
+	return nil
+}
+
+// Transport creates round trippers for HTTP clients.
+type Transport interface {
+	// RoundTripper returns a new round tripper which only accepts TLS
+	// certificates signed by cacert, if cacert is not nil.
+	RoundTripper(cacert []byte) (http.RoundTripper, error)
+}
+
+// DialFunc dials the address addr on the named network.
+type DialFunc func(network, addr string) (net.Conn, error)
+
+// NetTransport is a transport over the network.
+type NetTransport struct {
+	Dial DialFunc // custom dialer (nil for direct connections)
+}
+
+// RoundTripper returns a new round tripper which only accepts TLS
+// certificates signed by cacert, if cacert is not nil. For hosts with a
+// pinned CA certificate (see Pin) the pinned one is enforced instead.
+func (t *NetTransport) RoundTripper(cacert []byte) (http.RoundTripper, error) {
+	rt := &netRoundTripper{
+		dial:       t.Dial,
+		cacert:     cacert,
+		transports: make(map[string]*http.Transport),
+	}
+	// make sure cacert can be loaded
+	if _, err := rt.transport(cacert); err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// netRoundTripper is the round tripper of NetTransport. It keeps one
+// http.Transport per enforced CA certificate.
+type netRoundTripper struct {
+	dial       DialFunc
+	cacert     []byte
+	mutex      sync.Mutex
+	transports map[string]*http.Transport
+}
+
+// transport returns the http.Transport which only accepts TLS certificates
+// signed by cacert, if cacert is not nil.
+func (rt *netRoundTripper) transport(cacert []byte) (*http.Transport, error) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	if tr, ok := rt.transports[string(cacert)]; ok {
+		return tr, nil
+	}
+	tr := &http.Transport{}
+	if cacert != nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(cacert) {
+			return nil, ErrCertLoad
+		}
+		tr.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	if rt.dial != nil {
+		tr.Dial = rt.dial
+	}
+	rt.transports[string(cacert)] = tr
+	return tr, nil
+}
+
+// RoundTrip executes a single HTTP transaction.
+func (rt *netRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	cacert := rt.cacert
+	if pinned := PinnedCACert(req.URL.Hostname()); pinned != nil {
+		cacert = pinned
+	}
+	tr, err := rt.transport(cacert)
+	if err != nil {
+		return nil, err
+	}
+	return tr.RoundTrip(req)
+}
+
+// NewSOCKS5 returns a new network transport which connects via the SOCKS5
+// proxy at address addr (for example, 127.0.0.1:9050 for Tor).
+func NewSOCKS5(addr string) (*NetTransport, error) {
+	dialer, err := proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	return &NetTransport{Dial: dialer.Dial}, nil
+}
+
+// MemTransport is an in-memory transport which passes all requests directly
+// to Handler. It is meant for tests.
+type MemTransport struct {
+	Handler http.Handler
+}
+
+// RoundTripper returns the in-memory transport itself, cacert is ignored.
+func (t *MemTransport) RoundTripper(cacert []byte) (http.RoundTripper, error) {
+	return t, nil
+}
+
+// RoundTrip passes the request req to the handler of the in-memory transport.
+func (t *MemTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	req.RequestURI = req.URL.RequestURI()
+	req.RemoteAddr = "127.0.0.1:0"
+	t.Handler.ServeHTTP(rec, req)
+	resp := rec.Result()
+	resp.Request = req
+	return resp, nil
+}
+
+// Client is a HTTP client which retries failed requests.
+type Client struct {
+	http.Client
+	Retries int // number of retries for failed requests
+}
+
+// New returns a new client for the default transport with the given timeout
+// (0 for DefaultTimeout). If cacert is not nil, only TLS certificates signed
+// by cacert are accepted (CA pinning, see also Pin).
+func New(cacert []byte, timeout time.Duration) (*Client, error) {
+	t := Default
+	if t == nil {
+		t = &NetTransport{}
+	}
+	rt, err := t.RoundTripper(cacert)
+	if err != nil {
+		return nil, err
+	}
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	c := &Client{
+		Client: http.Client{
+			Transport: rt,
+			Timeout:   timeout,
+		},
+		Retries: DefaultRetries,
+	}
+	return c, nil
+}
+
+// connectionError returns true, if err signals that the connection to the
+// server could not be established (that is, the request has not been sent).
+func connectionError(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		return false
+	}
+	switch opErr.Op {
+	case "dial", "proxyconnect", "socks connect":
+		return true
+	}
+	return false
+}
+
+// retry returns true, if the request req with the given result should be
+// retried. Requests with non-idempotent methods (like JSON-RPC calls, which
+// use POST) are only retried, if the connection could not be established.
+func retry(req *http.Request, resp *http.Response, err error) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+	default:
+		return connectionError(err)
+	}
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Do sends the HTTP request req and returns the HTTP response. Failed
+// requests are retried with exponential backoff, up to c.Retries times (see
+// retry for the requests which are retried).
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	b := &backoff.Backoff{
+		Min:    100 * time.Millisecond,
+		Max:    5 * time.Second,
+		Factor: 1.5,
+		Jitter: true,
+	}
+	for i := 0; ; i++ {
+		resp, err := c.Client.Do(req)
+		if i >= c.Retries || !retry(req, resp, err) {
+			return resp, err
+		}
+		if err != nil {
+			log.Warnf("transport: retry %s: %s", req.URL, err)
+		} else {
+			log.Warnf("transport: retry %s: %s", req.URL, resp.Status)
+			resp.Body.Close()
+		}
+		if req.Body != nil {
+			if req.GetBody == nil {
+				return nil, log.Error(ErrNoBody)
+			}
+			req.Body, err = req.GetBody()
+			if err != nil {
+				return nil, log.Error(err)
+			}
+		}
+		time.Sleep(b.Duration())
+	}
+}
+
+// Get issues a GET to the specified URL.
+func (c *Client) Get(url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// PostForm issues a POST to the specified URL, with data's keys and values
+// URL-encoded as the request body.
+func (c *Client) PostForm(url string, data url.Values) (*http.Response, error) {
+	req, err := http.NewRequest("POST", url, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.Do(req)
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package transport
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func memClient(t *testing.T, handler http.HandlerFunc, retries int) *Client {
+	def := Default
+	Default = &MemTransport{Handler: handler}
+	defer func() { Default = def }()
+	c, err := New(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Retries = retries
+	return c
+}
+
+func TestMemTransport(t *testing.T) {
+	c := memClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, r.Form.Get("key"))
+	}, 0)
+	resp, err := c.PostForm("https://mute.berlin/test", url.Values{"key": {"value"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if string(body) != "POST /test value" {
+		t.Errorf("wrong body: %s", body)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var calls int
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}
+	// not enough retries
+	c := memClient(t, handler, 1)
+	resp, err := c.Get("https://mute.berlin/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("wrong status code: %d", resp.StatusCode)
+	}
+	if calls != 2 {
+		t.Errorf("wrong number of calls: %d", calls)
+	}
+	// enough retries
+	calls = 0
+	c = memClient(t, handler, 2)
+	resp, err = c.Get("https://mute.berlin/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("wrong status code: %d", resp.StatusCode)
+	}
+	// POST requests reached the server, they are not retried
+	calls = 0
+	c = memClient(t, handler, 2)
+	resp, err = c.PostForm("https://mute.berlin/", url.Values{"key": {"value"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("wrong status code: %d", resp.StatusCode)
+	}
+	if calls != 1 {
+		t.Errorf("wrong number of calls: %d", calls)
+	}
+}
+
+// dialFailTransport is an in-memory transport which fails to connect the
+// first fails many times.
+type dialFailTransport struct {
+	MemTransport
+	fails int
+}
+
+func (t *dialFailTransport) RoundTripper(cacert []byte) (http.RoundTripper, error) {
+	return t, nil
+}
+
+func (t *dialFailTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.fails > 0 {
+		t.fails--
+		return nil, &net.OpError{Op: "dial", Net: "tcp",
+			Err: errors.New("connection refused")}
+	}
+	return t.MemTransport.RoundTrip(req)
+}
+
+func TestRetriesConnectionError(t *testing.T) {
+	def := Default
+	defer func() { Default = def }()
+	Default = &dialFailTransport{
+		MemTransport: MemTransport{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				w.Write(body)
+			}),
+		},
+		fails: 2,
+	}
+	c, err := New(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Retries = 2
+	// POST requests which did not reach the server are retried (body is
+	// resent)
+	resp, err := c.PostForm("https://mute.berlin/", url.Values{"key": {"value"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "key=value" {
+		t.Errorf("wrong response: %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestPin(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+	cacert := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: srv.Certificate().Raw,
+	})
+	def := Default
+	defer func() { Default = def }()
+	Default = nil
+	c, err := New(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// unknown CA
+	if _, err := c.Get(srv.URL); err == nil {
+		t.Error("should fail")
+	}
+	// pinned CA
+	Pin("127.0.0.1", cacert)
+	defer Pin("127.0.0.1", nil)
+	resp, err := c.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// subdomains
+	Pin(".mute.one", cacert)
+	defer Pin(".mute.one", nil)
+	if PinnedCACert("keylookup.serviceguard.mute.one") == nil {
+		t.Error("subdomain not pinned")
+	}
+	if PinnedCACert("mute.berlin") != nil {
+		t.Error("mute.berlin should not be pinned")
+	}
+}
+
+func TestNetTransport(t *testing.T) {
+	if _, err := New([]byte("no cert"), 0); err != ErrCertLoad {
+		t.Errorf("should fail with ErrCertLoad: %v", err)
+	}
+	s, err := NewSOCKS5("127.0.0.1:9050")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Dial == nil {
+		t.Error("SOCKS5 dialer not set")
+	}
+}